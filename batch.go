@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"main/p2p"
+	"main/ratelimit"
+	"main/session"
+	"main/torrentfile"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// how often batch prints where every torrent is at
+const batchStatusInterval = 10 * time.Second
+
+// gotorrent batch [flags] [.torrent files and magnet links]
+// downloads them all at once in one session (one port, one set of limits), into -o
+func runBatch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	c := addCommonFlags(fs)
+	keepSeeding := fs.Bool("seed", false, "keep seeding once everything's downloaded, until ctrl-c")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : [executable] batch [flags] [paths to .torrent files or magnet links...]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, *c.config, args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	c.apply()
+	settings := c.settings()
+	err := os.MkdirAll(c.output, 0755)
+	if err != nil {
+		fatal(err)
+	}
+	var torrents []torrentfile.Torrent
+	for _, arg := range fs.Args() {
+		torrents = append(torrents, openTorrent(arg))
+	}
+
+	// the session has its own limits, so the global ones apply has set stay out of the way
+	ratelimit.GlobalDownload.SetRate(0)
+	ratelimit.GlobalUpload.SetRate(0)
+	s, err := session.New(session.Config{
+		Port:               settings.Port,
+		DataDir:            c.output,
+		Encryption:         settings.Encryption,
+		Dial:               settings.Dial,
+		MaxConns:           c.maxPeersTotal,
+		MaxConnsPerTorrent: c.maxPeers,
+		DownloadLimit:      c.downloadLimit * 1024,
+		UploadLimit:        c.uploadLimit * 1024,
+	})
+	if err != nil {
+		fatal(err)
+	}
+	for _, tf := range torrents {
+		_, err := s.Add(tf)
+		if err != nil {
+			s.Close()
+			fatal(err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastStatus := time.Now()
+	interrupted := false
+	for !interrupted {
+		select {
+		case <-signals:
+			log.Println("Stopping")
+			interrupted = true
+			continue
+		case <-ticker.C:
+		}
+		if time.Since(lastStatus) >= batchStatusInterval {
+			printBatchStatus(s)
+			lastStatus = time.Now()
+		}
+		if !*keepSeeding && batchDone(s) {
+			break
+		}
+	}
+
+	printBatchStatus(s)
+	s.Close()
+	for _, t := range s.Torrents() {
+		if state, _ := t.State(); state == session.Failed {
+			os.Exit(exitError)
+		}
+	}
+	if interrupted && !batchDone(s) {
+		os.Exit(exitError)
+	}
+}
+
+// whether every torrent has finished downloading (or failed)
+func batchDone(s *session.Session) bool {
+	for _, t := range s.Torrents() {
+		state, _ := t.State()
+		if state != session.Seeding && state != session.Failed {
+			return false
+		}
+	}
+	return true
+}
+
+func printBatchStatus(s *session.Session) {
+	for _, t := range s.Torrents() {
+		state, err := t.State()
+		if err != nil {
+			fmt.Printf("%s: %s, %s\n", t.Name(), state, err.Error())
+			continue
+		}
+		stats := t.Stats()
+		fmt.Printf("%s: %s, %s, %d peers\n", t.Name(), state, percentDone(stats), len(stats.Peers))
+	}
+}
+
+func percentDone(s p2p.Stats) string {
+	if s.NumPieces == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(s.PiecesDone)/float64(s.NumPieces)*100)
+}
@@ -0,0 +1,98 @@
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// bencode is the encoding .torrent files, tracker responses and the extension protocol use.
+// There are only four kinds of value:
+//   integers      i42e
+//   byte strings  4:spam
+//   lists         l4:spami42ee
+//   dictionaries  d3:cow3:moo4:spam4:eggse   (keys are strings, sorted)
+//
+// Marshal and Unmarshal work like encoding/json. Struct fields are matched with the
+// `bencode:"name"` tag (or the field name if there isn't one), and unlike encoding/json
+// the key has to match exactly, case and all. `bencode:"name,omitempty"` leaves out zero
+// values when encoding and `bencode:"-"` skips the field
+
+// Marshaler is implemented by types that know how to bencode themselves, like bitfield.Bitfield.
+// The bytes returned have to be exactly one valid bencoded value
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that know how to decode themselves.
+// data is exactly one bencoded value, and it's only valid until UnmarshalBencode returns
+type Unmarshaler interface {
+	UnmarshalBencode(data []byte) error
+}
+
+// RawMessage is a bencoded value that's left as is. Decoding into one keeps the exact bytes
+// from the input, which is how we get the info dictionary for the info hash, and encoding
+// one writes it back out untouched
+type RawMessage []byte
+
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, fmt.Errorf("bencode: can't marshal an empty RawMessage")
+	}
+	return m, nil
+}
+
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+// SyntaxError is returned for input that isn't valid bencode.
+// Offset is where in the input things went wrong
+type SyntaxError struct {
+	Offset int64
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+// UnmarshalTypeError is returned when a value doesn't fit the Go type it's being decoded into,
+// e.g. a string where the struct has an int
+type UnmarshalTypeError struct {
+	// "integer", "string", "list" or "dictionary"
+	Value  string
+	Type   reflect.Type
+	Offset int64
+	// the dictionary key we were decoding, if any
+	Field string
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("bencode: can't decode %s into %q (%v) at offset %d", e.Value, e.Field, e.Type, e.Offset)
+	}
+	return fmt.Sprintf("bencode: can't decode %s into %v at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// InvalidUnmarshalError is returned when Unmarshal isn't given a non-nil pointer
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "bencode: Unmarshal(nil)"
+	}
+	return fmt.Sprintf("bencode: Unmarshal(non-pointer %v)", e.Type)
+}
+
+// UnsupportedTypeError is returned when Marshal is given something bencode can't represent,
+// like a float or a channel
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("bencode: unsupported type %v", e.Type)
+}
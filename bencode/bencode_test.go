@@ -0,0 +1,281 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// .torrent files and tracker responses both come from people we don't trust
+func FuzzUnmarshal(f *testing.F) {
+	f.Add([]byte("i42e"))
+	f.Add([]byte("4:spam"))
+	f.Add([]byte("l4:spami42ee"))
+	f.Add([]byte("d3:cow3:moo4:spam4:eggse"))
+	f.Add([]byte("d8:announce17:http://t/announce4:infod6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces0:ee"))
+	f.Add([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	f.Add([]byte("i-0e"))
+	f.Add([]byte("d1:bi1e1:ai2ee"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v any
+		err := Unmarshal(data, &v)
+		if err != nil {
+			return
+		}
+		// anything canonical has to encode back to exactly the same bytes
+		if UnmarshalStrict(data, &v) != nil {
+			return
+		}
+		out, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("couldn't marshal %#v: %v", v, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("strict input %q came back as %q", data, out)
+		}
+	})
+}
+
+type tagged struct {
+	Name     string   `bencode:"name"`
+	Length   int64    `bencode:"length,omitempty"`
+	Private  bool     `bencode:"private,omitempty"`
+	Files    []string `bencode:"files,omitempty"`
+	Hash     [4]byte  `bencode:"hash"`
+	Skipped  string   `bencode:"-"`
+	Untagged int
+	Pointer  *int `bencode:"pointer,omitempty"`
+	hidden   int
+}
+
+func TestMarshalStruct(t *testing.T) {
+	seven := 7
+	cases := []struct {
+		in   tagged
+		want string
+	}{
+		// empty fields with omitempty are left out, the rest aren't, and keys are sorted
+		{tagged{}, "d8:Untaggedi0e4:hash4:\x00\x00\x00\x004:name0:e"},
+		{tagged{Name: "a", Length: 3, Private: true, Files: []string{"x", "y"}, Hash: [4]byte{'h', 'a', 's', 'h'}, Skipped: "no", Untagged: 1, Pointer: &seven, hidden: 2},
+			"d8:Untaggedi1e5:filesl1:x1:ye4:hash4:hash6:lengthi3e4:name1:a7:pointeri7e7:privatei1ee"},
+	}
+	for _, c := range cases {
+		got, err := Marshal(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.want {
+			t.Errorf("%+v came out as %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	data := "d8:Untaggedi5e5:filesl1:xe4:hash4:abcd6:lengthi9e4:name4:spam7:privatei1e7:Skipped3:yes6:hiddeni3e5:extrali1eee"
+	var got tagged
+	err := Unmarshal([]byte(data), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := tagged{Name: "spam", Length: 9, Private: true, Files: []string{"x"}, Hash: [4]byte{'a', 'b', 'c', 'd'}, Untagged: 5}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// keys only match exactly, so these all get skipped
+	got = tagged{}
+	err = Unmarshal([]byte("d8:untaggedi5e6:LENGTHi9e4:Name4:spame"), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, tagged{}) {
+		t.Fatalf("keys in the wrong case got decoded: %+v", got)
+	}
+}
+
+// a RawMessage keeps the bytes exactly as they were, even when they aren't canonical
+func TestRawMessage(t *testing.T) {
+	var v struct {
+		Info RawMessage `bencode:"info"`
+		Name string     `bencode:"name"`
+	}
+	for _, info := range []string{
+		"d6:lengthi3e4:name1:ae",
+		// unsorted, which re-encoding would "fix" and change the info hash
+		"d4:name1:a6:lengthi3ee",
+		"d6:lengthi03e4:name1:ae",
+		"l1:ai-0ee",
+	} {
+		data := "d4:info" + info + "4:name4:spame"
+		err := Unmarshal([]byte(data), &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v.Info) != info || v.Name != "spam" {
+			t.Fatalf("info came out as %q", v.Info)
+		}
+		out, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != data {
+			t.Fatalf("%q went back out as %q", data, out)
+		}
+	}
+
+	if _, err := Marshal(RawMessage(nil)); err == nil {
+		t.Fatal("marshaled an empty RawMessage")
+	}
+	if _, err := Marshal(RawMessage("i1ei2e")); err == nil {
+		t.Fatal("marshaled a RawMessage with two values in it")
+	}
+}
+
+// a Decoder reads one value at a time, and InputOffset says where the next one starts
+func TestDecoderStream(t *testing.T) {
+	stream := "i42e4:spamd1:ai1ee" + "l1:xe" + "trailing"
+	d := NewDecoder(strings.NewReader(stream))
+	var n int
+	var s string
+	var m map[string]int
+	var l []string
+	steps := []struct {
+		v      any
+		offset int64
+	}{{&n, 4}, {&s, 10}, {&m, 18}, {&l, 23}}
+	for _, step := range steps {
+		err := d.Decode(step.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.InputOffset() != step.offset {
+			t.Fatalf("offset is %d after decoding %T, want %d", d.InputOffset(), step.v, step.offset)
+		}
+	}
+	if n != 42 || s != "spam" || m["a"] != 1 || len(l) != 1 || l[0] != "x" {
+		t.Fatalf("decoded %d, %q, %v, %q", n, s, m, l)
+	}
+	// "trailing" isn't bencode, and the error says where it is
+	var syntaxErr *SyntaxError
+	err := d.Decode(&s)
+	if !errors.As(err, &syntaxErr) || syntaxErr.Offset != 24 {
+		t.Fatalf("got %v, want a syntax error at offset 24", err)
+	}
+
+	// the end of the stream between values is io.EOF, in the middle of one it isn't
+	d = NewDecoder(strings.NewReader("i1e"))
+	d.Decode(&n)
+	if err := d.Decode(&n); err != io.EOF {
+		t.Fatalf("got %v at the end, want io.EOF", err)
+	}
+	d = NewDecoder(strings.NewReader("i1e10:abc"))
+	d.Decode(&n)
+	if err := d.Decode(&s); !errors.As(err, &syntaxErr) || syntaxErr.Offset != 9 {
+		t.Fatalf("got %v for a cut off string, want a syntax error at offset 9", err)
+	}
+
+	// the data part of a ut_metadata message comes straight after the dictionary
+	payload := []byte("d8:msg_typei1e5:piecei0ee" + "rawdata")
+	d = NewDecoder(bytes.NewReader(payload))
+	err = d.Decode(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rest := payload[d.InputOffset():]; string(rest) != "rawdata" {
+		t.Fatalf("after the dictionary comes %q", rest)
+	}
+}
+
+// what strict mode turns down that plain Unmarshal takes
+func TestStrict(t *testing.T) {
+	for _, data := range []string{
+		"i-0e",
+		"i03e",
+		"i-03e",
+		"03:abc",
+		"d1:bi1e1:ai2ee",
+		"d1:ai1e1:ai2ee",
+		"l" + "d1:bi1e1:ai2ee" + "e",
+		"d1:xd2:bb0:2:aa0:ee",
+	} {
+		var v any
+		if err := Unmarshal([]byte(data), &v); err != nil {
+			t.Errorf("%q: Unmarshal says %v", data, err)
+		}
+		var syntaxErr *SyntaxError
+		if err := UnmarshalStrict([]byte(data), &v); !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: UnmarshalStrict says %v, want a syntax error", data, err)
+		}
+		d := NewDecoder(strings.NewReader(data))
+		d.Strict()
+		if err := d.Decode(&v); !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: a strict Decoder says %v, want a syntax error", data, err)
+		}
+	}
+	// the keys of a dictionary that gets skipped are checked too
+	var v struct{}
+	if err := UnmarshalStrict([]byte("d1:xd1:bi1e1:ai2eee"), &v); err == nil {
+		t.Error("UnmarshalStrict took unsorted keys in a skipped dictionary")
+	}
+	for _, data := range []string{"i0e", "i-3e", "0:", "d1:ai1e1:bi2ee", "de", "le"} {
+		var v any
+		if err := UnmarshalStrict([]byte(data), &v); err != nil {
+			t.Errorf("%q: UnmarshalStrict says %v", data, err)
+		}
+	}
+}
+
+// syntax errors say where in the input they are
+func TestSyntaxErrorOffset(t *testing.T) {
+	cases := []struct {
+		data   string
+		offset int64
+	}{
+		{"", 0},
+		{"x", 0},
+		{"i12", 0},
+		{"i1x2e", 0},
+		{"l4:spami4", 7},
+		{"5:spam", 0},
+		{"d3:cowi1ex", 9},
+		{"di1ei2ee", 1},
+		{"l", 1},
+		{"i1ei2e", 3},
+		{"d1:bi1e1:ai2ee", 7},
+		{"d1:ai1e1:ai2ee", 7},
+		{"i-0e", 0},
+	}
+	for _, c := range cases {
+		var v any
+		err := UnmarshalStrict([]byte(c.data), &v)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: got %v, want a syntax error", c.data, err)
+			continue
+		}
+		if syntaxErr.Offset != c.offset {
+			t.Errorf("%q: error at offset %d (%s), want %d", c.data, syntaxErr.Offset, err, c.offset)
+		}
+	}
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	var v struct {
+		Length int `bencode:"length"`
+	}
+	err := Unmarshal([]byte("d6:length3:abce"), &v)
+	var typeErr *UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Field != "length" || typeErr.Offset != 9 || typeErr.Value != "string" {
+		t.Fatalf("got %#v", err)
+	}
+	var small int8
+	if err := Unmarshal([]byte("i300e"), &small); !errors.As(err, &typeErr) {
+		t.Fatalf("got %v for an int8 overflow", err)
+	}
+	if err := Unmarshal([]byte("i1e"), v); err == nil {
+		t.Fatal("unmarshaled into a non-pointer")
+	}
+}
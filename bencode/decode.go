@@ -0,0 +1,458 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+)
+
+// Unmarshal decodes the bencoded value in data into v, which has to be a non-nil pointer.
+// data has to be exactly one value, anything after it is an error.
+//
+// Dictionary keys that don't match a field are skipped. Decoding into an empty interface
+// gives int64, string, []any and map[string]any
+func Unmarshal(data []byte, v any) error {
+	d := decodeState{data: data}
+	err := d.unmarshal(v)
+	if err != nil {
+		return err
+	}
+	if d.off != len(data) {
+		return d.syntaxError("trailing data after value")
+	}
+	return nil
+}
+
+// UnmarshalStrict is Unmarshal, but only accepts canonical bencode: dictionary keys sorted
+// with no duplicates, and no leading zeros or negative zero in numbers. A strictly valid
+// value encodes back to exactly the same bytes, which matters for anything that gets hashed
+func UnmarshalStrict(data []byte, v any) error {
+	d := decodeState{data: data, strict: true}
+	err := d.unmarshal(v)
+	if err != nil {
+		return err
+	}
+	if d.off != len(data) {
+		return d.syntaxError("trailing data after value")
+	}
+	return nil
+}
+
+// nesting deeper than this is somebody trying to blow our stack
+const maxDepth = 256
+
+type decodeState struct {
+	data   []byte
+	off    int
+	strict bool
+	// where data starts in the whole stream, so errors from a Decoder have the right offsets
+	base int64
+	// the dictionary key we're decoding the value of, for error messages
+	field string
+}
+
+func (d *decodeState) unmarshal(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+	return d.value(rv, 0)
+}
+
+func (d *decodeState) syntaxError(msg string) error {
+	return &SyntaxError{Offset: d.base + int64(d.off), msg: msg}
+}
+
+func (d *decodeState) typeError(value string, t reflect.Type, off int) error {
+	return &UnmarshalTypeError{Value: value, Type: t, Offset: d.base + int64(off), Field: d.field}
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// indirect follows pointers down to the value we should decode into, allocating any nil ones
+// on the way. If something along the way is an Unmarshaler, it returns that instead
+func indirect(v reflect.Value) (Unmarshaler, reflect.Value) {
+	for {
+		if v.Kind() != reflect.Pointer && v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+			return v.Addr().Interface().(Unmarshaler), reflect.Value{}
+		}
+		// an interface holding a pointer, decode into what it points at
+		if v.Kind() == reflect.Interface && !v.IsNil() {
+			e := v.Elem()
+			if e.Kind() == reflect.Pointer && !e.IsNil() {
+				v = e
+				continue
+			}
+		}
+		if v.Kind() != reflect.Pointer {
+			return nil, v
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().Implements(unmarshalerType) {
+			return v.Interface().(Unmarshaler), reflect.Value{}
+		}
+		v = v.Elem()
+	}
+}
+
+func (d *decodeState) value(v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return d.syntaxError("nested too deep")
+	}
+	if d.off >= len(d.data) {
+		return d.syntaxError("unexpected end of input")
+	}
+
+	u, v := indirect(v)
+	if u != nil {
+		start := d.off
+		err := d.skip(depth)
+		if err != nil {
+			return err
+		}
+		return u.UnmarshalBencode(d.data[start:d.off])
+	}
+
+	switch c := d.data[d.off]; {
+	case c == 'i':
+		return d.integer(v)
+	case c >= '0' && c <= '9':
+		return d.str(v)
+	case c == 'l':
+		return d.list(v, depth)
+	case c == 'd':
+		return d.dict(v, depth)
+	default:
+		return d.syntaxError("unexpected " + strconv.QuoteRune(rune(c)))
+	}
+}
+
+// read the number in i...e, leaving off just past the e
+func (d *decodeState) readInt() (string, error) {
+	end := bytes.IndexByte(d.data[d.off:], 'e')
+	if end < 0 {
+		return "", d.syntaxError("unterminated integer")
+	}
+	digits := string(d.data[d.off+1 : d.off+end])
+	if !validNumber(digits, true, d.strict) {
+		return "", d.syntaxError("bad integer " + strconv.Quote(digits))
+	}
+	d.off += end + 1
+	return digits, nil
+}
+
+// checks digits is a number. In strict mode "03" and "-0" aren't allowed since
+// there's exactly one way to write every number
+func validNumber(digits string, signed, strict bool) bool {
+	s := digits
+	if signed && len(s) > 0 && s[0] == '-' {
+		s = s[1:]
+		if strict && s == "0" {
+			return false
+		}
+	}
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	if strict && len(s) > 1 && s[0] == '0' {
+		return false
+	}
+	return true
+}
+
+// read a <length>:<bytes> string, leaving off just past it
+func (d *decodeState) readString() ([]byte, error) {
+	colon := bytes.IndexByte(d.data[d.off:], ':')
+	if colon < 0 {
+		return nil, d.syntaxError("string length with no ':'")
+	}
+	digits := string(d.data[d.off : d.off+colon])
+	length, err := strconv.Atoi(digits)
+	if err != nil || !validNumber(digits, false, d.strict) {
+		return nil, d.syntaxError("bad string length " + strconv.Quote(digits))
+	}
+	start := d.off + colon + 1
+	if length > len(d.data)-start {
+		return nil, d.syntaxError("string runs past the end of the input")
+	}
+	d.off = start + length
+	return d.data[start:d.off], nil
+}
+
+func (d *decodeState) integer(v reflect.Value) error {
+	start := d.off
+	digits, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			return d.typeError("integer "+digits, v.Type(), start)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(digits, 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			return d.typeError("integer "+digits, v.Type(), start)
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		v.SetBool(digits != "0")
+	case reflect.Interface:
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return d.typeError("integer "+digits, v.Type(), start)
+		}
+		if v.NumMethod() != 0 {
+			return d.typeError("integer", v.Type(), start)
+		}
+		v.Set(reflect.ValueOf(n))
+	default:
+		return d.typeError("integer", v.Type(), start)
+	}
+	return nil
+}
+
+func (d *decodeState) str(v reflect.Value) error {
+	start := d.off
+	s, err := d.readString()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(s))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return d.typeError("string", v.Type(), start)
+		}
+		// copy it, data might get reused
+		v.SetBytes(append([]byte(nil), s...))
+	case reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 || v.Len() != len(s) {
+			return d.typeError("string of length "+strconv.Itoa(len(s)), v.Type(), start)
+		}
+		reflect.Copy(v, reflect.ValueOf(s))
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return d.typeError("string", v.Type(), start)
+		}
+		v.Set(reflect.ValueOf(string(s)))
+	default:
+		return d.typeError("string", v.Type(), start)
+	}
+	return nil
+}
+
+func (d *decodeState) list(v reflect.Value, depth int) error {
+	start := d.off
+	switch v.Kind() {
+	case reflect.Slice:
+		v.SetLen(0)
+	case reflect.Array:
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return d.typeError("list", v.Type(), start)
+		}
+		var items []any
+		rv := reflect.ValueOf(&items).Elem()
+		err := d.list(rv, depth)
+		if err != nil {
+			return err
+		}
+		v.Set(rv)
+		return nil
+	default:
+		return d.typeError("list", v.Type(), start)
+	}
+
+	d.off++ // the 'l'
+	field := d.field
+	i := 0
+	for {
+		if d.off >= len(d.data) {
+			return d.syntaxError("unterminated list")
+		}
+		if d.data[d.off] == 'e' {
+			d.off++
+			break
+		}
+		d.field = field
+		var err error
+		if v.Kind() == reflect.Slice {
+			if i >= v.Cap() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			v.SetLen(i + 1)
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+			err = d.value(v.Index(i), depth+1)
+		} else if i < v.Len() {
+			err = d.value(v.Index(i), depth+1)
+		} else {
+			// more items than the array has room for, drop the rest
+			err = d.skip(depth + 1)
+		}
+		if err != nil {
+			return err
+		}
+		i++
+	}
+	// zero whatever's left of an array we didn't fill
+	if v.Kind() == reflect.Array {
+		for ; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+	}
+	if v.Kind() == reflect.Slice && v.IsNil() {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	return nil
+}
+
+func (d *decodeState) dict(v reflect.Value, depth int) error {
+	start := d.off
+	var fields []field
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return d.typeError("dictionary", v.Type(), start)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Struct:
+		fields = cachedFields(v.Type())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return d.typeError("dictionary", v.Type(), start)
+		}
+		m := map[string]any{}
+		rv := reflect.ValueOf(m)
+		err := d.dict(rv, depth)
+		if err != nil {
+			return err
+		}
+		v.Set(rv)
+		return nil
+	default:
+		return d.typeError("dictionary", v.Type(), start)
+	}
+
+	d.off++ // the 'd'
+	var prevKey []byte
+	for {
+		if d.off >= len(d.data) {
+			return d.syntaxError("unterminated dictionary")
+		}
+		if d.data[d.off] == 'e' {
+			d.off++
+			return nil
+		}
+		if c := d.data[d.off]; c < '0' || c > '9' {
+			return d.syntaxError("dictionary key isn't a string")
+		}
+		keyStart := d.off
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if d.strict && prevKey != nil && bytes.Compare(prevKey, key) >= 0 {
+			d.off = keyStart
+			return d.syntaxError("dictionary key " + strconv.Quote(string(key)) + " is out of order or repeated")
+		}
+		prevKey = key
+		d.field = string(key)
+
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err = d.value(elem, depth+1)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+			continue
+		}
+		f := findField(fields, string(key))
+		if f == nil {
+			err = d.skip(depth + 1)
+		} else {
+			err = d.value(v.Field(f.index), depth+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// skip moves past one value without decoding it, checking it's valid on the way
+func (d *decodeState) skip(depth int) error {
+	if depth > maxDepth {
+		return d.syntaxError("nested too deep")
+	}
+	if d.off >= len(d.data) {
+		return d.syntaxError("unexpected end of input")
+	}
+	switch c := d.data[d.off]; {
+	case c == 'i':
+		_, err := d.readInt()
+		return err
+	case c >= '0' && c <= '9':
+		_, err := d.readString()
+		return err
+	case c == 'l':
+		d.off++
+		for {
+			if d.off >= len(d.data) {
+				return d.syntaxError("unterminated list")
+			}
+			if d.data[d.off] == 'e' {
+				d.off++
+				return nil
+			}
+			err := d.skip(depth + 1)
+			if err != nil {
+				return err
+			}
+		}
+	case c == 'd':
+		d.off++
+		var prevKey []byte
+		for {
+			if d.off >= len(d.data) {
+				return d.syntaxError("unterminated dictionary")
+			}
+			if d.data[d.off] == 'e' {
+				d.off++
+				return nil
+			}
+			if c := d.data[d.off]; c < '0' || c > '9' {
+				return d.syntaxError("dictionary key isn't a string")
+			}
+			keyStart := d.off
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			if d.strict && prevKey != nil && bytes.Compare(prevKey, key) >= 0 {
+				d.off = keyStart
+				return d.syntaxError("dictionary key " + strconv.Quote(string(key)) + " is out of order or repeated")
+			}
+			prevKey = key
+			err = d.skip(depth + 1)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return d.syntaxError("unexpected " + strconv.QuoteRune(rune(c)))
+	}
+}
@@ -0,0 +1,189 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Marshal returns the bencoding of v.
+// Bools are encoded as i1e/i0e, []byte and [N]byte as strings, and maps need string keys.
+// Dictionary keys always come out sorted, so the output is the same every time
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encodeValue(&buf, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// An Encoder writes bencoded values to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the bencoding of v to the stream
+func (e *Encoder) Encode(v any) error {
+	data, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("bencode: can't marshal nil")
+	}
+
+	// types that encode themselves. Check the pointer too, in case the method has a pointer receiver
+	if v.Type().Implements(marshalerType) {
+		if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+			return fmt.Errorf("bencode: can't marshal nil %v", v.Type())
+		}
+		return encodeMarshaler(buf, v.Interface().(Marshaler))
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(marshalerType) {
+		return encodeMarshaler(buf, v.Addr().Interface().(Marshaler))
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("bencode: can't marshal nil %v", v.Type())
+		}
+		return encodeValue(buf, v.Elem())
+	case reflect.String:
+		writeString(buf, v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+		buf.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+		buf.WriteByte('e')
+	case reflect.Slice, reflect.Array:
+		// byte slices and arrays are strings, not lists of integers
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			writeString(buf, string(b))
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			err := encodeValue(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnsupportedTypeError{v.Type()}
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		buf.WriteByte('d')
+		for _, k := range keys {
+			elem := v.MapIndex(k)
+			// there's no way to write nil, so leave the key out
+			if isNil(elem) {
+				continue
+			}
+			writeString(buf, k.String())
+			err := encodeValue(buf, elem)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		buf.WriteByte('d')
+		for _, f := range cachedFields(v.Type()) {
+			fv := v.Field(f.index)
+			if isNil(fv) || (f.omitEmpty && isEmpty(fv)) {
+				continue
+			}
+			writeString(buf, f.name)
+			err := encodeValue(buf, fv)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
+	return nil
+}
+
+// check that what a Marshaler gave us is really one bencoded value before we splice it in,
+// otherwise one bad MarshalBencode quietly corrupts the whole output
+func encodeMarshaler(buf *bytes.Buffer, m Marshaler) error {
+	data, err := m.MarshalBencode()
+	if err != nil {
+		return err
+	}
+	d := decodeState{data: data}
+	err = d.skip(0)
+	if err == nil && d.off != len(data) {
+		err = d.syntaxError("trailing data after value")
+	}
+	if err != nil {
+		return fmt.Errorf("bencode: MarshalBencode for %T returned invalid bencode: %w", m, err)
+	}
+	buf.Write(data)
+	return nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// what omitempty leaves out
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// a struct field and the dictionary key it goes with
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// working the fields out with reflect every time is slow, so do it once per type
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// the fields of struct type t, sorted by key since that's the order they get encoded in
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{
+			name:      name,
+			index:     i,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+	f, _ := fieldCache.LoadOrStore(t, fields)
+	return f.([]field)
+}
+
+// the field that a dictionary key goes into, nil if there isn't one. Keys are byte
+// strings that get hashed, so "Name" and "name" are different keys: only an exact
+// match counts
+func findField(fields []field, key string) *field {
+	i := sort.Search(len(fields), func(i int) bool {
+		return fields[i].name >= key
+	})
+	if i < len(fields) && fields[i].name == key {
+		return &fields[i]
+	}
+	return nil
+}
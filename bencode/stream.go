@@ -0,0 +1,127 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// A Decoder reads bencoded values one after another from a stream, e.g. a tracker's
+// HTTP response body. It only reads as far as the end of each value
+type Decoder struct {
+	r      *bufio.Reader
+	off    int64
+	strict bool
+	buf    bytes.Buffer
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Strict makes the decoder only accept canonical bencode, see UnmarshalStrict
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// InputOffset is how many bytes of the stream have been decoded so far
+func (d *Decoder) InputOffset() int64 {
+	return d.off
+}
+
+// Decode reads the next value from the stream and decodes it into v.
+// It returns io.EOF if the stream ends cleanly before a value starts
+func (d *Decoder) Decode(v any) error {
+	d.buf.Reset()
+	err := d.readValue(0)
+	if err != nil {
+		if err == io.EOF && d.buf.Len() == 0 {
+			return io.EOF
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = &SyntaxError{Offset: d.off + int64(d.buf.Len()), msg: "unexpected end of input"}
+		}
+		return err
+	}
+
+	ds := decodeState{data: d.buf.Bytes(), strict: d.strict, base: d.off}
+	err = ds.unmarshal(v)
+	d.off += int64(d.buf.Len())
+	return err
+}
+
+func (d *Decoder) syntaxError(msg string) error {
+	return &SyntaxError{Offset: d.off + int64(d.buf.Len()), msg: msg}
+}
+
+// copy one whole value from the stream into d.buf. This only finds where the value ends,
+// the proper checking happens when decodeState goes over it afterwards
+func (d *Decoder) readValue(depth int) error {
+	if depth > maxDepth {
+		return d.syntaxError("nested too deep")
+	}
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	d.buf.WriteByte(c)
+	switch {
+	case c == 'i':
+		for {
+			c, err := d.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			d.buf.WriteByte(c)
+			if c == 'e' {
+				return nil
+			}
+			if (c < '0' || c > '9') && c != '-' {
+				return d.syntaxError("bad integer")
+			}
+		}
+	case c >= '0' && c <= '9':
+		digits := []byte{c}
+		for {
+			c, err := d.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			d.buf.WriteByte(c)
+			if c == ':' {
+				break
+			}
+			if c < '0' || c > '9' || len(digits) > 18 {
+				return d.syntaxError("bad string length")
+			}
+			digits = append(digits, c)
+		}
+		length, _ := strconv.ParseInt(string(digits), 10, 64)
+		// CopyN rather than allocating length bytes up front, so a huge length
+		// that the stream doesn't back up can't make us allocate it all
+		n, err := io.CopyN(&d.buf, d.r, length)
+		if err == io.EOF && n < length {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	case c == 'l' || c == 'd':
+		for {
+			next, err := d.r.Peek(1)
+			if err != nil {
+				return err
+			}
+			if next[0] == 'e' {
+				d.r.ReadByte()
+				d.buf.WriteByte('e')
+				return nil
+			}
+			err = d.readValue(depth + 1)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return d.syntaxError("unexpected " + strconv.QuoteRune(rune(c)))
+	}
+}
@@ -1,5 +1,12 @@
 package bitfield
 
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"strconv"
+)
+
 // A Bitfield represents the pieces that a peer has
 // the reason why we need this type is simple- Go doesn't let you define
 // methods on types that aren't in the same package. I ran into this firsthand
@@ -14,9 +21,12 @@ type Bitfield []byte
 func (clientPieces Bitfield) HasPiece(requestedPieceIdx int) bool {
 	// since its 8 bits per byte, first calculate
 	// which byte it belongs to, then which bit its offset
+	if requestedPieceIdx < 0 {
+		return false
+	}
 	byteNo := requestedPieceIdx / 8
 	byteNoOffset := requestedPieceIdx % 8
-	if byteNo < 0 || byteNo >= len(clientPieces) {
+	if byteNo >= len(clientPieces) {
 		return false
 	}
 
@@ -25,8 +35,174 @@ func (clientPieces Bitfield) HasPiece(requestedPieceIdx int) bool {
 }
 
 // kinda same as above, except we are setting it to 1 this time
+// the index usually comes straight from a peer's have message, so an index
+// outside the bitfield is just ignored instead of crashing us
 func (b Bitfield) SetPiece(index int) {
+	if index < 0 || index/8 >= len(b) {
+		return
+	}
 	byteNo := index / 8
 	byteNoOffset := index % 8
 	b[byteNo] |= 1 << uint8(7-byteNoOffset)
 }
+
+// New makes an empty bitfield big enough for numPieces pieces.
+// It's the number of pieces divided by 8, rounded up, since each byte holds 8 pieces
+func New(numPieces int) Bitfield {
+	if numPieces < 0 {
+		numPieces = 0
+	}
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+// the opposite of SetPiece, sets the bit to 0
+func (b Bitfield) ClearPiece(index int) {
+	if index < 0 || index/8 >= len(b) {
+		return
+	}
+	byteNo := index / 8
+	byteNoOffset := index % 8
+	b[byteNo] &^= 1 << uint8(7-byteNoOffset)
+}
+
+// Count returns how many pieces are set
+func (b Bitfield) Count() int {
+	count := 0
+	for _, byt := range b {
+		count += bits.OnesCount8(byt)
+	}
+	return count
+}
+
+// IsComplete tells you if all numPieces pieces are set
+func (b Bitfield) IsComplete(numPieces int) bool {
+	if len(b)*8 < numPieces {
+		return false
+	}
+	for i := 0; i < numPieces/8; i++ {
+		if b[i] != 0xff {
+			return false
+		}
+	}
+	for i := numPieces / 8 * 8; i < numPieces; i++ {
+		if !b.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that a bitfield we got from somewhere else (a peer, a resume file)
+// fits a torrent with numPieces pieces: it has to be exactly the right number of
+// bytes, and the spare bits at the end of the last byte have to be 0
+func (b Bitfield) Validate(numPieces int) error {
+	if len(b) != (numPieces+7)/8 {
+		return fmt.Errorf("bitfield is %d bytes, expected %d for %d pieces", len(b), (numPieces+7)/8, numPieces)
+	}
+	if spare := len(b)*8 - numPieces; spare > 0 {
+		mask := byte(1<<uint(spare)) - 1
+		if b[len(b)-1]&mask != 0 {
+			return fmt.Errorf("bitfield has spare bits set")
+		}
+	}
+	return nil
+}
+
+// And returns a new bitfield with the pieces that are in both b and other
+// e.g. "pieces the peer has" And "pieces we still need". The result is as long as b,
+// anything past the end of other counts as not set
+func (b Bitfield) And(other Bitfield) Bitfield {
+	ret := make(Bitfield, len(b))
+	for i := range ret {
+		if i < len(other) {
+			ret[i] = b[i] & other[i]
+		}
+	}
+	return ret
+}
+
+// AndNot returns a new bitfield with the pieces in b that aren't in other
+// e.g. "pieces the peer has" AndNot "pieces we have" is what we could get from it
+func (b Bitfield) AndNot(other Bitfield) Bitfield {
+	ret := make(Bitfield, len(b))
+	copy(ret, b)
+	for i := range ret {
+		if i < len(other) {
+			ret[i] &^= other[i]
+		}
+	}
+	return ret
+}
+
+// Or returns a new bitfield with the pieces in either one. The result is as long as the longer one
+func (b Bitfield) Or(other Bitfield) Bitfield {
+	longer, shorter := b, other
+	if len(other) > len(b) {
+		longer, shorter = other, b
+	}
+	ret := make(Bitfield, len(longer))
+	copy(ret, longer)
+	for i := range shorter {
+		ret[i] |= shorter[i]
+	}
+	return ret
+}
+
+// NextSet returns the first set piece at index from or later, or -1 if there isn't one
+func (b Bitfield) NextSet(from int) int {
+	if from < 0 {
+		from = 0
+	}
+	for i := from; i < len(b)*8; {
+		byt := b[i/8] << uint(i%8)
+		if byt == 0 {
+			// nothing else set in this byte, skip to the next one
+			i = (i/8 + 1) * 8
+			continue
+		}
+		return i + bits.LeadingZeros8(byt)
+	}
+	return -1
+}
+
+// ForEach calls fn with the index of every set piece, in order.
+// If fn returns false we stop early
+func (b Bitfield) ForEach(fn func(index int) bool) {
+	for i := b.NextSet(0); i >= 0; i = b.NextSet(i + 1) {
+		if !fn(i) {
+			return
+		}
+	}
+}
+
+// Pieces returns the indexes of every set piece
+func (b Bitfield) Pieces() []int {
+	ret := make([]int, 0, b.Count())
+	b.ForEach(func(index int) bool {
+		ret = append(ret, index)
+		return true
+	})
+	return ret
+}
+
+// MarshalBencode writes the bitfield as a bencoded byte string, which is how
+// resume files and the like store it. The bytes are the same as on the wire
+func (b Bitfield) MarshalBencode() ([]byte, error) {
+	ret := []byte(strconv.Itoa(len(b)) + ":")
+	return append(ret, b...), nil
+}
+
+// UnmarshalBencode reads a bitfield back from a bencoded byte string.
+// It doesn't know the number of pieces, so call Validate afterwards
+func (b *Bitfield) UnmarshalBencode(data []byte) error {
+	colon := bytes.IndexByte(data, ':')
+	if colon < 1 {
+		return fmt.Errorf("bitfield: expected a bencoded string")
+	}
+	length, err := strconv.Atoi(string(data[:colon]))
+	if err != nil || length < 0 || length != len(data)-colon-1 {
+		return fmt.Errorf("bitfield: bad bencoded string length %q", data[:colon])
+	}
+	*b = append(Bitfield(nil), data[colon+1:]...)
+	return nil
+}
@@ -0,0 +1,55 @@
+package bitfield
+
+import "testing"
+
+// the index comes from the peer (have messages), so nothing it can send should panic
+func FuzzBitfield(f *testing.F) {
+	f.Add([]byte{0xff, 0x00}, 3)
+	f.Add([]byte{}, 0)
+	f.Add([]byte{0x80}, -1)
+	f.Add([]byte{0x01}, 1<<40)
+	f.Fuzz(func(t *testing.T, data []byte, index int) {
+		bf := Bitfield(append([]byte(nil), data...))
+		had := bf.HasPiece(index)
+		bf.SetPiece(index)
+		inRange := index >= 0 && index/8 < len(bf)
+		if inRange && !bf.HasPiece(index) {
+			t.Fatalf("piece %d not set after SetPiece", index)
+		}
+		if !inRange && (had || bf.HasPiece(index)) {
+			t.Fatalf("out of range piece %d reported as present", index)
+		}
+
+		// iterating has to agree with HasPiece and Count
+		pieces := bf.Pieces()
+		if len(pieces) != bf.Count() {
+			t.Fatalf("Pieces found %d, Count says %d", len(pieces), bf.Count())
+		}
+		for _, p := range pieces {
+			if !bf.HasPiece(p) {
+				t.Fatalf("Pieces returned %d which isn't set", p)
+			}
+		}
+		if !bf.IsComplete(bf.Count()) && bf.Count() == len(bf)*8 {
+			t.Fatalf("full bitfield isn't complete")
+		}
+
+		bf.ClearPiece(index)
+		if bf.HasPiece(index) {
+			t.Fatalf("piece %d still set after ClearPiece", index)
+		}
+
+		// set operations never panic on mismatched lengths, and And/AndNot split b in two
+		other := Bitfield(data[len(data)/2:])
+		and, andNot := bf.And(other), bf.AndNot(other)
+		if and.Or(andNot).Count() != bf.Count() {
+			t.Fatalf("And and AndNot don't add back up to the original")
+		}
+
+		var decoded Bitfield
+		encoded, _ := bf.MarshalBencode()
+		if err := decoded.UnmarshalBencode(encoded); err != nil || string(decoded) != string(bf) {
+			t.Fatalf("bencode round trip failed: %v", err)
+		}
+	})
+}
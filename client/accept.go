@@ -0,0 +1,41 @@
+package client
+
+import (
+	"fmt"
+	"main/peers"
+	"net"
+	"time"
+)
+
+// Accept does the handshake for a peer that connected to us, so it goes the other
+// way round: the peer sends its handshake first, and we only answer if lookup says we're
+// serving the torrent it asked for (and whether to set the v2 bit in our answer, for a v2
+// or hybrid torrent). conn should already be through mse.Accept if the peer might be
+// encrypting. Bitfield is nil, we're not going to download from this peer
+func Accept(conn net.Conn, peerID [20]byte, lookup func(infoHash [20]byte) (ok bool, v2 bool)) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	peerReserved, infoHash, err := readHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	ok, v2 := lookup(infoHash)
+	if !ok {
+		return nil, fmt.Errorf("peer %s asked for a torrent we don't have", conn.RemoteAddr())
+	}
+	err = writeHandshake(conn, peerID, infoHash, v2)
+	if err != nil {
+		return nil, err
+	}
+
+	// the port is whatever the peer dialed from, not the one it listens on, but
+	// it's still the best name we have for it
+	var peer peers.Peer
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		peer = peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	} else if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+		peer = peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	return newClient(conn, peer, peerID, infoHash, peerReserved), nil
+}
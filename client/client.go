@@ -1,11 +1,8 @@
 package client
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 	"main/bitfield"
 	"main/message"
 	"main/peers"
@@ -20,120 +17,244 @@ type Client struct {
 	Choked bool
 	// which pieces does this peer own?
 	Bitfield bitfield.Bitfield
+	// how many pieces the torrent has, 0 if we don't know yet (see Connect)
+	numPieces int
 	// the peer that this client will work with
 	peer peers.Peer
 	// the peerID is a 20byte identifier for OUR client actually, not the peer
 	peerID [20]byte
 	// the SHA1 hash of the info dict in the .torrent file
 	infoHash [20]byte
+
+	// Fast Extension (BEP 6) stuff, only used if both of us set the bit in the handshake
+	SupportsFast bool
+	// pieces the peer lets us download even while it's choking us. Use AddAllowedFast
+	AllowedFast map[int]bool
+	// pieces the peer suggested we download, e.g. because it has them cached. Use AddSuggested
+	Suggested map[int]bool
+
+	// the peer set the BitTorrent v2 bit in its handshake (BEP 52)
+	SupportsV2 bool
+	// the peer speaks the extension protocol (BEP 10), e.g. for getting metadata
+	SupportsExtensions bool
+}
+
+// the most AllowedFast or Suggested pieces we keep for one peer. BEP 6 has peers
+// send 10 or so, anything past this is just the peer filling up our memory
+const maxFastPieces = 64
+
+// AddAllowedFast notes a piece from the peer's allowed fast message. Indexes that
+// aren't in the torrent are dropped, and so is everything past maxFastPieces
+func (client *Client) AddAllowedFast(index int) {
+	client.addFastPiece(client.AllowedFast, index)
+}
+
+// AddSuggested notes a piece from the peer's suggest piece message, like AddAllowedFast
+func (client *Client) AddSuggested(index int) {
+	client.addFastPiece(client.Suggested, index)
+}
+
+func (client *Client) addFastPiece(pieces map[int]bool, index int) {
+	if index < 0 || index >= client.numPieces || len(pieces) >= maxFastPieces {
+		return
+	}
+	pieces[index] = true
 }
 
 // message format is bitfield: <len=0001+X><id=5><bitfield>
-func receiveBitfieldMessage(conn net.Conn) (*message.Message, error) {
+// with the Fast Extension the peer can send Have All or Have None instead,
+// which is why we need numPieces (to build the bitfield ourselves)
+// The bitfield is optional though: a peer with no pieces is allowed to skip it and go
+// straight to e.g. have or unchoke messages. In that case we start with an empty
+// bitfield and also return the message, so the caller can act on it
+func receiveBitfieldMessage(conn net.Conn, numPieces int, fast bool) (bitfield.Bitfield, *message.Message, error) {
 	// do deadline thing
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline
 
-	lengthOfMsg := make([]byte, 4)
-	_, err := io.ReadFull(conn, lengthOfMsg)
-	if err != nil {
-		return nil, err
+	// message.Read takes care of the length prefix, and refuses anything ridiculously big
+	// keep-alives don't tell us anything, so skip past them
+	var msg *message.Message
+	var err error
+	for msg == nil {
+		msg, err = message.Read(conn)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	// "The length prefix is a four byte big-endian value."
-	// The message ID is a single decimal byte. The payload is message dependent.
-	msgLen := binary.BigEndian.Uint32(lengthOfMsg)
-	if msgLen == 0 {
-		err := fmt.Errorf("expected bitfield message, got keepalive instead")
-		return nil, err
+	switch {
+	case msg.ID == message.Bitfield:
+		bf := message.BitfieldMessage{}
+		err = bf.Unmarshal(msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		// A bitfield of the wrong length is considered an error. Clients should drop the
+		// connection if they receive bitfields that are not of the correct size, or
+		// if the bitfield has any of the spare bits set.
+		err = bf.Bitfield.Validate(numPieces)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bf.Bitfield, nil, nil
+	case msg.ID == message.HaveAll && fast:
+		// every piece, so every bit set
+		ret := bitfield.New(numPieces)
+		for i := 0; i < numPieces; i++ {
+			ret.SetPiece(i)
+		}
+		return ret, nil, nil
+	case msg.ID == message.HaveNone && fast:
+		return bitfield.New(numPieces), nil, nil
+	case msg.ID == message.Bitfield || msg.ID == message.HaveAll || msg.ID == message.HaveNone:
+		// have all/none from a peer that didn't negotiate the fast extension
+		err = fmt.Errorf("peer sent message %d without the fast extension", msg.ID)
+		return nil, nil, err
 	}
+	return bitfield.New(numPieces), msg, nil
+}
 
-	// read in the bitfield (remember that first byte is the ID, 5)
-	bitFieldBuf := make([]byte, msgLen)
-	_, err = io.ReadFull(conn, bitFieldBuf)
+// this actually forms the connection using net.Dial, and outputs a net.Conn variable
+// and puts the connection into a Client struct for easy use later
+// opts decides how we connect (uTP or TCP, encrypted or not), see dial.go
+func New(peer peers.Peer, peerID [20]byte, infoHash [20]byte, numPieces int, opts Options) (*Client, error) {
+	ret, err := Connect(peer, peerID, infoHash, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	if bitFieldBuf[0] != message.Bitfield {
-		err := fmt.Errorf("expected bitfield message, got message with id %d instead", bitFieldBuf[0])
+	// receive the bitfield message that tells us what pieces this particular peer owns
+	// (the length and spare bits get checked in there, and we hang up if they're wrong)
+	piecesOwned, firstMsg, err := receiveBitfieldMessage(ret.Conn, numPieces, ret.SupportsFast)
+	if err != nil {
+		ret.Conn.Close()
 		return nil, err
 	}
+	ret.Bitfield = piecesOwned
+	ret.numPieces = numPieces
 
-	// make a message struct to return
-	msg := message.Message{
-		Length:  msgLen,
-		ID:      uint8(bitFieldBuf[0]),
-		Payload: bitFieldBuf[1:],
+	// the peer skipped the bitfield, so don't lose the message it sent instead
+	err = ret.handleFirstMessage(firstMsg)
+	if err != nil {
+		ret.Conn.Close()
+		return nil, err
 	}
-	return &msg, nil
+	return ret, nil
 }
 
-// this actually forms the connection using net.Dial, and outputs a net.Conn variable
-// and puts the connection into a Client struct for easy use later
-func New(peer peers.Peer, peerID [20]byte, infoHash [20]byte, numPieces int) (*Client, error) {
-	// we could just do net.Dial here but its better to use a timeout with this connection
-	// therefore we choose to use net.DialTimeout instead
-	// conn, err := net.Dial("tcp", peer.String())
-
-	// lets use a 10 second timeout
-	conn, err := net.DialTimeout("tcp", peer.String(), time.Second*10)
+// Connect dials the peer and does the handshake, but doesn't wait for a bitfield. That's
+// for when we don't know how many pieces there are yet, like when we're getting the
+// metadata for a magnet link. Bitfield is nil
+func Connect(peer peers.Peer, peerID [20]byte, infoHash [20]byte, opts Options) (*Client, error) {
+	conn, err := dial(peer, infoHash, opts)
 	if err != nil {
 		return nil, err
 	}
 
 	// setup and perform handshake on this peer
-	err = performPeerHandshake(conn, peerID, infoHash)
+	peerReserved, err := performPeerHandshake(conn, peerID, infoHash, opts.V2)
 	if err != nil {
 		conn.Close()
-		// log.Println(err.Error())
 		return nil, err
 	}
-	// log.Println("Handshake finished on peer", peer.String())
+	return newClient(conn, peer, peerID, infoHash, peerReserved), nil
+}
 
-	// receive the bitfield message that tells us what pieces this particular peer owns
-	piecesOwned, err := receiveBitfieldMessage(conn)
-	if err != nil {
-		conn.Close()
-		log.Println(err.Error())
-		return nil, err
+// a Client for a connection that's done the handshake
+func newClient(conn net.Conn, peer peers.Peer, peerID [20]byte, infoHash [20]byte, peerReserved [8]byte) *Client {
+	return &Client{
+		Conn:               conn,
+		Choked:             true,
+		peer:               peer,
+		peerID:             peerID,
+		infoHash:           infoHash,
+		SupportsFast:       peerReserved[7]&fastExtensionBit != 0,
+		SupportsV2:         peerReserved[7]&v2Bit != 0,
+		SupportsExtensions: peerReserved[5]&extensionBit != 0,
+		AllowedFast:        make(map[int]bool),
+		Suggested:          make(map[int]bool),
 	}
+}
 
-	// A bitfield of the wrong length is considered an error. Clients should drop the
-	// connection if they receive bitfields that are not of the correct size, or
-	// if the bitfield has any of the spare bits set.
-	// aka bitfield length is not equal to number of pieces, then terminate connection
-	// ok update this keep failing here so I'll comment it out. Original code didnt have
-	// this anyways, I just wanted to be fancy.
-
-	// if len(piecesOwned.Payload) != numPieces {
-	// 	conn.Close()
-	// 	err = fmt.Errorf("number of pieces is not equal to len of bitfield from peer return message")
-	// 	log.Println(err.Error())
-	// 	return nil, err
-	// }
-
-	ret := Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: piecesOwned.Payload,
-		peer:     peer,
-		peerID:   peerID,
-		infoHash: infoHash,
+// deal with the first message from a peer that didn't send a bitfield.
+// only the messages that change the client's state matter here, the rest
+// (e.g. interested) don't mean anything to us yet
+func (client *Client) handleFirstMessage(msg *message.Message) error {
+	if msg == nil {
+		return nil
+	}
+	typed, err := message.Parse(msg)
+	if err != nil {
+		return err
+	}
+	switch m := typed.(type) {
+	case *message.HaveMessage:
+		client.Bitfield.SetPiece(m.Index)
+	case *message.AllowedFastMessage:
+		client.AddAllowedFast(m.Index)
+	case *message.SuggestMessage:
+		client.AddSuggested(m.Index)
 	}
-	return &ret, nil
+	switch msg.ID {
+	case message.Unchoke:
+		client.Choked = false
+	case message.Choke:
+		client.Choked = true
+	}
+	return nil
 }
 
+// the bit in the reserved bytes of the handshake that says we support the Fast Extension (BEP 6)
+const fastExtensionBit = 0x04
+
+// the bit that says we understand v2 torrents (BEP 52)
+const v2Bit = 0x10
+
+// the bit (in reserved[5], not [7]) that says we speak the extension protocol (BEP 10)
+const extensionBit = 0x10
+
 // handshake format goes pstrlen, pstr, reserved, infohash, peerid
-func performPeerHandshake(conn net.Conn, peerID [20]byte, infoHash [20]byte) error {
+// returns the reserved bytes from the peer's handshake, which say what extensions it supports
+// v2 sets the bit that says we support BitTorrent v2. For a v2 torrent infoHash is the
+// SHA-256 info hash cut down to 20 bytes
+func performPeerHandshake(conn net.Conn, peerID [20]byte, infoHash [20]byte, v2 bool) ([8]byte, error) {
 	// idk exactly why we need this, didnt we do DialTimeout on conn already?
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 
+	// send our handshake first, the peer answers with the exact same format
+	err := writeHandshake(conn, peerID, infoHash, v2)
+	if err != nil {
+		return [8]byte{}, err
+	}
+	peerReserved, peerInfoHash, err := readHandshake(conn)
+	if err != nil {
+		return peerReserved, err
+	}
+
+	// check that the infoHashes match
+	if peerInfoHash != infoHash {
+		err := fmt.Errorf("peer handshake failed, infoHashes don't match")
+		return peerReserved, err
+	}
+
+	// otherwise we are happy. We've made a handshake, peer response was correct, and
+	// now we can start transferring actual data
+	return peerReserved, nil
+}
+
+// send our half of the handshake
+func writeHandshake(conn net.Conn, peerID [20]byte, infoHash [20]byte, v2 bool) error {
 	// we basically have to transform handshake info into a single []byte
 	pstrlen := 19
 	pstr := "BitTorrent protocol"
 	var reserved [8]byte
+	reserved[5] |= extensionBit
+	reserved[7] |= fastExtensionBit
+	if v2 {
+		reserved[7] |= v2Bit
+	}
 
 	// we can hardcode this slice's capacity as 49+len(pstr). Check the wiki for more info
 	handshakeBuf := make([]byte, 49+len(pstr))
@@ -148,45 +269,38 @@ func performPeerHandshake(conn net.Conn, peerID [20]byte, infoHash [20]byte) err
 
 	// send the byte slice into the connection...
 	_, err := conn.Write(handshakeBuf)
-	if err != nil {
-		return err
-	}
+	return err
+}
+
+// read the peer's half of the handshake, returns its reserved bytes and the info hash it sent
+func readHandshake(conn net.Conn) ([8]byte, [20]byte, error) {
+	var peerReserved [8]byte
+	var peerInfoHash [20]byte
 
-	// read the response from peer (should be exact same as the one we sent to peer)
 	// using io.ReadFull, not io.ReadAll since that doesnt give us control over length
-	// also IDK why we cant just read the whole response in at once but OK
+	// we need the first byte on its own, it tells us how long the rest is
 	firstByte := make([]byte, 1)
-	_, err = io.ReadFull(conn, firstByte)
+	_, err := io.ReadFull(conn, firstByte)
 	if err != nil {
-		// log.Println("EOF check")
-		return err
+		return peerReserved, peerInfoHash, err
 	}
 	pstrlenResponse := int(firstByte[0])
 	if pstrlenResponse == 0 {
 		err := fmt.Errorf("peer handshake failed, first byte (pstrlen) was %d", pstrlenResponse)
-		return err
+		return peerReserved, peerInfoHash, err
 	}
 
 	// read in the rest of the peer handshake response
 	restOfResponse := make([]byte, 48+pstrlenResponse)
 	_, err = io.ReadFull(conn, restOfResponse)
 	if err != nil {
-		return err
-	}
-
-	// check that the infoHashes match
-	if bytes.Compare(infoHash[:], restOfResponse[len(pstr)+8:len(pstr)+8+20]) != 0 {
-		err := fmt.Errorf("peer handshake failed, infoHashes don't match")
-		return err
+		return peerReserved, peerInfoHash, err
 	}
-	// if bytes.Compare(peerID[:], restOfResponse[len(pstr)+28:len(pstr)+28+20]) != 0 {
-	// 	err := fmt.Errorf("peer handshake failed, peerIDs don't match")
-	// 	return err
-	// }
 
-	// otherwise we are happy. We've made a handshake, peer response was correct, and
-	// now we can start transferring actual data
-	return nil
+	// the offsets depend on the pstr length the peer sent, not ours
+	copy(peerReserved[:], restOfResponse[pstrlenResponse:pstrlenResponse+8])
+	copy(peerInfoHash[:], restOfResponse[pstrlenResponse+8:pstrlenResponse+8+20])
+	return peerReserved, peerInfoHash, nil
 }
 
 // two quick functions to help us send a unchoke and interested message to the peer
@@ -227,21 +341,30 @@ func (client *Client) SendChoke() error {
 	return err
 }
 
-// tells the peer that we have a piece
-// <len=0005><id=4><piece index>
-func (client *Client) SendHave(index int) error {
+// tells the peer we have every piece, instead of sending a full bitfield (Fast Extension)
+func (client *Client) SendHaveAll() error {
+	msg := message.Message{
+		ID: message.HaveAll,
+	}
+	_, err := client.Conn.Write(msg.MessageToByteSlice())
+	return err
+}
 
-	payload := make([]byte, 4)
-	binary.BigEndian.PutUint32(payload[0:], uint32(index))
+// tells the peer we don't have any pieces yet, instead of sending an empty bitfield (Fast Extension)
+func (client *Client) SendHaveNone() error {
 	msg := message.Message{
-		ID:      message.Have,
-		Payload: payload,
+		ID: message.HaveNone,
 	}
-	msgInBytes := msg.MessageToByteSlice()
-	_, err := client.Conn.Write(msgInBytes)
+	_, err := client.Conn.Write(msg.MessageToByteSlice())
 	return err
 }
 
+// tells the peer that we have a piece
+// <len=0005><id=4><piece index>
+func (client *Client) SendHave(index int) error {
+	return client.Send(&message.HaveMessage{Index: index})
+}
+
 // request: <len=0013><id=6><index><begin><length>
 // The request message is fixed length, and is used to request a block.
 // The payload contains the following information:
@@ -250,20 +373,32 @@ func (client *Client) SendHave(index int) error {
 // begin: integer specifying the zero-based byte offset within the piece
 // length: integer specifying the requested length.
 func (client *Client) SendRequest(index, begin, length int) error {
+	return client.Send(&message.RequestMessage{Index: index, Begin: begin, Length: length})
+}
 
-	payload := make([]byte, 12)
-	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
-	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
-	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+// which peer is on the other end of this connection
+func (client *Client) Peer() peers.Peer {
+	return client.peer
+}
 
-	msg := message.Message{
-		ID:      message.Request,
-		Payload: payload,
-	}
+// which torrent this connection is for
+func (client *Client) InfoHash() [20]byte {
+	return client.infoHash
+}
 
-	msgInBytes := msg.MessageToByteSlice()
-	_, err := client.Conn.Write(msgInBytes)
+// tells the peer we won't be sending a block it asked for
+// reject request: <len=0013><id=16><index><begin><length>
+func (client *Client) SendReject(index, begin, length int) error {
+	return client.Send(&message.RejectMessage{Index: index, Begin: begin, Length: length})
+}
 
+// marshals any of the typed messages and sends it to the peer
+func (client *Client) Send(m message.Typed) error {
+	msg, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = client.Conn.Write(msg.MessageToByteSlice())
 	return err
 }
 
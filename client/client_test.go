@@ -0,0 +1,110 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// a net.Conn that replies with canned bytes and throws away whatever we write
+type fakeConn struct {
+	r io.Reader
+}
+
+func (c *fakeConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c *fakeConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *fakeConn) Close() error                       { return nil }
+func (c *fakeConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *fakeConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// a valid handshake reply for an info hash of all 0x01s
+func handshakeReply() []byte {
+	buf := []byte{19}
+	buf = append(buf, "BitTorrent protocol"...)
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, fastExtensionBit)
+	buf = append(buf, bytes.Repeat([]byte{1}, 20)...)
+	buf = append(buf, bytes.Repeat([]byte{2}, 20)...)
+	return buf
+}
+
+func FuzzHandshake(f *testing.F) {
+	f.Add(handshakeReply())
+	f.Add([]byte{0})
+	f.Add([]byte{1, 'x'})
+	f.Add([]byte{255})
+	f.Fuzz(func(t *testing.T, reply []byte) {
+		var peerID, infoHash [20]byte
+		for i := range infoHash {
+			infoHash[i] = 1
+		}
+		performPeerHandshake(&fakeConn{r: bytes.NewReader(reply)}, peerID, infoHash, false)
+	})
+}
+
+func FuzzReceiveBitfield(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 2, 5, 0xff}, 8, false)
+	f.Add([]byte{0, 0, 0, 2, 5, 0xf1}, 4, false)
+	f.Add([]byte{0, 0, 0, 5, 4, 0, 0, 0, 3}, 8, false)
+	f.Add([]byte{0, 0, 0, 1, 1}, 8, true)
+	f.Add([]byte{0, 0, 0, 1, 14}, 20, true)
+	f.Add([]byte{0, 0, 0, 1, 15}, 20, true)
+	f.Add([]byte{0, 0, 0, 0}, 1, false)
+	// allowed fast and suggest for pieces past the end
+	f.Add([]byte{0, 0, 0, 5, 17, 0, 0, 0, 9}, 8, true)
+	f.Add([]byte{0, 0, 0, 5, 13, 0xff, 0xff, 0xff, 0xff}, 8, true)
+	f.Fuzz(func(t *testing.T, data []byte, numPieces int, fast bool) {
+		// keep the piece count sane so HaveAll doesn't allocate gigabytes
+		if numPieces < 0 || numPieces > 1<<16 {
+			return
+		}
+		bf, first, err := receiveBitfieldMessage(&fakeConn{r: bytes.NewReader(data)}, numPieces, fast)
+		if err != nil {
+			return
+		}
+		if len(bf) != (numPieces+7)/8 {
+			t.Fatalf("accepted a %d byte bitfield for %d pieces", len(bf), numPieces)
+		}
+		for i := numPieces; i < len(bf)*8; i++ {
+			if bf.HasPiece(i) {
+				t.Fatalf("accepted a bitfield with spare bit %d set", i)
+			}
+		}
+		c := Client{Bitfield: bf, numPieces: numPieces, AllowedFast: map[int]bool{}, Suggested: map[int]bool{}}
+		c.handleFirstMessage(first)
+		for _, pieces := range []map[int]bool{c.AllowedFast, c.Suggested} {
+			for index := range pieces {
+				if index < 0 || index >= numPieces {
+					t.Fatalf("took piece %d of %d from the peer", index, numPieces)
+				}
+			}
+		}
+	})
+}
+
+// a peer can send as many allowed fast and suggest messages as it likes
+func TestFastPiecesBounded(t *testing.T) {
+	c := Client{numPieces: 1000, AllowedFast: map[int]bool{}, Suggested: map[int]bool{}}
+	for _, index := range []int{-1, 1000, 1 << 30} {
+		c.AddAllowedFast(index)
+		c.AddSuggested(index)
+	}
+	if len(c.AllowedFast) != 0 || len(c.Suggested) != 0 {
+		t.Fatalf("kept pieces that aren't in the torrent: %v %v", c.AllowedFast, c.Suggested)
+	}
+	for i := 0; i < 1000; i++ {
+		c.AddAllowedFast(i)
+		c.AddSuggested(i)
+	}
+	if len(c.AllowedFast) != maxFastPieces || len(c.Suggested) != maxFastPieces {
+		t.Fatalf("kept %d allowed fast and %d suggested pieces, the most is %d",
+			len(c.AllowedFast), len(c.Suggested), maxFastPieces)
+	}
+	if !c.AllowedFast[0] || !c.Suggested[maxFastPieces-1] {
+		t.Fatal("the first pieces should be the ones kept")
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"main/mse"
+	"main/peers"
+	"main/utp"
+	"net"
+	"time"
+)
+
+// DialStrategy decides which transport we use to reach a peer
+type DialStrategy int
+
+const (
+	// plain old TCP, the default
+	DialTCP DialStrategy = iota
+	// try uTP first since it's nicer to the network, and fall back to TCP
+	// if the peer doesn't answer over UDP. That costs up to utpDialTimeout for
+	// every peer that only does TCP, which is most of them
+	DialUTPThenTCP
+	// only uTP
+	DialUTP
+)
+
+func (d DialStrategy) String() string {
+	switch d {
+	case DialTCP:
+		return "tcp"
+	case DialUTPThenTCP:
+		return "auto"
+	case DialUTP:
+		return "utp"
+	}
+	return "unknown"
+}
+
+// ParseDialStrategy turns "tcp", "utp" or "auto" into a DialStrategy
+func ParseDialStrategy(s string) (DialStrategy, error) {
+	for _, d := range []DialStrategy{DialTCP, DialUTPThenTCP, DialUTP} {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+	return DialTCP, fmt.Errorf("unknown transport %q, must be tcp, utp or auto", s)
+}
+
+// Options are the knobs for how New connects to a peer
+type Options struct {
+	// whether we do the MSE handshake before the bittorrent one
+	Encryption mse.Policy
+	// which transport(s) to try
+	Dial DialStrategy
+	// whether the torrent is v2 (or hybrid), so we tell the peer we speak v2 in the handshake
+	V2 bool
+}
+
+// how long we wait for a TCP connection, and for a peer to answer our uTP SYN.
+// uTP gets less time since we still have TCP to try afterwards
+const (
+	tcpDialTimeout = 10 * time.Second
+	utpDialTimeout = 3 * time.Second
+)
+
+// open the connection to the peer, wrapping it in MSE encryption if the options say so
+func dial(peer peers.Peer, infoHash [20]byte, opts Options) (net.Conn, error) {
+	conn, err := dialTransport(peer, opts.Dial)
+	if err != nil || opts.Encryption == mse.Disabled {
+		return conn, err
+	}
+
+	encrypted, err := mse.Initiate(conn, infoHash, opts.Encryption)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+	if opts.Encryption == mse.Required {
+		return nil, err
+	}
+
+	// peers that don't know MSE just hang up on us, and there's no way to go back to
+	// plaintext on the same connection, so dial again for the plain handshake. Over
+	// whichever transport got through the first time, so auto doesn't sit through
+	// another uTP timeout for a peer that only does TCP
+	redial := DialTCP
+	if _, ok := conn.(*utp.Conn); ok {
+		redial = DialUTP
+	}
+	return dialTransport(peer, redial)
+}
+
+// the raw connection to the peer, before any handshakes
+func dialTransport(peer peers.Peer, strategy DialStrategy) (net.Conn, error) {
+	if strategy == DialUTP || strategy == DialUTPThenTCP {
+		conn, err := utp.Dial(peer.String(), utpDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		if strategy == DialUTP {
+			return nil, err
+		}
+	}
+
+	// we could just do net.Dial here but its better to use a timeout with this connection
+	// therefore we choose to use net.DialTimeout instead
+	// conn, err := net.Dial("tcp", peer.String())
+	return net.DialTimeout("tcp", peer.String(), tcpDialTimeout)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"main/client"
+	"main/mse"
+	"main/peerpool"
+	"main/ratelimit"
+	"main/torrentfile"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// exit codes: 0 when it worked, 1 when something went wrong, 2 when the command line was wrong
+// (that's what the flag package uses too)
+const (
+	exitError = 1
+	exitUsage = 2
+)
+
+// print the error and quit. Not log.Fatal, since -log-level error turns the log off
+func fatal(v ...any) {
+	fmt.Fprintln(os.Stderr, append([]any{"gotorrent:"}, v...)...)
+	os.Exit(exitError)
+}
+
+// the flags every command that talks to peers has
+type commonFlags struct {
+	port          int
+	output        string
+	maxPeers      int
+	maxPeersTotal int
+	downloadLimit int
+	uploadLimit   int
+	encryption    string
+	transport     string
+	logLevel      string
+	config        *string
+}
+
+func addCommonFlags(fs *flag.FlagSet) *commonFlags {
+	c := &commonFlags{}
+	fs.IntVar(&c.port, "port", int(torrentfile.DefaultPort), "port to accept peer connections on, and tell trackers about")
+	fs.StringVar(&c.output, "o", ".", "directory the torrent's files go in")
+	fs.IntVar(&c.maxPeers, "max-peers", peerpool.DefaultTorrentConns, "most peers to be connected to at once for this torrent")
+	fs.IntVar(&c.maxPeersTotal, "max-peers-total", peerpool.DefaultGlobalConns, "most peer connections at once, across every torrent")
+	fs.IntVar(&c.downloadLimit, "download-limit", 0, "max download rate in KB/s across all peers, 0 for unlimited")
+	fs.IntVar(&c.uploadLimit, "upload-limit", 0, "max upload rate in KB/s across all peers, 0 for unlimited")
+	fs.StringVar(&c.encryption, "encryption", "preferred", "message stream encryption with peers: disabled, preferred or required")
+	fs.StringVar(&c.transport, "transport", "tcp", "how to connect to peers: tcp, utp, or auto (uTP, falling back to TCP)")
+	fs.StringVar(&c.logLevel, "log-level", "info", "how much to log: error (nothing but errors), info, or debug (with file and line)")
+	c.config = addConfigFlag(fs)
+	return c
+}
+
+// the -config flag, for commands that don't have the rest of the common flags
+func addConfigFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", defaultConfigPath(), "config file with default flag values, one \"name = value\" per line")
+}
+
+// parse args into fs, with the config file's values as the defaults. The config file
+// can itself be picked with -config, so that gets looked for before anything else
+func parseFlags(fs *flag.FlagSet, config string, args []string) {
+	path, explicit := configPath(fs, config, args)
+	err := loadConfig(fs, path)
+	// no config file is fine, unless you asked for one
+	if err != nil && (explicit || !os.IsNotExist(err)) {
+		fmt.Fprintln(os.Stderr, "gotorrent:", err)
+		os.Exit(exitUsage)
+	}
+	fs.Parse(args)
+}
+
+// the config file args ask for with -config, or config if they don't. Only the flags
+// before the first positional argument count, the same as for fs.Parse, and the values
+// of other flags get skipped so "-o config" isn't taken for -config
+func configPath(fs *flag.FlagSet, config string, args []string) (path string, explicit bool) {
+	path = config
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		name, value, hasValue := strings.Cut(name, "=")
+		if name == "config" {
+			if !hasValue {
+				if i+1 >= len(args) {
+					break
+				}
+				value = args[i+1]
+			}
+			path, explicit = value, true
+		}
+		if !hasValue && takesValue(fs, name) {
+			i++
+		}
+	}
+	return path, explicit
+}
+
+// whether the flag called name is followed by its value, like -o dir, rather than
+// being a bool flag on its own
+func takesValue(fs *flag.FlagSet, name string) bool {
+	f := fs.Lookup(name)
+	if f == nil {
+		// fs.Parse will complain about it
+		return false
+	}
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return false
+	}
+	return true
+}
+
+// where the config file is if you don't say, e.g. ~/.config/gotorrent/config on linux
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gotorrent", "config")
+}
+
+// set fs's flags from the config file at path. Lines are "name = value", # starts a
+// comment. Flags the command doesn't have are skipped, since every command shares the file
+func loadConfig(fs *flag.FlagSet, path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected name = value", path, lineNum)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "config" || fs.Lookup(name) == nil {
+			continue
+		}
+		err = fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, lineNum, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// apply the flags that aren't per torrent: logging and the global limits
+func (c *commonFlags) apply() {
+	switch c.logLevel {
+	case "error":
+		log.SetOutput(io.Discard)
+	case "info":
+	case "debug":
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+	default:
+		usageError(fmt.Sprintf("unknown log level %q, use error, info or debug", c.logLevel))
+	}
+	if c.port <= 0 || c.port > 65535 {
+		usageError(fmt.Sprintf("bad port %d", c.port))
+	}
+	if c.maxPeers <= 0 || c.maxPeersTotal <= 0 {
+		usageError("peer limits have to be at least 1")
+	}
+	ratelimit.GlobalDownload.SetRate(c.downloadLimit * 1024)
+	ratelimit.GlobalUpload.SetRate(c.uploadLimit * 1024)
+	peerpool.DefaultLimiter = peerpool.NewLimiter(c.maxPeersTotal)
+}
+
+// the per torrent settings the flags ask for
+func (c *commonFlags) settings() torrentfile.Settings {
+	policy, err := mse.ParsePolicy(c.encryption)
+	if err != nil {
+		usageError(err.Error())
+	}
+	dialStrategy, err := client.ParseDialStrategy(c.transport)
+	if err != nil {
+		usageError(err.Error())
+	}
+	return torrentfile.Settings{
+		Port:       uint16(c.port),
+		Encryption: policy,
+		Dial:       dialStrategy,
+		MaxConns:   c.maxPeers,
+	}
+}
+
+func usageError(msg string) {
+	fmt.Fprintln(os.Stderr, "gotorrent:", msg)
+	os.Exit(exitUsage)
+}
+
+// open a .torrent file, or read a magnet link
+func openTorrent(arg string) torrentfile.Torrent {
+	var tf torrentfile.Torrent
+	var err error
+	if strings.HasPrefix(arg, "magnet:") {
+		tf, err = torrentfile.ParseMagnet(arg)
+	} else {
+		tf, err = torrentfile.Open(arg)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	return tf
+}
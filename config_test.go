@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the download command's flags, without exiting on errors
+func testFlags() (*flag.FlagSet, *commonFlags, *bool) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	c := addCommonFlags(fs)
+	quiet := fs.Bool("quiet", false, "")
+	return fs, c, quiet
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPath(t *testing.T) {
+	cases := []struct {
+		args     []string
+		want     string
+		explicit bool
+	}{
+		{nil, "default", false},
+		{[]string{"-config", "a"}, "a", true},
+		{[]string{"--config", "a", "x.torrent"}, "a", true},
+		{[]string{"-config=a"}, "a", true},
+		{[]string{"--config=a"}, "a", true},
+		{[]string{"-quiet", "-config", "a"}, "a", true},
+		// a flag's value, or a positional argument, that happens to be called config
+		{[]string{"-o", "config", "x.torrent"}, "default", false},
+		{[]string{"-o", "config", "-config", "a"}, "a", true},
+		{[]string{"x.torrent", "config", "y"}, "default", false},
+		{[]string{"x.torrent", "-config", "a"}, "default", false},
+		{[]string{"--", "-config", "a"}, "default", false},
+		{[]string{"-config"}, "default", false},
+	}
+	for _, c := range cases {
+		fs, _, _ := testFlags()
+		path, explicit := configPath(fs, "default", c.args)
+		if path != c.want || explicit != c.explicit {
+			t.Errorf("%q: got %q, %v, want %q, %v", c.args, path, explicit, c.want, c.explicit)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	fs, c, quiet := testFlags()
+	path := writeConfig(t, `
+# a comment
+port = 7000
+o = /downloads   # where things go
+quiet=true
+# the ctl command's, so not ours
+token = abc
+config = /somewhere/else
+`)
+	err := loadConfig(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.port != 7000 || c.output != "/downloads" || !*quiet || *c.config == "/somewhere/else" {
+		t.Fatalf("got port %d, o %q, quiet %v, config %q", c.port, c.output, *quiet, *c.config)
+	}
+
+	for contents, want := range map[string]string{
+		"port 7000\n":         ":1: expected name = value",
+		"\nport = lots\n":     ":2: port: ",
+		"quiet = sometimes\n": ":1: quiet: ",
+	} {
+		fs, _, _ := testFlags()
+		err := loadConfig(fs, writeConfig(t, contents))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want an error with %q", contents, err, want)
+		}
+	}
+	if err := loadConfig(fs, filepath.Join(t.TempDir(), "nope")); !os.IsNotExist(err) {
+		t.Fatalf("missing file: %v", err)
+	}
+	if err := loadConfig(fs, ""); err != nil {
+		t.Fatalf("no config file: %v", err)
+	}
+}
+
+// the config file sets the defaults and the command line beats it
+func TestParseFlags(t *testing.T) {
+	config := writeConfig(t, "port = 7000\no = /from/config\n")
+	fs, c, _ := testFlags()
+	parseFlags(fs, "/does/not/exist", []string{"-config", config, "-o", "config", "x.torrent"})
+	if c.port != 7000 || c.output != "config" {
+		t.Fatalf("got port %d and o %q, want 7000 from the file and config from the command line", c.port, c.output)
+	}
+	if fs.NArg() != 1 || fs.Arg(0) != "x.torrent" {
+		t.Fatalf("args are %q", fs.Args())
+	}
+
+	// -o config used to be taken for -config, and x.torrent loaded as the config file
+	fs, c, _ = testFlags()
+	parseFlags(fs, config, []string{"-o", "config", "x.torrent"})
+	if c.output != "config" || c.port != 7000 || fs.Arg(0) != "x.torrent" {
+		t.Fatalf("got o %q, port %d, args %q", c.output, c.port, fs.Args())
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	path, err := outputPath("/downloads", "file.iso")
+	if err != nil || path != filepath.Join("/downloads", "file.iso") {
+		t.Fatalf("got %q, %v", path, err)
+	}
+	for _, name := range []string{"", "..", "../file.iso", "dir/file.iso"} {
+		_, err := outputPath("/downloads", name)
+		if err == nil || !strings.Contains(err.Error(), "give a path to put it") {
+			t.Errorf("%q: got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"main/torrentfile"
+	"os"
+	"strings"
+)
+
+// a flag that can be given more than once, e.g. -announce a -announce b
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// gotorrent create [flags] [file or directory]
+func runCreate(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	output := fs.String("o", "", "where to write the .torrent file (default: the name of the file or directory + .torrent)")
+	var announce, webSeeds stringList
+	fs.Var(&announce, "announce", "tracker URL. Repeat for backup trackers, each one is its own tier; put several in one tier by separating them with commas")
+	fs.Var(&webSeeds, "webseed", "URL of an HTTP server with a copy of the files. Can be repeated")
+	comment := fs.String("comment", "", "comment to put in the torrent")
+	private := fs.Bool("private", false, "mark the torrent private, so clients only get peers from the trackers")
+	pieceLength := fs.Int("piece-length", 0, "piece length in KB, a power of two. 0 picks one based on the size")
+	workers := fs.Int("workers", 0, "how many pieces to hash at once, 0 for one per CPU")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : [executable] create [flags] [file or directory to make a torrent of]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	opts := torrentfile.CreateOptions{
+		Path:        fs.Arg(0),
+		Comment:     *comment,
+		Private:     *private,
+		WebSeeds:    webSeeds,
+		PieceLength: *pieceLength * 1024,
+		Workers:     *workers,
+	}
+	for _, tier := range announce {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	// a single tracker doesn't need an announce-list
+	if len(opts.AnnounceList) == 1 && len(opts.AnnounceList[0]) == 1 {
+		opts.Announce = opts.AnnounceList[0][0]
+		opts.AnnounceList = nil
+	}
+
+	out := *output
+	if out == "" {
+		out = strings.TrimRight(fs.Arg(0), "/\\") + ".torrent"
+	}
+	err := torrentfile.CreateFile(opts, out)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Println("wrote", out)
+}
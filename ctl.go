@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"main/daemon"
+	"main/torrentfile"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// gotorrent ctl [flags] [command] [args]
+// controls a running gotorrent daemon over its API
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	a := addAPIFlags(fs)
+	asJSON := fs.Bool("json", false, "print what the daemon says as JSON")
+	config := addConfigFlag(fs)
+	fs.Usage = func() {
+		w := fs.Output()
+		fmt.Fprintln(w, "Usage : [executable] ctl [flags] [command] [args]")
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "Commands:")
+		fmt.Fprintln(w, "  list                          every torrent in the daemon")
+		fmt.Fprintln(w, "  add [.torrent, magnet or URL]  add torrents")
+		fmt.Fprintln(w, "  show [info hash]              how one torrent is going")
+		fmt.Fprintln(w, "  peers [info hash]             who a torrent is connected to")
+		fmt.Fprintln(w, "  pause [info hash]             stop a torrent, leaving it in the daemon")
+		fmt.Fprintln(w, "  resume [info hash]            start it again")
+		fmt.Fprintln(w, "  remove [-data] [info hash]    take a torrent out, -data deletes its files too")
+		fmt.Fprintln(w, "  limits [download] [upload]    show or set the rate limits, in KB/s (0 for unlimited)")
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "Info hashes can be cut short, as long as only one torrent starts with it")
+		fmt.Fprintln(w, "")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, *config, args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	token, err := a.clientToken()
+	if err != nil {
+		fatal(err)
+	}
+	ctl := &ctlCommand{c: daemon.NewClient(a.addr, token), json: *asJSON}
+
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "list":
+		ctl.list(rest)
+	case "add":
+		ctl.add(rest)
+	case "show", "peers", "pause", "resume":
+		ctl.one(cmd, rest)
+	case "remove":
+		ctl.remove(rest)
+	case "limits":
+		ctl.limits(rest)
+	default:
+		usageError(fmt.Sprintf("unknown ctl command %q", cmd))
+	}
+}
+
+type ctlCommand struct {
+	c    *daemon.Client
+	json bool
+}
+
+func (ctl *ctlCommand) list(args []string) {
+	if len(args) != 0 {
+		usageError("list doesn't take any arguments")
+	}
+	torrents, err := ctl.c.List()
+	if err != nil {
+		fatal(err)
+	}
+	if ctl.json {
+		printJSON(torrents)
+		return
+	}
+	for _, t := range torrents {
+		printTorrentLine(t)
+	}
+}
+
+func (ctl *ctlCommand) add(args []string) {
+	if len(args) == 0 {
+		usageError("add what? Give it .torrent files, magnet links or URLs")
+	}
+	failed := false
+	for _, arg := range args {
+		var req daemon.AddRequest
+		switch {
+		case strings.HasPrefix(arg, "magnet:"):
+			req.Magnet = arg
+		case strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://"):
+			req.URL = arg
+		default:
+			// the daemon might not be able to see our files, so send it the whole thing
+			data, err := os.ReadFile(arg)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "gotorrent:", err)
+				failed = true
+				continue
+			}
+			req.Torrent = data
+		}
+		t, err := ctl.c.Add(req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gotorrent: %s: %s\n", arg, err.Error())
+			failed = true
+			continue
+		}
+		if ctl.json {
+			printJSON(t)
+		} else {
+			printTorrentLine(t)
+		}
+	}
+	if failed {
+		os.Exit(exitError)
+	}
+}
+
+// the commands that take one info hash
+func (ctl *ctlCommand) one(cmd string, args []string) {
+	if len(args) != 1 {
+		usageError(cmd + " takes one info hash")
+	}
+	h := ctl.resolve(args[0])
+	var v any
+	var err error
+	switch cmd {
+	case "show":
+		v, err = ctl.c.Get(h)
+	case "peers":
+		v, err = ctl.c.Peers(h)
+	case "pause":
+		v, err = ctl.c.Pause(h)
+	case "resume":
+		v, err = ctl.c.Resume(h)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if ctl.json {
+		printJSON(v)
+		return
+	}
+	switch v := v.(type) {
+	case daemon.Torrent:
+		if cmd == "show" {
+			printTorrent(v)
+		} else {
+			printTorrentLine(v)
+		}
+	case []daemon.Peer:
+		for _, p := range v {
+			choked := ""
+			if p.Choked {
+				choked = ", choking us"
+			}
+			fmt.Printf("%s: %s down, %s up%s\n", p.Addr, torrentfile.FormatSize(p.Downloaded), torrentfile.FormatSize(p.Uploaded), choked)
+		}
+	}
+}
+
+func (ctl *ctlCommand) remove(args []string) {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	deleteData := fs.Bool("data", false, "delete the torrent's files too")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usageError("remove takes one info hash")
+	}
+	err := ctl.c.Remove(ctl.resolve(fs.Arg(0)), *deleteData)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func (ctl *ctlCommand) limits(args []string) {
+	var l daemon.Limits
+	var err error
+	switch len(args) {
+	case 0:
+		l, err = ctl.c.Limits()
+	case 2:
+		download, err1 := strconv.Atoi(args[0])
+		upload, err2 := strconv.Atoi(args[1])
+		if err1 != nil || err2 != nil || download < 0 || upload < 0 {
+			usageError("limits are in KB/s, 0 for unlimited")
+		}
+		l, err = ctl.c.SetLimits(daemon.Limits{Download: download * 1024, Upload: upload * 1024})
+	default:
+		usageError("limits takes no arguments, or the download and upload limits")
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if ctl.json {
+		printJSON(l)
+		return
+	}
+	fmt.Printf("download: %s\nupload: %s\n", formatLimit(l.Download), formatLimit(l.Upload))
+}
+
+// turn a (maybe shortened) info hash into the whole thing, by asking the daemon
+// which torrent it is
+func (ctl *ctlCommand) resolve(arg string) [20]byte {
+	var h [20]byte
+	if b, err := hex.DecodeString(arg); err == nil && len(b) == 20 {
+		copy(h[:], b)
+		return h
+	}
+	torrents, err := ctl.c.List()
+	if err != nil {
+		fatal(err)
+	}
+	var matches []daemon.Torrent
+	for _, t := range torrents {
+		if arg != "" && strings.HasPrefix(t.InfoHash, strings.ToLower(arg)) {
+			matches = append(matches, t)
+		}
+	}
+	if len(matches) != 1 {
+		fatal(fmt.Sprintf("%d torrents have an info hash starting with %q", len(matches), arg))
+	}
+	b, _ := hex.DecodeString(matches[0].InfoHash)
+	copy(h[:], b)
+	return h
+}
+
+func printTorrentLine(t daemon.Torrent) {
+	status := t.State
+	if t.Error != "" {
+		status += ": " + t.Error
+	}
+	fmt.Printf("%.8s  %-11s %5.1f%%  %s/s down, %s/s up, %d peers  %s\n", t.InfoHash, status,
+		t.Progress*100, torrentfile.FormatSize(t.DownloadRate), torrentfile.FormatSize(t.UploadRate), t.Peers, t.Name)
+}
+
+func printTorrent(t daemon.Torrent) {
+	fmt.Printf("Name:       %s\n", t.Name)
+	fmt.Printf("Info hash:  %s\n", t.InfoHash)
+	fmt.Printf("State:      %s\n", t.State)
+	if t.Error != "" {
+		fmt.Printf("Error:      %s\n", t.Error)
+	}
+	fmt.Printf("Done:       %s of %s (%d of %d pieces, %.1f%%)\n", torrentfile.FormatSize(t.BytesDone), torrentfile.FormatSize(t.Size),
+		t.PiecesDone, t.Pieces, t.Progress*100)
+	fmt.Printf("Download:   %s/s (%s so far)\n", torrentfile.FormatSize(t.DownloadRate), torrentfile.FormatSize(t.Downloaded))
+	fmt.Printf("Upload:     %s/s (%s so far)\n", torrentfile.FormatSize(t.UploadRate), torrentfile.FormatSize(t.Uploaded))
+	fmt.Printf("Peers:      %d\n", t.Peers)
+}
+
+func formatLimit(bytesPerSec int) string {
+	if bytesPerSec == 0 {
+		return "unlimited"
+	}
+	return torrentfile.FormatSize(int64(bytesPerSec)) + "/s"
+}
+
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
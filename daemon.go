@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"main/daemon"
+	"main/ratelimit"
+	"main/session"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// where the daemon's API listens unless -api says otherwise. Only this machine can get at it
+const defaultAPIAddr = "127.0.0.1:6880"
+
+// gotorrent daemon [flags] [.torrent files and magnet links]
+// runs a session until it's killed, controlled over a local HTTP API (see gotorrent ctl)
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	c := addCommonFlags(fs)
+	a := addAPIFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : [executable] daemon [flags] [paths to .torrent files or magnet links to start with...]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, *c.config, args)
+
+	c.apply()
+	settings := c.settings()
+	err := os.MkdirAll(c.output, 0755)
+	if err != nil {
+		fatal(err)
+	}
+	token, err := a.daemonToken()
+	if err != nil {
+		fatal(err)
+	}
+
+	// the session has its own limits, which the API can change
+	ratelimit.GlobalDownload.SetRate(0)
+	ratelimit.GlobalUpload.SetRate(0)
+	s, err := session.New(session.Config{
+		Port:               settings.Port,
+		DataDir:            c.output,
+		Encryption:         settings.Encryption,
+		Dial:               settings.Dial,
+		MaxConns:           c.maxPeersTotal,
+		MaxConnsPerTorrent: c.maxPeers,
+		DownloadLimit:      c.downloadLimit * 1024,
+		UploadLimit:        c.uploadLimit * 1024,
+	})
+	if err != nil {
+		fatal(err)
+	}
+	for _, arg := range fs.Args() {
+		_, err := s.Add(openTorrent(arg))
+		if err != nil {
+			s.Close()
+			fatal(err)
+		}
+	}
+
+	api, err := daemon.NewServer(s, token)
+	if err != nil {
+		s.Close()
+		fatal(err)
+	}
+	listener, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		s.Close()
+		fatal(err)
+	}
+	server := &http.Server{Handler: api, ReadHeaderTimeout: 10 * time.Second}
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(listener) }()
+	log.Printf("API on http://%s/api/", listener.Addr())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-signals:
+		log.Println("Stopping")
+	case err = <-errs:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	server.Shutdown(ctx)
+	cancel()
+	api.Close()
+	s.Close()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal(err)
+	}
+}
+
+// the flags for finding the daemon's API, which the daemon and ctl share so one config
+// file works for both
+type apiFlags struct {
+	addr      string
+	token     string
+	tokenFile string
+}
+
+func addAPIFlags(fs *flag.FlagSet) *apiFlags {
+	a := &apiFlags{}
+	fs.StringVar(&a.addr, "api", defaultAPIAddr, "address of the daemon's HTTP API")
+	fs.StringVar(&a.token, "token", "", "the API token, instead of the one in -token-file")
+	fs.StringVar(&a.tokenFile, "token-file", defaultTokenPath(), "file the API token is kept in")
+	return a
+}
+
+// where the daemon keeps its token if you don't say, next to the config file
+func defaultTokenPath() string {
+	config := defaultConfigPath()
+	if config == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(config), "daemon-token")
+}
+
+// the token the daemon wants: -token, or whatever's in -token-file. If there's no
+// token file yet a random token goes in a new one, readable only by us
+func (a *apiFlags) daemonToken() (string, error) {
+	if a.token != "" {
+		return a.token, nil
+	}
+	token, err := a.clientToken()
+	if err == nil || !errors.Is(err, os.ErrNotExist) || a.tokenFile == "" {
+		return token, err
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	token = hex.EncodeToString(b[:])
+	err = os.MkdirAll(filepath.Dir(a.tokenFile), 0700)
+	if err == nil {
+		err = os.WriteFile(a.tokenFile, []byte(token+"\n"), 0600)
+	}
+	if err != nil {
+		return "", err
+	}
+	log.Println("Made a new API token in", a.tokenFile)
+	return token, nil
+}
+
+// the token to talk to the daemon with: -token, or whatever's in -token-file
+func (a *apiFlags) clientToken() (string, error) {
+	if a.token != "" {
+		return a.token, nil
+	}
+	if a.tokenFile == "" {
+		return "", fmt.Errorf("no token, use -token or -token-file")
+	}
+	b, err := os.ReadFile(a.tokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", a.tokenFile)
+	}
+	return token, nil
+}
@@ -0,0 +1,66 @@
+package daemon
+
+// what goes back and forth over the daemon's HTTP API, as JSON. Every request needs
+// "Authorization: Bearer <token>", and errors come back as {"error": "..."} with a 4xx
+// or 5xx status.
+//
+//	GET    /api/torrents                      every torrent, []Torrent
+//	POST   /api/torrents                      add one, AddRequest in, Torrent out
+//	GET    /api/torrents/<info hash>          one Torrent
+//	GET    /api/torrents/<info hash>/peers    who it's connected to, []Peer
+//	POST   /api/torrents/<info hash>/pause
+//	POST   /api/torrents/<info hash>/resume
+//	DELETE /api/torrents/<info hash>          remove it, ?data=true deletes its files too
+//	GET    /api/limits                        Limits
+//	PUT    /api/limits                        Limits in, Limits out
+
+// Torrent is how one torrent in the daemon is going
+type Torrent struct {
+	// 40 hex characters, what the other endpoints want
+	InfoHash string `json:"info_hash"`
+	Name     string `json:"name"`
+	// paused, starting, downloading, seeding or failed, see session.State
+	State string `json:"state"`
+	// why it failed
+	Error      string  `json:"error,omitempty"`
+	Size       int64   `json:"size"`
+	BytesDone  int64   `json:"bytes_done"`
+	Pieces     int     `json:"pieces"`
+	PiecesDone int     `json:"pieces_done"`
+	Progress   float64 `json:"progress"`
+	// bytes to and from peers so far, and bytes per second over the last few seconds
+	Downloaded   int64 `json:"downloaded"`
+	Uploaded     int64 `json:"uploaded"`
+	DownloadRate int64 `json:"download_rate"`
+	UploadRate   int64 `json:"upload_rate"`
+	Peers        int   `json:"peers"`
+}
+
+// Peer is one peer a torrent is connected to
+type Peer struct {
+	Addr string `json:"addr"`
+	// whether it's choking us, so we can't download from it
+	Choked     bool  `json:"choked"`
+	Downloaded int64 `json:"downloaded"`
+	Uploaded   int64 `json:"uploaded"`
+}
+
+// AddRequest adds a torrent. Set one of them
+type AddRequest struct {
+	// the .torrent file itself (base64 in the JSON)
+	Torrent []byte `json:"torrent,omitempty"`
+	Magnet  string `json:"magnet,omitempty"`
+	// where the daemon can download the .torrent file from, over HTTP
+	URL string `json:"url,omitempty"`
+}
+
+// Limits are the daemon's rate limits in bytes per second, shared by every torrent.
+// 0 is unlimited
+type Limits struct {
+	Download int `json:"download"`
+	Upload   int `json:"upload"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,140 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to a daemon's API
+type Client struct {
+	// where the daemon is, e.g. http://127.0.0.1:6880
+	URL   string
+	Token string
+	HTTP  *http.Client
+}
+
+// NewClient is a Client for the daemon at addr, either host:port or a URL
+func NewClient(addr string, token string) *Client {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return &Client{
+		URL:   strings.TrimSuffix(addr, "/"),
+		Token: token,
+		// adding a torrent from a URL means the daemon downloads it first
+		HTTP: &http.Client{Timeout: fetchTimeout + 10*time.Second},
+	}
+}
+
+// List is every torrent in the daemon
+func (c *Client) List() ([]Torrent, error) {
+	var ret []Torrent
+	err := c.do(http.MethodGet, "/api/torrents", nil, &ret)
+	return ret, err
+}
+
+// Add adds a torrent, see AddRequest
+func (c *Client) Add(req AddRequest) (Torrent, error) {
+	var ret Torrent
+	err := c.do(http.MethodPost, "/api/torrents", req, &ret)
+	return ret, err
+}
+
+// Get is how one torrent is going
+func (c *Client) Get(infoHash [20]byte) (Torrent, error) {
+	var ret Torrent
+	err := c.do(http.MethodGet, torrentPath(infoHash, ""), nil, &ret)
+	return ret, err
+}
+
+// Peers are the peers a torrent is connected to
+func (c *Client) Peers(infoHash [20]byte) ([]Peer, error) {
+	var ret []Peer
+	err := c.do(http.MethodGet, torrentPath(infoHash, "/peers"), nil, &ret)
+	return ret, err
+}
+
+// Pause stops a torrent, leaving it in the daemon
+func (c *Client) Pause(infoHash [20]byte) (Torrent, error) {
+	var ret Torrent
+	err := c.do(http.MethodPost, torrentPath(infoHash, "/pause"), nil, &ret)
+	return ret, err
+}
+
+// Resume starts a paused (or failed) torrent again
+func (c *Client) Resume(infoHash [20]byte) (Torrent, error) {
+	var ret Torrent
+	err := c.do(http.MethodPost, torrentPath(infoHash, "/resume"), nil, &ret)
+	return ret, err
+}
+
+// Remove takes a torrent out of the daemon, and deletes its files if deleteData is set
+func (c *Client) Remove(infoHash [20]byte, deleteData bool) error {
+	path := torrentPath(infoHash, "")
+	if deleteData {
+		path += "?" + url.Values{"data": {"true"}}.Encode()
+	}
+	return c.do(http.MethodDelete, path, nil, nil)
+}
+
+// Limits are the daemon's rate limits
+func (c *Client) Limits() (Limits, error) {
+	var ret Limits
+	err := c.do(http.MethodGet, "/api/limits", nil, &ret)
+	return ret, err
+}
+
+// SetLimits changes the daemon's rate limits
+func (c *Client) SetLimits(l Limits) (Limits, error) {
+	var ret Limits
+	err := c.do(http.MethodPut, "/api/limits", l, &ret)
+	return ret, err
+}
+
+func torrentPath(infoHash [20]byte, action string) string {
+	return "/api/torrents/" + hex.EncodeToString(infoHash[:]) + action
+}
+
+// send in as JSON (if it's not nil), and decode the answer into out (if that's not nil)
+func (c *Client) do(method string, path string, in any, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e errorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return fmt.Errorf("daemon says: %s", e.Error)
+		}
+		return fmt.Errorf("daemon says: %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,360 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"main/p2p"
+	"main/session"
+	"main/torrentfile"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the daemon's side of the API: a session that runs for as long as the process does,
+// controlled over HTTP by whoever has the token. It's meant to listen on localhost (or
+// a private network), the token keeps other users on the same machine out but the
+// traffic isn't encrypted. See api.go for the endpoints
+
+// how often the download and upload rates get worked out
+const rateInterval = 2 * time.Second
+
+// the biggest .torrent file we'll take, sent to us or downloaded from a URL
+const maxTorrentSize = 16 << 20
+
+// how long we wait on a URL for a .torrent file
+const fetchTimeout = 30 * time.Second
+
+// Server is an http.Handler for the API, running the torrents in a session
+type Server struct {
+	s          *session.Session
+	token      string
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	rates map[[20]byte]*rate
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// how fast one torrent is going, from the last two samples
+type rate struct {
+	downloaded int64
+	uploaded   int64
+	down       int64
+	up         int64
+}
+
+// NewServer serves the API for s. Only requests with the token get anywhere, so it
+// can't be empty. Close it when done, the session is left to you
+func NewServer(s *session.Session, token string) (*Server, error) {
+	if token == "" {
+		return nil, fmt.Errorf("the daemon needs a token")
+	}
+	srv := &Server{
+		s:          s,
+		token:      token,
+		httpClient: &http.Client{Timeout: fetchTimeout},
+		rates:      make(map[[20]byte]*rate),
+		stop:       make(chan struct{}),
+	}
+	go srv.sampleRates()
+	return srv, nil
+}
+
+// Close stops working out the rates
+func (srv *Server) Close() {
+	srv.once.Do(func() { close(srv.stop) })
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !srv.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "missing or wrong token")
+		return
+	}
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/api/torrents":
+		switch r.Method {
+		case http.MethodGet:
+			srv.list(w)
+		case http.MethodPost:
+			srv.add(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+	case strings.HasPrefix(path, "/api/torrents/"):
+		hash, action, _ := strings.Cut(strings.TrimPrefix(path, "/api/torrents/"), "/")
+		t, err := srv.lookup(hash)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		srv.torrent(w, r, t, action)
+	case path == "/api/limits":
+		srv.limits(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+// whether the request has our token
+func (srv *Server) authorized(r *http.Request) bool {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(srv.token)) == 1
+}
+
+// find a torrent by its info hash in hex
+func (srv *Server) lookup(hash string) (*session.Torrent, error) {
+	b, err := hex.DecodeString(hash)
+	if err != nil || len(b) != 20 {
+		return nil, fmt.Errorf("%q isn't a 40 character hex info hash", hash)
+	}
+	var h [20]byte
+	copy(h[:], b)
+	t := srv.s.Get(h)
+	if t == nil {
+		return nil, fmt.Errorf("%s isn't in the daemon", hash)
+	}
+	return t, nil
+}
+
+func (srv *Server) list(w http.ResponseWriter) {
+	ret := []Torrent{}
+	for _, t := range srv.s.Torrents() {
+		ret = append(ret, srv.describe(t))
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func (srv *Server) add(w http.ResponseWriter, r *http.Request) {
+	var req AddRequest
+	// base64 makes the .torrent file a third bigger
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTorrentSize*2)).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return
+	}
+	tf, err := srv.open(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t, err := srv.s.Add(tf)
+	if errors.Is(err, session.ErrExists) || errors.Is(err, session.ErrNameTaken) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Added %s (%x)", t.Name(), t.InfoHash())
+	writeJSON(w, http.StatusCreated, srv.describe(t))
+}
+
+// turn an AddRequest into a torrent
+func (srv *Server) open(req AddRequest) (torrentfile.Torrent, error) {
+	set := 0
+	for _, ok := range []bool{req.Torrent != nil, req.Magnet != "", req.URL != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return torrentfile.Torrent{}, fmt.Errorf("give exactly one of torrent, magnet and url")
+	}
+	switch {
+	case req.Torrent != nil:
+		return torrentfile.Load(req.Torrent)
+	case req.Magnet != "":
+		return torrentfile.ParseMagnet(req.Magnet)
+	}
+	if strings.HasPrefix(req.URL, "magnet:") {
+		return torrentfile.ParseMagnet(req.URL)
+	}
+	if !strings.HasPrefix(req.URL, "http://") && !strings.HasPrefix(req.URL, "https://") {
+		return torrentfile.Torrent{}, fmt.Errorf("%q isn't an http(s) or magnet URL", req.URL)
+	}
+	data, err := srv.fetch(req.URL)
+	if err != nil {
+		return torrentfile.Torrent{}, err
+	}
+	return torrentfile.Load(data)
+}
+
+// download a .torrent file
+func (srv *Server) fetch(url string) ([]byte, error) {
+	resp, err := srv.httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxTorrentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	if len(data) > maxTorrentSize {
+		return nil, fmt.Errorf("%s: that's too big to be a .torrent file", url)
+	}
+	return data, nil
+}
+
+// everything under /api/torrents/<info hash>
+func (srv *Server) torrent(w http.ResponseWriter, r *http.Request, t *session.Torrent, action string) {
+	method := r.Method
+	switch {
+	case action == "" && method == http.MethodGet:
+		writeJSON(w, http.StatusOK, srv.describe(t))
+	case action == "" && method == http.MethodDelete:
+		deleteData := false
+		if v := r.URL.Query().Get("data"); v != "" {
+			var err error
+			deleteData, err = strconv.ParseBool(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "data should be true or false")
+				return
+			}
+		}
+		err := srv.s.Remove(t.InfoHash(), deleteData)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		srv.mu.Lock()
+		delete(srv.rates, t.InfoHash())
+		srv.mu.Unlock()
+		log.Printf("Removed %s (%x)", t.Name(), t.InfoHash())
+		w.WriteHeader(http.StatusNoContent)
+	case action == "peers" && method == http.MethodGet:
+		ret := []Peer{}
+		for _, p := range t.Stats().Peers {
+			ret = append(ret, Peer{Addr: p.Addr, Choked: p.Choked, Downloaded: p.Downloaded, Uploaded: p.Uploaded})
+		}
+		writeJSON(w, http.StatusOK, ret)
+	case action == "pause" && method == http.MethodPost:
+		t.Pause()
+		writeJSON(w, http.StatusOK, srv.describe(t))
+	case action == "resume" && method == http.MethodPost:
+		t.Resume()
+		writeJSON(w, http.StatusOK, srv.describe(t))
+	case action == "" || action == "peers" || action == "pause" || action == "resume":
+		writeError(w, http.StatusMethodNotAllowed, "wrong method for "+r.URL.Path)
+	default:
+		writeError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+func (srv *Server) limits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var l Limits
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&l)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad request: "+err.Error())
+			return
+		}
+		if l.Download < 0 || l.Upload < 0 {
+			writeError(w, http.StatusBadRequest, "limits can't be negative")
+			return
+		}
+		srv.s.SetRateLimits(l.Download, l.Upload)
+		log.Printf("Limits are now %d B/s down, %d B/s up", l.Download, l.Upload)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "use GET or PUT")
+		return
+	}
+	download, upload := srv.s.RateLimits()
+	writeJSON(w, http.StatusOK, Limits{Download: download, Upload: upload})
+}
+
+// a torrent as the API shows it
+func (srv *Server) describe(t *session.Torrent) Torrent {
+	state, err := t.State()
+	stats := t.Stats()
+	infoHash := t.InfoHash()
+	ret := Torrent{
+		InfoHash:   hex.EncodeToString(infoHash[:]),
+		Name:       t.Name(),
+		State:      state.String(),
+		Size:       stats.Length,
+		BytesDone:  stats.BytesDone,
+		Pieces:     stats.NumPieces,
+		PiecesDone: stats.PiecesDone,
+		Downloaded: stats.Downloaded,
+		Uploaded:   stats.Uploaded,
+		Peers:      len(stats.Peers),
+	}
+	if err != nil {
+		ret.Error = err.Error()
+	}
+	if stats.NumPieces > 0 {
+		ret.Progress = float64(stats.PiecesDone) / float64(stats.NumPieces)
+	}
+	srv.mu.Lock()
+	if r, ok := srv.rates[infoHash]; ok {
+		ret.DownloadRate, ret.UploadRate = r.down, r.up
+	}
+	srv.mu.Unlock()
+	return ret
+}
+
+// every rateInterval, see how far each torrent got since last time
+func (srv *Server) sampleRates() {
+	ticker := time.NewTicker(rateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, t := range srv.s.Torrents() {
+			srv.sample(t.InfoHash(), t.Stats())
+		}
+	}
+}
+
+func (srv *Server) sample(infoHash [20]byte, stats p2p.Stats) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	r, ok := srv.rates[infoHash]
+	if !ok {
+		r = &rate{}
+		srv.rates[infoHash] = r
+	}
+	perSecond := func(now int64, before int64) int64 {
+		// the counts start again from 0 when a torrent is resumed
+		if !ok || now < before {
+			return 0
+		}
+		return (now - before) * int64(time.Second) / int64(rateInterval)
+	}
+	r.down = perSecond(stats.Downloaded, r.downloaded)
+	r.up = perSecond(stats.Uploaded, r.uploaded)
+	r.downloaded, r.uploaded = stats.Downloaded, stats.Uploaded
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
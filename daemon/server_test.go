@@ -0,0 +1,201 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"main/client"
+	"main/internal/testutil"
+	"main/session"
+	"main/torrentfile"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testToken = "sekrit"
+
+// a daemon on loopback with an empty data dir, and where that is
+func startDaemon(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	dataDir := t.TempDir()
+	s, err := session.New(session.Config{Listeners: []net.Listener{testutil.Listen(t)}, DataDir: dataDir, Dial: client.DialTCP, Log: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	srv, err := NewServer(s, testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	web := httptest.NewServer(srv)
+	t.Cleanup(web.Close)
+	return web, dataDir
+}
+
+// a .torrent of one file, which is put in dir too
+func testTorrentFile(t *testing.T, dir string) ([]byte, [20]byte) {
+	t.Helper()
+	path := filepath.Join(dir, "file.bin")
+	err := os.WriteFile(path, bytes.Repeat([]byte{5}, 50000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = torrentfile.Create(torrentfile.CreateOptions{Path: path, Announce: "http://127.0.0.1:1/announce", PieceLength: 16 << 10}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := torrentfile.Load(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), tf.InfoHash
+}
+
+// send a request with token (none if it's empty), and decode the answer into out if
+// it's not nil. Returns the status
+func call(t *testing.T, web *httptest.Server, token string, method string, path string, in any, out any) int {
+	t.Helper()
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, web.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := web.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestNewServerNeedsToken(t *testing.T) {
+	_, err := NewServer(nil, "")
+	if err == nil {
+		t.Fatal("made a daemon anyone can use")
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	web, _ := startDaemon(t)
+	for _, token := range []string{"", "wrong", testToken + "x"} {
+		var e errorResponse
+		status := call(t, web, token, http.MethodGet, "/api/torrents", nil, &e)
+		if status != http.StatusUnauthorized || e.Error == "" {
+			t.Fatalf("token %q got %d %q, want 401 and an error", token, status, e.Error)
+		}
+	}
+	// nothing gets past it, not even a bad path
+	if status := call(t, web, "", http.MethodDelete, "/api/torrents/00", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("delete without the token got %d, want 401", status)
+	}
+}
+
+// add a torrent, list it, pause and resume it, then remove it and its file
+func TestTorrentLifecycle(t *testing.T) {
+	web, dataDir := startDaemon(t)
+	data, infoHash := testTorrentFile(t, dataDir)
+	c := NewClient(web.URL, testToken)
+
+	var added Torrent
+	status := call(t, web, testToken, http.MethodPost, "/api/torrents", AddRequest{Torrent: data}, &added)
+	if status != http.StatusCreated {
+		t.Fatalf("add got %d, want 201", status)
+	}
+	if added.InfoHash != hex.EncodeToString(infoHash[:]) || added.Name != "file.bin" {
+		t.Fatalf("added %+v", added)
+	}
+
+	// the same one again
+	var e errorResponse
+	status = call(t, web, testToken, http.MethodPost, "/api/torrents", AddRequest{Torrent: data}, &e)
+	if status != http.StatusConflict {
+		t.Fatalf("adding it twice got %d (%s), want 409", status, e.Error)
+	}
+	// and nonsense
+	status = call(t, web, testToken, http.MethodPost, "/api/torrents", AddRequest{Torrent: data, Magnet: "magnet:?"}, &e)
+	if status != http.StatusBadRequest {
+		t.Fatalf("adding with a torrent and a magnet got %d, want 400", status)
+	}
+
+	list, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].InfoHash != added.InfoHash {
+		t.Fatalf("list is %+v, want just the one we added", list)
+	}
+
+	paused, err := c.Pause(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paused.State != session.Paused.String() {
+		t.Fatalf("state is %s after pausing", paused.State)
+	}
+	resumed, err := c.Resume(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.State == session.Paused.String() {
+		t.Fatal("still paused after resuming")
+	}
+
+	status = call(t, web, testToken, http.MethodDelete, "/api/torrents/"+added.InfoHash+"?data=true", nil, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("delete got %d, want 204", status)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "file.bin")); !os.IsNotExist(err) {
+		t.Fatalf("the file is still there after deleting with data=true: %v", err)
+	}
+	status = call(t, web, testToken, http.MethodGet, "/api/torrents/"+added.InfoHash, nil, &e)
+	if status != http.StatusNotFound {
+		t.Fatalf("getting a removed torrent got %d, want 404", status)
+	}
+	list, err = c.List()
+	if err != nil || len(list) != 0 {
+		t.Fatalf("list after removing is %+v, %v", list, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	web, _ := startDaemon(t)
+	c := NewClient(web.URL, testToken)
+	got, err := c.SetLimits(Limits{Download: 1000, Upload: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != (Limits{Download: 1000, Upload: 500}) {
+		t.Fatalf("limits are %+v after setting them", got)
+	}
+	if got, err = c.Limits(); err != nil || got.Download != 1000 {
+		t.Fatalf("limits are %+v, %v", got, err)
+	}
+	status := call(t, web, testToken, http.MethodPut, "/api/limits", Limits{Download: -1}, nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("a negative limit got %d, want 400", status)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"main/progress"
+	"main/torrentfile"
+	"os"
+)
+
+// gotorrent download [flags] [.torrent file or magnet link] [path]
+// without a path the file (or directory, for a multi file torrent) goes in -o, named after the torrent
+func runDownload(args []string) {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	c := addCommonFlags(fs)
+	quiet := fs.Bool("quiet", false, "don't show the progress")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : [executable] download [flags] [path to .torrent file or magnet link] [optional path to put it]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, *c.config, args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	c.apply()
+	tf := openTorrent(fs.Arg(0))
+	tf.Settings = c.settings()
+	if !*quiet {
+		display := progress.New(os.Stdout)
+		tf.Watch = display.Watch
+		if c.logLevel != "error" {
+			log.SetOutput(display.Logs(log.Writer()))
+		}
+	}
+
+	// a magnet link doesn't have the name until we have the metadata
+	err := tf.FetchMetadata(nil)
+	if err != nil {
+		fatal(err)
+	}
+	out := fs.Arg(1)
+	if out == "" {
+		out, err = outputPath(c.output, tf.Name)
+		if err == nil {
+			err = os.MkdirAll(c.output, 0755)
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	err = tf.DownloadToFile(out)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// where a torrent called name goes in dir, see torrentfile.PathFor
+func outputPath(dir string, name string) (string, error) {
+	path, err := torrentfile.PathFor(dir, name)
+	if err != nil {
+		return "", fmt.Errorf("%w, give a path to put it", err)
+	}
+	return path, nil
+}
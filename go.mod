@@ -1,5 +1,3 @@
 module gotorrent
 
 go 1.18
-
-require github.com/jackpal/bencode-go v1.0.0 // indirect
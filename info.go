@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"main/torrentfile"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// what info prints, and its JSON for -json. Fields a magnet link doesn't have are left out
+type torrentInfo struct {
+	Name           string     `json:"name"`
+	InfoHash       string     `json:"info_hash,omitempty"`
+	InfoHashBase32 string     `json:"info_hash_base32,omitempty"`
+	InfoHashV2     string     `json:"info_hash_v2,omitempty"`
+	MetaVersion    int        `json:"meta_version"`
+	Size           int64      `json:"size,omitempty"`
+	PieceLength    int        `json:"piece_length,omitempty"`
+	Pieces         int        `json:"pieces,omitempty"`
+	Private        bool       `json:"private"`
+	Files          []fileInfo `json:"files,omitempty"`
+	// one list of trackers per tier
+	Trackers     [][]string `json:"trackers"`
+	WebSeeds     []string   `json:"web_seeds"`
+	Comment      string     `json:"comment,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	Magnet       string     `json:"magnet"`
+}
+
+type fileInfo struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// gotorrent info [flags] [.torrent file or magnet link]
+// prints what's in a torrent
+func runInfo(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print it as JSON, for scripts")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : [executable] info [flags] [path to .torrent file or magnet link]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	tf := openTorrent(fs.Arg(0))
+	info := getInfo(&tf)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		err := enc.Encode(info)
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+	printInfo(info)
+}
+
+func getInfo(tf *torrentfile.Torrent) torrentInfo {
+	info := torrentInfo{
+		Name:        tf.Name,
+		MetaVersion: tf.MetaVersion,
+		Private:     tf.Private,
+		Trackers:    tf.AnnounceList,
+		WebSeeds:    tf.WebSeeds,
+		Comment:     tf.Comment,
+		CreatedBy:   tf.CreatedBy,
+		Magnet:      tf.MagnetLink(),
+	}
+	// v2 only torrents have no SHA1 pieces, and no v1 info hash to speak of
+	if tf.MetaVersion != 2 || tf.PieceHash != nil {
+		info.InfoHash = hex.EncodeToString(tf.InfoHash[:])
+		info.InfoHashBase32 = base32.StdEncoding.EncodeToString(tf.InfoHash[:])
+	}
+	if tf.MetaVersion == 2 {
+		info.InfoHashV2 = hex.EncodeToString(tf.InfoHashV2[:])
+	}
+	if !tf.CreationDate.IsZero() {
+		info.CreationDate = &tf.CreationDate
+	}
+	// JSON gets [] rather than null
+	if info.Trackers == nil {
+		info.Trackers = [][]string{}
+	}
+	if info.WebSeeds == nil {
+		info.WebSeeds = []string{}
+	}
+	if tf.InfoBytes == nil {
+		// a magnet link, the rest comes from peers
+		return info
+	}
+
+	info.Size = int64(tf.Length)
+	info.PieceLength = tf.PieceLength
+	info.Pieces = tf.NumPieces()
+	if tf.Files == nil {
+		info.Files = []fileInfo{{Path: tf.Name, Size: int64(tf.Length)}}
+	}
+	for _, f := range tf.Files {
+		if !f.Padding {
+			path := append([]string{tf.Name}, f.Path...)
+			info.Files = append(info.Files, fileInfo{Path: filepath.Join(path...), Size: int64(f.Length)})
+		}
+	}
+	return info
+}
+
+func printInfo(info torrentInfo) {
+	fmt.Println("Name:          ", info.Name)
+	if info.InfoHash != "" {
+		fmt.Printf("Info hash:      %s (%s)\n", info.InfoHash, info.InfoHashBase32)
+	}
+	if info.InfoHashV2 != "" {
+		fmt.Println("Info hash v2:  ", info.InfoHashV2)
+	}
+	if info.Pieces > 0 {
+		fmt.Printf("Size:           %s (%d bytes)\n", torrentfile.FormatSize(info.Size), info.Size)
+		fmt.Printf("Pieces:         %d of %s\n", info.Pieces, torrentfile.FormatSize(int64(info.PieceLength)))
+	}
+	fmt.Println("Private:       ", info.Private)
+	if info.CreationDate != nil {
+		fmt.Println("Created:       ", info.CreationDate.Format(time.RFC1123))
+	}
+	if info.CreatedBy != "" {
+		fmt.Println("Created by:    ", info.CreatedBy)
+	}
+	if info.Comment != "" {
+		fmt.Println("Comment:       ", info.Comment)
+	}
+	for i, tier := range info.Trackers {
+		printList(fmt.Sprintf("Tier %d:", i+1), tier)
+	}
+	printList("Web seeds:", info.WebSeeds)
+	if len(info.Files) > 0 {
+		fmt.Println("Files:")
+		for _, f := range info.Files {
+			fmt.Printf("  %s (%s)\n", f.Path, torrentfile.FormatSize(f.Size))
+		}
+	}
+	fmt.Println("Magnet:        ", info.Magnet)
+}
+
+// print items under a label, lined up with the rest
+func printList(label string, items []string) {
+	for i, item := range items {
+		if i > 0 {
+			label = ""
+		}
+		fmt.Printf("%-16s%s\n", label, item)
+	}
+}
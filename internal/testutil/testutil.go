@@ -0,0 +1,44 @@
+package testutil
+
+import (
+	"net"
+	"testing"
+)
+
+// fixtures the tests of more than one package need
+
+// Loopback is both ends of a TCP connection over loopback, closed when the test ends.
+// Not net.Pipe: that has no buffering, so two sides that both write before reading
+// (like the MSE handshake, or a peer sending blocks while we send requests) block forever
+func Loopback(t testing.TB) (ours net.Conn, theirs net.Conn) {
+	t.Helper()
+	l := Listen(t)
+	ours, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err = l.Accept()
+	if err != nil {
+		ours.Close()
+		t.Fatal(err)
+	}
+	l.Close()
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+	return ours, theirs
+}
+
+// Listen listens for TCP on a free port on loopback, until the test ends. Hand the
+// listener itself to whatever needs a port, rather than its port number: once it's
+// closed someone else can take the port
+func Listen(t testing.TB) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
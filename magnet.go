@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// gotorrent magnet [.torrent file]
+// prints a magnet link for the torrent
+func runMagnet(args []string) {
+	fs := flag.NewFlagSet("magnet", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : [executable] magnet [path to .torrent file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	tf := openTorrent(fs.Arg(0))
+	fmt.Println(tf.MagnetLink())
+}
@@ -2,27 +2,66 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"main/torrentfile"
+	"io"
 	"os"
+	"strings"
 )
 
-func main() {
-	torrentFile := os.Args[1]
-	downloadPath := os.Args[2]
+// every subcommand, gotorrent [command] [flags] [args]
+var commands = map[string]func(args []string){
+	"download": runDownload,
+	"batch":    runBatch,
+	"create":   runCreate,
+	"verify":   runVerify,
+	"info":     runInfo,
+	"seed":     runSeed,
+	"magnet":   runMagnet,
+	"scrape":   runScrape,
+	"tracker":  runTracker,
+	"daemon":   runDaemon,
+	"ctl":      runCtl,
+}
 
-	if len(os.Args) != 3 {
-		fmt.Println("Usage : [executable] [path to .torrent file] [path to where you want file to download] \n ") // return the program name back to %s
-		os.Exit(1)                                                                                                // graceful exit
-	}
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage : [executable] [command] [flags] [args]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  download  download a torrent from a .torrent file or magnet link")
+	fmt.Fprintln(w, "  batch     download many torrents at once, sharing one port and one set of limits")
+	fmt.Fprintln(w, "  create    make a .torrent file of a file or directory")
+	fmt.Fprintln(w, "  verify    check files you have against a .torrent file")
+	fmt.Fprintln(w, "  info      show what's in a .torrent file or magnet link")
+	fmt.Fprintln(w, "  seed      upload files you have to other peers")
+	fmt.Fprintln(w, "  magnet    print the magnet link for a .torrent file")
+	fmt.Fprintln(w, "  scrape    ask a torrent's trackers how many seeders and leechers it has")
+	fmt.Fprintln(w, "  tracker   run a tracker")
+	fmt.Fprintln(w, "  daemon    run in the background, controlled over a local HTTP API")
+	fmt.Fprintln(w, "  ctl       control a running daemon")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Run [executable] [command] -h for a command's flags")
+}
 
-	tf, err := torrentfile.Open(torrentFile)
-	if err != nil {
-		log.Fatal(err)
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(exitUsage)
 	}
-
-	err = tf.DownloadToFile(downloadPath)
-	if err != nil {
-		log.Fatal(err)
+	name := os.Args[1]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+		return
+	}
+	if run, ok := commands[name]; ok {
+		run(os.Args[2:])
+		return
+	}
+	// the old way, before there were commands: [flags] [.torrent file] [path]
+	if strings.HasPrefix(name, "-") || strings.HasSuffix(name, ".torrent") || strings.HasPrefix(name, "magnet:") {
+		runDownload(os.Args[1:])
+		return
 	}
+	fmt.Fprintf(os.Stderr, "gotorrent: unknown command %q\n\n", name)
+	usage(os.Stderr)
+	os.Exit(exitUsage)
 }
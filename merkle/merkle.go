@@ -0,0 +1,88 @@
+package merkle
+
+import (
+	"crypto/sha256"
+)
+
+// BitTorrent v2 (BEP 52) hashes every file as a merkle tree instead of one flat list of
+// SHA1s. The leaves are the SHA-256 of each 16KB block of the file, and every node above
+// is the SHA-256 of its two children glued together. The tree always has a power of two
+// leaves, the ones past the end of the file are all zeros (32 zero bytes, not a hash of anything)
+//
+// The root of a file's tree is its "pieces root" in the .torrent. The layer of the tree
+// where each node covers exactly one piece is the "piece layer", and that's what we check
+// downloaded pieces against
+
+// BlockSize is how much of the file each leaf covers
+const BlockSize = 16384
+
+// HashSize is the size of every hash in the tree
+const HashSize = sha256.Size
+
+// Hash is a node in the tree
+type Hash [HashSize]byte
+
+// Leaves hashes data in BlockSize chunks. The last chunk can be short, it's hashed as is
+func Leaves(data []byte) []Hash {
+	ret := make([]Hash, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		ret = append(ret, sha256.Sum256(data[begin:end]))
+	}
+	return ret
+}
+
+// Root builds the tree on top of hashes and returns the top of it. width is how many
+// nodes wide the bottom layer is (a power of two, at least len(hashes)), and the spots
+// past the end of hashes are filled with pad
+func Root(hashes []Hash, width int, pad Hash) Hash {
+	if width < 1 {
+		width = 1
+	}
+	layer := make([]Hash, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+	var buf [2 * HashSize]byte
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			copy(buf[:HashSize], layer[2*i][:])
+			copy(buf[HashSize:], layer[2*i+1][:])
+			layer[i] = sha256.Sum256(buf[:])
+		}
+		layer = layer[:len(layer)/2]
+	}
+	return layer[0]
+}
+
+// ZeroRoot is the root of a tree of leaves zero leaves. It's what a piece past the end of
+// a file hashes to, which we need to pad the piece layer out to a power of two
+func ZeroRoot(leaves int) Hash {
+	return Root(nil, leaves, Hash{})
+}
+
+// NextPowerOfTwo returns the smallest power of two that's >= n (and at least 1)
+func NextPowerOfTwo(n int) int {
+	ret := 1
+	for ret < n {
+		ret *= 2
+	}
+	return ret
+}
+
+// PieceRoot is the hash of one piece of a file: the root of the subtree over its blocks.
+// leaves is how many leaves that subtree has, which is pieceLength/BlockSize for files
+// bigger than a piece, or the file's own (rounded up) block count for smaller files
+func PieceRoot(data []byte, leaves int) Hash {
+	return Root(Leaves(data), leaves, Hash{})
+}
+
+// VerifyPieceLayer checks that the piece hashes for a file really do build up to its
+// pieces root. pieceLeaves is how many blocks are in a piece
+func VerifyPieceLayer(layer []Hash, pieceLeaves int, piecesRoot Hash) bool {
+	return Root(layer, NextPowerOfTwo(len(layer)), ZeroRoot(pieceLeaves)) == piecesRoot
+}
@@ -0,0 +1,101 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// glue two nodes together the slow way
+func parent(a, b Hash) Hash {
+	return sha256.Sum256(append(a[:], b[:]...))
+}
+
+func TestLeaves(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, 2*BlockSize+100)
+	leaves := Leaves(data)
+	if len(leaves) != 3 {
+		t.Fatalf("%d leaves, want 3", len(leaves))
+	}
+	// the short last block is hashed as is, not padded
+	if leaves[2] != sha256.Sum256(data[2*BlockSize:]) {
+		t.Fatal("last leaf isn't the hash of the last 100 bytes")
+	}
+	if len(Leaves(nil)) != 0 {
+		t.Fatal("no data should have no leaves")
+	}
+}
+
+func TestRoot(t *testing.T) {
+	a, b, c := Hash{1}, Hash{2}, Hash{3}
+	if Root([]Hash{a}, 1, Hash{}) != a {
+		t.Fatal("a tree of one leaf should be that leaf")
+	}
+	if got, want := Root([]Hash{a, b}, 2, Hash{}), parent(a, b); got != want {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+	// padded out to 4 wide with the pad hash
+	pad := Hash{9}
+	if got, want := Root([]Hash{a, b, c}, 4, pad), parent(parent(a, b), parent(c, pad)); got != want {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+	if got, want := ZeroRoot(4), parent(parent(Hash{}, Hash{}), parent(Hash{}, Hash{})); got != want {
+		t.Fatalf("ZeroRoot(4) is %x, want %x", got, want)
+	}
+}
+
+func TestNextPowerOfTwo(t *testing.T) {
+	for n, want := range map[int]int{0: 1, 1: 1, 2: 2, 3: 4, 4: 4, 5: 8, 1000: 1024} {
+		if got := NextPowerOfTwo(n); got != want {
+			t.Errorf("NextPowerOfTwo(%d) is %d, want %d", n, got, want)
+		}
+	}
+}
+
+// the piece layer of a file builds up to the same root as hashing the whole file
+// block by block, including the padding past the end of the file
+func TestVerifyPieceLayer(t *testing.T) {
+	const pieceLeaves = 4
+	pieceLength := pieceLeaves * BlockSize
+	// 2 and a bit pieces, so the layer gets padded to 4 and the last piece to 4 leaves
+	data := make([]byte, 2*pieceLength+BlockSize+5)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	leaves := Leaves(data)
+	piecesRoot := Root(leaves, NextPowerOfTwo(len(leaves)), Hash{})
+
+	var layer []Hash
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		layer = append(layer, PieceRoot(data[begin:end], pieceLeaves))
+	}
+	if len(layer) != 3 {
+		t.Fatalf("%d pieces, want 3", len(layer))
+	}
+	if !VerifyPieceLayer(layer, pieceLeaves, piecesRoot) {
+		t.Fatal("the real piece layer doesn't verify")
+	}
+
+	layer[1][0] ^= 1
+	if VerifyPieceLayer(layer, pieceLeaves, piecesRoot) {
+		t.Fatal("a piece layer with a bad hash verified")
+	}
+	layer[1][0] ^= 1
+	if VerifyPieceLayer(layer[:2], pieceLeaves, piecesRoot) {
+		t.Fatal("a piece layer missing a piece verified")
+	}
+}
+
+// a file smaller than a piece is its own tree, so its root is the only piece hash
+func TestPieceRootSmallFile(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 3*BlockSize)
+	leaves := Leaves(data)
+	root := Root(leaves, NextPowerOfTwo(len(leaves)), Hash{})
+	if PieceRoot(data, NextPowerOfTwo(len(leaves))) != root {
+		t.Fatal("a small file's piece root isn't its pieces root")
+	}
+}
@@ -22,8 +22,24 @@ const (
 	Piece         uint8 = 7
 	Cancel        uint8 = 8
 	Port          uint8 = 9
+
+	// Fast Extension (BEP 6), only sent if both sides set the fast bit in the handshake
+	SuggestPiece  uint8 = 13
+	HaveAll       uint8 = 14
+	HaveNone      uint8 = 15
+	RejectRequest uint8 = 16
+	AllowedFast   uint8 = 17
+
+	// Extension Protocol (BEP 10)
+	Extended uint8 = 20
 )
 
+// MaxLength is the biggest message (ID + payload) we'll accept from a peer.
+// The length prefix is 4 bytes, so without this a peer could make us allocate 4 GB.
+// The biggest thing we ever legitimately get is a piece message with a 16KB block,
+// or a bitfield, and 1 MB of bitfield is 8 million pieces
+const MaxLength = 1 << 20
+
 // this struct represents a message sent back to us from the peer
 type Message struct {
 	Length  uint32 // length in bytes of the payload + id (aka 1 byte) (not including the 4 bytes for length itself)
@@ -65,6 +81,9 @@ func Read(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > MaxLength {
+		return nil, fmt.Errorf("peer sent a message of %d bytes, the max is %d", length, MaxLength)
+	}
 
 	restOfMessage := make([]byte, length)
 	_, err = io.ReadFull(r, restOfMessage)
@@ -88,9 +107,14 @@ func Read(r io.Reader) (*Message, error) {
 // begin: integer specifying the zero-based byte offset within the piece
 // block: block of data, which is a subset of the piece specified by index.
 func ParsePiece(pg bitfield.Bitfield, index int, m *Message) (int, error) {
-	actualindex := int(binary.BigEndian.Uint32(m.Payload[0:4]))
-	begin := int(binary.BigEndian.Uint32(m.Payload[4:8]))
-	block := m.Payload[8:]
+	piece := PieceMessage{}
+	err := piece.Unmarshal(m)
+	if err != nil {
+		return 0, err
+	}
+	actualindex := piece.Index
+	begin := piece.Begin
+	block := piece.Block
 
 	if actualindex != index {
 		return 0, fmt.Errorf("The index for this piece doesn't match the index we want")
@@ -111,6 +135,8 @@ func ParsePiece(pg bitfield.Bitfield, index int, m *Message) (int, error) {
 
 // <len=0005><id=4><piece index>
 // so payload is just the piece index that the peer has
-func ParseHave(m *Message) int {
-	return int(binary.BigEndian.Uint32(m.Payload[:]))
+func ParseHave(m *Message) (int, error) {
+	have := HaveMessage{}
+	err := have.Unmarshal(m)
+	return have.Index, err
 }
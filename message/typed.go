@@ -0,0 +1,322 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+	"main/bitfield"
+)
+
+// typed versions of the messages that carry a payload. Marshal turns one into a
+// Message ready for MessageToByteSlice, and Unmarshal fills one in from a Message,
+// checking the ID and that the payload is the right size. The peer controls every
+// byte we read, so nothing here trusts the lengths it sends us
+
+// Typed is implemented by all the typed messages
+type Typed interface {
+	Marshal() (*Message, error)
+	Unmarshal(m *Message) error
+}
+
+// RequestMessage asks for a block
+// request: <len=0013><id=6><index><begin><length>
+type RequestMessage struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+func (r *RequestMessage) Marshal() (*Message, error) {
+	return marshalBlockRef(Request, r.Index, r.Begin, r.Length)
+}
+
+func (r *RequestMessage) Unmarshal(m *Message) error {
+	return unmarshalBlockRef(m, Request, &r.Index, &r.Begin, &r.Length)
+}
+
+// CancelMessage takes back a request we don't need anymore
+// cancel: <len=0013><id=8><index><begin><length>
+type CancelMessage struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+func (c *CancelMessage) Marshal() (*Message, error) {
+	return marshalBlockRef(Cancel, c.Index, c.Begin, c.Length)
+}
+
+func (c *CancelMessage) Unmarshal(m *Message) error {
+	return unmarshalBlockRef(m, Cancel, &c.Index, &c.Begin, &c.Length)
+}
+
+// RejectMessage says a request won't be served (Fast Extension)
+// reject request: <len=0013><id=16><index><begin><length>
+type RejectMessage struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+func (r *RejectMessage) Marshal() (*Message, error) {
+	return marshalBlockRef(RejectRequest, r.Index, r.Begin, r.Length)
+}
+
+func (r *RejectMessage) Unmarshal(m *Message) error {
+	return unmarshalBlockRef(m, RejectRequest, &r.Index, &r.Begin, &r.Length)
+}
+
+// the three messages above all have the same <index><begin><length> payload
+func marshalBlockRef(id uint8, index, begin, length int) (*Message, error) {
+	if !fitsUint32(index) || !fitsUint32(begin) || !fitsUint32(length) {
+		return nil, fmt.Errorf("message %d: index %d, begin %d, length %d out of range", id, index, begin, length)
+	}
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: id, Payload: payload}, nil
+}
+
+func unmarshalBlockRef(m *Message, id uint8, index, begin, length *int) error {
+	err := checkMessage(m, id, 12)
+	if err != nil {
+		return err
+	}
+	*index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	*begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	*length = int(binary.BigEndian.Uint32(m.Payload[8:12]))
+	return nil
+}
+
+// PieceMessage carries a block of data
+// piece: <len=0009+X><id=7><index><begin><block>
+type PieceMessage struct {
+	Index int
+	Begin int
+	Block []byte
+}
+
+func (p *PieceMessage) Marshal() (*Message, error) {
+	if !fitsUint32(p.Index) || !fitsUint32(p.Begin) {
+		return nil, fmt.Errorf("piece message: index %d, begin %d out of range", p.Index, p.Begin)
+	}
+	if 8+len(p.Block)+1 > MaxLength {
+		return nil, fmt.Errorf("piece message: block of %d bytes is too big", len(p.Block))
+	}
+	payload := make([]byte, 8+len(p.Block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(p.Index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(p.Begin))
+	copy(payload[8:], p.Block)
+	return &Message{ID: Piece, Payload: payload}, nil
+}
+
+// Block points into m.Payload, it isn't copied
+func (p *PieceMessage) Unmarshal(m *Message) error {
+	if m == nil || m.ID != Piece {
+		return wrongID(m, Piece)
+	}
+	if len(m.Payload) < 8 {
+		return fmt.Errorf("piece message: payload is %d bytes, need at least 8", len(m.Payload))
+	}
+	p.Index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	p.Begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	p.Block = m.Payload[8:]
+	return nil
+}
+
+// HaveMessage says the sender has a piece
+// have: <len=0005><id=4><piece index>
+type HaveMessage struct {
+	Index int
+}
+
+func (h *HaveMessage) Marshal() (*Message, error) {
+	return marshalIndex(Have, h.Index)
+}
+
+func (h *HaveMessage) Unmarshal(m *Message) error {
+	return unmarshalIndex(m, Have, &h.Index)
+}
+
+// SuggestMessage suggests a piece to download (Fast Extension)
+// suggest piece: <len=0005><id=13><piece index>
+type SuggestMessage struct {
+	Index int
+}
+
+func (s *SuggestMessage) Marshal() (*Message, error) {
+	return marshalIndex(SuggestPiece, s.Index)
+}
+
+func (s *SuggestMessage) Unmarshal(m *Message) error {
+	return unmarshalIndex(m, SuggestPiece, &s.Index)
+}
+
+// AllowedFastMessage says a piece can be requested even while choked (Fast Extension)
+// allowed fast: <len=0005><id=17><piece index>
+type AllowedFastMessage struct {
+	Index int
+}
+
+func (a *AllowedFastMessage) Marshal() (*Message, error) {
+	return marshalIndex(AllowedFast, a.Index)
+}
+
+func (a *AllowedFastMessage) Unmarshal(m *Message) error {
+	return unmarshalIndex(m, AllowedFast, &a.Index)
+}
+
+// the three messages above are all just a piece index
+func marshalIndex(id uint8, index int) (*Message, error) {
+	if !fitsUint32(index) {
+		return nil, fmt.Errorf("message %d: piece index %d out of range", id, index)
+	}
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: id, Payload: payload}, nil
+}
+
+func unmarshalIndex(m *Message, id uint8, index *int) error {
+	err := checkMessage(m, id, 4)
+	if err != nil {
+		return err
+	}
+	*index = int(binary.BigEndian.Uint32(m.Payload))
+	return nil
+}
+
+// BitfieldMessage says which pieces the sender has
+// bitfield: <len=0001+X><id=5><bitfield>
+type BitfieldMessage struct {
+	Bitfield bitfield.Bitfield
+}
+
+func (b *BitfieldMessage) Marshal() (*Message, error) {
+	if len(b.Bitfield)+1 > MaxLength {
+		return nil, fmt.Errorf("bitfield message: bitfield of %d bytes is too big", len(b.Bitfield))
+	}
+	return &Message{ID: Bitfield, Payload: b.Bitfield}, nil
+}
+
+func (b *BitfieldMessage) Unmarshal(m *Message) error {
+	if m == nil || m.ID != Bitfield {
+		return wrongID(m, Bitfield)
+	}
+	b.Bitfield = bitfield.Bitfield(m.Payload)
+	return nil
+}
+
+// PortMessage is the port the sender's DHT node listens on
+// port: <len=0003><id=9><listen-port>
+type PortMessage struct {
+	Port uint16
+}
+
+func (p *PortMessage) Marshal() (*Message, error) {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, p.Port)
+	return &Message{ID: Port, Payload: payload}, nil
+}
+
+func (p *PortMessage) Unmarshal(m *Message) error {
+	err := checkMessage(m, Port, 2)
+	if err != nil {
+		return err
+	}
+	p.Port = binary.BigEndian.Uint16(m.Payload)
+	return nil
+}
+
+// ExtendedMessage is a message from the extension protocol (BEP 10). ExtendedID 0 is
+// the extension handshake, anything else is whatever ID the receiver assigned to that
+// extension in its handshake. Payload is usually a bencoded dictionary
+// extended: <len=0002+X><id=20><extended id><payload>
+type ExtendedMessage struct {
+	ExtendedID uint8
+	Payload    []byte
+}
+
+func (e *ExtendedMessage) Marshal() (*Message, error) {
+	if len(e.Payload)+2 > MaxLength {
+		return nil, fmt.Errorf("extended message: payload of %d bytes is too big", len(e.Payload))
+	}
+	payload := make([]byte, 1+len(e.Payload))
+	payload[0] = e.ExtendedID
+	copy(payload[1:], e.Payload)
+	return &Message{ID: Extended, Payload: payload}, nil
+}
+
+// Payload points into m.Payload, it isn't copied
+func (e *ExtendedMessage) Unmarshal(m *Message) error {
+	if m == nil || m.ID != Extended {
+		return wrongID(m, Extended)
+	}
+	if len(m.Payload) < 1 {
+		return fmt.Errorf("extended message: missing extended message id")
+	}
+	e.ExtendedID = m.Payload[0]
+	e.Payload = m.Payload[1:]
+	return nil
+}
+
+// Parse figures out which typed message m is and unmarshals it. Messages without
+// a payload (choke, unchoke, interested, not interested, have all, have none)
+// don't have a typed version, so for those (and unknown IDs) it returns nil, nil
+func Parse(m *Message) (Typed, error) {
+	if m == nil {
+		return nil, nil
+	}
+	var t Typed
+	switch m.ID {
+	case Request:
+		t = &RequestMessage{}
+	case Cancel:
+		t = &CancelMessage{}
+	case RejectRequest:
+		t = &RejectMessage{}
+	case Piece:
+		t = &PieceMessage{}
+	case Have:
+		t = &HaveMessage{}
+	case SuggestPiece:
+		t = &SuggestMessage{}
+	case AllowedFast:
+		t = &AllowedFastMessage{}
+	case Bitfield:
+		t = &BitfieldMessage{}
+	case Port:
+		t = &PortMessage{}
+	case Extended:
+		t = &ExtendedMessage{}
+	default:
+		return nil, nil
+	}
+	err := t.Unmarshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// check the ID and that the payload is exactly the size this kind of message should be
+func checkMessage(m *Message, id uint8, payloadLen int) error {
+	if m == nil || m.ID != id {
+		return wrongID(m, id)
+	}
+	if len(m.Payload) != payloadLen {
+		return fmt.Errorf("message %d: payload is %d bytes, expected %d", id, len(m.Payload), payloadLen)
+	}
+	return nil
+}
+
+func wrongID(m *Message, want uint8) error {
+	if m == nil {
+		return fmt.Errorf("expected message %d, got keep-alive", want)
+	}
+	return fmt.Errorf("expected message %d, got message %d", want, m.ID)
+}
+
+// everything on the wire is a 4 byte unsigned int
+func fitsUint32(n int) bool {
+	return n >= 0 && uint64(n) <= 0xFFFFFFFF
+}
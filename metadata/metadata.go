@@ -0,0 +1,308 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"main/bencode"
+	"main/client"
+	"main/message"
+	"main/peers"
+	"time"
+)
+
+// a magnet link only has the info hash, not the info dictionary, so before we can download
+// anything we have to get the info dictionary (the "metadata") from peers (BEP 9). It goes
+// over the extension protocol (BEP 10): both sides send an extension handshake saying which
+// extensions they speak and what message ID they want for each, then we ask for the
+// metadata in 16KB pieces with ut_metadata messages, and check it hashes to the info hash
+
+// BlockSize is the size of every piece of metadata but the last
+const BlockSize = 16384
+
+// MaxSize is the biggest info dictionary we'll take. Without a cap a peer could
+// claim any metadata_size and have us allocate it
+const MaxSize = 8 << 20
+
+// ExtensionName is what ut_metadata is called in the extension handshake
+const ExtensionName = "ut_metadata"
+
+// LocalID is the extended message ID we ask peers to use when they send us ut_metadata messages
+const LocalID = 1
+
+// the ut_metadata message types
+const (
+	MsgRequest = 0
+	MsgData    = 1
+	MsgReject  = 2
+)
+
+// ExtensionHandshake is the extension handshake (extended message ID 0, BEP 10)
+type ExtensionHandshake struct {
+	// extension name -> the extended message ID the sender wants for it, 0 means it doesn't do it
+	M map[string]int `bencode:"m"`
+	// how big the info dictionary is, only from peers that have it
+	MetadataSize int    `bencode:"metadata_size,omitempty"`
+	Version      string `bencode:"v,omitempty"`
+}
+
+// Message is the bencoded part of a ut_metadata message. Data messages have the
+// piece of metadata right after it, in the same extended message
+type Message struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// Handshake is the extension handshake payload we send. infoSize is how big our info
+// dictionary is, 0 if we don't have it yet
+func Handshake(infoSize int) ([]byte, error) {
+	return bencode.Marshal(ExtensionHandshake{
+		M:            map[string]int{ExtensionName: LocalID},
+		MetadataSize: infoSize,
+		Version:      "gotorrent",
+	})
+}
+
+// numBlocks is how many pieces of metadata size bytes of metadata comes in
+func numBlocks(size int) int {
+	return (size + BlockSize - 1) / BlockSize
+}
+
+// Respond answers a ut_metadata request (payload is what came after the extended message ID).
+// info is our info dictionary. Returns the payload to send back, or nil if there's
+// nothing to answer (e.g. the peer sent us a data message we didn't ask for)
+func Respond(info []byte, payload []byte) ([]byte, error) {
+	msg := Message{}
+	decoder := bencode.NewDecoder(bytes.NewReader(payload))
+	err := decoder.Decode(&msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.MsgType != MsgRequest {
+		return nil, nil
+	}
+	if msg.Piece < 0 || msg.Piece >= numBlocks(len(info)) {
+		return bencode.Marshal(Message{MsgType: MsgReject, Piece: msg.Piece})
+	}
+	header, err := bencode.Marshal(Message{MsgType: MsgData, Piece: msg.Piece, TotalSize: len(info)})
+	if err != nil {
+		return nil, err
+	}
+	end := (msg.Piece + 1) * BlockSize
+	if end > len(info) {
+		end = len(info)
+	}
+	return append(header, info[msg.Piece*BlockSize:end]...), nil
+}
+
+// how many peers we ask at once, and how long one gets
+const (
+	maxFetchers  = 8
+	fetchTimeout = 30 * time.Second
+)
+
+// ErrStopped is what Fetch returns when it's stopped before any peer gave us the metadata
+var ErrStopped = errors.New("stopped getting the metadata")
+
+// Fetch gets the info dictionary for infoHash from whichever of ps has it first,
+// and checks it against the info hash. Closing stop (which can be nil) hangs up on
+// the peers it's asking and ends it early with ErrStopped
+func Fetch(ps []peers.Peer, peerID [20]byte, infoHash [20]byte, opts client.Options, stop <-chan struct{}) ([]byte, error) {
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("no peers to get the metadata from")
+	}
+	type result struct {
+		info []byte
+		err  error
+	}
+	results := make(chan result)
+	done := make(chan struct{})
+	defer close(done)
+
+	// feed the peers to a few workers, the first good answer wins
+	work := make(chan peers.Peer, len(ps))
+	for _, p := range ps {
+		work <- p
+	}
+	close(work)
+	workers := maxFetchers
+	if len(ps) < workers {
+		workers = len(ps)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for p := range work {
+				info, err := fetchFrom(p, peerID, infoHash, opts, stop)
+				if err != nil {
+					err = fmt.Errorf("%s: %w", p.String(), err)
+				}
+				select {
+				case results <- result{info, err}:
+				case <-done:
+					return
+				}
+				if err == nil {
+					return
+				}
+			}
+		}()
+	}
+
+	var lastErr error
+	for range ps {
+		var r result
+		select {
+		case r = <-results:
+		case <-stop:
+			return nil, ErrStopped
+		}
+		if r.err == nil {
+			return r.info, nil
+		}
+		lastErr = r.err
+	}
+	return nil, fmt.Errorf("none of the %d peers gave us the metadata, last error: %w", len(ps), lastErr)
+}
+
+// get the whole info dictionary from one peer, hanging up if stop is closed
+func fetchFrom(p peers.Peer, peerID [20]byte, infoHash [20]byte, opts client.Options, stop <-chan struct{}) ([]byte, error) {
+	select {
+	case <-stop:
+		return nil, ErrStopped
+	default:
+	}
+	c, err := client.Connect(p, peerID, infoHash, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Conn.Close()
+	// closing the connection is what gets a read or write going on it to return
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-stop:
+			c.Conn.Close()
+		case <-finished:
+		}
+	}()
+	if !c.SupportsExtensions {
+		return nil, fmt.Errorf("peer doesn't support the extension protocol")
+	}
+	c.Conn.SetDeadline(time.Now().Add(fetchTimeout))
+
+	hs, err := Handshake(0)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Send(&message.ExtendedMessage{ExtendedID: 0, Payload: hs})
+	if err != nil {
+		return nil, err
+	}
+
+	// wait for the peer's extension handshake, skipping its bitfield, haves and so on
+	var theirs ExtensionHandshake
+	for {
+		ext, err := readExtended(c)
+		if err != nil {
+			return nil, err
+		}
+		if ext.ExtendedID != 0 {
+			continue
+		}
+		err = bencode.Unmarshal(ext.Payload, &theirs)
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	remoteID := theirs.M[ExtensionName]
+	if remoteID <= 0 || remoteID > 255 {
+		return nil, fmt.Errorf("peer doesn't support %s", ExtensionName)
+	}
+	size := theirs.MetadataSize
+	if size <= 0 || size > MaxSize {
+		return nil, fmt.Errorf("peer says the metadata is %d bytes", size)
+	}
+
+	// ask for every piece up front, they're small
+	info := make([]byte, size)
+	got := make([]bool, numBlocks(size))
+	for i := range got {
+		req, err := bencode.Marshal(Message{MsgType: MsgRequest, Piece: i})
+		if err != nil {
+			return nil, err
+		}
+		err = c.Send(&message.ExtendedMessage{ExtendedID: uint8(remoteID), Payload: req})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for remaining := len(got); remaining > 0; {
+		ext, err := readExtended(c)
+		if err != nil {
+			return nil, err
+		}
+		if ext.ExtendedID != LocalID {
+			continue
+		}
+		// the data comes straight after the bencoded dictionary, so we need to know
+		// where the dictionary ends
+		msg := Message{}
+		decoder := bencode.NewDecoder(bytes.NewReader(ext.Payload))
+		err = decoder.Decode(&msg)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.MsgType {
+		case MsgReject:
+			return nil, fmt.Errorf("peer rejected our request for metadata piece %d", msg.Piece)
+		case MsgData:
+		default:
+			continue
+		}
+		if msg.Piece < 0 || msg.Piece >= len(got) {
+			return nil, fmt.Errorf("peer sent metadata piece %d, there are only %d", msg.Piece, len(got))
+		}
+		data := ext.Payload[decoder.InputOffset():]
+		begin := msg.Piece * BlockSize
+		want := BlockSize
+		if begin+want > size {
+			want = size - begin
+		}
+		if len(data) != want {
+			return nil, fmt.Errorf("metadata piece %d is %d bytes, expected %d", msg.Piece, len(data), want)
+		}
+		if !got[msg.Piece] {
+			copy(info[begin:], data)
+			got[msg.Piece] = true
+			remaining--
+		}
+	}
+
+	if sha1.Sum(info) != infoHash {
+		return nil, fmt.Errorf("metadata doesn't match the info hash")
+	}
+	return info, nil
+}
+
+// read messages until an extended one comes along
+func readExtended(c *client.Client) (*message.ExtendedMessage, error) {
+	for {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.Extended {
+			continue
+		}
+		ext := &message.ExtendedMessage{}
+		err = ext.Unmarshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		return ext, nil
+	}
+}
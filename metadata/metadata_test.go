@@ -0,0 +1,250 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"main/bencode"
+	"main/client"
+	"main/internal/testutil"
+	"main/message"
+	"main/peers"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ourID = [20]byte{'u', 's'}
+
+// an info dictionary a bit over two blocks long, so the last piece is short
+func testInfo() []byte {
+	info, err := bencode.Marshal(map[string]any{
+		"name":         "file.iso",
+		"piece length": 16384,
+		"pieces":       strings.Repeat("x", 2*BlockSize+100),
+		"length":       100000,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return info
+}
+
+// a peer on loopback that has the metadata. answer turns each of our requests into the
+// ut_metadata payload it sends back, nil to send nothing. size is what it says in its
+// extension handshake
+func metadataPeer(t *testing.T, infoHash [20]byte, size int, answer func(req []byte) []byte) peers.Peer {
+	t.Helper()
+	l := testutil.Listen(t)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c, err := client.Accept(conn, [20]byte{'t', 'h'}, func(h [20]byte) (bool, bool) { return h == infoHash, false })
+		if err != nil {
+			return
+		}
+		// a bitfield first, like a real peer, which the fetcher has to skip
+		c.Send(&message.BitfieldMessage{Bitfield: []byte{0xff}})
+		var theirID uint8
+		for {
+			ext, err := readExtended(c)
+			if err != nil {
+				return
+			}
+			if ext.ExtendedID == 0 {
+				var hs ExtensionHandshake
+				bencode.Unmarshal(ext.Payload, &hs)
+				theirID = uint8(hs.M[ExtensionName])
+				payload, _ := bencode.Marshal(ExtensionHandshake{M: map[string]int{ExtensionName: 3}, MetadataSize: size})
+				c.Send(&message.ExtendedMessage{ExtendedID: 0, Payload: payload})
+				continue
+			}
+			if reply := answer(ext.Payload); reply != nil {
+				c.Send(&message.ExtendedMessage{ExtendedID: theirID, Payload: reply})
+			}
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+// answers requests from info, like we do
+func honest(info []byte) func([]byte) []byte {
+	return func(req []byte) []byte {
+		reply, _ := Respond(info, req)
+		return reply
+	}
+}
+
+func TestFetch(t *testing.T) {
+	info := testInfo()
+	infoHash := sha1.Sum(info)
+	p := metadataPeer(t, infoHash, len(info), honest(info))
+	got, err := Fetch([]peers.Peer{p}, ourID, infoHash, client.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, info) {
+		t.Fatal("got different metadata")
+	}
+}
+
+func TestFetchBadPeers(t *testing.T) {
+	info := testInfo()
+	infoHash := sha1.Sum(info)
+	// the data part of a reply for piece, with the header claiming it's piece claimed
+	data := func(claimed int, piece []byte) []byte {
+		header, _ := bencode.Marshal(Message{MsgType: MsgData, Piece: claimed, TotalSize: len(info)})
+		return append(header, piece...)
+	}
+	block := func(req []byte) (Message, []byte) {
+		var msg Message
+		bencode.NewDecoder(bytes.NewReader(req)).Decode(&msg)
+		end := (msg.Piece + 1) * BlockSize
+		if end > len(info) {
+			end = len(info)
+		}
+		return msg, info[msg.Piece*BlockSize : end]
+	}
+	cases := []struct {
+		name   string
+		size   int
+		answer func([]byte) []byte
+		want   string
+	}{
+		{"piece past the end", len(info), func(req []byte) []byte {
+			msg, piece := block(req)
+			return data(msg.Piece+3, piece)
+		}, "there are only 3"},
+		{"negative piece", len(info), func(req []byte) []byte {
+			_, piece := block(req)
+			return data(-1, piece)
+		}, "piece -1"},
+		{"short piece", len(info), func(req []byte) []byte {
+			msg, piece := block(req)
+			return data(msg.Piece, piece[:len(piece)-1])
+		}, "expected"},
+		{"long piece", len(info), func(req []byte) []byte {
+			msg, piece := block(req)
+			return data(msg.Piece, append(append([]byte(nil), piece...), 0))
+		}, "expected"},
+		{"wrong metadata", len(info), func(req []byte) []byte {
+			msg, piece := block(req)
+			return data(msg.Piece, bytes.Repeat([]byte{'z'}, len(piece)))
+		}, "doesn't match the info hash"},
+		{"rejects", len(info), func(req []byte) []byte {
+			msg, _ := block(req)
+			reply, _ := bencode.Marshal(Message{MsgType: MsgReject, Piece: msg.Piece})
+			return reply
+		}, "rejected"},
+		{"huge size", MaxSize + 1, honest(info), "peer says the metadata is"},
+		{"no size", 0, honest(info), "peer says the metadata is 0 bytes"},
+	}
+	for _, c := range cases {
+		p := metadataPeer(t, infoHash, c.size, c.answer)
+		_, err := fetchFrom(p, ourID, infoHash, client.Options{}, nil)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error with %q", c.name, err, c.want)
+		}
+	}
+}
+
+// every peer failing is an error, with the last one's reason
+func TestFetchAllFail(t *testing.T) {
+	info := testInfo()
+	infoHash := sha1.Sum(info)
+	// one says the metadata is a byte longer than it is, the other a byte shorter
+	long := metadataPeer(t, infoHash, len(info)+1, honest(info))
+	short := metadataPeer(t, infoHash, len(info)-1, honest(info))
+	_, err := Fetch([]peers.Peer{long, short}, ourID, infoHash, client.Options{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "none of the 2 peers") {
+		t.Fatalf("got %v", err)
+	}
+	_, err = Fetch(nil, ourID, infoHash, client.Options{}, nil)
+	if err == nil {
+		t.Fatal("fetched from no peers")
+	}
+}
+
+// stopping hangs up on a peer that's sitting on our requests, instead of waiting out
+// the timeout
+func TestFetchStopped(t *testing.T) {
+	info := testInfo()
+	infoHash := sha1.Sum(info)
+	asked := make(chan struct{}, 10)
+	silent := func(req []byte) []byte {
+		asked <- struct{}{}
+		return nil
+	}
+	stop := make(chan struct{})
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := fetchFrom(metadataPeer(t, infoHash, len(info), silent), ourID, infoHash, client.Options{}, stop)
+		fetched <- err
+	}()
+	<-asked
+	close(stop)
+	select {
+	case err := <-fetched:
+		if err == nil {
+			t.Fatal("got metadata from a peer that never sent any")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fetchFrom is still waiting on the peer a second after stop")
+	}
+
+	// and Fetch says it was stopped, not that the peers failed
+	_, err := Fetch([]peers.Peer{metadataPeer(t, infoHash, len(info), silent)}, ourID, infoHash, client.Options{}, stop)
+	if err != ErrStopped {
+		t.Fatalf("got %v, want ErrStopped", err)
+	}
+}
+
+func TestRespond(t *testing.T) {
+	info := testInfo()
+	request := func(piece int) []byte {
+		req, _ := bencode.Marshal(Message{MsgType: MsgRequest, Piece: piece})
+		return req
+	}
+	for piece, want := range map[int][]byte{0: info[:BlockSize], 2: info[2*BlockSize:]} {
+		reply, err := Respond(info, request(piece))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg Message
+		decoder := bencode.NewDecoder(bytes.NewReader(reply))
+		err = decoder.Decode(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != (Message{MsgType: MsgData, Piece: piece, TotalSize: len(info)}) {
+			t.Fatalf("piece %d: header is %+v", piece, msg)
+		}
+		if !bytes.Equal(reply[decoder.InputOffset():], want) {
+			t.Fatalf("piece %d: wrong data", piece)
+		}
+	}
+
+	for _, piece := range []int{-1, 3, 1 << 30} {
+		reply, err := Respond(info, request(piece))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg Message
+		if bencode.Unmarshal(reply, &msg) != nil || msg.MsgType != MsgReject || msg.Piece != piece {
+			t.Fatalf("piece %d: got %q, want a reject", piece, reply)
+		}
+	}
+
+	// data we didn't ask for gets no answer, and garbage is an error
+	data, _ := bencode.Marshal(Message{MsgType: MsgData, Piece: 0})
+	if reply, err := Respond(info, data); reply != nil || err != nil {
+		t.Fatalf("answered a data message: %q, %v", reply, err)
+	}
+	if _, err := Respond(info, []byte("d8:msg_type")); err == nil {
+		t.Fatal("no error for a truncated request")
+	}
+}
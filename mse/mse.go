@@ -0,0 +1,462 @@
+package mse
+
+// Message Stream Encryption (also called Protocol Encryption), the obfuscation layer
+// most clients put in front of the normal bittorrent handshake. Its whole point is to
+// make the connection look like random bytes so ISPs can't throttle it by spotting the
+// "BitTorrent protocol" string. It isn't meant to be real security.
+// The spec lives here https://wiki.vuze.com/w/Message_Stream_Encryption
+//
+// The handshake goes (A is whoever dialed, B is whoever accepted)
+//
+// 1 A->B: Diffie Hellman Ya, PadA
+// 2 B->A: Diffie Hellman Yb, PadB
+// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+// 5 A->B: ENCRYPT2(Payload Stream)
+//
+// S is the shared DH secret and SKEY is the info hash of the torrent. After that, the
+// connection is either RC4 encrypted or plaintext, depending on crypto_select
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Policy decides whether we use encryption with a peer
+type Policy int
+
+const (
+	// never encrypt, just do the plain bittorrent handshake
+	Disabled Policy = iota
+	// try encryption first, but fall back to plaintext if the peer doesn't support it
+	Preferred
+	// only talk to peers that do encryption
+	Required
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Preferred:
+		return "preferred"
+	case Required:
+		return "required"
+	}
+	return "unknown"
+}
+
+// ParsePolicy turns "disabled", "preferred" or "required" into a Policy
+func ParsePolicy(s string) (Policy, error) {
+	for _, p := range []Policy{Disabled, Preferred, Required} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return Disabled, fmt.Errorf("unknown encryption policy %q, must be disabled, preferred or required", s)
+}
+
+// the crypto_provide/crypto_select bits
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+// the 768 bit prime from the spec, and generator 2
+var (
+	dhPrime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	dhGenerator = big.NewInt(2)
+)
+
+const (
+	// DH public keys are always sent as exactly 96 bytes
+	keyLen = 96
+	// padding is random junk of 0 to 512 bytes, to make packet sizes unpredictable
+	maxPadLen = 512
+	// verification constant, 8 zero bytes
+	vcLen = 8
+)
+
+// how long the whole encryption handshake is allowed to take
+const handshakeTimeout = 10 * time.Second
+
+// a DH key pair. The spec says the private key should be 160 bits
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(dhGenerator, private, dhPrime)
+	return &keyPair{private: private, public: padKey(public.Bytes())}, nil
+}
+
+// the shared secret S, from the other side's public key
+func (k *keyPair) secret(otherPublic []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(otherPublic)
+	// a public key of 0, 1 or P-1 would make S guessable
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(dhPrime, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("peer sent an invalid diffie hellman key")
+	}
+	s := new(big.Int).Exp(y, k.private, dhPrime)
+	return padKey(s.Bytes()), nil
+}
+
+// big.Int drops leading zero bytes, but the spec wants exactly 96 bytes
+func padKey(b []byte) []byte {
+	ret := make([]byte, keyLen)
+	copy(ret[keyLen-len(b):], b)
+	return ret
+}
+
+// SHA1 over all the parts glued together
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// RC4 keyed with HASH(name, S, SKEY), with the first 1024 bytes of keystream thrown away like the spec says
+func newCipher(name string, s []byte, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// random padding between 0 and max bytes long
+func randomPad(max int) ([]byte, error) {
+	var n [2]byte
+	_, err := rand.Read(n[:])
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(max+1))
+	_, err = rand.Read(pad)
+	return pad, err
+}
+
+// Conn is a net.Conn that (maybe) encrypts everything with RC4 after the MSE handshake
+// If the peers agreed on plaintext, the ciphers are nil and it's just a passthrough
+type Conn struct {
+	net.Conn
+	// bytes we had to read during the handshake that belong to the payload stream
+	// (already decrypted). Read hands these out before touching the socket again
+	buffered []byte
+	encrypt  *rc4.Cipher
+	decrypt  *rc4.Cipher
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.buffered) > 0 {
+		n := copy(b, c.buffered)
+		c.buffered = c.buffered[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(b)
+	if c.decrypt != nil {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+	// encrypt into a copy, the caller probably doesn't expect their slice to change
+	out := make([]byte, len(b))
+	c.encrypt.XORKeyStream(out, b)
+	return c.Conn.Write(out)
+}
+
+// Encrypted tells you if the connection actually ended up RC4 encrypted
+func (c *Conn) Encrypted() bool {
+	return c.encrypt != nil
+}
+
+// Initiate does the A side of the handshake on a conn we dialed. skey is the info hash
+// of the torrent we want. With Preferred we offer both RC4 and plaintext and let the
+// peer pick, with Required we only offer RC4
+func Initiate(conn net.Conn, skey [20]byte, policy Policy) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	// step 1, send Ya and PadA
+	padA, err := randomPad(maxPadLen)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(append([]byte{}, keys.public...), padA...))
+	if err != nil {
+		return nil, err
+	}
+
+	// step 2, get Yb. PadB comes after it but we deal with that when syncing below
+	yb := make([]byte, keyLen)
+	_, err = io.ReadFull(conn, yb)
+	if err != nil {
+		return nil, err
+	}
+	s, err := keys.secret(yb)
+	if err != nil {
+		return nil, err
+	}
+
+	// A encrypts with keyA, B encrypts with keyB
+	encrypt := newCipher("keyA", s, skey[:])
+	decrypt := newCipher("keyB", s, skey[:])
+
+	// step 3
+	provide := cryptoRC4
+	if policy != Required {
+		provide |= cryptoPlaintext
+	}
+	req2 := hash([]byte("req2"), skey[:])
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	// VC, crypto_provide, len(PadC), PadC (we send none), len(IA) (we send no initial payload,
+	// the bittorrent handshake just goes over the encrypted stream afterwards)
+	plain := make([]byte, vcLen+4+2+2)
+	binary.BigEndian.PutUint32(plain[vcLen:], provide)
+	encrypted := make([]byte, len(plain))
+	encrypt.XORKeyStream(encrypted, plain)
+
+	step3 := hash([]byte("req1"), s)
+	step3 = append(step3, req2...)
+	step3 = append(step3, encrypted...)
+	_, err = conn.Write(step3)
+	if err != nil {
+		return nil, err
+	}
+
+	// step 4. B's reply starts with ENCRYPT(VC), but there's up to 512 bytes of PadB
+	// in front of it, so we scan the stream for what encrypted VC would look like
+	encryptedVC := make([]byte, vcLen)
+	decrypt.XORKeyStream(encryptedVC, make([]byte, vcLen))
+	err = syncTo(conn, encryptedVC, maxPadLen)
+	if err != nil {
+		return nil, fmt.Errorf("mse: couldn't find the verification constant from peer: %w", err)
+	}
+
+	// crypto_select and len(padD)
+	header := make([]byte, 6)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header[0:4])
+	padDLen := int(binary.BigEndian.Uint16(header[4:6]))
+	if padDLen > maxPadLen {
+		return nil, fmt.Errorf("mse: peer's padding is too long (%d bytes)", padDLen)
+	}
+	padD := make([]byte, padDLen)
+	_, err = io.ReadFull(conn, padD)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(padD, padD)
+
+	ret := &Conn{Conn: conn}
+	switch {
+	case selected == cryptoRC4:
+		ret.encrypt = encrypt
+		ret.decrypt = decrypt
+	case selected == cryptoPlaintext && policy != Required:
+	default:
+		return nil, fmt.Errorf("mse: peer selected crypto method %d, which we didn't offer", selected)
+	}
+	return ret, nil
+}
+
+// Accept does the B side of the handshake on a conn someone dialed into us.
+// Since we don't know yet whether the peer is going to encrypt, we first peek at the
+// first bytes: a plain handshake starts with 19 then "BitTorrent protocol".
+// skeys are the info hashes of the torrents we're serving, the peer proves which one
+// it wants without sending it in the clear, so we have to try all of them.
+// Returns the conn to use for the bittorrent handshake, and the info hash the peer
+// asked for (zero if the peer didn't encrypt, in which case the handshake says it)
+func Accept(conn net.Conn, skeys [][20]byte, policy Policy) (net.Conn, [20]byte, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	pstr := "BitTorrent protocol"
+	first := make([]byte, 1+len(pstr))
+	_, err := io.ReadFull(conn, first)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	if first[0] == byte(len(pstr)) && string(first[1:]) == pstr {
+		if policy == Required {
+			return nil, [20]byte{}, fmt.Errorf("mse: peer sent a plaintext handshake but encryption is required")
+		}
+		// hand the bytes we peeked at back to whoever reads the handshake
+		return &Conn{Conn: conn, buffered: first}, [20]byte{}, nil
+	}
+	if policy == Disabled {
+		return nil, [20]byte{}, fmt.Errorf("mse: peer wants encryption but it is disabled")
+	}
+
+	// step 1, the rest of Ya. PadA follows but we skip that when we sync on req1
+	ya := make([]byte, keyLen)
+	copy(ya, first)
+	_, err = io.ReadFull(conn, ya[len(first):])
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	s, err := keys.secret(ya)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+
+	// step 2, send Yb and PadB
+	padB, err := randomPad(maxPadLen)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	_, err = conn.Write(append(append([]byte{}, keys.public...), padB...))
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+
+	// step 3, find HASH('req1', S) after PadA
+	err = syncTo(conn, hash([]byte("req1"), s), maxPadLen)
+	if err != nil {
+		return nil, [20]byte{}, fmt.Errorf("mse: couldn't find req1 from peer: %w", err)
+	}
+
+	// figure out which torrent the peer wants: undo the xor with req3 and compare
+	// against HASH('req2', SKEY) for every torrent we have
+	obfuscated := make([]byte, 20)
+	_, err = io.ReadFull(conn, obfuscated)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	req3 := hash([]byte("req3"), s)
+	for i := range obfuscated {
+		obfuscated[i] ^= req3[i]
+	}
+	var skey [20]byte
+	found := false
+	for _, candidate := range skeys {
+		if bytes.Equal(obfuscated, hash([]byte("req2"), candidate[:])) {
+			skey = candidate
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, [20]byte{}, fmt.Errorf("mse: peer asked for a torrent we don't have")
+	}
+
+	encrypt := newCipher("keyB", s, skey[:])
+	decrypt := newCipher("keyA", s, skey[:])
+
+	// VC, crypto_provide, len(PadC)
+	header := make([]byte, vcLen+4+2)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[:vcLen], make([]byte, vcLen)) {
+		return nil, [20]byte{}, fmt.Errorf("mse: bad verification constant from peer")
+	}
+	provide := binary.BigEndian.Uint32(header[vcLen : vcLen+4])
+	padCLen := int(binary.BigEndian.Uint16(header[vcLen+4:]))
+	if padCLen > maxPadLen {
+		return nil, [20]byte{}, fmt.Errorf("mse: peer's padding is too long (%d bytes)", padCLen)
+	}
+
+	// PadC and len(IA)
+	rest := make([]byte, padCLen+2)
+	_, err = io.ReadFull(conn, rest)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	decrypt.XORKeyStream(rest, rest)
+	iaLen := int(binary.BigEndian.Uint16(rest[padCLen:]))
+
+	// the initial payload is usually the peer's bittorrent handshake. It's always
+	// RC4 encrypted, even if we end up picking plaintext for the rest of the stream
+	ia := make([]byte, iaLen)
+	_, err = io.ReadFull(conn, ia)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	decrypt.XORKeyStream(ia, ia)
+
+	// pick RC4 whenever we can, plaintext only if the peer doesn't do RC4 and we don't require it
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy != Required:
+		selected = cryptoPlaintext
+	default:
+		return nil, [20]byte{}, fmt.Errorf("mse: no crypto method in common with peer (they offered %d)", provide)
+	}
+
+	// step 4, VC, crypto_select, len(padD), no padD
+	reply := make([]byte, vcLen+4+2)
+	binary.BigEndian.PutUint32(reply[vcLen:], selected)
+	encrypt.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+
+	ret := &Conn{Conn: conn, buffered: ia}
+	if selected == cryptoRC4 {
+		ret.encrypt = encrypt
+		ret.decrypt = decrypt
+	}
+	return ret, skey, nil
+}
+
+// read from r until we've just read the bytes in want. There can be up to maxSkip
+// bytes of junk (padding) in front of it
+func syncTo(r io.Reader, want []byte, maxSkip int) error {
+	window := make([]byte, 0, maxSkip+len(want))
+	one := make([]byte, 1)
+	for len(window) < maxSkip+len(want) {
+		_, err := io.ReadFull(r, one)
+		if err != nil {
+			return err
+		}
+		window = append(window, one[0])
+		if len(window) >= len(want) && bytes.Equal(window[len(window)-len(want):], want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("gave up after %d bytes", len(window))
+}
@@ -0,0 +1,153 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"main/internal/testutil"
+	"net"
+	"testing"
+)
+
+type accepted struct {
+	conn net.Conn
+	skey [20]byte
+	err  error
+}
+
+// run Initiate on one end and Accept on the other. If either side fails the other one's
+// conn gets closed, like a real peer hanging up, so neither waits for the timeout
+func handshake(t *testing.T, skey [20]byte, initiator Policy, skeys [][20]byte, acceptor Policy) (*Conn, accepted, error) {
+	t.Helper()
+	a, b := testutil.Loopback(t)
+	done := make(chan accepted, 1)
+	go func() {
+		conn, skey, err := Accept(b, skeys, acceptor)
+		if err != nil {
+			b.Close()
+		}
+		done <- accepted{conn, skey, err}
+	}()
+	conn, err := Initiate(a, skey, initiator)
+	if err != nil {
+		a.Close()
+	}
+	return conn, <-done, err
+}
+
+// check that what one side writes comes out the other, both ways
+func checkStream(t *testing.T, a, b net.Conn) {
+	t.Helper()
+	for _, dir := range []struct {
+		from, to net.Conn
+		msg      string
+	}{{a, b, "\x13BitTorrent protocol from A"}, {b, a, "\x13BitTorrent protocol from B"}} {
+		go dir.from.Write([]byte(dir.msg))
+		got := make([]byte, len(dir.msg))
+		_, err := io.ReadFull(dir.to, got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != dir.msg {
+			t.Fatalf("sent %q, got %q", dir.msg, got)
+		}
+	}
+}
+
+func TestRequired(t *testing.T) {
+	skey := [20]byte{1, 2, 3}
+	conn, acc, err := handshake(t, skey, Required, [][20]byte{skey}, Required)
+	if err != nil || acc.err != nil {
+		t.Fatalf("initiate: %v, accept: %v", err, acc.err)
+	}
+	if !conn.Encrypted() || !acc.conn.(*Conn).Encrypted() {
+		t.Fatal("required but not encrypted")
+	}
+	if acc.skey != skey {
+		t.Fatalf("accept says the peer wants %x, not %x", acc.skey, skey)
+	}
+	checkStream(t, conn, acc.conn)
+}
+
+// both sides would take plaintext, but RC4 wins whenever the peer has it
+func TestPreferred(t *testing.T) {
+	skey := [20]byte{4, 5, 6}
+	other := [20]byte{7, 8, 9}
+	conn, acc, err := handshake(t, skey, Preferred, [][20]byte{other, skey}, Preferred)
+	if err != nil || acc.err != nil {
+		t.Fatalf("initiate: %v, accept: %v", err, acc.err)
+	}
+	if !conn.Encrypted() || !acc.conn.(*Conn).Encrypted() {
+		t.Fatal("both sides do RC4 but it ended up plaintext")
+	}
+	if acc.skey != skey {
+		t.Fatalf("accept picked %x out of its torrents, not %x", acc.skey, skey)
+	}
+	checkStream(t, conn, acc.conn)
+}
+
+// with encryption off we never Initiate, and Accept turns away anyone who does
+func TestDisabled(t *testing.T) {
+	skey := [20]byte{1}
+	for _, initiator := range []Policy{Preferred, Required} {
+		_, acc, err := handshake(t, skey, initiator, [][20]byte{skey}, Disabled)
+		if acc.err == nil || err == nil {
+			t.Fatalf("%s against disabled: initiate: %v, accept: %v", initiator, err, acc.err)
+		}
+	}
+}
+
+// a peer that skips MSE and starts with the bittorrent handshake. Disabled and Preferred
+// hand it over untouched, Required hangs up
+func TestPlaintextPeer(t *testing.T) {
+	msg := []byte("\x13BitTorrent protocol and the rest of the handshake")
+	for _, policy := range []Policy{Disabled, Preferred, Required} {
+		a, b := testutil.Loopback(t)
+		go a.Write(msg)
+		conn, skey, err := Accept(b, [][20]byte{{1}}, policy)
+		if policy == Required {
+			if err == nil {
+				t.Fatal("required took a plaintext handshake")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", policy, err)
+		}
+		if skey != ([20]byte{}) {
+			t.Fatalf("%s: got info hash %x from a plaintext handshake", policy, skey)
+		}
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("%s: got %q, want %q", policy, got, msg)
+		}
+	}
+}
+
+// the peer wants a torrent we don't have, which fails on both ends
+func TestSKEYMismatch(t *testing.T) {
+	for _, policy := range []Policy{Preferred, Required} {
+		_, acc, err := handshake(t, [20]byte{1}, policy, [][20]byte{{2}, {3}}, policy)
+		if acc.err == nil {
+			t.Fatalf("%s: accept took an info hash it doesn't have", policy)
+		}
+		if err == nil {
+			t.Fatalf("%s: initiate didn't notice the peer hung up", policy)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{Disabled, Preferred, Required} {
+		got, err := ParsePolicy(p.String())
+		if err != nil || got != p {
+			t.Fatalf("%s: got %s, %v", p, got, err)
+		}
+	}
+	if _, err := ParsePolicy("off"); err == nil {
+		t.Fatal("off isn't a policy")
+	}
+}
@@ -0,0 +1,56 @@
+package p2p
+
+import "log"
+
+// EventType is what happened, see Event
+type EventType int
+
+const (
+	// we connected to a peer, or one connected to us
+	PeerConnected EventType = iota
+	PeerDisconnected
+	// a piece passed its hash check and got written
+	PieceDone
+	// a piece failed its hash check, and will be downloaded again
+	PieceFailed
+)
+
+func (e EventType) String() string {
+	switch e {
+	case PeerConnected:
+		return "peer connected"
+	case PeerDisconnected:
+		return "peer disconnected"
+	case PieceDone:
+		return "piece done"
+	case PieceFailed:
+		return "piece failed"
+	}
+	return "unknown"
+}
+
+// Event is something that happened in a download or while seeding, handed to
+// Torrent.OnEvent as it happens
+type Event struct {
+	Type EventType
+	// the peer's address, for the peer events and PieceFailed
+	Peer string
+	// the piece's index, for the piece events
+	Piece int
+}
+
+// tell whoever's listening. OnEvent gets called from the peers' goroutines, so never
+// with t.mu held
+func (t *Torrent) emit(e Event) {
+	if t.OnEvent != nil {
+		t.OnEvent(e)
+	}
+}
+
+// where the log lines go, the standard logger unless Log says otherwise
+func (t *Torrent) logger() *log.Logger {
+	if t.Log != nil {
+		return t.Log
+	}
+	return log.Default()
+}
@@ -3,11 +3,20 @@ package p2p
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"main/bitfield"
 	"main/client"
+	"main/merkle"
 	"main/message"
+	"main/mse"
+	"main/peerpool"
 	"main/peers"
-	"runtime"
+	"main/ratelimit"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,6 +36,87 @@ type Torrent struct {
 	PieceLength int
 	Name        string
 	Length      int
+	// nil for single file torrents
+	Files []File
+	// HTTP servers with a copy of the files (BEP 19), see webseed.go
+	WebSeeds []string
+	// private torrents (BEP 27) only get peers from their trackers, never from DHT, PEX or LSD
+	Private bool
+	// max number of peers to be connected to at once for this torrent, 0 means the default
+	MaxConns int
+	// shared cap on connections across all torrents, nil means peerpool.DefaultLimiter
+	ConnLimiter *peerpool.Limiter
+	// rate limits for just this torrent, on top of ratelimit.GlobalDownload/GlobalUpload.
+	// nil means no per torrent limit. Call SetRate on them to change the limit mid download
+	DownloadLimiter *ratelimit.Limiter
+	UploadLimiter   *ratelimit.Limiter
+	// whether to use Message Stream Encryption with peers
+	Encryption mse.Policy
+	// whether to connect to peers over TCP, uTP or both
+	Dial client.DialStrategy
+	// the raw info dictionary from the .torrent file, for serving metadata to peers (BEP 9)
+	InfoBytes []byte
+
+	// BitTorrent v2 (BEP 52). For v2 only torrents PieceHash is nil and every piece is checked
+	// against its merkle hash here instead. Hybrid torrents have both and get checked twice
+	PieceHashV2 []PieceHashV2
+	// the v2 info hash cut down to 20 bytes, for the handshake. For v2 only torrents it's the
+	// same as InfoHash, for hybrids it's how we talk to the v2 swarm
+	InfoHashV2 [20]byte
+	// peers from announcing the v2 info hash of a hybrid torrent, we handshake with them using InfoHashV2
+	PeersV2 []peers.Peer
+
+	// where the log lines go, nil for the standard logger
+	Log *log.Logger
+	// if set, it's told about peers coming and going and pieces finishing, see events.go.
+	// It's called from the goroutines doing the work, so it has to be quick
+	OnEvent func(Event)
+
+	// decides which peers we're connected to, only set while Download is running
+	pool *peerpool.Pool
+	// keeps score of who sent us corrupt pieces
+	bans *banTracker
+	// which peers are in the v2 swarm of a hybrid torrent
+	mu      sync.Mutex
+	v2Peers map[string]bool
+	// how many web seeds are still downloading
+	webSeedsActive int32
+	// bytes of pieces sent to peers, see seed.go
+	uploaded int64
+
+	// for Stats, see stats.go. All under mu
+	active       map[*activePeer]bool
+	availability []int32
+	done         []bool
+	piecesDone   int
+	bytesDone    int64
+	// what peers that already disconnected sent and got
+	pastDownloaded int64
+	pastUploaded   int64
+	// who we're uploading to, nil when we aren't. See seed.go
+	serving *seeder
+}
+
+// File is one file of a multi file torrent
+type File struct {
+	// relative to the torrent's directory, e.g. ["docs", "readme.txt"]
+	Path   []string
+	Length int
+	// where the file starts in the torrent's stream of bytes (the thing pieces are cut out of)
+	Offset int
+	// pad files (BEP 47) only exist to line files up with pieces, they don't get written to disk
+	Padding bool
+}
+
+// PieceHashV2 is what one piece of a v2 torrent gets checked against
+type PieceHashV2 struct {
+	// the root of the merkle subtree over this piece's blocks
+	Root merkle.Hash
+	// how many bytes of the piece are file data. In a hybrid torrent the rest of
+	// the last piece of a file is padding, which isn't part of the merkle tree
+	DataLength int
+	// how many leaves the subtree has
+	Leaves int
 }
 
 // a struct to represent all the info we need about a piece that is in need of download
@@ -43,11 +133,11 @@ type PieceWork struct {
 
 // a struct to represent the result of a piece transfer
 // the index of the piece and the actual contents of the piece
-// also I added which peer did the work as a field, for fun :P
+// also I added who did the work as a field, for fun :P (a peer, or a web seed's URL)
 type pieceResult struct {
 	index    int
 	contents []byte
-	peer     peers.Peer
+	from     string
 }
 
 // a strict to keep track of the progress for a specific peer connection
@@ -63,10 +153,32 @@ type PieceProgress struct {
 	// how many bytes have been requested. We need this to know which offset into the piece
 	// we need to start our next block request at
 	Requested int
+	// where choke/unchoke and have messages get reported for Stats, can be nil
+	peer *activePeer
 	// how many requests are currently sent and haven't been responded to
 	Backlog int
+	// which peer sent each block, so we know who to blame if the piece is corrupt
+	BlockPeers []peers.Peer
+	// blocks the peer rejected (Fast Extension) that we need to ask for again
+	Rejected []blockRequest
+	// how many rejects we've gotten for this piece, so a peer that keeps rejecting
+	// doesn't make us loop forever
+	Rejects int
+}
+
+// one block we asked for
+type blockRequest struct {
+	begin  int
+	length int
 }
 
+// a peer that rejects more requests than this for one piece probably doesn't want
+// to give it to us, so we let another peer try
+const maxRejects = 8
+
+// errPieceRejected means the peer wouldn't give us the piece, but the connection is fine
+var errPieceRejected = errors.New("peer rejected our requests for this piece")
+
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
 	begin = index * t.PieceLength
 	end = begin + t.PieceLength
@@ -77,22 +189,73 @@ func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
 }
 
 func (t *Torrent) calculatePieceSize(index int) int {
+	// in a v2 only torrent every file starts on a new piece, so the last piece
+	// of each file is short, not just the last piece of the torrent
+	if t.PieceHash == nil && index < len(t.PieceHashV2) {
+		return t.PieceHashV2[index].DataLength
+	}
 	begin, end := t.calculateBoundsForPiece(index)
 	return end - begin
 }
 
+// how many pieces the torrent has, whichever version it is
+func (t *Torrent) numPieces() int {
+	if t.PieceHash != nil {
+		return len(t.PieceHash)
+	}
+	return len(t.PieceHashV2)
+}
+
+// ErrStopped is what DownloadTo returns when it's stopped before it's done
+var ErrStopped = errors.New("download stopped")
+
+// how often DownloadTo checks whether there's anyone left to download from
+var peerCheckInterval = 10 * time.Second
+
 // this function returns the FILE as a []byte
 func (t *Torrent) Download() ([]byte, error) {
+	theFile := make([]byte, t.Length)
+	err := t.DownloadTo(bufferWriter(theFile), bitfield.New(t.numPieces()), nil)
+	if err != nil {
+		return nil, err
+	}
+	return theFile, nil
+}
+
+// an io.WriterAt for a []byte, so Download can share DownloadTo
+type bufferWriter []byte
+
+func (b bufferWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(b)) {
+		return 0, fmt.Errorf("offset %d is outside the buffer", off)
+	}
+	return copy(b[off:], p), nil
+}
+
+// DownloadTo downloads the pieces that aren't in have and writes each one to w, at its
+// offset in the torrent's stream of bytes, as soon as it's checked. have gets the pieces
+// set as they come in, so when there's already some of the torrent on disk (e.g. from
+// Verify) only the rest gets downloaded. Closing stop (which can be nil) ends it early
+// with ErrStopped
+func (t *Torrent) DownloadTo(w io.WriterAt, have bitfield.Bitfield, stop <-chan struct{}) error {
 	size := float64(t.Length) / (1 << 30)
-	log.Printf("Starting torrent for %s, size %0.2f GB", t.Name, size)
+	t.logger().Printf("Starting torrent for %s, size %0.2f GB", t.Name, size)
 
 	// make a channel with a buffer length of the # of pieces we need to download
 	// and which passes thru the channel, values of type pieceWork and pieceResult respectively
-	workQueue := make(chan *PieceWork, len(t.PieceHash))
+	workQueue := make(chan *PieceWork, t.numPieces())
 	results := make(chan *pieceResult)
 
 	// for each piece we need to download...
-	for idx, pieceHash := range t.PieceHash {
+	for idx := 0; idx < t.numPieces(); idx++ {
+		if have.HasPiece(idx) {
+			continue
+		}
+		// v2 only torrents don't have a SHA1 for the piece, see verifyPiece
+		var pieceHash [20]byte
+		if t.PieceHash != nil {
+			pieceHash = t.PieceHash[idx]
+		}
 		// make new pieceWork struct and put into the workQueue channel
 		// super important to check the bounds for "Length" properly
 		// otherwise we will hang the entire client. Only the last piece
@@ -105,66 +268,190 @@ func (t *Torrent) Download() ([]byte, error) {
 		workQueue <- &newWork
 	}
 
-	// start workers for each of the # of peers available to us
+	// start workers for the peers available to us
 	// this number doesn't need to equal the # of pieces necessarily. It's not
 	// one worker per piece, in fact, bittorrent caps # of peers at 30 usually
-	// so one peer will give you many pieces
-
-	numPieces := len(t.PieceHash)
-	for _, peer := range t.Peers {
-		// log.Printf("Starting goroutine for peer %s", peer.String())
-		go t.startPeer(peer, workQueue, results, numPieces)
+	// so one peer will give you many pieces. The pool takes care of the cap,
+	// and of reconnecting to peers that drop out
+	numPieces := t.numPieces()
+	t.resetStats(numPieces, have)
+	t.bans = newBanTracker(t.logger())
+	// quit tells the peers and web seeds to stop, when we're done or stopped early
+	quit := make(chan struct{})
+	pool := peerpool.New(func(p peers.Peer) error {
+		return t.startPeer(p, workQueue, results, numPieces, quit)
+	}, peerpool.Config{
+		MaxConns: t.MaxConns,
+		Global:   t.ConnLimiter,
+		Private:  t.Private,
+		Log:      t.Log,
+	})
+	t.mu.Lock()
+	t.pool = pool
+	startPeers := t.Peers
+	t.mu.Unlock()
+	pool.Add(peerpool.SourceTracker, startPeers...)
+	t.AddPeersV2(t.PeersV2...)
+	go pool.Run()
+	defer func() {
+		pool.Stop()
+		t.mu.Lock()
+		t.pool = nil
+		t.mu.Unlock()
+	}()
+
+	// web seeds pull off the same work queue as the peers
+	for _, seedURL := range t.WebSeeds {
+		atomic.AddInt32(&t.webSeedsActive, 1)
+		go t.startWebSeed(seedURL, workQueue, results, quit)
 	}
-	numRoutinesStarted := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-	log.Printf("Started %d goroutines total", numRoutinesStarted)
-	log.Printf("There are %d pieces in total", numPieces)
-	// receive pieces from the results channel and stitch together into one big file
-	theFile := make([]byte, t.Length)
+
+	t.logger().Printf("Got %d peers to choose from", len(startPeers)+len(t.PeersV2))
+	t.logger().Printf("There are %d pieces in total", numPieces)
 
 	// keep track of how many pieces have finished
 	donePieces := 0
+	for idx := 0; idx < numPieces; idx++ {
+		if have.HasPiece(idx) {
+			donePieces++
+		}
+	}
+	if donePieces > 0 {
+		t.logger().Printf("Already have %d of them", donePieces)
+	}
+
+	// every so often check that we haven't run out of peers, otherwise we'd wait on results forever
+	peerCheck := time.NewTicker(peerCheckInterval)
+	defer peerCheck.Stop()
 
 	// while not all pieces have been received...
 	for donePieces < numPieces {
 		// sends/receives from channel BLOCK AUTOMATICALLY in go...
-		// so this means we can just write this..
-		pieceRes := <-results
+		// so we just wait for whichever comes first
+		var pieceRes *pieceResult
+		select {
+		case pieceRes = <-results:
+		case <-stop:
+			// the peers put back the pieces they were working on, so the work
+			// queue can't be closed yet. Closing their connections gets them going
+			close(quit)
+			t.closePeers()
+			return ErrStopped
+		case <-peerCheck.C:
+			if pool.Active() == 0 && pool.Candidates() == 0 && atomic.LoadInt32(&t.webSeedsActive) == 0 {
+				// a peer could still turn up between those checks and take a piece,
+				// so stop the workers like Stop does rather than closing the work queue
+				close(quit)
+				t.closePeers()
+				return fmt.Errorf("ran out of peers with %d of %d pieces downloaded", donePieces, numPieces)
+			}
+			continue
+		}
 
-		begin := pieceRes.index * t.PieceLength
-		end := begin + t.PieceLength
-		if end > t.Length {
-			end = t.Length
+		begin := int64(pieceRes.index) * int64(t.PieceLength)
+		contents := pieceRes.contents
+		if end := begin + int64(len(contents)); end > int64(t.Length) {
+			contents = contents[:int64(t.Length)-begin]
+		}
+		// write the piece where it goes in the file(s)
+		_, err := w.WriteAt(contents, begin)
+		if err != nil {
+			close(quit)
+			t.closePeers()
+			return fmt.Errorf("couldn't write piece %d: %w", pieceRes.index, err)
 		}
-		// copy the piece contents into the greater file buffer
-		copy(theFile[begin:end], pieceRes.contents)
+		have.SetPiece(pieceRes.index)
 
 		donePieces++
+		// there's no log line per piece, that's thousands of lines for a big torrent.
+		// Stats has the progress, for whoever wants to show it
+		t.pieceDone(pieceRes.index, len(pieceRes.contents))
+	}
+
+	// the work queue never gets closed, workers send pieces back to it. They're all
+	// waiting on it now that every piece is in, quit gets them to return
+	close(quit)
+	return nil
+}
 
-		// UI stuff
-		percent := (float64(donePieces) / float64(numPieces)) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		log.Printf("(%0.2f%%) Piece #%d downloaded successfully by peer %s, %d peers working", percent, pieceRes.index, pieceRes.peer.String(), numWorkers)
+// AddPeers hands more peers to the download, e.g. from a later tracker announce. If it
+// isn't running they're kept for when it starts. Peers we already know about are
+// ignored, and so are DHT, PEX and LSD peers if the torrent is private
+func (t *Torrent) AddPeers(source peerpool.Source, ps ...peers.Peer) {
+	t.mu.Lock()
+	pool := t.pool
+	if pool == nil && !(t.Private && source.Decentralized()) {
+		t.Peers = append(t.Peers, ps...)
 	}
+	t.mu.Unlock()
+	if pool != nil {
+		pool.Add(source, ps...)
+	}
+}
 
-	close(workQueue)
-	return theFile, nil
+// AddPeersV2 is AddPeers for peers from the v2 swarm of a hybrid torrent, we need to
+// remember they get the v2 info hash in the handshake
+func (t *Torrent) AddPeersV2(ps ...peers.Peer) {
+	if len(ps) == 0 {
+		return
+	}
+	t.mu.Lock()
+	if t.v2Peers == nil {
+		t.v2Peers = make(map[string]bool)
+	}
+	for _, p := range ps {
+		t.v2Peers[p.String()] = true
+	}
+	t.mu.Unlock()
+	t.AddPeers(peerpool.SourceTracker, ps...)
+}
+
+// which info hash to send a peer in the handshake
+func (t *Torrent) infoHashFor(p peers.Peer) [20]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.v2Peers[p.String()] {
+		return t.InfoHashV2
+	}
+	return t.InfoHash
 }
 
 // this function operates on ONE peer and will be invoked many times using goroutines
-func (t *Torrent) startPeer(p peers.Peer, workqueue chan *PieceWork, results chan *pieceResult, numPieces int) {
+// (the peer pool runs it). Returns nil once quit is closed, or an error if the peer
+// couldn't be reached or dropped out, so the pool knows to retry it later
+func (t *Torrent) startPeer(p peers.Peer, workqueue chan *PieceWork, results chan *pieceResult, numPieces int, quit <-chan struct{}) error {
 
 	// create client struct for this specific peer
 	// this actually goes ahead and makes the TCP connection to the peer
-	peerClient, err := client.New(p, t.PeerID, t.InfoHash, numPieces)
+	peerClient, err := client.New(p, t.PeerID, t.infoHashFor(p), numPieces, client.Options{
+		Encryption: t.Encryption,
+		Dial:       t.Dial,
+		V2:         t.PieceHashV2 != nil,
+	})
 	if err != nil {
-		log.Printf("Could not handshake with peer %s. Disconnecting\n", p.String())
-		return
+		t.logger().Printf("Could not handshake with peer %s. Disconnecting\n", p.String())
+		return err
 	}
 
 	// close the connection eventually
 	defer peerClient.Conn.Close()
+
+	// from here on every byte to/from this peer counts towards the rate limits, and the stats
+	peerClient.Conn = ratelimit.NewConn(peerClient.Conn, t.downloadLimiters(), t.uploadLimiters())
+	ap, counted := t.trackPeer(peerClient.Conn, p.String(), peerClient.Choked, peerClient.Bitfield.HasPiece)
+	peerClient.Conn = counted
+	defer t.untrackPeer(ap, peerClient.Bitfield.HasPiece)
 	// log.Printf("Handshake and bitfield received for peer %s successfully", p.String())
 
+	// a peer with the Fast Extension expects Have All, Have None or a bitfield before
+	// anything else (BEP 6). Others can do without, since we don't upload from here
+	if peerClient.SupportsFast {
+		err = t.sendPiecesWeHave(peerClient)
+		if err != nil {
+			return err
+		}
+	}
+
 	// send unchoke and interested message to this peer
 	peerClient.UnchokePeer()
 	peerClient.SendInterestedPeer()
@@ -182,11 +469,27 @@ func (t *Torrent) startPeer(p peers.Peer, workqueue chan *PieceWork, results cha
 	// picked up by another worker (in this case, for example, if a peer gives us a piece
 	// and that piece doesn't match up to our hash, then we want to put that piece back
 	// into the channel, so another worker talking with a different peer can try it)
-	for pieceToGet := range workqueue {
+	for {
+		var pieceToGet *PieceWork
+		select {
+		case pieceToGet = <-workqueue:
+		case <-quit:
+			t.logger().Printf("Peer %s is done", p.String())
+			return nil
+		}
+
+		// with the Fast Extension, we'd rather grab a piece we can download straight away
+		pieceToGet = pickPreferredPiece(peerClient, pieceToGet, workqueue)
+
+		// we might have been banned for corrupt data since the last piece
+		if t.pool.IsBanned(p) {
+			workqueue <- pieceToGet
+			return fmt.Errorf("peer %s is banned, disconnecting", p.String())
+		}
 
 		// check if our peer has this piece
 		if !peerClient.Bitfield.HasPiece(pieceToGet.Index) {
-			log.Println("doesnt have piece", pieceToGet.Index)
+			t.logger().Println("doesnt have piece", pieceToGet.Index)
 			// if it doesnt have this piece, then put this piece back into the queue
 			// for another peer to get and move on to another one
 			workqueue <- pieceToGet
@@ -198,20 +501,34 @@ func (t *Torrent) startPeer(p peers.Peer, workqueue chan *PieceWork, results cha
 		// we know the error was something from the connection
 		// just check the function, none of the errors generated are from
 		// this project.
-		pieceContents, err := tryDownloadPiece(peerClient, pieceToGet)
+		pieceContents, blockPeers, err := tryDownloadPiece(peerClient, ap, pieceToGet, t.downloadLimiters())
+		if err == errPieceRejected {
+			// the peer is fine, it just won't give us this piece, so let someone else try
+			workqueue <- pieceToGet
+			continue
+		}
 		if err != nil {
-			log.Println(err.Error())
+			// when we're being stopped, it's us that closed the connection
+			select {
+			case <-quit:
+			default:
+				t.logger().Println(err.Error())
+			}
 			workqueue <- pieceToGet
-			return
+			return err
 		}
 
 		// verify piece hash
-		isHashGood := verifyPieceHash(pieceContents, pieceToGet.PieceHash[:])
+		isHashGood := t.verifyPiece(pieceToGet, pieceContents)
 		if !isHashGood {
-			log.Printf("Piece #%d failed integrity check, piece came from peer %s\n", pieceToGet.Index, p.String())
+			t.logger().Printf("Piece #%d failed integrity check, piece came from peer %s\n", pieceToGet.Index, p.String())
+			t.emit(Event{Type: PieceFailed, Peer: p.String(), Piece: pieceToGet.Index})
+			t.banPeers(t.bans.pieceFailed(pieceToGet.Index, pieceContents, blockPeers))
 			workqueue <- pieceToGet
 			continue
 		}
+		// if this piece failed before, this good copy tells us who sent the bad blocks
+		t.banPeers(t.bans.piecePassed(pieceToGet.Index, pieceContents))
 
 		// hash looks OK. We now have the piece contents!
 
@@ -222,63 +539,162 @@ func (t *Torrent) startPeer(p peers.Peer, workqueue chan *PieceWork, results cha
 		result := pieceResult{
 			index:    pieceToGet.Index,
 			contents: pieceContents,
-			peer:     p,
+			from:     p.String(),
+		}
+		select {
+		case results <- &result:
+		case <-quit:
+			return nil
 		}
-		results <- &result
 	}
-	numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-	log.Printf("Peer %s is done, %d peers left", p.String(), numWorkers)
+}
+
+// the Fast Extension gives us two hints about which pieces to get from a peer:
+// "allowed fast" pieces we can download even while choked, and "suggested" pieces
+// the peer would like us to get. If the piece we pulled off the queue isn't one of
+// those, look through what's queued for one that is, and put the rest back
+func pickPreferredPiece(c *client.Client, current *PieceWork, workqueue chan *PieceWork) *PieceWork {
+	want := c.Suggested
+	if c.Choked {
+		want = c.AllowedFast
+	}
+	if len(want) == 0 || want[current.Index] {
+		return current
+	}
+	// only look at what's in the queue right now, and never block
+	for n := len(workqueue); n > 0; n-- {
+		var candidate *PieceWork
+		select {
+		case candidate = <-workqueue:
+		default:
+			return current
+		}
+		if want[candidate.Index] && c.Bitfield.HasPiece(candidate.Index) {
+			workqueue <- current
+			return candidate
+		}
+		workqueue <- candidate
+	}
+	return current
+}
+
+// the limiters that downloads for this torrent are subject to
+func (t *Torrent) downloadLimiters() []*ratelimit.Limiter {
+	return []*ratelimit.Limiter{ratelimit.GlobalDownload, t.DownloadLimiter}
+}
+
+func (t *Torrent) uploadLimiters() []*ratelimit.Limiter {
+	return []*ratelimit.Limiter{ratelimit.GlobalUpload, t.UploadLimiter}
+}
+
+// ban the IPs of peers that sent us too much corrupt data. Their workers
+// notice the ban before their next piece and disconnect
+func (t *Torrent) banPeers(toBan []peers.Peer) {
+	for _, p := range toBan {
+		t.logger().Printf("Banning %s for sending corrupt data", p.IP.String())
+		t.pool.BanIP(p.IP)
+	}
+}
+
+// how long a peer gets to send us the next block before we give up on it
+var blockTimeout = 30 * time.Second
+
+// blockTimeout, plus however long the rate limits make us take to read every block
+// we could have asked for. Otherwise a low enough limit times out every peer
+func blockDeadline(limiters []*ratelimit.Limiter) time.Duration {
+	slowest := 0
+	for _, l := range limiters {
+		if r := l.Rate(); r > 0 && (slowest == 0 || r < slowest) {
+			slowest = r
+		}
+	}
+	if slowest == 0 {
+		return blockTimeout
+	}
+	backlog := time.Duration(MaxBacklog*NormalBlockSize) * time.Second / time.Duration(slowest)
+	return blockTimeout + backlog
 }
 
 // this is for downloading a specific PIECE
-func tryDownloadPiece(client *client.Client, piece *PieceWork) ([]byte, error) {
+// also returns which peer sent each block of the piece
+// limiters are only used to decide how many requests to pipeline, the actual
+// limiting happens on the connection itself
+func tryDownloadPiece(client *client.Client, peer *activePeer, piece *PieceWork, limiters []*ratelimit.Limiter) ([]byte, []peers.Peer, error) {
 	// initialize the state of this piece download
 	// this is also where we allocate the byte slice to hold the eventual contents
+	numBlocks := (piece.Length + NormalBlockSize - 1) / NormalBlockSize
 	progress := PieceProgress{
 		Index:         piece.Index,
 		Client:        client,
 		PieceContents: make([]byte, piece.Length),
+		BlockPeers:    make([]peers.Peer, numBlocks),
+		peer:          peer,
 	}
 
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece
-	client.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	// Setting a deadline helps get unresponsive peers unstuck. It's for the next block,
+	// not the whole piece, since under a low download limit a piece can take minutes
+	client.Conn.SetDeadline(time.Now().Add(blockDeadline(limiters)))
 	defer client.Conn.SetDeadline(time.Time{}) // Disable the deadline
 
 	// check if we are done downloading this block
 	for progress.Downloaded < piece.Length {
 		// log.Printf("piece idx %d, downloaded is %d length is %d", piece.Index, progress.Downloaded, piece.Length)
 
+		if progress.Rejects > maxRejects {
+			return nil, nil, errPieceRejected
+		}
+
 		// check if we are choked out by the peer, if we are don't bother sending a request
-		if !progress.Client.Choked {
+		// (unless the peer said this piece is allowed fast, then we can ask while choked)
+		if !progress.Client.Choked || progress.Client.AllowedFast[piece.Index] {
 			// check if we have sent out requests for all the pieces at least
 			// but don't send out any requests if we have sent out too many (backlog > 5)
 			// btw there are no while loops in go, its just a for loop instead :P
-			for progress.Backlog < MaxBacklog && progress.Requested < piece.Length {
+			for progress.Backlog < MaxBacklog && (len(progress.Rejected) > 0 || progress.Requested < piece.Length) {
+				// blocks that got rejected go first, otherwise the next block in the piece
 				// change the blocksize requested if we are on the last block and
 				// its not just the normal blocksize
+				begin := progress.Requested
 				blockSize := NormalBlockSize
-				if piece.Length-progress.Requested < NormalBlockSize {
+				if len(progress.Rejected) > 0 {
+					begin = progress.Rejected[0].begin
+					blockSize = progress.Rejected[0].length
+				} else if piece.Length-progress.Requested < NormalBlockSize {
 					blockSize = piece.Length - progress.Requested
 				}
 
+				// if we're at the download limit, asking for more blocks just means they
+				// pile up in the socket, so only keep one request in flight until there's room
+				if progress.Backlog > 0 && !ratelimit.Allow(blockSize, limiters...) {
+					break
+				}
+
 				// first, send the request for the block
-				err := client.SendRequest(piece.Index, progress.Requested, blockSize)
+				err := client.SendRequest(piece.Index, begin, blockSize)
 				if err != nil {
-					return nil, err
+					return nil, nil, err
 				}
 
 				// update the number of requests we have sent out
 				progress.Backlog++
 
 				// update the position that we need to request next
-				progress.Requested += blockSize
+				if len(progress.Rejected) > 0 {
+					progress.Rejected = progress.Rejected[1:]
+				} else {
+					progress.Requested += blockSize
+				}
 			}
 		}
 		// ok so at this point we've sent out requests, check if anything came in back from peer
+		before := progress.Downloaded
 		err := progress.tryReadBlock()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		// a block came in, so the peer's alive: give it until the next one
+		if progress.Downloaded > before {
+			client.Conn.SetDeadline(time.Now().Add(blockDeadline(limiters)))
 		}
 	}
 
@@ -286,7 +702,7 @@ func tryDownloadPiece(client *client.Client, piece *PieceWork) ([]byte, error) {
 	// return the contents of the piece!
 	// log.Println("done")
 
-	return progress.PieceContents, nil
+	return progress.PieceContents, progress.BlockPeers, nil
 }
 
 // we define this on PieceProgress because we wanna directly change the downloaded field
@@ -301,6 +717,13 @@ func (p *PieceProgress) tryReadBlock() error {
 		return nil
 	}
 
+	// turn the raw message into one of the typed ones. This is also where a
+	// malformed message (e.g. a Have with no index in it) gets caught
+	typed, err := message.Parse(msg)
+	if err != nil {
+		return err
+	}
+
 	// log.Printf("message ID %d", msg.ID)
 	// check what kind of message it is
 	switch msg.ID {
@@ -311,25 +734,109 @@ func (p *PieceProgress) tryReadBlock() error {
 			return err
 		}
 		p.Downloaded += bytesCopied
-		p.Backlog--
+		// a peer could send us blocks we never asked for, don't let that
+		// trick us into sending more requests than MaxBacklog
+		if p.Backlog > 0 {
+			p.Backlog--
+		}
+		// remember who sent this block
+		begin := typed.(*message.PieceMessage).Begin
+		if blockIdx := begin / NormalBlockSize; blockIdx < len(p.BlockPeers) {
+			p.BlockPeers[blockIdx] = p.Client.Peer()
+		}
 	case message.Choke:
 		// we've been choked by peer :(
 		p.Client.Choked = true
+		if p.peer != nil {
+			p.peer.setChoked(true)
+		}
 	case message.Unchoke:
 		p.Client.Choked = false
+		if p.peer != nil {
+			p.peer.setChoked(false)
+		}
 	case message.Have:
 		// peer can send us "have" messages which tell us which pieces it has
 		// this is an alternative to the bitfield message. But we should be ready
 		// to receive them if they come
 
 		// get the index in question
-		index := message.ParseHave(msg)
+		index := typed.(*message.HaveMessage).Index
 		// set the bitfield such that it now marks the piece as owned for this peer
+		if !p.Client.Bitfield.HasPiece(index) && p.peer != nil {
+			p.peer.gotPiece(index)
+		}
 		p.Client.Bitfield.SetPiece(index)
+	case message.RejectRequest:
+		// the peer won't send a block we asked for (e.g. because it just choked us).
+		// instead of waiting for the deadline, free the slot and ask again later
+		// only take it if it's a block we actually asked for, otherwise a peer could
+		// make us request any old range
+		reject := typed.(*message.RejectMessage)
+		if reject.Index == p.Index && reject.Begin < p.Requested && reject.Length > 0 &&
+			reject.Length <= NormalBlockSize && reject.Begin+reject.Length <= len(p.PieceContents) {
+			p.Rejected = append(p.Rejected, blockRequest{begin: reject.Begin, length: reject.Length})
+			if p.Backlog > 0 {
+				p.Backlog--
+			}
+			p.Rejects++
+		}
+	case message.AllowedFast:
+		p.Client.AddAllowedFast(typed.(*message.AllowedFastMessage).Index)
+	case message.SuggestPiece:
+		p.Client.AddSuggested(typed.(*message.SuggestMessage).Index)
+	case message.Request:
+		// we don't upload yet, so if the peer supports it, tell it right away
+		// that it's not getting the block instead of leaving it hanging
+		if p.Client.SupportsFast {
+			req := typed.(*message.RequestMessage)
+			p.Client.SendReject(req.Index, req.Begin, req.Length)
+		}
 	}
 	return nil
 }
 
+// VerifyPiece checks the contents of piece index against the torrent's hashes,
+// e.g. for checking files that are already on disk
+func (t *Torrent) VerifyPiece(index int, pieceContents []byte) bool {
+	if index < 0 || index >= t.numPieces() || len(pieceContents) != t.calculatePieceSize(index) {
+		return false
+	}
+	piece := &PieceWork{Index: index, Length: len(pieceContents)}
+	if t.PieceHash != nil {
+		piece.PieceHash = t.PieceHash[index]
+	}
+	return t.verifyPiece(piece, pieceContents)
+}
+
+// NumPieces is how many pieces the torrent has
+func (t *Torrent) NumPieces() int {
+	return t.numPieces()
+}
+
+// PieceSize is how long piece index is. Usually PieceLength, but the last one is shorter
+// (and for v2 torrents, the last piece of every file)
+func (t *Torrent) PieceSize(index int) int {
+	return t.calculatePieceSize(index)
+}
+
+// check a piece against every hash we have for it: SHA1 for v1, the merkle hash for v2
+func (t *Torrent) verifyPiece(piece *PieceWork, pieceContents []byte) bool {
+	if t.PieceHash != nil && !verifyPieceHash(pieceContents, piece.PieceHash[:]) {
+		return false
+	}
+	if piece.Index < len(t.PieceHashV2) {
+		v2 := t.PieceHashV2[piece.Index]
+		if v2.DataLength > len(pieceContents) {
+			return false
+		}
+		if merkle.PieceRoot(pieceContents[:v2.DataLength], v2.Leaves) != v2.Root {
+			return false
+		}
+	}
+	return true
+}
+
 func verifyPieceHash(pieceContents []byte, correctHashForThisPiece []byte) bool {
 	hash := sha1.Sum(pieceContents)
 
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"bytes"
+	"main/bitfield"
+	"main/client"
+	"main/internal/testutil"
+	"main/message"
+	"main/ratelimit"
+	"net"
+	"testing"
+	"time"
+)
+
+// a peer on the other end of conn that has data and answers every request for it
+func servePieces(t *testing.T, conn net.Conn, index int, data []byte) {
+	t.Helper()
+	go func() {
+		for {
+			msg, err := message.Read(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != message.Request {
+				continue
+			}
+			req := message.RequestMessage{}
+			if req.Unmarshal(msg) != nil || req.Index != index {
+				return
+			}
+			piece, _ := (&message.PieceMessage{Index: index, Begin: req.Begin, Block: data[req.Begin : req.Begin+req.Length]}).Marshal()
+			_, err = conn.Write(piece.MessageToByteSlice())
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// a client for our end of the connection, to a peer that has every piece and isn't choking us
+func testClient(conn net.Conn, numPieces int) *client.Client {
+	bf := bitfield.New(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+	return &client.Client{Conn: conn, Bitfield: bf, AllowedFast: map[int]bool{}, Suggested: map[int]bool{}}
+}
+
+// with a download limit the piece takes longer than blockTimeout, but every block comes
+// in well before the next one's due, so it has to finish
+func TestSlowLimitStillFinishesPiece(t *testing.T) {
+	defer func(d time.Duration) { blockTimeout = d }(blockTimeout)
+	blockTimeout = 300 * time.Millisecond
+
+	ours, theirs := testutil.Loopback(t)
+	data := bytes.Repeat([]byte("slow"), 4*NormalBlockSize)
+	servePieces(t, theirs, 0, data)
+
+	// 4 blocks a second, so a bit under 4 seconds for the piece after the first second's burst
+	limiter := ratelimit.NewLimiter(4 * NormalBlockSize)
+	limiters := []*ratelimit.Limiter{limiter}
+	c := testClient(ratelimit.NewConn(ours, limiters, nil), 1)
+
+	start := time.Now()
+	got, _, err := tryDownloadPiece(c, nil, &PieceWork{Index: 0, Length: len(data)}, limiters)
+	if err != nil {
+		t.Fatalf("piece didn't finish after %s: %s", time.Since(start), err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got the wrong piece back")
+	}
+	if took := time.Since(start); took < blockTimeout {
+		t.Fatalf("took %s, the limit isn't slowing it down enough to test anything", took)
+	}
+}
+
+func TestBlockDeadline(t *testing.T) {
+	if d := blockDeadline(nil); d != blockTimeout {
+		t.Fatalf("no limit: got %s, want %s", d, blockTimeout)
+	}
+	unlimited := ratelimit.NewLimiter(0)
+	if d := blockDeadline([]*ratelimit.Limiter{unlimited}); d != blockTimeout {
+		t.Fatalf("0 limit: got %s, want %s", d, blockTimeout)
+	}
+	// 8 KB/s: 5 blocks of 16 KiB take 10 seconds on top
+	slow := ratelimit.NewLimiter(8192)
+	want := blockTimeout + 10*time.Second
+	if d := blockDeadline([]*ratelimit.Limiter{unlimited, slow}); d != want {
+		t.Fatalf("8 KB/s: got %s, want %s", d, want)
+	}
+}
+
+// the first thing a peer hears from us after the handshake
+func TestSendPiecesWeHave(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		fast bool
+		have []int
+		want uint8
+	}{
+		{"fast, nothing", true, nil, message.HaveNone},
+		{"fast, everything", true, []int{0, 1, 2}, message.HaveAll},
+		{"fast, some", true, []int{1}, message.Bitfield},
+		{"no fast, nothing", false, nil, message.Bitfield},
+		{"no fast, everything", false, []int{0, 1, 2}, message.Bitfield},
+	} {
+		tor := &Torrent{PieceHash: make([][20]byte, 3), PieceLength: 16, Length: 40}
+		have := bitfield.New(3)
+		for _, i := range c.have {
+			have.SetPiece(i)
+		}
+		tor.SetHave(have)
+
+		ours, theirs := testutil.Loopback(t)
+		peer := testClient(ours, 3)
+		peer.SupportsFast = c.fast
+		err := tor.sendPiecesWeHave(peer)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		msg, err := message.Read(theirs)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if msg.ID != c.want {
+			t.Fatalf("%s: sent message %d, want %d", c.name, msg.ID, c.want)
+		}
+		if msg.ID != message.Bitfield {
+			continue
+		}
+		for i := 0; i < 3; i++ {
+			if bitfield.Bitfield(msg.Payload).HasPiece(i) != have.HasPiece(i) {
+				t.Fatalf("%s: bitfield has piece %d wrong", c.name, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"main/bencode"
+	"main/bitfield"
+	"main/client"
+	"main/message"
+	"main/metadata"
+	"main/mse"
+	"main/peerpool"
+	"main/ratelimit"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// seeding is the other half of bittorrent: peers connect to us, we tell them which
+// pieces we have, and send them blocks when they ask. We don't have any fancy choking
+// algorithm, the first few interested peers get unchoked and everyone else waits for a
+// slot to free up. With the Fast Extension the ones waiting get their requests rejected
+// straight away instead of being left hanging
+
+// how many peers we upload to at once
+const uploadSlots = 8
+
+// the biggest block we'll send in one piece message. Everyone asks for 16KB blocks,
+// but some clients go up to 128KB
+const maxRequestLength = 128 * 1024
+
+// peers send a keep-alive every two minutes, so a peer that's quiet for longer is gone
+const seedIdleTimeout = 3 * time.Minute
+
+// what we need to keep track of while we're uploading
+type seeder struct {
+	t    *Torrent
+	data io.ReaderAt
+
+	mu       sync.Mutex
+	unchoked int
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+// Seed uploads to peers that connect on the listeners, until stop is closed. data is the
+// torrent's stream of bytes (what the pieces are cut out of), and have says which pieces
+// are in it. Each listener is usually one TCP and one uTP socket on the same port
+func (t *Torrent) Seed(listeners []net.Listener, data io.ReaderAt, have bitfield.Bitfield, stop <-chan struct{}) error {
+	if len(listeners) == 0 {
+		return fmt.Errorf("nothing to listen on")
+	}
+	t.resetStats(t.numPieces(), have)
+	t.StartServing(data)
+	defer t.StopServing()
+	return t.AcceptPeers(listeners, stop)
+}
+
+// AcceptPeers takes the peers that connect on the listeners and hands the ones that
+// want this torrent to ServePeer, until stop is closed. It closes the listeners when
+// it returns
+func (t *Torrent) AcceptPeers(listeners []net.Listener, stop <-chan struct{}) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					errs <- err
+					return
+				}
+				go t.serve(conn)
+			}
+		}(l)
+	}
+
+	var err error
+	select {
+	case <-stop:
+	case err = <-errs:
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return err
+}
+
+// StartServing lets peers download the pieces we have from us, with ServePeer. data is
+// the torrent's stream of bytes. Seed does this itself, it's for when something else
+// (like a session with many torrents on one port) takes the connections
+func (t *Torrent) StartServing(data io.ReaderAt) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.serving == nil {
+		t.serving = &seeder{t: t, data: data, conns: make(map[net.Conn]bool)}
+	}
+}
+
+// StopServing hangs up on everyone we're uploading to, and turns away anyone new
+func (t *Torrent) StopServing() {
+	t.mu.Lock()
+	s := t.serving
+	t.serving = nil
+	t.mu.Unlock()
+	if s != nil {
+		s.closeAll()
+	}
+}
+
+// ServePeer uploads to a peer that connected to us and asked for this torrent, so
+// client.Accept has already been done. It returns when the peer or we hang up, and
+// straight away if we're not serving
+func (t *Torrent) ServePeer(c *client.Client) {
+	defer c.Conn.Close()
+	t.mu.Lock()
+	s := t.serving
+	t.mu.Unlock()
+	maxConns := t.MaxConns
+	if maxConns <= 0 {
+		maxConns = peerpool.DefaultTorrentConns
+	}
+	if s == nil || !s.track(c.Conn, maxConns) {
+		return
+	}
+	defer s.untrack(c.Conn)
+
+	peerName := c.Conn.RemoteAddr().String()
+	// the rate limits and the stats count this peer as well
+	c.Conn = ratelimit.NewConn(c.Conn, t.downloadLimiters(), t.uploadLimiters())
+	ap, counted := t.trackPeer(c.Conn, peerName, false, func(int) bool { return false })
+	c.Conn = counted
+	defer t.untrackPeer(ap, func(int) bool { return false })
+	t.logger().Printf("Peer %s connected", peerName)
+
+	err := s.servePeer(c)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		t.logger().Printf("Peer %s: %s", peerName, err.Error())
+	}
+	t.logger().Printf("Peer %s disconnected", peerName)
+}
+
+// Uploaded is how many bytes of pieces we've sent to peers so far
+func (t *Torrent) Uploaded() int64 {
+	return atomic.LoadInt64(&t.uploaded)
+}
+
+// remember a new connection, unless we're full or shutting down
+func (s *seeder) track(conn net.Conn, maxConns int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.conns) >= maxConns {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *seeder) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+func (s *seeder) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// try to get an upload slot
+func (s *seeder) takeSlot() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unchoked >= uploadSlots {
+		return false
+	}
+	s.unchoked++
+	return true
+}
+
+func (s *seeder) freeSlot() {
+	s.mu.Lock()
+	s.unchoked--
+	s.mu.Unlock()
+}
+
+// InfoHashes are the info hashes peers can ask us for this torrent by: both of them
+// for a hybrid torrent
+func (t *Torrent) InfoHashes() [][20]byte {
+	hashes := [][20]byte{t.InfoHash}
+	if t.InfoHashV2 != [20]byte{} && t.InfoHashV2 != t.InfoHash {
+		hashes = append(hashes, t.InfoHashV2)
+	}
+	return hashes
+}
+
+// whether to set the v2 bit when we answer a handshake for this torrent
+func (t *Torrent) isV2() bool {
+	return t.PieceHashV2 != nil
+}
+
+// do the handshakes with one peer that connected to our listeners, then serve it
+func (t *Torrent) serve(conn net.Conn) {
+	// encrypted or not, the peer decides, and our policy says what we put up with
+	wrapped, _, err := mse.Accept(conn, t.InfoHashes(), t.Encryption)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	c, err := client.Accept(wrapped, t.PeerID, func(h [20]byte) (bool, bool) {
+		for _, ours := range t.InfoHashes() {
+			if h == ours {
+				return true, t.isV2()
+			}
+		}
+		return false, false
+	})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	t.ServePeer(c)
+}
+
+// one peer we're seeding to. Its messages get handled on one goroutine, but waiting
+// for an upload slot happens on another, so everything we send goes through mu
+type seedPeer struct {
+	c *client.Client
+
+	mu         sync.Mutex
+	interested bool
+	unchoked   bool
+	// the ID the peer wants its ut_metadata messages sent with, 0 until it tells us
+	metadataID int
+}
+
+func (p *seedPeer) send(m message.Typed) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.c.Send(m)
+}
+
+// tell a peer what we have, right after the handshake. A peer with the Fast Extension
+// gets the short version if we have everything or nothing, and BEP 6 says it has to get
+// one of the three as the first message
+func (t *Torrent) sendPiecesWeHave(c *client.Client) error {
+	numPieces := t.numPieces()
+	have := bitfield.New(numPieces)
+	count := 0
+	for i := 0; i < numPieces; i++ {
+		if t.hasPiece(i) {
+			have.SetPiece(i)
+			count++
+		}
+	}
+	switch {
+	case c.SupportsFast && count == numPieces:
+		return c.SendHaveAll()
+	case c.SupportsFast && count == 0:
+		return c.SendHaveNone()
+	}
+	return c.Send(&message.BitfieldMessage{Bitfield: have})
+}
+
+// how often a peer that's waiting for an upload slot checks if one has come free
+const slotCheckInterval = 5 * time.Second
+
+func (s *seeder) servePeer(c *client.Client) error {
+	p := &seedPeer{c: c}
+
+	err := s.t.sendPiecesWeHave(c)
+	if err != nil {
+		return err
+	}
+	if c.SupportsExtensions && s.t.InfoBytes != nil {
+		hs, err := metadata.Handshake(len(s.t.InfoBytes))
+		if err != nil {
+			return err
+		}
+		err = c.Send(&message.ExtendedMessage{ExtendedID: 0, Payload: hs})
+		if err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.waitForSlot(p, done)
+	defer func() {
+		p.mu.Lock()
+		if p.unchoked {
+			s.freeSlot()
+		}
+		p.mu.Unlock()
+	}()
+
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(seedIdleTimeout))
+		msg, err := c.Read()
+		if err != nil {
+			return err
+		}
+		typed, err := message.Parse(msg)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case message.Interested:
+			p.mu.Lock()
+			p.interested = true
+			if !p.unchoked && s.takeSlot() {
+				p.unchoked = true
+				err = c.UnchokePeer()
+			}
+			p.mu.Unlock()
+		case message.Notinterested:
+			p.mu.Lock()
+			p.interested = false
+			if p.unchoked {
+				p.unchoked = false
+				s.freeSlot()
+				err = c.SendChoke()
+			}
+			p.mu.Unlock()
+		case message.Request:
+			err = s.serveRequest(p, typed.(*message.RequestMessage))
+		case message.Extended:
+			err = s.serveExtended(p, typed.(*message.ExtendedMessage))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// a peer that's interested but didn't get a slot keeps checking until one frees up
+func (s *seeder) waitForSlot(p *seedPeer, done <-chan struct{}) {
+	ticker := time.NewTicker(slotCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		if p.interested && !p.unchoked && s.takeSlot() {
+			p.unchoked = true
+			p.c.UnchokePeer()
+		}
+		p.mu.Unlock()
+	}
+}
+
+// send the block a peer asked for, or turn it down
+func (s *seeder) serveRequest(p *seedPeer, req *message.RequestMessage) error {
+	p.mu.Lock()
+	unchoked := p.unchoked
+	p.mu.Unlock()
+
+	// the fields are 32 bit unsigned on the wire, but that's negative in an int on 32 bit machines
+	ok := unchoked && req.Index >= 0 && req.Index < s.t.numPieces() && s.t.hasPiece(req.Index) &&
+		req.Begin >= 0 && req.Length > 0 && req.Length <= maxRequestLength &&
+		req.Begin+req.Length <= s.t.calculatePieceSize(req.Index)
+	if !ok {
+		// without the Fast Extension there's no way to say no, the peer just never gets it
+		if p.c.SupportsFast {
+			return p.send(&message.RejectMessage{Index: req.Index, Begin: req.Begin, Length: req.Length})
+		}
+		// asking while choked is allowed (the choke might not have reached it yet),
+		// but asking for something that doesn't exist isn't
+		if unchoked {
+			return fmt.Errorf("peer asked for %d bytes at %d of piece %d, which we can't give it", req.Length, req.Begin, req.Index)
+		}
+		return nil
+	}
+
+	block := make([]byte, req.Length)
+	_, err := s.data.ReadAt(block, int64(req.Index)*int64(s.t.PieceLength)+int64(req.Begin))
+	if err != nil {
+		return fmt.Errorf("couldn't read piece %d: %w", req.Index, err)
+	}
+	err = p.send(&message.PieceMessage{Index: req.Index, Begin: req.Begin, Block: block})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.t.uploaded, int64(req.Length))
+	return nil
+}
+
+// extension protocol messages: the peer's handshake, and metadata requests
+func (s *seeder) serveExtended(p *seedPeer, ext *message.ExtendedMessage) error {
+	if ext.ExtendedID == 0 {
+		hs := metadata.ExtensionHandshake{}
+		err := bencode.Unmarshal(ext.Payload, &hs)
+		if err != nil {
+			return err
+		}
+		if id, ok := hs.M[metadata.ExtensionName]; ok && id >= 0 && id <= 255 {
+			p.metadataID = id
+		}
+		return nil
+	}
+	if ext.ExtendedID != metadata.LocalID || p.metadataID == 0 || s.t.InfoBytes == nil {
+		return nil
+	}
+	reply, err := metadata.Respond(s.t.InfoBytes, ext.Payload)
+	if err != nil || reply == nil {
+		return err
+	}
+	return p.send(&message.ExtendedMessage{ExtendedID: uint8(p.metadataID), Payload: reply})
+}
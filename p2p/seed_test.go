@@ -0,0 +1,201 @@
+package p2p
+
+import (
+	"bytes"
+	"main/bitfield"
+	"main/client"
+	"main/internal/testutil"
+	"main/message"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a torrent of 2.5 pieces of 256 bytes, where we have the first and the last piece
+func seedTorrent() (*Torrent, []byte) {
+	data := make([]byte, 640)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	tor := quietTorrent(&Torrent{Name: "file", PieceHash: make([][20]byte, 3), PieceLength: 256, Length: len(data)})
+	have := bitfield.New(3)
+	have.SetPiece(0)
+	have.SetPiece(2)
+	tor.resetStats(3, have)
+	tor.StartServing(bytes.NewReader(data))
+	return tor, data
+}
+
+// the next message the peer gets from us, parsed
+func readTyped(t *testing.T, conn net.Conn) (uint8, message.Typed) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := message.Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg == nil {
+		t.Fatal("got a keep-alive")
+	}
+	typed, err := message.Parse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.ID, typed
+}
+
+func TestServeRequest(t *testing.T) {
+	tor, data := seedTorrent()
+	bad := []message.RequestMessage{
+		// a piece we don't have, or that doesn't exist
+		{Index: 1, Begin: 0, Length: 16},
+		{Index: 3, Begin: 0, Length: 16},
+		// past the end of a piece, and of the short last piece
+		{Index: 0, Begin: 250, Length: 16},
+		{Index: 2, Begin: 100, Length: 100},
+		{Index: 0, Begin: 0, Length: 0},
+		{Index: 0, Begin: 0, Length: maxRequestLength + 1},
+	}
+
+	for _, fast := range []bool{false, true} {
+		ours, theirs := testutil.Loopback(t)
+		p := &seedPeer{c: &client.Client{Conn: ours, SupportsFast: fast}, unchoked: true}
+		for _, req := range bad {
+			req := req
+			err := tor.serving.serveRequest(p, &req)
+			if !fast {
+				// there's no way to say no, so the peer gets hung up on
+				if err == nil || !strings.Contains(err.Error(), "which we can't give it") {
+					t.Fatalf("%+v: got %v, want an error", req, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%+v: %s", req, err)
+			}
+			id, typed := readTyped(t, theirs)
+			if id != message.RejectRequest || *typed.(*message.RejectMessage) != message.RejectMessage(req) {
+				t.Fatalf("%+v: got message %d %+v, want it rejected", req, id, typed)
+			}
+		}
+
+		// negative numbers can't even be put in a reject, so the peer gets hung up on
+		for _, req := range []message.RequestMessage{{Index: -1, Begin: 0, Length: 16}, {Index: 0, Begin: -16, Length: 32}} {
+			req := req
+			if err := tor.serving.serveRequest(p, &req); err == nil {
+				t.Fatalf("%+v: no error", req)
+			}
+		}
+
+		// and the ones we can answer, including the end of the last piece
+		uploaded := tor.Uploaded()
+		for _, req := range []message.RequestMessage{{Index: 0, Begin: 16, Length: 32}, {Index: 2, Begin: 100, Length: 28}} {
+			req := req
+			err := tor.serving.serveRequest(p, &req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, typed := readTyped(t, theirs)
+			begin := req.Index*256 + req.Begin
+			want := message.PieceMessage{Index: req.Index, Begin: req.Begin, Block: data[begin : begin+req.Length]}
+			if got, ok := typed.(*message.PieceMessage); id != message.Piece || !ok || got.Index != want.Index || got.Begin != want.Begin || !bytes.Equal(got.Block, want.Block) {
+				t.Fatalf("%+v: got message %d %+v", req, id, typed)
+			}
+		}
+		if got := tor.Uploaded() - uploaded; got != 60 {
+			t.Fatalf("counted %d bytes uploaded, want 60", got)
+		}
+	}
+}
+
+// asking while choked isn't the peer's fault, the choke might still be on its way
+func TestServeRequestChoked(t *testing.T) {
+	tor, _ := seedTorrent()
+	req := message.RequestMessage{Index: 0, Begin: 0, Length: 16}
+
+	ours, theirs := testutil.Loopback(t)
+	p := &seedPeer{c: &client.Client{Conn: ours}}
+	err := tor.serving.serveRequest(p, &req)
+	if err != nil {
+		t.Fatalf("choked peer without the Fast Extension: %s", err)
+	}
+	// nothing gets sent, so the next thing the peer sees is the answer once it's unchoked
+	p.unchoked = true
+	err = tor.serving.serveRequest(p, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := readTyped(t, theirs); id != message.Piece {
+		t.Fatalf("got message %d, the choked request should have been dropped", id)
+	}
+
+	ours, theirs = testutil.Loopback(t)
+	p = &seedPeer{c: &client.Client{Conn: ours, SupportsFast: true}}
+	err = tor.serving.serveRequest(p, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := readTyped(t, theirs); id != message.RejectRequest {
+		t.Fatalf("got message %d, want the choked request rejected", id)
+	}
+}
+
+// a peer that's interested gets unchoked, one that isn't anymore gets choked again
+func TestServePeerChoking(t *testing.T) {
+	tor, data := seedTorrent()
+	ours, theirs := testutil.Loopback(t)
+	done := make(chan struct{})
+	go func() {
+		tor.ServePeer(&client.Client{Conn: ours, SupportsFast: true})
+		close(done)
+	}()
+	// the other end, as the peer sees it
+	peer := &client.Client{Conn: theirs}
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want uint8) message.Typed {
+		t.Helper()
+		id, typed := readTyped(t, theirs)
+		if id != want {
+			t.Fatalf("got message %d, want %d", id, want)
+		}
+		return typed
+	}
+
+	// we have some pieces, so a bitfield
+	if got := expect(message.Bitfield).(*message.BitfieldMessage).Bitfield; !got.HasPiece(0) || got.HasPiece(1) || !got.HasPiece(2) {
+		t.Fatal("wrong bitfield")
+	}
+	check(peer.SendRequest(2, 0, 16))
+	expect(message.RejectRequest)
+
+	check(peer.SendInterestedPeer())
+	expect(message.Unchoke)
+	check(peer.SendRequest(2, 0, 16))
+	if got := expect(message.Piece).(*message.PieceMessage); !bytes.Equal(got.Block, data[512:528]) {
+		t.Fatal("wrong block")
+	}
+
+	check(peer.SendUnInterestedPeer())
+	expect(message.Choke)
+	check(peer.SendRequest(2, 0, 16))
+	expect(message.RejectRequest)
+	tor.serving.mu.Lock()
+	slots := tor.serving.unchoked
+	tor.serving.mu.Unlock()
+	if slots != 0 {
+		t.Fatalf("%d upload slots still taken after the peer was choked", slots)
+	}
+
+	tor.StopServing()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServePeer didn't return after StopServing")
+	}
+}
@@ -0,0 +1,131 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"log"
+	"main/peers"
+	"sync"
+)
+
+// MaxStrikes is how many corrupt pieces an IP can send us before we ban it.
+// Hash failures do happen by accident sometimes, so one strike isn't enough
+const MaxStrikes = 3
+
+// remembers one block of a piece that failed its hash check, and who sent it
+type blockOrigin struct {
+	peer peers.Peer
+	hash [20]byte
+}
+
+// banTracker figures out which peers are sending us bad data.
+// If a failed piece came entirely from one peer, it's obviously that peer's fault.
+// If several peers contributed blocks, we can't tell who it was yet, so we remember
+// a hash of every block. Once the piece eventually passes, whoever sent a block that
+// doesn't match the good copy is the culprit (this is what other clients call "smart ban").
+// Right now tryDownloadPiece gets every block of a piece from the one peer, so it's
+// always the first case. The second is for when pieces get split between peers (e.g.
+// endgame mode), which is why blockPeers is per block
+type banTracker struct {
+	mu sync.Mutex
+	// per IP, since a bad peer can easily reconnect on a different port
+	strikes map[string]int
+	// piece index -> the blocks from the failed attempts, keyed by block offset
+	failed map[int]map[int][]blockOrigin
+	log    *log.Logger
+}
+
+func newBanTracker(logger *log.Logger) *banTracker {
+	return &banTracker{
+		log:     logger,
+		strikes: make(map[string]int),
+		failed:  make(map[int]map[int][]blockOrigin),
+	}
+}
+
+// record a piece that failed its hash check. blockPeers[i] is the peer that sent block i
+// Returns the peers that just crossed the strike threshold and should be banned
+func (b *banTracker) pieceFailed(index int, contents []byte, blockPeers []peers.Peer) []peers.Peer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// did a single IP send every block?
+	single := true
+	for _, p := range blockPeers {
+		if !p.IP.Equal(blockPeers[0].IP) {
+			single = false
+			break
+		}
+	}
+	if single && len(blockPeers) > 0 {
+		return b.strike(blockPeers[0])
+	}
+
+	// several peers (which doesn't happen yet, see banTracker), save the block hashes so
+	// we can compare once we get a good copy
+	blocks, ok := b.failed[index]
+	if !ok {
+		blocks = make(map[int][]blockOrigin)
+		b.failed[index] = blocks
+	}
+	for i, p := range blockPeers {
+		begin, end := blockBounds(i, len(contents))
+		blocks[begin] = append(blocks[begin], blockOrigin{
+			peer: p,
+			hash: sha1.Sum(contents[begin:end]),
+		})
+	}
+	return nil
+}
+
+// record a piece that passed its hash check. If this piece failed before, anyone who
+// sent us a block that differs from this (known good) copy gets a strike
+func (b *banTracker) piecePassed(index int, contents []byte) []peers.Peer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	blocks, ok := b.failed[index]
+	if !ok {
+		return nil
+	}
+	delete(b.failed, index)
+
+	var toBan []peers.Peer
+	for begin, origins := range blocks {
+		end := begin + NormalBlockSize
+		if end > len(contents) {
+			end = len(contents)
+		}
+		if begin >= end {
+			continue
+		}
+		goodHash := sha1.Sum(contents[begin:end])
+		for _, origin := range origins {
+			if origin.hash != goodHash {
+				toBan = append(toBan, b.strike(origin.peer)...)
+			}
+		}
+	}
+	return toBan
+}
+
+// give an IP a strike, returns the peer if that was one strike too many
+// expects b.mu to be held
+func (b *banTracker) strike(p peers.Peer) []peers.Peer {
+	ip := p.IP.String()
+	b.strikes[ip]++
+	b.log.Printf("Peer %s sent us corrupt data, %d/%d strikes", p.String(), b.strikes[ip], MaxStrikes)
+	if b.strikes[ip] == MaxStrikes {
+		return []peers.Peer{p}
+	}
+	return nil
+}
+
+// start and end offsets of the ith block in a piece of this length
+func blockBounds(i int, pieceLength int) (begin int, end int) {
+	begin = i * NormalBlockSize
+	end = begin + NormalBlockSize
+	if end > pieceLength {
+		end = pieceLength
+	}
+	return begin, end
+}
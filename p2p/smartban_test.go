@@ -0,0 +1,79 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"main/peers"
+	"net"
+	"testing"
+)
+
+func quietBans() *banTracker {
+	return newBanTracker(log.New(io.Discard, "", 0))
+}
+
+func testPeer(ip string, port uint16) peers.Peer {
+	return peers.Peer{IP: net.ParseIP(ip), Port: port}
+}
+
+// every block from one peer, which is how tryDownloadPiece gets pieces: it's that
+// peer's fault straight away, and MaxStrikes of them gets its IP banned
+func TestSinglePeerStrikes(t *testing.T) {
+	b := quietBans()
+	contents := make([]byte, 2*NormalBlockSize)
+	bad := testPeer("10.0.0.1", 6881)
+	for i := 1; i < MaxStrikes; i++ {
+		if banned := b.pieceFailed(i, contents, []peers.Peer{bad, bad}); len(banned) != 0 {
+			t.Fatalf("banned after %d strikes", i)
+		}
+	}
+	// a different port is still the same IP
+	banned := b.pieceFailed(MaxStrikes, contents, []peers.Peer{testPeer("10.0.0.1", 7000)})
+	if len(banned) != 1 || !banned[0].IP.Equal(bad.IP) {
+		t.Fatalf("wanted %s banned after %d strikes, got %v", bad.IP, MaxStrikes, banned)
+	}
+	// and it only gets returned the once
+	if banned := b.pieceFailed(0, contents, []peers.Peer{bad}); len(banned) != 0 {
+		t.Fatalf("banned again: %v", banned)
+	}
+	if len(b.failed) != 0 {
+		t.Fatalf("single peer failures shouldn't be kept for later, have %d", len(b.failed))
+	}
+}
+
+func TestSinglePeerStrikesArePerIP(t *testing.T) {
+	b := quietBans()
+	contents := make([]byte, NormalBlockSize)
+	for i := 0; i < MaxStrikes; i++ {
+		ip := net.IPv4(10, 0, 0, byte(i+1)).String()
+		if banned := b.pieceFailed(0, contents, []peers.Peer{testPeer(ip, 6881)}); len(banned) != 0 {
+			t.Fatalf("%s banned after one strike", ip)
+		}
+	}
+}
+
+// blocks from two peers: nobody's blamed until a good copy shows who sent the bad block
+func TestSeveralPeersBlamedOnceGood(t *testing.T) {
+	b := quietBans()
+	good := bytes.Repeat([]byte{1}, 2*NormalBlockSize)
+	honest, liar := testPeer("10.0.0.1", 6881), testPeer("10.0.0.2", 6881)
+
+	for i := 0; i < MaxStrikes; i++ {
+		bad := append([]byte(nil), good...)
+		bad[NormalBlockSize] = 2
+		if banned := b.pieceFailed(i, bad, []peers.Peer{honest, liar}); len(banned) != 0 {
+			t.Fatalf("banned before there was a good copy: %v", banned)
+		}
+	}
+	var banned []peers.Peer
+	for i := 0; i < MaxStrikes; i++ {
+		banned = append(banned, b.piecePassed(i, good)...)
+	}
+	if len(banned) != 1 || !banned[0].IP.Equal(liar.IP) {
+		t.Fatalf("wanted just %s banned, got %v", liar.IP, banned)
+	}
+	if b.strikes[honest.IP.String()] != 0 {
+		t.Fatalf("%s sent good blocks but has %d strikes", honest.IP, b.strikes[honest.IP.String()])
+	}
+}
@@ -0,0 +1,213 @@
+package p2p
+
+import (
+	"main/bitfield"
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of how a download is going, for showing progress. Rates aren't
+// in here, take two snapshots and compare the byte counts
+type Stats struct {
+	Name      string
+	Length    int64
+	NumPieces int
+	// pieces that have been downloaded and checked, and how many bytes that is
+	PiecesDone int
+	BytesDone  int64
+	// which pieces are done, by index
+	Done []bool
+	// how many of the peers we're connected to have each piece
+	Availability []int
+	// bytes read from and written to peers so far, protocol overhead and all. Includes
+	// peers that have since disconnected
+	Downloaded int64
+	Uploaded   int64
+	// the peers we're connected to right now, sorted by address
+	Peers []PeerStats
+	// web seeds that are still downloading
+	WebSeeds int
+}
+
+// PeerStats is one connected peer in Stats
+type PeerStats struct {
+	Addr string
+	// whether the peer is choking us, so we can't ask it for anything
+	Choked     bool
+	Downloaded int64
+	Uploaded   int64
+}
+
+// a peer we're connected to while downloading, so Stats can see it
+type activePeer struct {
+	addr string
+	conn net.Conn
+	// atomic, the peer's goroutine updates them while Stats reads them
+	downloaded int64
+	uploaded   int64
+	choked     int32
+	// the torrent's piece availability, updated as the peer tells us what it has
+	availability []int32
+}
+
+func (p *activePeer) setChoked(choked bool) {
+	var v int32
+	if choked {
+		v = 1
+	}
+	atomic.StoreInt32(&p.choked, v)
+}
+
+// the peer told us it has a piece it didn't have before
+func (p *activePeer) gotPiece(index int) {
+	if index >= 0 && index < len(p.availability) {
+		atomic.AddInt32(&p.availability[index], 1)
+	}
+}
+
+// counts the bytes that go through a peer connection
+type countingConn struct {
+	net.Conn
+	p *activePeer
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.p.downloaded, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.p.uploaded, int64(n))
+	return n, err
+}
+
+// start keeping stats for a download of numPieces pieces, of which we already have have
+func (t *Torrent) resetStats(numPieces int, have bitfield.Bitfield) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// peers we're uploading to might already be connected, see seed.go
+	if t.active == nil {
+		t.active = make(map[*activePeer]bool)
+	}
+	t.availability = make([]int32, numPieces)
+	t.done = make([]bool, numPieces)
+	t.piecesDone, t.bytesDone = 0, 0
+	t.pastDownloaded, t.pastUploaded = 0, 0
+	for i := 0; i < numPieces; i++ {
+		if have.HasPiece(i) {
+			t.done[i] = true
+			t.piecesDone++
+			t.bytesDone += int64(t.calculatePieceSize(i))
+		}
+	}
+}
+
+// SetHave says which pieces we already have, e.g. from checking the files on disk, so
+// they can be served and count as done before the download starts
+func (t *Torrent) SetHave(have bitfield.Bitfield) {
+	t.resetStats(t.numPieces(), have)
+}
+
+// whether we have piece index, so we can upload it
+func (t *Torrent) hasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return index >= 0 && index < len(t.done) && t.done[index]
+}
+
+// hang up on every peer, e.g. because we've been stopped
+func (t *Torrent) closePeers() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ap := range t.active {
+		ap.conn.Close()
+	}
+}
+
+// a peer connected, everything it has counts towards availability
+func (t *Torrent) trackPeer(c net.Conn, addr string, choked bool, has func(int) bool) (*activePeer, net.Conn) {
+	defer t.emit(Event{Type: PeerConnected, Peer: addr})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ap := &activePeer{addr: addr, availability: t.availability}
+	ap.setChoked(choked)
+	for i := range t.availability {
+		if has(i) {
+			atomic.AddInt32(&t.availability[i], 1)
+		}
+	}
+	ap.conn = &countingConn{Conn: c, p: ap}
+	if t.active == nil {
+		t.active = make(map[*activePeer]bool)
+	}
+	t.active[ap] = true
+	return ap, ap.conn
+}
+
+// the peer went away, and so did its pieces
+func (t *Torrent) untrackPeer(ap *activePeer, has func(int) bool) {
+	defer t.emit(Event{Type: PeerDisconnected, Peer: ap.addr})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range ap.availability {
+		if has(i) {
+			atomic.AddInt32(&ap.availability[i], -1)
+		}
+	}
+	t.pastDownloaded += atomic.LoadInt64(&ap.downloaded)
+	t.pastUploaded += atomic.LoadInt64(&ap.uploaded)
+	delete(t.active, ap)
+}
+
+// a piece made it
+func (t *Torrent) pieceDone(index int, length int) {
+	t.mu.Lock()
+	if index < len(t.done) && !t.done[index] {
+		t.done[index] = true
+		t.piecesDone++
+		t.bytesDone += int64(length)
+	}
+	t.mu.Unlock()
+	t.emit(Event{Type: PieceDone, Piece: index})
+}
+
+// Stats is how the download is going right now. It's safe to call from any goroutine
+// while Download runs, and before it starts you get a Stats with nothing done yet
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Stats{
+		Name:         t.Name,
+		Length:       int64(t.Length),
+		NumPieces:    t.numPieces(),
+		PiecesDone:   t.piecesDone,
+		BytesDone:    t.bytesDone,
+		Done:         append([]bool(nil), t.done...),
+		Availability: make([]int, len(t.availability)),
+		Downloaded:   t.pastDownloaded,
+		Uploaded:     t.pastUploaded,
+		WebSeeds:     int(atomic.LoadInt32(&t.webSeedsActive)),
+	}
+	if s.Done == nil {
+		s.Done = make([]bool, s.NumPieces)
+	}
+	for i := range t.availability {
+		s.Availability[i] = int(atomic.LoadInt32(&t.availability[i]))
+	}
+	for ap := range t.active {
+		ps := PeerStats{
+			Addr:       ap.addr,
+			Choked:     atomic.LoadInt32(&ap.choked) == 1,
+			Downloaded: atomic.LoadInt64(&ap.downloaded),
+			Uploaded:   atomic.LoadInt64(&ap.uploaded),
+		}
+		s.Downloaded += ps.Downloaded
+		s.Uploaded += ps.Uploaded
+		s.Peers = append(s.Peers, ps)
+	}
+	sort.Slice(s.Peers, func(i, j int) bool { return s.Peers[i].Addr < s.Peers[j].Addr })
+	return s
+}
@@ -0,0 +1,199 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"main/ratelimit"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// web seeds (BEP 19) are plain HTTP servers with a copy of the torrent's files, listed in
+// the .torrent's url-list. We download whole pieces from them with range requests, so
+// they're just another worker pulling off the same work queue as the peers.
+//
+// For a single file torrent the URL is the file itself, unless it ends in a slash, then the
+// torrent's name goes on the end. For a multi file torrent the URL is the directory the
+// torrent's directory is in, so a file's URL is url/name/path/to/file
+
+// a web seed that fails this many pieces in a row gets dropped
+const webSeedMaxFailures = 5
+
+// how long to wait after the first failure before trying again, doubles every failure
+const webSeedBackoff = 5 * time.Second
+
+// one HTTP request's worth of a piece: a range of one file
+type fileRange struct {
+	url    string
+	begin  int
+	length int
+	// where the bytes go in the piece
+	pieceOffset int
+	// padding isn't on the server, it's just zeros
+	padding bool
+}
+
+// the HTTP client for web seeds. The connections get wrapped like the peer ones, so
+// web seeds count towards the rate limits too
+func (t *Torrent) webSeedClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return ratelimit.NewConn(conn, t.downloadLimiters(), t.uploadLimiters()), nil
+		},
+		MaxIdleConnsPerHost: 2,
+	}
+	return &http.Client{Transport: transport, Timeout: 60 * time.Second}
+}
+
+// startWebSeed downloads pieces from one web seed until quit is closed, or the web
+// seed fails too many times in a row
+// Download counts it in webSeedsActive before starting it, and this takes it back out
+func (t *Torrent) startWebSeed(seedURL string, workqueue chan *PieceWork, results chan *pieceResult, quit <-chan struct{}) {
+	defer atomic.AddInt32(&t.webSeedsActive, -1)
+
+	httpClient := t.webSeedClient()
+	failures := 0
+	for {
+		var pieceToGet *PieceWork
+		select {
+		case pieceToGet = <-workqueue:
+		case <-quit:
+			return
+		}
+		contents, err := t.downloadFromWebSeed(httpClient, seedURL, pieceToGet)
+		if err == nil && !t.verifyPiece(pieceToGet, contents) {
+			err = fmt.Errorf("piece #%d failed integrity check", pieceToGet.Index)
+		}
+		if err != nil {
+			workqueue <- pieceToGet
+			failures++
+			t.logger().Printf("Web seed %s: %s", seedURL, err.Error())
+			if failures >= webSeedMaxFailures {
+				t.logger().Printf("Giving up on web seed %s", seedURL)
+				return
+			}
+			// back off, and let the peers have a go at the piece in the meantime
+			select {
+			case <-time.After(webSeedBackoff << uint(failures-1)):
+			case <-quit:
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		select {
+		case results <- &pieceResult{index: pieceToGet.Index, contents: contents, from: seedURL}:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// get one whole piece from a web seed, one range request per file the piece touches
+func (t *Torrent) downloadFromWebSeed(httpClient *http.Client, seedURL string, piece *PieceWork) ([]byte, error) {
+	contents := make([]byte, piece.Length)
+	for _, r := range t.pieceRanges(seedURL, piece) {
+		if r.padding {
+			// make gave us zeros already
+			continue
+		}
+		err := fetchRange(httpClient, r, contents[r.pieceOffset:r.pieceOffset+r.length])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+// work out which bits of which files make up a piece
+func (t *Torrent) pieceRanges(seedURL string, piece *PieceWork) []fileRange {
+	begin := piece.Index * t.PieceLength
+	end := begin + piece.Length
+
+	if t.Files == nil {
+		u := seedURL
+		if strings.HasSuffix(u, "/") {
+			u += url.PathEscape(t.Name)
+		}
+		return []fileRange{{url: u, begin: begin, length: piece.Length}}
+	}
+
+	var ret []fileRange
+	for _, f := range t.Files {
+		fileEnd := f.Offset + f.Length
+		if fileEnd <= begin || f.Offset >= end {
+			continue
+		}
+		from, to := begin, end
+		if f.Offset > from {
+			from = f.Offset
+		}
+		if fileEnd < to {
+			to = fileEnd
+		}
+		ret = append(ret, fileRange{
+			url:         fileURL(seedURL, t.Name, f.Path),
+			begin:       from - f.Offset,
+			length:      to - from,
+			pieceOffset: from - begin,
+			padding:     f.Padding,
+		})
+	}
+	return ret
+}
+
+// url/name/path/to/file, with every part escaped
+func fileURL(seedURL string, name string, path []string) string {
+	if !strings.HasSuffix(seedURL, "/") {
+		seedURL += "/"
+	}
+	parts := []string{url.PathEscape(name)}
+	for _, p := range path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return seedURL + strings.Join(parts, "/")
+}
+
+// GET one byte range of a file into buf
+func fetchRange(httpClient *http.Client, r fileRange, buf []byte) error {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.begin, r.begin+r.length-1))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body := io.Reader(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range and is sending the whole file, skip to our bit
+		_, err = io.CopyN(io.Discard, body, int64(r.begin))
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.url, err)
+		}
+	default:
+		return fmt.Errorf("%s: %s", r.url, resp.Status)
+	}
+	_, err = io.ReadFull(body, buf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.url, err)
+	}
+	return nil
+}
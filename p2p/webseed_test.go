@@ -0,0 +1,220 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"log"
+	"main/bitfield"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a web seed serving files by path. It does range requests properly unless ignoreRange
+// is set, then it sends the whole file with a 200 like plenty of real servers do
+type testWebSeed struct {
+	files       map[string][]byte
+	ignoreRange bool
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func (s *testWebSeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requested = append(s.requested, r.URL.Path)
+	s.mu.Unlock()
+	data, ok := s.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if s.ignoreRange {
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (s *testWebSeed) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requested...)
+}
+
+func startWebSeed(t *testing.T, s *testWebSeed) string {
+	t.Helper()
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func quietTorrent(t *Torrent) *Torrent {
+	t.Log = log.New(io.Discard, "", 0)
+	return t
+}
+
+// get every piece of tor from the web seed and check they come out as data
+func checkWebSeedPieces(t *testing.T, tor *Torrent, seedURL string, data []byte) {
+	t.Helper()
+	httpClient := tor.webSeedClient()
+	for i := 0; i < tor.numPieces(); i++ {
+		begin, end := tor.calculateBoundsForPiece(i)
+		got, err := tor.downloadFromWebSeed(httpClient, seedURL, &PieceWork{Index: i, Length: end - begin})
+		if err != nil {
+			t.Fatalf("piece %d: %s", i, err)
+		}
+		if !bytes.Equal(got, data[begin:end]) {
+			t.Fatalf("piece %d isn't what the server has", i)
+		}
+	}
+}
+
+func TestWebSeedSingleFile(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	s := &testWebSeed{files: map[string][]byte{
+		"/some/where/big file.iso": data,
+		"/dir/big file.iso":        data,
+	}}
+	base := startWebSeed(t, s)
+	tor := quietTorrent(&Torrent{Name: "big file.iso", PieceHash: make([][20]byte, 4), PieceLength: 256, Length: len(data)})
+
+	// the URL is the file itself
+	checkWebSeedPieces(t, tor, base+"/some/where/big%20file.iso", data)
+	// or the directory it's in, when it ends in a slash
+	checkWebSeedPieces(t, tor, base+"/dir/", data)
+}
+
+func TestWebSeedMultiFile(t *testing.T) {
+	one := bytes.Repeat([]byte{1}, 300)
+	two := bytes.Repeat([]byte{2}, 50)
+	three := bytes.Repeat([]byte{3}, 200)
+	s := &testWebSeed{files: map[string][]byte{
+		"/seeds/stuff/one.bin":         one,
+		"/seeds/stuff/sub dir/two.bin": two,
+		"/seeds/stuff/three.bin":       three,
+	}}
+	base := startWebSeed(t, s)
+
+	// three gets lined up with a piece by a pad file, which isn't on the server
+	files := []File{
+		{Path: []string{"one.bin"}, Length: 300, Offset: 0},
+		{Path: []string{"sub dir", "two.bin"}, Length: 50, Offset: 300},
+		{Path: []string{".pad", "162"}, Length: 162, Offset: 350, Padding: true},
+		{Path: []string{"three.bin"}, Length: 200, Offset: 512},
+	}
+	var data []byte
+	data = append(data, one...)
+	data = append(data, two...)
+	data = append(data, make([]byte, 162)...)
+	data = append(data, three...)
+	tor := quietTorrent(&Torrent{Name: "stuff", Files: files, PieceHash: make([][20]byte, 3), PieceLength: 256, Length: len(data)})
+
+	checkWebSeedPieces(t, tor, base+"/seeds", data)
+	for _, path := range s.requests() {
+		if _, ok := s.files[path]; !ok {
+			t.Fatalf("asked the web seed for %s", path)
+		}
+	}
+}
+
+func TestWebSeedIgnoresRange(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	s := &testWebSeed{files: map[string][]byte{"/file": data}, ignoreRange: true}
+	base := startWebSeed(t, s)
+	tor := quietTorrent(&Torrent{Name: "file", PieceHash: make([][20]byte, 4), PieceLength: 256, Length: len(data)})
+	checkWebSeedPieces(t, tor, base+"/file", data)
+}
+
+// a web seed that's failing waits before trying again, but stopping the download
+// shouldn't have to wait for that
+func TestWebSeedBackoffStops(t *testing.T) {
+	s := &testWebSeed{files: map[string][]byte{}}
+	base := startWebSeed(t, s)
+	tor := quietTorrent(&Torrent{Name: "file", PieceHash: make([][20]byte, 1), PieceLength: 256, Length: 100})
+	tor.webSeedsActive = 1
+
+	workqueue := make(chan *PieceWork, 1)
+	workqueue <- &PieceWork{Index: 0, Length: 100}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		tor.startWebSeed(base+"/file", workqueue, make(chan *pieceResult), quit)
+		close(done)
+	}()
+
+	// the piece goes back on the queue when it fails, which is when the backoff starts
+	deadline := time.Now().Add(5 * time.Second)
+	for len(workqueue) == 0 || len(s.requests()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the web seed never tried the piece")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(quit)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("still backing off a second after quit, the backoff is %s", webSeedBackoff)
+	}
+	if n := atomic.LoadInt32(&tor.webSeedsActive); n != 0 {
+		t.Fatalf("webSeedsActive is %d after it stopped", n)
+	}
+}
+
+// a whole download from just a web seed. Once every piece is in, the web seed has to
+// return without anyone closing the work queue
+func TestDownloadFromWebSeed(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	var hashes [][20]byte
+	for begin := 0; begin < len(data); begin += 256 {
+		end := begin + 256
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+	s := &testWebSeed{files: map[string][]byte{"/file": data}}
+	base := startWebSeed(t, s)
+	tor := quietTorrent(&Torrent{Name: "file", PieceHash: hashes, PieceLength: 256, Length: len(data), WebSeeds: []string{base + "/file"}})
+
+	got := make(bufferWriter, len(data))
+	have := bitfield.New(len(hashes))
+	err := tor.DownloadTo(got, have, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || have.Count() != len(hashes) {
+		t.Fatal("downloaded the wrong thing")
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&tor.webSeedsActive) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the web seed is still going after the download finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// with nobody to download from, DownloadTo gives up instead of waiting forever
+func TestDownloadRunsOutOfPeers(t *testing.T) {
+	defer func(old time.Duration) { peerCheckInterval = old }(peerCheckInterval)
+	peerCheckInterval = 20 * time.Millisecond
+	tor := quietTorrent(&Torrent{Name: "file", PieceHash: make([][20]byte, 2), PieceLength: 256, Length: 500})
+	err := tor.DownloadTo(make(bufferWriter, 500), bitfield.New(2), nil)
+	if err == nil || !strings.Contains(err.Error(), "ran out of peers with 0 of 2 pieces") {
+		t.Fatalf("got %v, want ran out of peers", err)
+	}
+}
@@ -0,0 +1,382 @@
+package peerpool
+
+import (
+	"log"
+	"main/peers"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultGlobalConns is how many peer connections we allow across ALL torrents
+// at once. Each connection is a TCP socket plus a goroutine, so we don't want
+// a torrent with 200 peers in the tracker response to open 200 sockets.
+const DefaultGlobalConns = 200
+
+// DefaultTorrentConns is how many peer connections one torrent can have open at once.
+// bittorrent clients usually cap this around 30-50, more than that doesn't really help
+const DefaultTorrentConns = 40
+
+// Source tells us where we heard about a peer from
+type Source int
+
+const (
+	SourceTracker Source = iota
+	SourceIncoming
+	SourceDHT
+	SourcePEX
+	SourceLSD
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceIncoming:
+		return "incoming"
+	case SourceDHT:
+		return "dht"
+	case SourcePEX:
+		return "pex"
+	case SourceLSD:
+		return "lsd"
+	}
+	return "unknown"
+}
+
+// Decentralized is true for the sources that find peers without asking the tracker.
+// Private torrents (BEP 27) aren't allowed to use them
+func (s Source) Decentralized() bool {
+	return s == SourceDHT || s == SourcePEX || s == SourceLSD
+}
+
+// Limiter caps how many connections can be open at once. One Limiter is meant to be
+// shared by every Pool in the process so that the cap is global, not per torrent.
+// It's basically a counting semaphore, implemented with a buffered channel
+type Limiter struct {
+	slots chan struct{}
+}
+
+func NewLimiter(maxConns int) *Limiter {
+	if maxConns <= 0 {
+		maxConns = DefaultGlobalConns
+	}
+	return &Limiter{slots: make(chan struct{}, maxConns)}
+}
+
+// DefaultLimiter is the global limiter that pools use unless told otherwise
+var DefaultLimiter = NewLimiter(DefaultGlobalConns)
+
+// try to grab a slot without blocking, returns false if we're at the cap
+func (l *Limiter) tryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Limiter) release() {
+	<-l.slots
+}
+
+// InUse returns how many connections are currently open across everyone sharing this limiter
+func (l *Limiter) InUse() int {
+	return len(l.slots)
+}
+
+// Config holds the knobs for a Pool. Zero values get replaced by the defaults in New
+type Config struct {
+	// max connections for this torrent
+	MaxConns int
+	// the global limiter shared between torrents
+	Global *Limiter
+	// after this many failures in a row, the peer is banned for the rest of the download
+	MaxFailures int
+	// how long to wait before retrying a peer after its first failure, doubles every failure
+	BaseBackoff time.Duration
+	// the backoff never gets longer than this
+	MaxBackoff time.Duration
+	// for private torrents: ignore peers from DHT, PEX and LSD, only take
+	// the ones the tracker gave us (and ones that connected to us)
+	Private bool
+	// where to log peers getting banned, nil for the standard logger
+	Log *log.Logger
+}
+
+// Worker is what the pool runs for every peer it connects to. It should
+// connect to the peer and only return once the connection is done with.
+// A nil error means the peer finished normally (e.g. the download is complete),
+// anything else counts as a failure and the peer gets retried later.
+type Worker func(p peers.Peer) error
+
+// state the pool keeps about every peer it has ever heard of
+type peerState struct {
+	peer   peers.Peer
+	source Source
+	// how many times in a row this peer has failed
+	failures int
+	// don't try this peer again before this time
+	nextTry time.Time
+	// is the peer sitting in the candidates queue?
+	queued bool
+	// is there a goroutine connected to this peer right now?
+	active bool
+	banned bool
+}
+
+// Pool decides which peers a torrent is connected to. Peers from every source get added
+// with Add, and the pool keeps up to MaxConns of them connected, retrying failed peers
+// with exponential backoff and pulling in new candidates whenever a connection drops
+type Pool struct {
+	mu     sync.Mutex
+	cfg    Config
+	worker Worker
+
+	// every peer we know of, keyed by "ip:port"
+	known map[string]*peerState
+	// IPs that are banned on every port, e.g. for sending us corrupt data
+	bannedIPs map[string]bool
+	// peers waiting for a connection slot, in the order we heard of them
+	candidates []*peerState
+	active     int
+	stopped    bool
+
+	// poked whenever something happens that could let us start a new connection
+	wake chan struct{}
+	// closed by Stop, Run returns once it sees this
+	done chan struct{}
+	// so Stop can wait for all the workers to exit
+	workers sync.WaitGroup
+}
+
+func New(worker Worker, cfg Config) *Pool {
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = DefaultTorrentConns
+	}
+	if cfg.Global == nil {
+		cfg.Global = DefaultLimiter
+	}
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = 5
+	}
+	if cfg.Log == nil {
+		cfg.Log = log.Default()
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = 5 * time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+	return &Pool{
+		cfg:       cfg,
+		worker:    worker,
+		known:     make(map[string]*peerState),
+		bannedIPs: make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// Add queues up peers as candidates. Peers we already know about are ignored,
+// so it's fine to call this again with every tracker response
+func (p *Pool) Add(source Source, ps ...peers.Peer) {
+	if p.cfg.Private && source.Decentralized() {
+		return
+	}
+	p.mu.Lock()
+	added := 0
+	for _, peer := range ps {
+		key := peer.String()
+		if _, ok := p.known[key]; ok {
+			continue
+		}
+		st := &peerState{peer: peer, source: source, queued: true}
+		p.known[key] = st
+		p.candidates = append(p.candidates, st)
+		added++
+	}
+	p.mu.Unlock()
+	if added > 0 {
+		p.poke()
+	}
+}
+
+// Ban stops the pool from ever connecting to this peer again. It doesn't kill
+// an existing connection, the worker is expected to notice with IsBanned and return
+func (p *Pool) Ban(peer peers.Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := peer.String()
+	st, ok := p.known[key]
+	if !ok {
+		st = &peerState{peer: peer}
+		p.known[key] = st
+	}
+	st.banned = true
+}
+
+// BanIP bans every peer at this IP, whatever port it's on. Like Ban, running
+// connections to it are left for their worker to close
+func (p *Pool) BanIP(ip net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bannedIPs[ip.String()] = true
+}
+
+func (p *Pool) IsBanned(peer peers.Peer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.isBanned(peer)
+}
+
+// same as IsBanned but expects p.mu to be held already
+func (p *Pool) isBanned(peer peers.Peer) bool {
+	if p.bannedIPs[peer.IP.String()] {
+		return true
+	}
+	st, ok := p.known[peer.String()]
+	return ok && st.banned
+}
+
+// Active returns how many peers this pool is connected to right now
+func (p *Pool) Active() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active
+}
+
+// Candidates returns how many peers are waiting for a connection slot (including ones in backoff)
+func (p *Pool) Candidates() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.candidates)
+}
+
+// Run keeps connections topped up until Stop is called. Meant to be run in its own goroutine
+func (p *Pool) Run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		wait := p.fill()
+
+		// sleep until either a new candidate/slot shows up, or the next peer's backoff expires
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-p.done:
+			return
+		case <-p.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// Stop prevents new connections and waits for the running workers to exit.
+// The workers have to return on their own (e.g. because the download's quit channel got closed)
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.done)
+	p.mu.Unlock()
+	p.workers.Wait()
+}
+
+// start as many candidates as the caps allow. Returns how long until
+// the earliest candidate in backoff is ready to be tried again
+func (p *Pool) fill() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	wait := time.Hour
+	remaining := p.candidates[:0]
+	for _, st := range p.candidates {
+		if p.isBanned(st.peer) {
+			st.queued = false
+			continue
+		}
+		if p.stopped || p.active >= p.cfg.MaxConns || st.nextTry.After(now) {
+			if st.nextTry.After(now) && st.nextTry.Sub(now) < wait {
+				wait = st.nextTry.Sub(now)
+			}
+			remaining = append(remaining, st)
+			continue
+		}
+		if !p.cfg.Global.tryAcquire() {
+			// the global cap is full, someone will poke us once a slot frees up...
+			// except it might be another torrent's slot, so poll every so often too
+			if wait > time.Second {
+				wait = time.Second
+			}
+			remaining = append(remaining, st)
+			continue
+		}
+		st.queued = false
+		st.active = true
+		p.active++
+		p.workers.Add(1)
+		go p.runWorker(st)
+	}
+	p.candidates = remaining
+	return wait
+}
+
+// runs the worker for one peer, then decides whether the peer goes back in the queue
+func (p *Pool) runWorker(st *peerState) {
+	defer p.workers.Done()
+	err := p.worker(st.peer)
+	p.cfg.Global.release()
+
+	p.mu.Lock()
+	st.active = false
+	p.active--
+	if err == nil {
+		st.failures = 0
+	} else if !p.isBanned(st.peer) && !p.stopped {
+		st.failures++
+		if st.failures >= p.cfg.MaxFailures {
+			p.cfg.Log.Printf("Peer %s failed %d times in a row, banning it", st.peer.String(), st.failures)
+			st.banned = true
+		} else {
+			st.nextTry = time.Now().Add(p.backoff(st.failures))
+			st.queued = true
+			p.candidates = append(p.candidates, st)
+		}
+	}
+	p.mu.Unlock()
+
+	// a slot just opened up, so try to fill it with a replacement
+	p.poke()
+}
+
+// 5s, 10s, 20s, 40s... capped at MaxBackoff
+func (p *Pool) backoff(failures int) time.Duration {
+	d := p.cfg.BaseBackoff
+	for i := 1; i < failures; i++ {
+		d *= 2
+		if d >= p.cfg.MaxBackoff {
+			return p.cfg.MaxBackoff
+		}
+	}
+	return d
+}
+
+// non-blocking wake up of Run. The channel has a buffer of 1 so pokes never get lost
+func (p *Pool) poke() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
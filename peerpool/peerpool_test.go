@@ -0,0 +1,209 @@
+package peerpool
+
+import (
+	"errors"
+	"io"
+	"log"
+	"main/peers"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testPeers(n int) []peers.Peer {
+	var ret []peers.Peer
+	for i := 0; i < n; i++ {
+		ret = append(ret, peers.Peer{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 6881})
+	}
+	return ret
+}
+
+func quiet() *log.Logger {
+	return log.New(io.Discard, "", 0)
+}
+
+// a worker that stays connected until release is closed, and remembers the most
+// connections it saw at once
+type holdingWorker struct {
+	release chan struct{}
+
+	mu      sync.Mutex
+	running int
+	most    int
+	ran     map[string]int
+}
+
+func newHoldingWorker() *holdingWorker {
+	return &holdingWorker{release: make(chan struct{}), ran: make(map[string]int)}
+}
+
+func (w *holdingWorker) work(p peers.Peer) error {
+	w.mu.Lock()
+	w.running++
+	if w.running > w.most {
+		w.most = w.running
+	}
+	w.ran[p.String()]++
+	w.mu.Unlock()
+	<-w.release
+	w.mu.Lock()
+	w.running--
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *holdingWorker) stats() (running, most, tried int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.running, w.most, len(w.ran)
+}
+
+// wait for cond, or fail after a couple of seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	w := newHoldingWorker()
+	p := New(w.work, Config{MaxConns: 3, Global: NewLimiter(100), Log: quiet()})
+	go p.Run()
+	p.Add(SourceTracker, testPeers(10)...)
+
+	eventually(t, "3 connections", func() bool { running, _, _ := w.stats(); return running == 3 })
+	// give it a chance to go over
+	time.Sleep(50 * time.Millisecond)
+	if _, most, _ := w.stats(); most != 3 {
+		t.Fatalf("had %d connections at once, the most is 3", most)
+	}
+	if p.Active() != 3 || p.Candidates() != 7 {
+		t.Fatalf("%d active and %d candidates, want 3 and 7", p.Active(), p.Candidates())
+	}
+
+	// once they finish the rest get their turn
+	close(w.release)
+	eventually(t, "every peer to be tried", func() bool { _, _, n := w.stats(); return n == 10 })
+	p.Stop()
+	if p.Active() != 0 {
+		t.Fatalf("%d still active after Stop", p.Active())
+	}
+}
+
+// the global limiter caps connections across every pool sharing it
+func TestGlobalLimiter(t *testing.T) {
+	global := NewLimiter(4)
+	w := newHoldingWorker()
+	var pools []*Pool
+	for i := 0; i < 3; i++ {
+		p := New(w.work, Config{MaxConns: 10, Global: global, Log: quiet()})
+		go p.Run()
+		p.Add(SourceTracker, testPeers(5)...)
+		pools = append(pools, p)
+	}
+	eventually(t, "4 connections", func() bool { return global.InUse() == 4 })
+	time.Sleep(50 * time.Millisecond)
+	if _, most, _ := w.stats(); most != 4 {
+		t.Fatalf("had %d connections at once across the pools, the global cap is 4", most)
+	}
+	close(w.release)
+	for _, p := range pools {
+		p.Stop()
+	}
+	if global.InUse() != 0 {
+		t.Fatalf("%d global slots still taken after every pool stopped", global.InUse())
+	}
+}
+
+// a peer that keeps failing gets retried later and later, then banned
+func TestBackoffThenBan(t *testing.T) {
+	var mu sync.Mutex
+	var tries []time.Time
+	failing := func(peers.Peer) error {
+		mu.Lock()
+		tries = append(tries, time.Now())
+		mu.Unlock()
+		return errors.New("connection refused")
+	}
+	p := New(failing, Config{Global: NewLimiter(10), MaxFailures: 4, BaseBackoff: 20 * time.Millisecond, Log: quiet()})
+	go p.Run()
+	defer p.Stop()
+	peer := testPeers(1)[0]
+	p.Add(SourceTracker, peer)
+
+	eventually(t, "the peer to be banned", func() bool { return p.IsBanned(peer) })
+	// nothing else happens after the ban
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tries) != 4 {
+		t.Fatalf("tried %d times, want 4", len(tries))
+	}
+	// 20ms, 40ms, 80ms between tries
+	for i := 1; i < len(tries); i++ {
+		want := 20 * time.Millisecond << uint(i-1)
+		if gap := tries[i].Sub(tries[i-1]); gap < want {
+			t.Fatalf("try %d came %s after the one before, the backoff is %s", i+1, gap, want)
+		}
+	}
+	if p.Candidates() != 0 {
+		t.Fatalf("banned peer is still a candidate")
+	}
+}
+
+func TestBackoffCapped(t *testing.T) {
+	p := New(nil, Config{BaseBackoff: time.Second, MaxBackoff: 5 * time.Second})
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 20: 5 * time.Second} {
+		if got := p.backoff(failures); got != want {
+			t.Errorf("backoff after %d failures is %s, want %s", failures, got, want)
+		}
+	}
+}
+
+func TestBans(t *testing.T) {
+	w := newHoldingWorker()
+	close(w.release)
+	p := New(w.work, Config{Global: NewLimiter(10), Log: quiet()})
+	ps := testPeers(3)
+	p.Ban(ps[0])
+	p.BanIP(ps[1].IP)
+	// another port on a banned IP
+	other := peers.Peer{IP: ps[1].IP, Port: 7000}
+	if !p.IsBanned(ps[0]) || !p.IsBanned(other) || p.IsBanned(ps[2]) {
+		t.Fatal("wrong peers banned")
+	}
+
+	go p.Run()
+	p.Add(SourceTracker, ps[0], ps[1], other, ps[2])
+	eventually(t, "the good peer to be tried", func() bool { _, _, n := w.stats(); return n == 1 })
+	time.Sleep(50 * time.Millisecond)
+	p.Stop()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.ran) != 1 || w.ran[ps[2].String()] != 1 {
+		t.Fatalf("connected to %v, only %s isn't banned", w.ran, ps[2].String())
+	}
+}
+
+func TestAdd(t *testing.T) {
+	p := New(nil, Config{Private: true})
+	p.Add(SourceDHT, testPeers(2)...)
+	p.Add(SourcePEX, testPeers(2)...)
+	p.Add(SourceLSD, testPeers(2)...)
+	if p.Candidates() != 0 {
+		t.Fatalf("private torrent took %d peers from DHT, PEX or LSD", p.Candidates())
+	}
+	p.Add(SourceTracker, testPeers(2)...)
+	p.Add(SourceIncoming, testPeers(3)...)
+	// the same peers again from another tracker response don't count twice
+	p.Add(SourceTracker, testPeers(3)...)
+	if p.Candidates() != 3 {
+		t.Fatalf("%d candidates, want 3", p.Candidates())
+	}
+}
@@ -13,11 +13,6 @@ type Peer struct {
 	Port uint16
 }
 
-type PeersResponse struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
-}
-
 // transforms a string of peers info (6 byte ip+port chunks over and over again)
 // into []Peer
 func Unmarshal(s string) ([]Peer, error) {
@@ -39,7 +34,8 @@ func Unmarshal(s string) ([]Peer, error) {
 }
 
 // a quick function to convert this peer's IP and port info into a string
-// like "213.23.121.94:80" or something
+// like "213.23.121.94:80" or something. IPv6 addresses get brackets, "[2001:db8::1]:80",
+// so it works as an address for net.Dial
 func (p *Peer) String() string {
-	return p.IP.String() + ":" + strconv.Itoa(int(p.Port))
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
@@ -0,0 +1,51 @@
+package peers
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// the peers string comes straight out of the tracker response
+func FuzzUnmarshal(f *testing.F) {
+	f.Add("")
+	f.Add("\x7f\x00\x00\x01\x1a\xe1")
+	f.Add("\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x00\x50")
+	f.Add("\x01\x02\x03")
+	f.Fuzz(func(t *testing.T, s string) {
+		ps, err := Unmarshal(s)
+		if err != nil {
+			return
+		}
+		if len(ps)*6 != len(s) {
+			t.Fatalf("got %d peers out of %d bytes", len(ps), len(s))
+		}
+		for _, p := range ps {
+			_ = p.String()
+		}
+	})
+}
+
+func TestString(t *testing.T) {
+	for _, c := range []struct {
+		peer Peer
+		want string
+	}{
+		{Peer{IP: net.IPv4(213, 23, 121, 94), Port: 80}, "213.23.121.94:80"},
+		{Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}, "[2001:db8::1]:6881"},
+		{Peer{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 1}, "10.0.0.1:1"},
+	} {
+		got := c.peer.String()
+		if got != c.want {
+			t.Fatalf("got %q, want %q", got, c.want)
+		}
+		// it has to be something we can dial
+		host, port, err := net.SplitHostPort(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !net.ParseIP(host).Equal(c.peer.IP) || port != strconv.Itoa(int(c.peer.Port)) {
+			t.Fatalf("%q doesn't split back into %s and %d", got, c.peer.IP, c.peer.Port)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package progress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"main/p2p"
+	"main/torrentfile"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the progress display for a download. On a terminal it's a few lines that get redrawn
+// in place: a bar, the rates and ETA, how many peers we have, a map of which pieces are
+// done (and how many peers have the ones that aren't), and the fastest peers. Anywhere
+// else (a file, a pipe) redrawing would just make a mess, so it prints a summary line
+// every so often instead
+
+// how often the terminal display gets redrawn, and how often a summary line gets
+// printed when it's not a terminal
+const (
+	redrawInterval  = 500 * time.Millisecond
+	summaryInterval = 10 * time.Second
+)
+
+// ETAs longer than this aren't worth showing exactly
+const maxETA = 100 * 24 * time.Hour
+
+// how many peers get a line of their own
+const maxPeerLines = 5
+
+// rates are smoothed, otherwise they jump all over the place between redraws. Each new
+// sample counts for this much of the rate
+const rateSmoothing = 0.3
+
+// Display draws the progress of a download to out
+type Display struct {
+	out   io.Writer
+	tty   bool
+	width int
+
+	mu sync.Mutex
+	// how many lines are on the screen from the last redraw, 0 when we're not drawing
+	drawn     int
+	lastFrame []string
+	// for working out rates
+	lastTime       time.Time
+	lastDownloaded int64
+	lastUploaded   int64
+	downRate       float64
+	upRate         float64
+	peerLast       map[string]int64
+	peerRates      map[string]float64
+}
+
+// New makes a display that draws to out. It only redraws in place if out is a terminal
+func New(out *os.File) *Display {
+	return &Display{
+		out:   out,
+		tty:   isTerminal(out),
+		width: terminalWidth(),
+	}
+}
+
+// whether f is a terminal (a character device) rather than a file or a pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// shells export COLUMNS, which is good enough without asking the terminal itself
+func terminalWidth() int {
+	if w, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && w >= 40 {
+		return w
+	}
+	return 80
+}
+
+// Watch shows t's progress until done is closed, then shows it one last time.
+// It's made to be torrentfile.Settings.Watch
+func (d *Display) Watch(t *p2p.Torrent, done <-chan struct{}) {
+	interval := summaryInterval
+	if d.tty {
+		interval = redrawInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	d.mu.Lock()
+	d.lastTime = time.Now()
+	d.lastDownloaded, d.lastUploaded = 0, 0
+	d.downRate, d.upRate = 0, 0
+	d.peerLast = make(map[string]int64)
+	d.peerRates = make(map[string]float64)
+	d.mu.Unlock()
+
+	for {
+		select {
+		case <-done:
+			d.update(t.Stats(), true)
+			return
+		case <-ticker.C:
+			d.update(t.Stats(), false)
+		}
+	}
+}
+
+// work out the rates from the new stats, and show them
+func (d *Display) update(s p2p.Stats, final bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(d.lastTime).Seconds()
+	if elapsed > 0 {
+		d.downRate = smooth(d.downRate, float64(s.Downloaded-d.lastDownloaded)/elapsed)
+		d.upRate = smooth(d.upRate, float64(s.Uploaded-d.lastUploaded)/elapsed)
+		rates := make(map[string]float64)
+		last := make(map[string]int64)
+		for _, p := range s.Peers {
+			if prev, ok := d.peerLast[p.Addr]; ok {
+				rates[p.Addr] = smooth(d.peerRates[p.Addr], float64(p.Downloaded-prev)/elapsed)
+			}
+			last[p.Addr] = p.Downloaded
+		}
+		d.peerRates, d.peerLast = rates, last
+	}
+	d.lastTime, d.lastDownloaded, d.lastUploaded = now, s.Downloaded, s.Uploaded
+
+	if !d.tty {
+		fmt.Fprintln(d.out, d.summary(s))
+		return
+	}
+	d.clear()
+	d.lastFrame = d.frame(s)
+	d.draw()
+	if final {
+		// leave the last frame on the screen, log lines go after it from now on
+		d.drawn = 0
+	}
+}
+
+func smooth(old float64, sample float64) float64 {
+	if old == 0 {
+		return sample
+	}
+	return old + rateSmoothing*(sample-old)
+}
+
+// one line for when we're not on a terminal
+func (d *Display) summary(s p2p.Stats) string {
+	return fmt.Sprintf("%s: %s (%d of %d pieces), %s, %s, ETA %s",
+		s.Name, percent(s), s.PiecesDone, s.NumPieces, d.rates(), peerCount(s), d.eta(s))
+}
+
+// the lines of the terminal display
+func (d *Display) frame(s p2p.Stats) []string {
+	var lines []string
+	head := fmt.Sprintf("%s  %s / %s  %s", s.Name, torrentfile.FormatSize(s.BytesDone), torrentfile.FormatSize(s.Length), percent(s))
+	lines = append(lines, head)
+	barWidth := d.width - 2
+	lines = append(lines, "["+bar(s, barWidth)+"]")
+	status := fmt.Sprintf("%s  ETA %s  %s", d.rates(), d.eta(s), peerCount(s))
+	if s.WebSeeds > 0 {
+		status += fmt.Sprintf(", %d web seeds", s.WebSeeds)
+	}
+	lines = append(lines, status)
+	lines = append(lines, "["+pieceMap(s, barWidth)+"]")
+
+	// the fastest peers first
+	peers := append([]p2p.PeerStats(nil), s.Peers...)
+	sort.SliceStable(peers, func(i, j int) bool {
+		return d.peerRates[peers[i].Addr] > d.peerRates[peers[j].Addr]
+	})
+	for i, p := range peers {
+		if i == maxPeerLines {
+			lines = append(lines, fmt.Sprintf("  and %d more", len(peers)-maxPeerLines))
+			break
+		}
+		choked := ""
+		if p.Choked {
+			choked = "choking us"
+		}
+		lines = append(lines, fmt.Sprintf("  %-40s %12s/s  %s", p.Addr, torrentfile.FormatSize(int64(d.peerRates[p.Addr])), choked))
+	}
+	return lines
+}
+
+func (d *Display) rates() string {
+	return fmt.Sprintf("down %s/s, up %s/s", torrentfile.FormatSize(int64(d.downRate)), torrentfile.FormatSize(int64(d.upRate)))
+}
+
+// how long until we're done at the rate we're going
+func (d *Display) eta(s p2p.Stats) string {
+	left := s.Length - s.BytesDone
+	if left <= 0 {
+		return "done"
+	}
+	if d.downRate < 1 {
+		return "unknown"
+	}
+	// in float nanoseconds, a big download at a trickle is longer than a Duration can hold
+	ns := float64(left) / d.downRate * float64(time.Second)
+	if ns >= float64(maxETA) {
+		return fmt.Sprintf("over %d days", maxETA/(24*time.Hour))
+	}
+	return time.Duration(ns).Round(time.Second).String()
+}
+
+func percent(s p2p.Stats) string {
+	if s.NumPieces == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(s.PiecesDone)/float64(s.NumPieces)*100)
+}
+
+func peerCount(s p2p.Stats) string {
+	choked := 0
+	for _, p := range s.Peers {
+		if p.Choked {
+			choked++
+		}
+	}
+	return fmt.Sprintf("%d peers (%d choking us)", len(s.Peers), choked)
+}
+
+// a progress bar width characters wide
+func bar(s p2p.Stats, width int) string {
+	filled := 0
+	if s.NumPieces > 0 {
+		filled = width * s.PiecesDone / s.NumPieces
+	}
+	return strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+}
+
+// the pieces squashed into width characters. A character that's all done pieces is a
+// full block, otherwise it's shaded by how many peers have its rarest piece
+func pieceMap(s p2p.Stats, width int) string {
+	n := len(s.Done)
+	if n == 0 {
+		return strings.Repeat(" ", width)
+	}
+	var b strings.Builder
+	for c := 0; c < width; c++ {
+		start, end := c*n/width, (c+1)*n/width
+		if end == start {
+			// more characters than pieces, a piece gets several
+			end = start + 1
+		}
+		done := true
+		rarest := -1
+		for i := start; i < end; i++ {
+			if s.Done[i] {
+				continue
+			}
+			done = false
+			if rarest < 0 || s.Availability[i] < rarest {
+				rarest = s.Availability[i]
+			}
+		}
+		switch {
+		case done:
+			b.WriteRune('█')
+		case rarest == 0:
+			b.WriteRune('·')
+		case rarest == 1:
+			b.WriteRune('░')
+		case rarest <= 3:
+			b.WriteRune('▒')
+		default:
+			b.WriteRune('▓')
+		}
+	}
+	return b.String()
+}
+
+// take the last frame off the screen. d.mu has to be held
+func (d *Display) clear() {
+	if d.drawn > 0 {
+		// up to the first line of the frame, and clear everything below
+		fmt.Fprintf(d.out, "\x1b[%dA\r\x1b[J", d.drawn)
+		d.drawn = 0
+	}
+}
+
+// put the last frame back on the screen, cut to the width of the terminal. d.mu has to be held
+func (d *Display) draw() {
+	var buf bytes.Buffer
+	for _, line := range d.lastFrame {
+		if r := []rune(line); len(r) > d.width {
+			line = string(r[:d.width])
+		}
+		buf.WriteString(line)
+		buf.WriteString("\x1b[K\n")
+	}
+	d.out.Write(buf.Bytes())
+	d.drawn = len(d.lastFrame)
+}
+
+// Logs wraps w (where log lines usually go) so log lines show up above the display
+// instead of in the middle of it. Use it with log.SetOutput
+func (d *Display) Logs(w io.Writer) io.Writer {
+	return &logWriter{d: d, w: w}
+}
+
+type logWriter struct {
+	d *Display
+	w io.Writer
+}
+
+func (l *logWriter) Write(p []byte) (int, error) {
+	l.d.mu.Lock()
+	defer l.d.mu.Unlock()
+	if l.d.drawn == 0 {
+		return l.w.Write(p)
+	}
+	l.d.clear()
+	n, err := l.w.Write(p)
+	l.d.draw()
+	return n, err
+}
@@ -0,0 +1,86 @@
+package progress
+
+import (
+	"main/p2p"
+	"strings"
+	"testing"
+)
+
+func TestETA(t *testing.T) {
+	cases := []struct {
+		left int64
+		rate float64
+		want string
+	}{
+		{0, 0, "done"},
+		{100, 0.5, "unknown"},
+		{1000, 10, "1m40s"},
+		{3 << 20, 1 << 20, "3s"},
+		// 10 GiB at 1 B/s used to overflow into a negative ETA
+		{10 << 30, 1, "over 100 days"},
+		{1 << 62, 1, "over 100 days"},
+	}
+	for _, c := range cases {
+		d := &Display{downRate: c.rate}
+		s := p2p.Stats{Length: c.left + 500, BytesDone: 500}
+		if got := d.eta(s); got != c.want {
+			t.Errorf("%d bytes left at %g B/s: got %q, want %q", c.left, c.rate, got, c.want)
+		}
+	}
+}
+
+func TestBar(t *testing.T) {
+	for _, c := range []struct {
+		done, total int
+		want        string
+	}{
+		{0, 0, "          "},
+		{0, 4, "          "},
+		{1, 4, "==        "},
+		{3, 4, "=======   "},
+		{4, 4, "=========="},
+	} {
+		if got := bar(p2p.Stats{PiecesDone: c.done, NumPieces: c.total}, 10); got != c.want {
+			t.Errorf("%d of %d: got %q, want %q", c.done, c.total, got, c.want)
+		}
+	}
+}
+
+func TestPieceMap(t *testing.T) {
+	// 8 pieces in 4 characters, two each
+	s := p2p.Stats{
+		Done:         []bool{true, true, true, false, false, false, false, false},
+		Availability: []int{0, 0, 5, 5, 0, 2, 1, 9},
+	}
+	// done, rarest not done piece has 5, then 0, then 1
+	if got, want := pieceMap(s, 4), "█▓·░"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	// more characters than pieces, each piece gets a couple
+	s = p2p.Stats{Done: []bool{true, false}, Availability: []int{0, 3}}
+	if got, want := pieceMap(s, 4), "██▒▒"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got := pieceMap(p2p.Stats{}, 3); got != "   " {
+		t.Fatalf("no pieces yet: got %q", got)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	d := &Display{downRate: 2048, upRate: 100}
+	s := p2p.Stats{
+		Name:       "file.iso",
+		Length:     4096 + 10240,
+		BytesDone:  4096,
+		NumPieces:  8,
+		PiecesDone: 2,
+		Peers:      []p2p.PeerStats{{Addr: "10.0.0.1:1", Choked: true}, {Addr: "10.0.0.2:1"}},
+	}
+	want := "file.iso: 25.0% (2 of 8 pieces), down 2.0 KiB/s, up 100 B/s, 2 peers (1 choking us), ETA 5s"
+	if got := d.summary(s); got != want {
+		t.Fatalf("got  %q\nwant %q", got, want)
+	}
+	if !strings.Contains(d.summary(p2p.Stats{Name: "x"}), "0.0% (0 of 0 pieces)") {
+		t.Fatalf("summary before we know anything: %q", d.summary(p2p.Stats{Name: "x"}))
+	}
+}
@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket. Tokens are bytes: they drip into the bucket at Rate
+// bytes per second, and you have to take tokens out before reading/writing that
+// many bytes. The bucket holds at most one second worth of tokens, so after sitting
+// idle we can burst for a second but not more than that.
+// A rate of 0 means unlimited. All the methods are safe to call from many goroutines
+// and the rate can be changed while things are running
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int     // bytes per second, 0 for no limit
+	tokens float64 // can go negative when someone takes more than the bucket holds
+	last   time.Time
+}
+
+func NewLimiter(bytesPerSec int) *Limiter {
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	return &Limiter{
+		rate:   bytesPerSec,
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// the process wide limits that every torrent is subject to
+var (
+	GlobalDownload = NewLimiter(0)
+	GlobalUpload   = NewLimiter(0)
+)
+
+// SetRate changes the limit, 0 removes it
+func (l *Limiter) SetRate(bytesPerSec int) {
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = bytesPerSec
+	if l.tokens > float64(bytesPerSec) {
+		l.tokens = float64(bytesPerSec)
+	}
+}
+
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// add the tokens that dripped in since last time, expects l.mu to be held
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// WaitN takes n tokens out of the bucket, sleeping until they've dripped in if needed.
+// A nil Limiter never waits, which makes it easy to leave limits unset
+func (l *Limiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	l.refill(time.Now())
+	// take the tokens now (possibly going into debt) and then sleep off the debt.
+	// that way big reads don't starve, and everyone waiting queues up fairly
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Available reports roughly how many bytes could be taken right now without waiting
+// returns -1 if there's no limit
+func (l *Limiter) Available() int {
+	if l == nil {
+		return -1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return -1
+	}
+	l.refill(time.Now())
+	return int(l.tokens)
+}
+
+// Conn wraps a net.Conn so reads wait on the download limiters and writes wait
+// on the upload limiters. Usually there's two of each: the global one and the
+// torrent's own one. nil limiters are skipped
+type Conn struct {
+	net.Conn
+	Download []*Limiter
+	Upload   []*Limiter
+}
+
+// NewConn wraps conn with the given download (read) and upload (write) limiters
+func NewConn(conn net.Conn, download []*Limiter, upload []*Limiter) *Conn {
+	return &Conn{Conn: conn, Download: download, Upload: upload}
+}
+
+// Allow reports whether n bytes fit in all of these limiters right now, without waiting.
+// Used to hold off on pipelining more block requests when we're at the download limit
+func Allow(n int, limiters ...*Limiter) bool {
+	for _, l := range limiters {
+		if avail := l.Available(); avail >= 0 && avail < n {
+			return false
+		}
+	}
+	return true
+}
+
+// reads are limited after the fact: we can't know how much the peer is going to send
+// us, so we read first and then pay for it. Since the next read has to wait, the
+// average rate still comes out right. We also cap each read at one second worth of
+// the smallest limit so a single read can't blow way past the limit
+func (c *Conn) Read(b []byte) (int, error) {
+	if max := c.maxChunk(c.Download); max > 0 && len(b) > max {
+		b = b[:max]
+	}
+	n, err := c.Conn.Read(b)
+	for _, l := range c.Download {
+		l.WaitN(n)
+	}
+	return n, err
+}
+
+// writes are limited before sending, in chunks so big messages don't go out in one burst
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if max := c.maxChunk(c.Upload); max > 0 && len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		for _, l := range c.Upload {
+			l.WaitN(len(chunk))
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// the smallest non zero rate out of these limiters, or 0 if none of them limit anything
+func (c *Conn) maxChunk(limiters []*Limiter) int {
+	max := 0
+	for _, l := range limiters {
+		if r := l.Rate(); r > 0 && (max == 0 || r < max) {
+			max = r
+		}
+	}
+	return max
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"io"
+	"main/internal/testutil"
+	"testing"
+	"time"
+)
+
+func TestUnlimited(t *testing.T) {
+	var nilLimiter *Limiter
+	for _, l := range []*Limiter{nil, NewLimiter(0), NewLimiter(-5)} {
+		if l.Rate() != 0 || l.Available() != -1 {
+			t.Fatalf("rate %d and %d available, want 0 and -1", l.Rate(), l.Available())
+		}
+		start := time.Now()
+		l.WaitN(1 << 30)
+		if time.Since(start) > 50*time.Millisecond {
+			t.Fatal("waited with no limit")
+		}
+	}
+	if !Allow(1<<30, nilLimiter, NewLimiter(0)) {
+		t.Fatal("no limits but Allow said no")
+	}
+}
+
+// a fresh limiter has one second of burst, after that it's Rate bytes per second
+func TestWaitN(t *testing.T) {
+	l := NewLimiter(10000)
+	start := time.Now()
+	l.WaitN(10000)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("the first second's worth waited %s", time.Since(start))
+	}
+	// 2500 bytes past the burst is a quarter of a second
+	l.WaitN(2500)
+	if took := time.Since(start); took < 200*time.Millisecond || took > 500*time.Millisecond {
+		t.Fatalf("going 2500 bytes into debt at 10000/s took %s, want about 250ms", took)
+	}
+}
+
+func TestAvailableAndAllow(t *testing.T) {
+	l := NewLimiter(1000)
+	if a := l.Available(); a < 990 || a > 1000 {
+		t.Fatalf("%d available, want the whole burst of 1000", a)
+	}
+	// the bucket never holds more than a second's worth, however long it sits
+	time.Sleep(20 * time.Millisecond)
+	if a := l.Available(); a > 1000 {
+		t.Fatalf("%d available, the bucket only holds 1000", a)
+	}
+	if !Allow(500, l, nil) || Allow(2000, l, nil) {
+		t.Fatal("Allow doesn't match what's in the bucket")
+	}
+	l.WaitN(1000)
+	if Allow(100, l, NewLimiter(0)) {
+		t.Fatal("Allow said yes to an empty bucket")
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	l := NewLimiter(100000)
+	l.SetRate(1000)
+	if l.Rate() != 1000 {
+		t.Fatalf("rate is %d after SetRate(1000)", l.Rate())
+	}
+	// lowering the rate shrinks the bucket too
+	if a := l.Available(); a > 1000 {
+		t.Fatalf("%d available after lowering the rate to 1000", a)
+	}
+	l.SetRate(-1)
+	if l.Rate() != 0 || l.Available() != -1 {
+		t.Fatal("a negative rate should remove the limit")
+	}
+	start := time.Now()
+	l.WaitN(1 << 20)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("waited after the limit was removed")
+	}
+}
+
+// writes go out no faster than the slowest upload limiter, and nil ones are skipped
+func TestConnWrite(t *testing.T) {
+	ours, theirs := testutil.Loopback(t)
+	c := NewConn(ours, nil, []*Limiter{nil, NewLimiter(1 << 20), NewLimiter(20000)})
+	go io.Copy(io.Discard, theirs)
+
+	start := time.Now()
+	// 20000 of burst, then 10000 more at 20000/s
+	n, err := c.Write(make([]byte, 30000))
+	if err != nil || n != 30000 {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	if took := time.Since(start); took < 400*time.Millisecond || took > time.Second {
+		t.Fatalf("writing 30000 bytes at 20000/s with a 20000 burst took %s, want about 500ms", took)
+	}
+}
+
+// reads are capped at a second's worth of the download limit, and paid for afterwards
+func TestConnRead(t *testing.T) {
+	ours, theirs := testutil.Loopback(t)
+	c := NewConn(ours, []*Limiter{NewLimiter(10000)}, nil)
+	go theirs.Write(make([]byte, 25000))
+
+	start := time.Now()
+	buf := make([]byte, 25000)
+	got := 0
+	for got < len(buf) {
+		n, err := c.Read(buf[got:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 10000 {
+			t.Fatalf("one read got %d bytes, more than a second's worth", n)
+		}
+		got += n
+	}
+	// 10000 of burst and 15000 more at 10000/s, but the last read's wait happens inside it
+	if took := time.Since(start); took < time.Second || took > 2500*time.Millisecond {
+		t.Fatalf("reading 25000 bytes at 10000/s took %s, want about 1.5s", took)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"main/torrentfile"
+	"main/tracker"
+	"os"
+)
+
+// gotorrent scrape [.torrent file]
+// asks every tracker in the torrent how many seeders and leechers it has
+func runScrape(args []string) {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : [executable] scrape [path to .torrent file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	tf, err := torrentfile.Open(fs.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	trackers := tf.Trackers()
+	if len(trackers) == 0 {
+		fatal("the torrent doesn't have any trackers")
+	}
+
+	failed := 0
+	for _, announce := range trackers {
+		results, err := tracker.Scrape(announce, tf.InfoHash)
+		if err != nil {
+			fmt.Printf("%s: %s\n", announce, err.Error())
+			failed++
+			continue
+		}
+		stats, ok := results[tf.InfoHash]
+		if !ok {
+			fmt.Printf("%s: tracker doesn't know about this torrent\n", announce)
+			continue
+		}
+		fmt.Printf("%s: %d seeders, %d leechers, %d completed\n", announce, stats.Seeders, stats.Leechers, stats.Completed)
+	}
+	if failed == len(trackers) {
+		os.Exit(exitError)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// gotorrent seed [flags] [.torrent file] [path]
+// uploads the files you have to other peers until you stop it with ctrl-c
+func runSeed(args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	c := addCommonFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : [executable] seed [flags] [path to .torrent file] [optional path to the file or directory]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, *c.config, args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	c.apply()
+	tf := openTorrent(fs.Arg(0))
+	if tf.InfoBytes == nil {
+		usageError("can't seed from a magnet link, use a .torrent file")
+	}
+	tf.Settings = c.settings()
+	path := fs.Arg(1)
+	if path == "" {
+		var err error
+		path, err = outputPath(c.output, tf.Name)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Stopping")
+		close(stop)
+	}()
+
+	err := tf.Seed(path, stop)
+	if err != nil {
+		fatal(err)
+	}
+}
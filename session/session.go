@@ -0,0 +1,331 @@
+package session
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"main/client"
+	"main/mse"
+	"main/p2p"
+	"main/peerpool"
+	"main/ratelimit"
+	"main/torrentfile"
+	"main/tracker"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+// a Session runs many torrents at once in one process. They share one port for peers
+// connecting to us, one peer ID, the cap on connections and the rate limits, instead of
+// every torrent fighting over port 6881. Each torrent downloads into the session's data
+// directory, seeds once it's done, and can be paused, resumed and removed on its own.
+// There's no DHT yet, so peers come from trackers, magnet links and web seeds
+
+// ErrExists is what Add says when the torrent is already in the session
+var ErrExists = errors.New("already in the session")
+
+// ErrNameTaken is what Add says when another torrent in the session has the same name,
+// so they'd share files in the data directory. For a magnet link it's only known once
+// there's metadata, and then the torrent fails with it instead
+var ErrNameTaken = errors.New("another torrent in the session has that name")
+
+// Config are the settings for a Session. The zero value works
+type Config struct {
+	// the port peers connect to us on, over TCP and/or uTP depending on Dial. Default 6881
+	Port uint16
+	// already listening sockets to take peers from instead of listening on Port, which
+	// is then the first one's port if it isn't set. Tests use this to get a free port
+	// without racing for it. The session closes them
+	Listeners []net.Listener
+	// where the torrents get downloaded to, each one named after the torrent. Default "."
+	DataDir string
+	// whether to use Message Stream Encryption with peers
+	Encryption mse.Policy
+	// whether to connect to peers over TCP, uTP or both (and listen on the same)
+	Dial client.DialStrategy
+	// most peer connections at once across every torrent, 0 for peerpool.DefaultGlobalConns
+	MaxConns int
+	// and for each torrent, 0 for peerpool.DefaultTorrentConns
+	MaxConnsPerTorrent int
+	// bytes per second across every torrent, 0 for unlimited
+	DownloadLimit int
+	UploadLimit   int
+	// the HTTP client or proxy for HTTP trackers
+	Tracker tracker.Options
+	// where the log lines of the session and all its torrents go, nil for the standard logger
+	Log *log.Logger
+}
+
+// Session is a set of torrents sharing a port, a peer ID and limits
+type Session struct {
+	cfg         Config
+	peerID      [20]byte
+	connLimiter *peerpool.Limiter
+	download    *ratelimit.Limiter
+	upload      *ratelimit.Limiter
+	listeners   []net.Listener
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	// the torrents that are running, by every info hash peers can ask for them by
+	running map[[20]byte]*p2p.Torrent
+	// which torrent's files are at each name in the data directory
+	names  map[string]*Torrent
+	closed bool
+}
+
+// New starts a session, listening for peers on cfg.Port (or cfg.Listeners)
+func New(cfg Config) (*Session, error) {
+	if cfg.Port == 0 && len(cfg.Listeners) > 0 {
+		if addr, ok := cfg.Listeners[0].Addr().(*net.TCPAddr); ok {
+			cfg.Port = uint16(addr.Port)
+		}
+	}
+	if cfg.Port == 0 {
+		cfg.Port = torrentfile.DefaultPort
+	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = "."
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = peerpool.DefaultGlobalConns
+	}
+	if cfg.Log == nil {
+		cfg.Log = log.Default()
+	}
+	s := &Session{
+		cfg:         cfg,
+		connLimiter: peerpool.NewLimiter(cfg.MaxConns),
+		download:    ratelimit.NewLimiter(cfg.DownloadLimit),
+		upload:      ratelimit.NewLimiter(cfg.UploadLimit),
+		torrents:    make(map[[20]byte]*Torrent),
+		running:     make(map[[20]byte]*p2p.Torrent),
+		names:       make(map[string]*Torrent),
+	}
+	// the same kind of peer ID as everyone else's: client and version, then random
+	copy(s.peerID[:], "-GT0001-")
+	rand.Read(s.peerID[8:])
+
+	s.listeners = cfg.Listeners
+	if len(s.listeners) == 0 {
+		listeners, err := torrentfile.Listen(cfg.Port, cfg.Dial)
+		if err != nil {
+			return nil, err
+		}
+		s.listeners = listeners
+	}
+	cfg.Log.Printf("Listening for peers on port %d", cfg.Port)
+	for _, l := range s.listeners {
+		go s.acceptLoop(l)
+	}
+	return s, nil
+}
+
+// SetRateLimits changes the session's download and upload limits (bytes per second,
+// 0 for unlimited) while it's running
+func (s *Session) SetRateLimits(download int, upload int) {
+	s.download.SetRate(download)
+	s.upload.SetRate(upload)
+}
+
+// RateLimits are the session's download and upload limits, 0 for unlimited
+func (s *Session) RateLimits() (download int, upload int) {
+	return s.download.Rate(), s.upload.Rate()
+}
+
+// Add starts downloading tf (from torrentfile.Open or torrentfile.ParseMagnet) into the
+// data directory. Whatever the torrent's settings were, the session's are used
+func (s *Session) Add(tf torrentfile.Torrent) (*Torrent, error) {
+	tf.Settings = torrentfile.Settings{
+		Port:            s.cfg.Port,
+		Encryption:      s.cfg.Encryption,
+		Dial:            s.cfg.Dial,
+		MaxConns:        s.cfg.MaxConnsPerTorrent,
+		ConnLimiter:     s.connLimiter,
+		DownloadLimiter: s.download,
+		UploadLimiter:   s.upload,
+		PeerID:          s.peerID,
+		Tracker:         s.cfg.Tracker,
+		Log:             s.cfg.Log,
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("session is closed")
+	}
+	if _, ok := s.torrents[tf.InfoHash]; ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%x: %w", tf.InfoHash, ErrExists)
+	}
+	t := &Torrent{s: s, tf: &tf, infoHash: tf.InfoHash, name: tf.Name}
+	// a magnet link's name is only a guess until start has the metadata
+	if tf.InfoBytes != nil {
+		err := s.claimNameLocked(t, tf.Name)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+	}
+	s.torrents[tf.InfoHash] = t
+	s.mu.Unlock()
+
+	t.Resume()
+	return t, nil
+}
+
+// Get finds a torrent by its info hash, nil if it isn't in the session
+func (s *Session) Get(infoHash [20]byte) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.torrents[infoHash]
+}
+
+// Torrents are all the torrents in the session, sorted by name
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	ret := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		ret = append(ret, t)
+	}
+	s.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret
+}
+
+// Remove stops a torrent and takes it out of the session. Its files stay where they are,
+// unless deleteData is set
+func (s *Session) Remove(infoHash [20]byte, deleteData bool) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%x isn't in the session", infoHash)
+	}
+	t.Pause()
+	// the name stays taken until the files are gone, so nothing gets added in their place
+	// only to be deleted
+	s.mu.Lock()
+	name, claimed := t.tf.Name, s.names[t.tf.Name] == t
+	s.mu.Unlock()
+	// a magnet link that never got its metadata has nothing on disk, and its name is
+	// only whatever the link said, which could be anything
+	if !claimed {
+		return nil
+	}
+	var err error
+	if deleteData {
+		var path string
+		path, err = s.pathFor(name)
+		if err == nil {
+			err = os.RemoveAll(path)
+		}
+	}
+	s.mu.Lock()
+	delete(s.names, name)
+	s.mu.Unlock()
+	return err
+}
+
+// Close stops every torrent and stops listening
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	var wg sync.WaitGroup
+	for _, t := range s.Torrents() {
+		wg.Add(1)
+		go func(t *Torrent) {
+			defer wg.Done()
+			t.Pause()
+		}(t)
+	}
+	wg.Wait()
+	return nil
+}
+
+// say t's files are at name, unless another torrent's are. s.mu has to be held
+func (s *Session) claimNameLocked(t *Torrent, name string) error {
+	if other, ok := s.names[name]; ok && other != t {
+		return fmt.Errorf("%s: %w", name, ErrNameTaken)
+	}
+	s.names[name] = t
+	return nil
+}
+
+// claimNameLocked for a torrent that's only just got its name from the metadata. It has
+// to still be in the session, or Remove could already be done with it
+func (s *Session) claimName(t *Torrent, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.torrents[t.infoHash] != t {
+		return fmt.Errorf("%s was removed from the session", name)
+	}
+	return s.claimNameLocked(t, name)
+}
+
+// where a torrent's files go
+func (s *Session) pathFor(name string) (string, error) {
+	return torrentfile.PathFor(s.cfg.DataDir, name)
+}
+
+// a torrent started or stopped running, so incoming peers can or can't get at it
+func (s *Session) setRunning(pt *p2p.Torrent, running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range pt.InfoHashes() {
+		if running {
+			s.running[h] = pt
+		} else if s.running[h] == pt {
+			delete(s.running, h)
+		}
+	}
+}
+
+func (s *Session) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.cfg.Log.Println("Session stopped listening:", err)
+			}
+			return
+		}
+		go s.handleIncoming(conn)
+	}
+}
+
+// a peer connected to us: work out which torrent it wants, and hand it over
+func (s *Session) handleIncoming(conn net.Conn) {
+	s.mu.Lock()
+	skeys := make([][20]byte, 0, len(s.running))
+	for h := range s.running {
+		skeys = append(skeys, h)
+	}
+	s.mu.Unlock()
+
+	// encrypted or not, the peer decides, and our policy says what we put up with
+	wrapped, _, err := mse.Accept(conn, skeys, s.cfg.Encryption)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var pt *p2p.Torrent
+	c, err := client.Accept(wrapped, s.peerID, func(h [20]byte) (bool, bool) {
+		s.mu.Lock()
+		pt = s.running[h]
+		s.mu.Unlock()
+		return pt != nil, pt != nil && pt.PieceHashV2 != nil
+	})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	pt.ServePeer(c)
+}
@@ -0,0 +1,318 @@
+package session
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"main/client"
+	"main/internal/testutil"
+	"main/torrentfile"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a session on a free port, downloading into a temp dir
+func testSession(t *testing.T) *Session {
+	t.Helper()
+	s, err := New(Config{Listeners: []net.Listener{testutil.Listen(t)}, DataDir: t.TempDir(), Dial: client.DialTCP, Log: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// put a couple of files in the data dir under name, and make a torrent of them
+func seedTorrent(t *testing.T, s *Session, name string) torrentfile.Torrent {
+	t.Helper()
+	root := filepath.Join(s.cfg.DataDir, name)
+	for path, size := range map[string]int{"a.bin": 40000, "sub/b.bin": 1000} {
+		path = filepath.Join(root, path)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, bytes.Repeat([]byte{byte(size)}, size), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	err := torrentfile.Create(torrentfile.CreateOptions{Path: root, Announce: "http://127.0.0.1:1/announce", PieceLength: 16 << 10}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := torrentfile.Load(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+func waitForState(t *testing.T, tor *Torrent, want State) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, err := tor.State()
+		if state == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("torrent is %s (%v), want %s", state, err, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoveKeepsData(t *testing.T) {
+	s := testSession(t)
+	tf := seedTorrent(t, s, "stuff")
+	tor, err := s.Add(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// everything's on disk already, so it checks the files and goes straight to seeding
+	waitForState(t, tor, Seeding)
+
+	err = s.Remove(tf.InfoHash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Get(tf.InfoHash) != nil || len(s.Torrents()) != 0 {
+		t.Fatal("torrent is still in the session after Remove")
+	}
+	path, _ := s.pathFor("stuff")
+	if _, err := os.Stat(filepath.Join(path, "sub", "b.bin")); err != nil {
+		t.Fatalf("Remove without deleteData took the files: %s", err)
+	}
+	if s.Remove(tf.InfoHash, false) == nil {
+		t.Fatal("removed a torrent twice")
+	}
+}
+
+func TestRemoveDeleteData(t *testing.T) {
+	s := testSession(t)
+	tf := seedTorrent(t, s, "stuff")
+	// something else in the data dir that has to survive
+	other := filepath.Join(s.cfg.DataDir, "stuff2")
+	err := os.WriteFile(other, []byte("not ours"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, err := s.Add(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, tor, Seeding)
+
+	err = s.Remove(tf.InfoHash, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := s.pathFor("stuff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("%s is still there after Remove with deleteData: %v", path, err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("Remove took a file that wasn't the torrent's: %s", err)
+	}
+}
+
+func TestAddTwice(t *testing.T) {
+	s := testSession(t)
+	tf := seedTorrent(t, s, "stuff")
+	_, err := s.Add(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Add(tf)
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("adding the same torrent again: %v, want ErrExists", err)
+	}
+}
+
+// names that would put the files (or delete them) somewhere outside the data dir
+func TestPathFor(t *testing.T) {
+	s := &Session{cfg: Config{DataDir: "/data"}}
+	for _, name := range []string{"", ".", "..", "../etc", "a/b", "/etc"} {
+		if path, err := s.pathFor(name); err == nil {
+			t.Errorf("%q went to %s", name, path)
+		}
+	}
+	if path, err := s.pathFor("stuff"); err != nil || path != filepath.Join("/data", "stuff") {
+		t.Fatalf("stuff went to %q, %v", path, err)
+	}
+}
+
+// peers get told the port of the listener we were handed
+func TestListenersSetPort(t *testing.T) {
+	l := testutil.Listen(t)
+	s, err := New(Config{Listeners: []net.Listener{l}, DataDir: t.TempDir(), Log: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if want := l.Addr().(*net.TCPAddr).Port; int(s.cfg.Port) != want {
+		t.Fatalf("port is %d, want the listener's %d", s.cfg.Port, want)
+	}
+}
+
+// a torrent of the same files under the same name, but private, so it's a different
+// torrent that would use the same directory
+func privateCopy(t *testing.T, s *Session, name string) torrentfile.Torrent {
+	t.Helper()
+	var buf bytes.Buffer
+	err := torrentfile.Create(torrentfile.CreateOptions{Path: filepath.Join(s.cfg.DataDir, name), Private: true, PieceLength: 16 << 10}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := torrentfile.Load(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+// two torrents can't share a directory, or removing one with its data would take the
+// other's files too
+func TestAddSameName(t *testing.T) {
+	s := testSession(t)
+	tf := seedTorrent(t, s, "stuff")
+	other := privateCopy(t, s, "stuff")
+	if other.InfoHash == tf.InfoHash {
+		t.Fatal("the private copy has the same info hash")
+	}
+	tor, err := s.Add(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Add(other)
+	if !errors.Is(err, ErrNameTaken) {
+		t.Fatalf("adding another torrent called stuff: %v, want ErrNameTaken", err)
+	}
+	if s.Get(other.InfoHash) != nil {
+		t.Fatal("the rejected torrent is in the session")
+	}
+	waitForState(t, tor, Seeding)
+
+	// once the first one's gone, the name's free again
+	err = s.Remove(tf.InfoHash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, err = s.Add(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, tor, Seeding)
+}
+
+// a magnet link's name only comes with the metadata, so that's when it clashes
+func TestMagnetSameName(t *testing.T) {
+	// another session seeding stuff, to get the metadata from
+	seeder := testSession(t)
+	tf := seedTorrent(t, seeder, "stuff")
+	seeding, err := seeder.Add(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, seeding, Seeding)
+
+	// and here a different torrent called stuff
+	s := testSession(t)
+	seedTorrent(t, s, "stuff")
+	mine, err := s.Add(privateCopy(t, s, "stuff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, mine, Seeding)
+
+	link := "magnet:?xt=urn:btih:" + hex.EncodeToString(tf.InfoHash[:]) + "&x.pe=" + seeder.listeners[0].Addr().String()
+	magnet, err := torrentfile.ParseMagnet(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, err := s.Add(magnet)
+	if err != nil {
+		t.Fatalf("the magnet link's name isn't known yet, but Add says %v", err)
+	}
+	waitForState(t, tor, Failed)
+	if _, err := tor.State(); !errors.Is(err, ErrNameTaken) {
+		t.Fatalf("failed with %v, want ErrNameTaken", err)
+	}
+	// removing it with its data leaves the other one's alone
+	err = s.Remove(tf.InfoHash, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ := s.pathFor("stuff")
+	if _, err := os.Stat(filepath.Join(path, "a.bin")); err != nil {
+		t.Fatalf("removing the magnet link took the other torrent's files: %s", err)
+	}
+	if state, _ := mine.State(); state != Seeding {
+		t.Fatalf("the other torrent is %s", state)
+	}
+}
+
+// pausing, removing or closing doesn't wait for a peer that's sitting on the metadata
+func TestPauseFetchingMetadata(t *testing.T) {
+	l := testutil.Listen(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	link := "magnet:?xt=urn:btih:" + hex.EncodeToString(make([]byte, 20)) + "&x.pe=" + l.Addr().String()
+	magnet, err := torrentfile.ParseMagnet(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quickly := func(what string, f func()) {
+		t.Helper()
+		done := make(chan struct{})
+		go func() {
+			f()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s is still waiting on the metadata a second later", what)
+		}
+	}
+
+	s := testSession(t)
+	tor, err := s.Add(magnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, tor, Starting)
+	time.Sleep(50 * time.Millisecond)
+	quickly("Pause", tor.Pause)
+	// paused, not failed
+	if state, err := tor.State(); state != Paused {
+		t.Fatalf("torrent is %s (%v) after Pause", state, err)
+	}
+
+	tor.Resume()
+	time.Sleep(50 * time.Millisecond)
+	quickly("Remove", func() { s.Remove(magnet.InfoHash, true) })
+
+	_, err = s.Add(magnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	quickly("Close", func() { s.Close() })
+}
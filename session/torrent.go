@@ -0,0 +1,178 @@
+package session
+
+import (
+	"errors"
+	"main/p2p"
+	"main/torrentfile"
+	"sync"
+)
+
+// State is what a torrent in a session is doing
+type State int
+
+const (
+	// not running, because it was paused (or hasn't been resumed since it failed)
+	Paused State = iota
+	// getting the metadata for a magnet link, or checking what's already on disk
+	Starting
+	Downloading
+	// done downloading, uploading to whoever asks
+	Seeding
+	// stopped by an error, see Torrent.State
+	Failed
+)
+
+func (s State) String() string {
+	switch s {
+	case Paused:
+		return "paused"
+	case Starting:
+		return "starting"
+	case Downloading:
+		return "downloading"
+	case Seeding:
+		return "seeding"
+	case Failed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Torrent is one torrent in a session
+type Torrent struct {
+	s        *Session
+	infoHash [20]byte
+
+	mu sync.Mutex
+	// only touched by run, once it's going
+	tf   *torrentfile.Torrent
+	name string
+	// nil when it's paused, or still starting
+	running *p2p.Torrent
+	// closed to stop run, and closed by run when it's returned. nil when not running
+	stop chan struct{}
+	done chan struct{}
+	err  error
+}
+
+// InfoHash is what the torrent is known by in the session
+func (t *Torrent) InfoHash() [20]byte {
+	return t.infoHash
+}
+
+// Name is the torrent's name. For a magnet link it's whatever the link said, until
+// we have the metadata
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.name
+}
+
+// State is what the torrent is doing, and for Failed, why
+func (t *Torrent) State() (State, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.err != nil:
+		return Failed, t.err
+	case t.stop == nil:
+		return Paused, nil
+	case t.running == nil:
+		return Starting, nil
+	}
+	stats := t.running.Stats()
+	if stats.PiecesDone < stats.NumPieces {
+		return Downloading, nil
+	}
+	return Seeding, nil
+}
+
+// Stats is how the torrent is going, see p2p.Stats. All zeros while it's not running
+func (t *Torrent) Stats() p2p.Stats {
+	t.mu.Lock()
+	running, name := t.running, t.name
+	t.mu.Unlock()
+	if running == nil {
+		return p2p.Stats{Name: name}
+	}
+	return running.Stats()
+}
+
+// Pause stops the torrent, and waits for it to stop. The pieces it has stay on disk
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	stop, done := t.stop, t.done
+	if stop != nil {
+		// someone else might be pausing it too
+		select {
+		case <-stop:
+		default:
+			close(stop)
+		}
+	}
+	t.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Resume starts the torrent again, picking up where it left off. It does nothing
+// if it's already running
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop != nil {
+		return
+	}
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	t.err = nil
+	go t.run(t.stop, t.done)
+}
+
+func (t *Torrent) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	err := t.start(stop)
+	if err != nil {
+		t.s.cfg.Log.Printf("%s: %s", t.Name(), err.Error())
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.err = err
+	t.stop, t.done = nil, nil
+	if t.running != nil {
+		t.s.setRunning(t.running, false)
+		t.running = nil
+	}
+}
+
+func (t *Torrent) start(stop chan struct{}) error {
+	// the name (and so where it goes) might only come with the metadata. Pausing in the
+	// middle of getting it is just paused, not failed
+	err := t.tf.FetchMetadata(stop)
+	if errors.Is(err, p2p.ErrStopped) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.name = t.tf.Name
+	t.mu.Unlock()
+	path, err := t.s.pathFor(t.tf.Name)
+	if err != nil {
+		return err
+	}
+	err = t.s.claimName(t, t.tf.Name)
+	if err != nil {
+		return err
+	}
+
+	return t.tf.Run(path, stop, func(pt *p2p.Torrent) {
+		t.mu.Lock()
+		t.running = pt
+		t.mu.Unlock()
+		t.s.setRunning(pt, true)
+	})
+}
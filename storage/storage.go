@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// a torrent is really one long stream of bytes (that's what the pieces are cut out of),
+// but on disk it can be many files glued end to end. Storage hides that, you just
+// ReadAt/WriteAt an offset into the stream and it figures out which files that touches
+
+// File is one file of the torrent on disk
+type File struct {
+	// where the file is on disk. An empty Path is padding (BEP 47 pad files, or the gap
+	// after each file in a v2 torrent): it reads as zeros and writes to it go nowhere
+	Path   string
+	Length int64
+}
+
+type Storage struct {
+	files []File
+	// offsets[i] is where files[i] starts in the stream
+	offsets []int64
+	handles []*os.File
+	// files that weren't there when we opened read only
+	missing []bool
+	length  int64
+}
+
+// Open opens all the files. With writable set, missing files (and their directories)
+// get created and every file is sized to its length, ready for pieces to be written.
+// Read only, missing files aren't an error until you read from them, so you can still
+// check the pieces of the files that are there
+func Open(files []File, writable bool) (*Storage, error) {
+	s := &Storage{
+		files:   files,
+		offsets: make([]int64, len(files)),
+		handles: make([]*os.File, len(files)),
+		missing: make([]bool, len(files)),
+	}
+	for i, f := range files {
+		s.offsets[i] = s.length
+		s.length += f.Length
+
+		if f.Path == "" {
+			continue
+		}
+		var handle *os.File
+		var err error
+		if writable {
+			err = os.MkdirAll(filepath.Dir(f.Path), 0755)
+			if err == nil {
+				handle, err = os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE, 0644)
+			}
+			if err == nil {
+				err = handle.Truncate(f.Length)
+			}
+		} else {
+			handle, err = os.Open(f.Path)
+			if os.IsNotExist(err) {
+				s.missing[i] = true
+				continue
+			}
+		}
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles[i] = handle
+	}
+	return s, nil
+}
+
+// Length is the total size of all the files
+func (s *Storage) Length() int64 {
+	return s.length
+}
+
+// ReadAt reads len(p) bytes starting at offset off in the stream, across as many files as it takes
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	return s.each(p, off, func(h *os.File, b []byte, fileOff int64) (int, error) {
+		if h == nil {
+			// padding is all zeros
+			for i := range b {
+				b[i] = 0
+			}
+			return len(b), nil
+		}
+		return h.ReadAt(b, fileOff)
+	})
+}
+
+// WriteAt writes p at offset off in the stream, across as many files as it takes
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	return s.each(p, off, func(h *os.File, b []byte, fileOff int64) (int, error) {
+		if h == nil {
+			// padding, nothing to write to
+			return len(b), nil
+		}
+		return h.WriteAt(b, fileOff)
+	})
+}
+
+// split p up into the chunks that land in each file, and call fn for each one.
+// fn gets a nil handle for padding
+func (s *Storage) each(p []byte, off int64, fn func(h *os.File, b []byte, fileOff int64) (int, error)) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.length {
+		return 0, fmt.Errorf("storage: range %d+%d is outside the torrent (%d bytes)", off, len(p), s.length)
+	}
+	done := 0
+	for i, f := range s.files {
+		if done == len(p) {
+			break
+		}
+		start, end := s.offsets[i], s.offsets[i]+f.Length
+		pos := off + int64(done)
+		if pos >= end || pos < start {
+			continue
+		}
+		if s.missing[i] {
+			return done, fmt.Errorf("storage: %s: %w", f.Path, os.ErrNotExist)
+		}
+		chunk := p[done:]
+		if int64(len(chunk)) > end-pos {
+			chunk = chunk[:end-pos]
+		}
+		n, err := fn(s.handles[i], chunk, pos-start)
+		done += n
+		if err != nil && !(err == io.EOF && n == len(chunk)) {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// Sync flushes everything to disk
+func (s *Storage) Sync() error {
+	for _, h := range s.handles {
+		if h != nil {
+			err := h.Sync()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Storage) Close() error {
+	var firstErr error
+	for _, h := range s.handles {
+		if h != nil {
+			err := h.Close()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a, a pad file, an empty file and c, in a directory that doesn't exist yet
+func testFiles(dir string) []File {
+	return []File{
+		{Path: filepath.Join(dir, "a"), Length: 10},
+		{Length: 6},
+		{Path: filepath.Join(dir, "sub", "empty"), Length: 0},
+		{Path: filepath.Join(dir, "sub", "c"), Length: 20},
+	}
+}
+
+func open(t *testing.T, files []File, writable bool) *Storage {
+	t.Helper()
+	s, err := Open(files, writable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestReadWriteAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := open(t, testFiles(dir), true)
+	if s.Length() != 36 {
+		t.Fatalf("length is %d, want 36", s.Length())
+	}
+	// every file's there at its full length straight away, the empty one too
+	for name, size := range map[string]int64{"a": 10, "sub/empty": 0, "sub/c": 20} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || info.Size() != size {
+			t.Fatalf("%s: %v, %v", name, info, err)
+		}
+	}
+
+	// one write from the middle of a, over the padding and the empty file, into c
+	data := []byte("0123456789abcdefghijklmnop")
+	n, err := s.WriteAt(data, 4)
+	if err != nil || n != len(data) {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := os.ReadFile(filepath.Join(dir, "a"))
+	c, _ := os.ReadFile(filepath.Join(dir, "sub", "c"))
+	// what landed on the padding (6789ab) went nowhere
+	if want := "\x00\x00\x00\x00012345"; string(a) != want {
+		t.Fatalf("a is %q, want %q", a, want)
+	}
+	if want := "cdefghijklmnop\x00\x00\x00\x00\x00\x00"; string(c) != want {
+		t.Fatalf("c is %q, want %q", c, want)
+	}
+
+	// and reading it all back, the padding is zeros
+	got := make([]byte, 36)
+	n, err = s.ReadAt(got, 0)
+	if err != nil || n != 36 {
+		t.Fatalf("read %d, %v", n, err)
+	}
+	want := append(append(append([]byte(nil), a...), make([]byte, 6)...), c...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+	// a read that's only padding
+	pad := []byte("xxxx")
+	n, err = s.ReadAt(pad, 11)
+	if err != nil || n != 4 || !bytes.Equal(pad, make([]byte, 4)) {
+		t.Fatalf("read %q from the padding, %d, %v", pad, n, err)
+	}
+	// nothing at all is fine, even right at the end
+	if n, err := s.ReadAt(nil, 36); n != 0 || err != nil {
+		t.Fatalf("empty read at the end: %d, %v", n, err)
+	}
+}
+
+func TestOutOfRange(t *testing.T) {
+	s := open(t, testFiles(t.TempDir()), true)
+	for _, r := range []struct {
+		off  int64
+		size int
+	}{{-1, 1}, {36, 1}, {30, 7}, {0, 37}} {
+		if _, err := s.ReadAt(make([]byte, r.size), r.off); err == nil {
+			t.Errorf("read %d+%d of 36 bytes", r.off, r.size)
+		}
+		if _, err := s.WriteAt(make([]byte, r.size), r.off); err == nil {
+			t.Errorf("wrote %d+%d of 36 bytes", r.off, r.size)
+		}
+	}
+}
+
+// read only, missing files only matter to reads that touch them
+func TestReadOnlyMissing(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "a"), []byte("abcdefghij"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := open(t, testFiles(dir), false)
+
+	got := make([]byte, 14)
+	n, err := s.ReadAt(got, 2)
+	if err != nil || string(got) != "cdefghij\x00\x00\x00\x00\x00\x00" {
+		t.Fatalf("read %q (%d), %v", got, n, err)
+	}
+	n, err = s.ReadAt(make([]byte, 10), 12)
+	if !errors.Is(err, os.ErrNotExist) || n != 4 {
+		t.Fatalf("reading into sub/c: %d, %v, want os.ErrNotExist after the 4 bytes of padding", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub")); !os.IsNotExist(err) {
+		t.Fatalf("opening read only made sub: %v", err)
+	}
+}
+
+// opening for writing cuts files that are too long down to size, and fills out short ones
+func TestOpenResizes(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "a"), bytes.Repeat([]byte{'a'}, 15), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "c"), []byte("ccc"), 0644)
+	open(t, testFiles(dir), true)
+	a, _ := os.ReadFile(filepath.Join(dir, "a"))
+	c, _ := os.ReadFile(filepath.Join(dir, "sub", "c"))
+	if string(a) != "aaaaaaaaaa" || string(c) != "ccc"+string(make([]byte, 17)) {
+		t.Fatalf("a is %q, c is %q", a, c)
+	}
+}
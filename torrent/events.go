@@ -0,0 +1,152 @@
+package torrent
+
+import (
+	"main/p2p"
+	"sync"
+)
+
+// EventType is what happened, see Event
+type EventType int
+
+const (
+	// we connected to a peer, or one connected to us
+	PeerConnected EventType = iota
+	PeerDisconnected
+	// a piece passed its hash check and is on disk
+	PieceDone
+	// a piece failed its hash check, and will be downloaded again
+	PieceFailed
+	// the metadata's there and what was already on disk has been checked, so the
+	// download is about to start
+	Started
+	// every Options.ProgressInterval while it runs
+	Progress
+	// every piece is done. With Options.Seed it keeps seeding, otherwise it stops next
+	Completed
+	// it's not running anymore, see Err
+	Stopped
+)
+
+func (e EventType) String() string {
+	switch e {
+	case PeerConnected:
+		return "peer connected"
+	case PeerDisconnected:
+		return "peer disconnected"
+	case PieceDone:
+		return "piece done"
+	case PieceFailed:
+		return "piece failed"
+	case Started:
+		return "started"
+	case Progress:
+		return "progress"
+	case Completed:
+		return "completed"
+	case Stopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// Event is something that happened to a torrent
+type Event struct {
+	Type EventType
+	// the peer's address, for the peer events and PieceFailed
+	Peer string
+	// the piece's index, for the piece events
+	Piece int
+	// how it's going, for Started, Progress and Completed
+	Stats p2p.Stats
+	// for Stopped, the same as Wait returns: nil if it finished, the context's error if it
+	// was stopped before then, or whatever went wrong
+	Err error
+}
+
+// something listening for events: a callback, or a channel with a callback around it
+type subscriber struct {
+	fn func(Event)
+}
+
+// OnEvent calls fn with every event from now on, until remove is called. fn is called
+// from whichever goroutine the event happened on, so it can be called from several at
+// once, and it holds up the download while it runs: keep it quick
+func (t *Torrent) OnEvent(fn func(Event)) (remove func()) {
+	sub := &subscriber{fn: fn}
+	t.mu.Lock()
+	t.subs = append(t.subs, sub)
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for i, s := range t.subs {
+			if s == sub {
+				t.subs = append(t.subs[:i], t.subs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Events is OnEvent as a channel, with room for buffer events. Nothing waits for the
+// channel: if it's full when an event comes, that event is dropped, so read it promptly
+// (Progress and Stats always have the whole picture again). cancel stops the events and
+// closes the channel
+func (t *Torrent) Events(buffer int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, buffer)
+	var mu sync.Mutex
+	closed := false
+	remove := t.OnEvent(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	})
+	return ch, func() {
+		remove()
+		mu.Lock()
+		defer mu.Unlock()
+		if !closed {
+			closed = true
+			close(ch)
+		}
+	}
+}
+
+// tell everyone listening
+func (t *Torrent) emit(e Event) {
+	t.mu.Lock()
+	subs := append([]*subscriber(nil), t.subs...)
+	t.mu.Unlock()
+	for _, s := range subs {
+		s.fn(e)
+	}
+}
+
+// an event from the download (see torrentfile.Settings.OnEvent), which is also how we
+// know it's complete
+func (t *Torrent) p2pEvent(e p2p.Event) {
+	switch e.Type {
+	case p2p.PeerConnected:
+		t.emit(Event{Type: PeerConnected, Peer: e.Peer})
+	case p2p.PeerDisconnected:
+		t.emit(Event{Type: PeerDisconnected, Peer: e.Peer})
+	case p2p.PieceFailed:
+		t.emit(Event{Type: PieceFailed, Peer: e.Peer, Piece: e.Piece})
+	case p2p.PieceDone:
+		t.emit(Event{Type: PieceDone, Piece: e.Piece})
+		t.mu.Lock()
+		t.left--
+		pt := t.running
+		last := t.left == 0
+		t.mu.Unlock()
+		if last && pt != nil {
+			t.complete(pt)
+		}
+	}
+}
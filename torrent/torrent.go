@@ -0,0 +1,368 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"main/client"
+	"main/mse"
+	"main/p2p"
+	"main/ratelimit"
+	"main/torrentfile"
+	"main/tracker"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// gotorrent as a library, for Go programs that want to download (and seed) a torrent
+// without shelling out. Open a torrent from a file, from bytes or from a magnet link,
+// Start it with a context, and watch it go with Stats or events. Cancelling the context
+// or calling Stop hangs up on every peer and waits for everything to wind down, and
+// nothing gets logged unless you hand it a logger. For many torrents at once sharing a
+// port and limits, see the session package
+
+// Options are how a torrent gets downloaded. The zero value works
+type Options struct {
+	// the directory the torrent gets downloaded into, named after the torrent. Default "."
+	Dir string
+	// the port peers connect to us on, over TCP and/or uTP depending on Dial. Default 6881
+	Port uint16
+	// don't accept connections from peers at all, only connect to them. Use this when
+	// running more than one torrent at a time (they can't share a port), or use a session
+	NoListen bool
+	// whether to use Message Stream Encryption with peers
+	Encryption mse.Policy
+	// whether to connect to peers over TCP, uTP or both
+	Dial client.DialStrategy
+	// max peers to be connected to at once, 0 for peerpool.DefaultTorrentConns
+	MaxConns int
+	// bytes per second, 0 for unlimited. SetRateLimits changes them while it runs
+	DownloadLimit int
+	UploadLimit   int
+	// the HTTP client or proxy for HTTP trackers
+	Tracker tracker.Options
+	// keep seeding once the download is done, until stopped. Otherwise it stops by itself
+	Seed bool
+	// where the log lines go, nil for nowhere
+	Log *log.Logger
+	// how often Progress events come, default a second
+	ProgressInterval time.Duration
+}
+
+// Torrent is one torrent, ready to Start
+type Torrent struct {
+	opts     Options
+	infoHash [20]byte
+	download *ratelimit.Limiter
+	upload   *ratelimit.Limiter
+
+	mu sync.Mutex
+	// only touched by run, once it's going
+	tf   *torrentfile.Torrent
+	name string
+	// nil when it isn't running, or is still starting
+	running *p2p.Torrent
+	// pieces still to go, so we know when it's complete, and completed gets closed
+	// when it is
+	left       int
+	isComplete bool
+	completed  chan struct{}
+	// cancels the context run goes by, and closed by run when it's returned. nil when
+	// it's not running
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+	subs   []*subscriber
+}
+
+// Open reads a .torrent file
+func Open(path string, opts Options) (*Torrent, error) {
+	tf, err := torrentfile.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return newTorrent(tf, opts), nil
+}
+
+// Load is Open for a .torrent file that's already in memory
+func Load(data []byte, opts Options) (*Torrent, error) {
+	tf, err := torrentfile.Load(data)
+	if err != nil {
+		return nil, err
+	}
+	return newTorrent(tf, opts), nil
+}
+
+// OpenMagnet is Open for a magnet link. The metadata (what's actually in the torrent)
+// gets fetched from peers once it's started
+func OpenMagnet(link string, opts Options) (*Torrent, error) {
+	tf, err := torrentfile.ParseMagnet(link)
+	if err != nil {
+		return nil, err
+	}
+	return newTorrent(tf, opts), nil
+}
+
+func newTorrent(tf torrentfile.Torrent, opts Options) *Torrent {
+	if opts.Dir == "" {
+		opts.Dir = "."
+	}
+	if opts.Port == 0 {
+		opts.Port = torrentfile.DefaultPort
+	}
+	if opts.Log == nil {
+		opts.Log = log.New(io.Discard, "", 0)
+	}
+	if opts.ProgressInterval <= 0 {
+		opts.ProgressInterval = time.Second
+	}
+	t := &Torrent{
+		opts:     opts,
+		infoHash: tf.InfoHash,
+		name:     tf.Name,
+		download: ratelimit.NewLimiter(opts.DownloadLimit),
+		upload:   ratelimit.NewLimiter(opts.UploadLimit),
+	}
+	tf.Settings = torrentfile.Settings{
+		Port:            opts.Port,
+		Encryption:      opts.Encryption,
+		Dial:            opts.Dial,
+		MaxConns:        opts.MaxConns,
+		DownloadLimiter: t.download,
+		UploadLimiter:   t.upload,
+		Tracker:         opts.Tracker,
+		Log:             opts.Log,
+		OnEvent:         t.p2pEvent,
+	}
+	t.tf = &tf
+	return t
+}
+
+// InfoHash is what the torrent is known by
+func (t *Torrent) InfoHash() [20]byte {
+	return t.infoHash
+}
+
+// Name is the torrent's name. For a magnet link it's whatever the link said, until
+// we have the metadata
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.name
+}
+
+// Path is where the torrent gets downloaded to. For a magnet link it's only known once
+// the metadata is, "" until then
+func (t *Torrent) Path() string {
+	name := t.Name()
+	if name == "" {
+		return ""
+	}
+	return filepath.Join(t.opts.Dir, name)
+}
+
+// SetRateLimits changes the download and upload limits (bytes per second, 0 for
+// unlimited), even while it's running
+func (t *Torrent) SetRateLimits(download int, upload int) {
+	t.download.SetRate(download)
+	t.upload.SetRate(upload)
+}
+
+// Start starts downloading, picking up where it left off if some of it is already on
+// disk. It returns straight away, the download goes on until ctx is cancelled, Stop is
+// called, or it's done (and Options.Seed isn't set). Wait for that with Done or Wait.
+// A stopped torrent can be started again
+func (t *Torrent) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done != nil {
+		return fmt.Errorf("%s is already running", t.name)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t.cancel = cancel
+	t.done = make(chan struct{})
+	t.err = nil
+	t.isComplete = false
+	go t.run(ctx, t.done)
+	return nil
+}
+
+// Done is closed once the torrent stops, nil if it isn't running
+func (t *Torrent) Done() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done
+}
+
+// Wait waits for the torrent to stop, and says why it did: nil if it finished, the
+// context's error if it was stopped before then, or whatever went wrong
+func (t *Torrent) Wait() error {
+	t.mu.Lock()
+	done := t.done
+	t.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Stop stops the torrent and waits for it, see Wait. Every peer connection is closed by
+// the time it returns, and the pieces it got stay on disk for next time
+func (t *Torrent) Stop() error {
+	t.mu.Lock()
+	cancel := t.cancel
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return t.Wait()
+}
+
+// Stats is how the torrent is going, see p2p.Stats. Before it starts (and while it's
+// getting the metadata or checking what's already on disk) there's nothing in it but
+// the name
+func (t *Torrent) Stats() p2p.Stats {
+	t.mu.Lock()
+	running, name := t.running, t.name
+	t.mu.Unlock()
+	if running == nil {
+		return p2p.Stats{Name: name}
+	}
+	return running.Stats()
+}
+
+func (t *Torrent) run(ctx context.Context, done chan struct{}) {
+	err := t.start(ctx)
+	t.mu.Lock()
+	if err == nil && !t.isComplete {
+		err = ctx.Err()
+	}
+	t.err = err
+	t.running = nil
+	t.cancel()
+	t.cancel, t.done = nil, nil
+	t.mu.Unlock()
+
+	t.emit(Event{Type: Stopped, Err: err})
+	close(done)
+}
+
+func (t *Torrent) start(ctx context.Context) error {
+	// stop ends torrentfile.Run, which otherwise seeds forever once it's complete, and
+	// cuts short getting the metadata or checking what's already on disk
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	stopRun := func() { stopOnce.Do(func() { close(stop) }) }
+	completed := make(chan struct{})
+	t.mu.Lock()
+	t.completed = completed
+	t.mu.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-completed:
+			if t.opts.Seed {
+				<-ctx.Done()
+			}
+		case <-stop:
+		}
+		stopRun()
+	}()
+	// the listeners and Progress events keep going till stop, so they get stopped too
+	var background sync.WaitGroup
+	defer func() {
+		stopRun()
+		background.Wait()
+	}()
+
+	// the name (and so where it goes) might only come with the metadata
+	err := t.tf.FetchMetadata(stop)
+	if errors.Is(err, p2p.ErrStopped) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	name := t.tf.Name
+	path, err := torrentfile.PathFor(t.opts.Dir, name)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.name = name
+	t.mu.Unlock()
+
+	var listeners []net.Listener
+	if !t.opts.NoListen {
+		listeners, err = torrentfile.Listen(t.opts.Port, t.opts.Dial)
+		if err != nil {
+			return err
+		}
+		t.opts.Log.Printf("Listening for peers on port %d", t.opts.Port)
+	}
+
+	err = t.tf.Run(path, stop, func(pt *p2p.Torrent) {
+		stats := pt.Stats()
+		t.mu.Lock()
+		t.running = pt
+		t.left = stats.NumPieces - stats.PiecesDone
+		t.mu.Unlock()
+		t.emit(Event{Type: Started, Stats: stats})
+
+		background.Add(2)
+		go func() {
+			defer background.Done()
+			pt.AcceptPeers(listeners, stop)
+		}()
+		go func() {
+			defer background.Done()
+			t.reportProgress(pt, stop)
+		}()
+		if stats.PiecesDone == stats.NumPieces {
+			t.complete(pt)
+		}
+	})
+	// Run never got going, so nothing took the listeners
+	t.mu.Lock()
+	if t.running == nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	t.mu.Unlock()
+	return err
+}
+
+// every piece is done: say so, and stop if we're not seeding
+func (t *Torrent) complete(pt *p2p.Torrent) {
+	t.mu.Lock()
+	if t.isComplete {
+		t.mu.Unlock()
+		return
+	}
+	t.isComplete = true
+	close(t.completed)
+	t.mu.Unlock()
+	t.opts.Log.Printf("%s is complete", pt.Name)
+	t.emit(Event{Type: Completed, Stats: pt.Stats()})
+}
+
+// a Progress event every so often, until stop is closed
+func (t *Torrent) reportProgress(pt *p2p.Torrent, stop <-chan struct{}) {
+	ticker := time.NewTicker(t.opts.ProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.emit(Event{Type: Progress, Stats: pt.Stats()})
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"main/internal/testutil"
+	"main/torrentfile"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a .torrent for a file of size bytes, with the file itself in seedDir. No trackers,
+// so nothing leaves the machine
+func makeTorrent(t *testing.T, size int) (data []byte, seedDir string) {
+	t.Helper()
+	seedDir = t.TempDir()
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 13)
+	}
+	err := os.WriteFile(filepath.Join(seedDir, "file.bin"), content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = torrentfile.Create(torrentfile.CreateOptions{Path: filepath.Join(seedDir, "file.bin"), PieceLength: 16 << 10}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), seedDir
+}
+
+func load(t *testing.T, data []byte, opts Options) *Torrent {
+	t.Helper()
+	opts.NoListen = true
+	tor, err := Load(data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tor
+}
+
+// wait for an event of type typ, skipping the rest
+func waitFor(t *testing.T, events <-chan Event, typ EventType) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", typ)
+		}
+	}
+}
+
+// Wait, but giving up after a while rather than hanging the test
+func waitStopped(t *testing.T, tor *Torrent) error {
+	t.Helper()
+	stopped := make(chan error, 1)
+	go func() { stopped <- tor.Wait() }()
+	select {
+	case err := <-stopped:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("still running after 5 seconds")
+		return nil
+	}
+}
+
+// with everything already on disk it's complete straight away, and stops by itself
+func TestCompleteStops(t *testing.T) {
+	data, dir := makeTorrent(t, 40000)
+	tor := load(t, data, Options{Dir: dir})
+	events, cancel := tor.Events(100)
+	defer cancel()
+
+	err := tor.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = waitStopped(t, tor)
+	if err != nil {
+		t.Fatalf("Wait says %v, want nil for a finished torrent", err)
+	}
+	started := waitFor(t, events, Started)
+	if started.Stats.PiecesDone != started.Stats.NumPieces || started.Stats.NumPieces != 3 {
+		t.Fatalf("started with %d of %d pieces", started.Stats.PiecesDone, started.Stats.NumPieces)
+	}
+	waitFor(t, events, Completed)
+	if e := waitFor(t, events, Stopped); e.Err != nil {
+		t.Fatalf("stopped event has %v", e.Err)
+	}
+	if tor.Done() != nil {
+		t.Fatal("Done isn't nil once it's stopped")
+	}
+	if tor.Path() != filepath.Join(dir, "file.bin") {
+		t.Fatalf("path is %s", tor.Path())
+	}
+}
+
+// with Seed it keeps going after it's complete, until it's stopped, and that still
+// counts as finished
+func TestCompleteSeeds(t *testing.T) {
+	data, dir := makeTorrent(t, 40000)
+	tor := load(t, data, Options{Dir: dir, Seed: true})
+	events, cancel := tor.Events(100)
+	defer cancel()
+
+	err := tor.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, events, Completed)
+	done := tor.Done()
+	select {
+	case <-done:
+		t.Fatal("stopped after completing, with Seed set")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := tor.Start(context.Background()); err == nil {
+		t.Fatal("started it twice")
+	}
+	err = tor.Stop()
+	if err != nil {
+		t.Fatalf("Stop says %v, want nil for a finished torrent", err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("Done isn't closed once Stop returns")
+	}
+
+	// and it can be started again
+	err = tor.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, events, Completed)
+	err = tor.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stopped before it's done, Wait gives the context's error
+func TestStopBeforeComplete(t *testing.T) {
+	data, _ := makeTorrent(t, 40000)
+	for _, how := range []string{"Stop", "cancel"} {
+		tor := load(t, data, Options{Dir: t.TempDir()})
+		events, cancelEvents := tor.Events(100)
+		ctx, cancel := context.WithCancel(context.Background())
+		err := tor.Start(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e := waitFor(t, events, Started); e.Stats.PiecesDone != 0 {
+			t.Fatalf("%s: started with %d pieces of an empty directory", how, e.Stats.PiecesDone)
+		}
+		if how == "Stop" {
+			err = tor.Stop()
+		} else {
+			cancel()
+			err = waitStopped(t, tor)
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: got %v, want context.Canceled", how, err)
+		}
+		if e := waitFor(t, events, Stopped); !errors.Is(e.Err, context.Canceled) {
+			t.Fatalf("%s: stopped event has %v", how, e.Err)
+		}
+		// and it's the same when asked again
+		if err := tor.Wait(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: second Wait got %v", how, err)
+		}
+		cancel()
+		cancelEvents()
+	}
+}
+
+// stopping while it's still getting the metadata from a peer that never sends it
+// doesn't wait for the peer
+func TestStopFetchingMetadata(t *testing.T) {
+	l := testutil.Listen(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	link := "magnet:?xt=urn:btih:" + hex.EncodeToString(make([]byte, 20)) + "&x.pe=" + l.Addr().String()
+	tor, err := OpenMagnet(link, Options{Dir: t.TempDir(), NoListen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tor.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- tor.Stop() }()
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stop is still waiting on the metadata a second later")
+	}
+	if tor.Path() != "" {
+		t.Fatalf("path is %q without the metadata", tor.Path())
+	}
+}
@@ -0,0 +1,259 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"main/bencode"
+	"main/storage"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CreateOptions are the settings for making a new .torrent file
+type CreateOptions struct {
+	// the file or directory to make a torrent of
+	Path string
+	// the tracker, and optionally backup trackers grouped into tiers (BEP 12).
+	// If Announce is empty, the first tracker in AnnounceList is used
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	// defaults to "gotorrent"
+	CreatedBy string
+	// defaults to now
+	CreationDate time.Time
+	// private torrents only get peers from their trackers (BEP 27)
+	Private bool
+	// HTTP servers that have a copy of the files (BEP 19)
+	WebSeeds []string
+	// bytes per piece, 0 picks one based on the total size
+	PieceLength int
+	// how many goroutines hash pieces at once, 0 means one per CPU
+	Workers int
+}
+
+// the layout of a .torrent file we write. The field order doesn't matter,
+// bencode sorts dictionary keys anyway
+type createTorrent struct {
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	Info         createInfo `bencode:"info"`
+	URLList      []string   `bencode:"url-list,omitempty"`
+}
+
+// single file torrents have length, multi file torrents have files instead
+type createInfo struct {
+	Files       []createFile `bencode:"files,omitempty"`
+	Length      int64        `bencode:"length,omitempty"`
+	Name        string       `bencode:"name"`
+	PieceLength int          `bencode:"piece length"`
+	Pieces      string       `bencode:"pieces"`
+	Private     int          `bencode:"private,omitempty"`
+}
+
+type createFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+// piece lengths we pick from when choosing automatically
+const (
+	minAutoPieceLength = 1 << 15 // 32KB
+	maxAutoPieceLength = 1 << 24 // 16MB
+	// aim for around this many pieces. Fewer pieces means a smaller .torrent file,
+	// more pieces means less data thrown away when a piece fails its hash check
+	targetPieces = 1500
+)
+
+// Create makes a .torrent for opts.Path and writes it (bencoded) to w
+func Create(opts CreateOptions, w io.Writer) error {
+	if opts.Announce == "" && len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		opts.Announce = opts.AnnounceList[0][0]
+	}
+	if opts.CreatedBy == "" {
+		opts.CreatedBy = "gotorrent"
+	}
+	if opts.CreationDate.IsZero() {
+		opts.CreationDate = time.Now()
+	}
+
+	root, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	ct := createTorrent{
+		Announce:     opts.Announce,
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: opts.CreationDate.Unix(),
+		URLList:      opts.WebSeeds,
+		Info: createInfo{
+			Name: filepath.Base(root),
+		},
+	}
+	if opts.Private {
+		ct.Info.Private = 1
+	}
+
+	// figure out which files go in the torrent
+	var files []storage.File
+	if info.IsDir() {
+		files, ct.Info.Files, err = walkDir(root)
+		if err != nil {
+			return err
+		}
+	} else {
+		files = []storage.File{{Path: root, Length: info.Size()}}
+		ct.Info.Length = info.Size()
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.Length
+	}
+	if total == 0 {
+		return fmt.Errorf("%s has nothing in it to make a torrent from", opts.Path)
+	}
+
+	ct.Info.PieceLength = opts.PieceLength
+	if ct.Info.PieceLength == 0 {
+		ct.Info.PieceLength = pickPieceLength(total)
+	}
+	if ct.Info.PieceLength < 1<<14 || ct.Info.PieceLength&(ct.Info.PieceLength-1) != 0 {
+		return fmt.Errorf("piece length must be a power of two of at least 16KB, got %d", ct.Info.PieceLength)
+	}
+
+	pieces, err := hashPieces(files, total, ct.Info.PieceLength, opts.Workers)
+	if err != nil {
+		return err
+	}
+	ct.Info.Pieces = string(pieces)
+
+	return bencode.NewEncoder(w).Encode(ct)
+}
+
+// every regular file under root, in a stable (sorted) order, both as paths on disk and
+// as the path lists that go in the info dictionary
+func walkDir(root string) ([]storage.File, []createFile, error) {
+	var files []storage.File
+	var infoFiles []createFile
+	// WalkDir goes in lexical order, so the order is the same every time
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, storage.File{Path: path, Length: info.Size()})
+		infoFiles = append(infoFiles, createFile{
+			Length: info.Size(),
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		return nil
+	})
+	if err == nil && len(files) == 0 {
+		err = fmt.Errorf("%s has no files in it", root)
+	}
+	return files, infoFiles, err
+}
+
+// the smallest power of two that gets us down to about targetPieces pieces
+func pickPieceLength(total int64) int {
+	pieceLength := minAutoPieceLength
+	for pieceLength < maxAutoPieceLength && total/int64(pieceLength) > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// SHA1 every piece, spread over a few goroutines. Returns all the hashes glued together
+// which is exactly what goes in the "pieces" key
+func hashPieces(files []storage.File, total int64, pieceLength int, workers int) ([]byte, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	store, err := storage.Open(files, false)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	numPieces := int((total + int64(pieceLength) - 1) / int64(pieceLength))
+	hashes := make([]byte, numPieces*sha1.Size)
+
+	// hand out piece indexes over a channel, like the workQueue in p2p
+	indexes := make(chan int, numPieces)
+	for i := 0; i < numPieces; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for i := range indexes {
+				begin := int64(i) * int64(pieceLength)
+				end := begin + int64(pieceLength)
+				if end > total {
+					end = total
+				}
+				_, err := store.ReadAt(buf[:end-begin], begin)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				sum := sha1.Sum(buf[:end-begin])
+				copy(hashes[i*sha1.Size:], sum[:])
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return hashes, nil
+}
+
+// CreateFile is Create, but writes the .torrent straight to a file at out
+func CreateFile(opts CreateOptions, out string) error {
+	var buf bytes.Buffer
+	err := Create(opts, &buf)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, buf.Bytes(), 0644)
+}
@@ -0,0 +1,139 @@
+package torrentfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a directory with an empty file and files a few levels down goes through Create and
+// Load, and every piece of it checks out against what's on disk
+func TestCreateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "stuff")
+	contents := map[string][]byte{
+		"a.bin":            bytes.Repeat([]byte{1}, 40000),
+		"empty.txt":        nil,
+		"sub/b.bin":        bytes.Repeat([]byte{2}, 1000),
+		"sub/deeper/c.iso": bytes.Repeat([]byte{3}, 20000),
+	}
+	for path, data := range contents {
+		writeFile(t, filepath.Join(root, path), data)
+	}
+
+	var buf bytes.Buffer
+	err := Create(CreateOptions{
+		Path:         root,
+		AnnounceList: [][]string{{"http://one/announce", "http://two/announce"}, {"udp://three:80"}},
+		Comment:      "a comment",
+		CreationDate: time.Unix(1700000000, 0),
+		Private:      true,
+		WebSeeds:     []string{"http://mirror/"},
+		PieceLength:  16 << 10,
+		Workers:      3,
+	}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := Load(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tf.Name != "stuff" || tf.Length != 61000 || tf.PieceLength != 16<<10 || tf.NumPieces() != 4 || !tf.Private {
+		t.Fatalf("got name %q, length %d, piece length %d, %d pieces, private %v", tf.Name, tf.Length, tf.PieceLength, tf.NumPieces(), tf.Private)
+	}
+	// the first tracker is the announce URL, when there isn't one of its own
+	if tf.Announce != "http://one/announce" || len(tf.AnnounceList) != 2 || !reflect.DeepEqual(tf.WebSeeds, []string{"http://mirror/"}) {
+		t.Fatalf("trackers %q %q, web seeds %q", tf.Announce, tf.AnnounceList, tf.WebSeeds)
+	}
+	// in the order they're walked, the empty file included
+	want := []File{
+		{Path: []string{"a.bin"}, Length: 40000, Offset: 0},
+		{Path: []string{"empty.txt"}, Length: 0, Offset: 40000},
+		{Path: []string{"sub", "b.bin"}, Length: 1000, Offset: 40000},
+		{Path: []string{"sub", "deeper", "c.iso"}, Length: 20000, Offset: 41000},
+	}
+	if !reflect.DeepEqual(tf.Files, want) {
+		t.Fatalf("files are %+v, want %+v", tf.Files, want)
+	}
+
+	have, err := tf.Verify(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.Count() != tf.NumPieces() {
+		t.Fatalf("%d of %d pieces check out straight after creating it", have.Count(), tf.NumPieces())
+	}
+
+	// a changed byte in b.bin fails the piece it's in, and only that one
+	writeFile(t, filepath.Join(root, "sub", "b.bin"), append(bytes.Repeat([]byte{2}, 999), 9))
+	have, err = tf.Verify(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.Count() != 3 || have.HasPiece(2) {
+		t.Fatalf("%d pieces good after changing a byte in piece 2, has piece 2 is %v", have.Count(), have.HasPiece(2))
+	}
+
+	// and somewhere with nothing there has no good pieces, without that being an error
+	have, err = tf.Verify(filepath.Join(dir, "nowhere"), nil)
+	if err != nil || have.Count() != 0 {
+		t.Fatalf("verifying nothing: %d pieces, %v", have.Count(), err)
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "file.iso"), bytes.Repeat([]byte{5}, 50000))
+	tf := makeTorrent(t, dir, "file.iso")
+	if tf.Name != "file.iso" || tf.Length != 50000 || tf.Files != nil || tf.NumPieces() != 4 {
+		t.Fatalf("got name %q, length %d, files %v, %d pieces", tf.Name, tf.Length, tf.Files, tf.NumPieces())
+	}
+	have, err := tf.Verify(filepath.Join(dir, "file.iso"), nil)
+	if err != nil || have.Count() != 4 {
+		t.Fatalf("%d good pieces, %v", have.Count(), err)
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "file"), []byte("data"))
+	writeFile(t, filepath.Join(dir, "only empty", "empty"), nil)
+	os.Mkdir(filepath.Join(dir, "nothing"), 0755)
+
+	cases := []struct {
+		opts CreateOptions
+		want string
+	}{
+		{CreateOptions{Path: filepath.Join(dir, "missing")}, "no such file"},
+		{CreateOptions{Path: filepath.Join(dir, "nothing")}, "has no files in it"},
+		{CreateOptions{Path: filepath.Join(dir, "only empty")}, "nothing in it"},
+		{CreateOptions{Path: filepath.Join(dir, "file"), PieceLength: 1000}, "power of two"},
+		{CreateOptions{Path: filepath.Join(dir, "file"), PieceLength: 3 << 14}, "power of two"},
+		{CreateOptions{Path: filepath.Join(dir, "file"), PieceLength: 1 << 13}, "at least 16KB"},
+	}
+	for _, c := range cases {
+		err := Create(c.opts, &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%+v: got %v, want an error with %q", c.opts, err, c.want)
+		}
+	}
+}
+
+func TestPickPieceLength(t *testing.T) {
+	for total, want := range map[int64]int{
+		1:         minAutoPieceLength,
+		100 << 20: 1 << 17,
+		4 << 30:   1 << 22,
+		1 << 50:   maxAutoPieceLength,
+	} {
+		if got := pickPieceLength(total); got != want {
+			t.Errorf("%d bytes: piece length %d, want %d", total, got, want)
+		}
+	}
+}
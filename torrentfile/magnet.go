@@ -0,0 +1,203 @@
+package torrentfile
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"main/client"
+	"main/metadata"
+	"main/p2p"
+	"main/peers"
+	"main/tracker"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// magnet links (BEP 9) are a torrent without the .torrent file, e.g.
+// magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker>&ws=<web seed>&x.pe=<host:port>
+// The info hash is either 40 hex characters or 32 base32 ones. Everything but the info
+// hash is optional, and the info dictionary itself comes from peers, see FetchMetadata
+
+// ParseMagnet reads a magnet link. What you get back only has what the link has in it,
+// FetchMetadata (or DownloadToFile, which calls it) gets the rest from peers
+func ParseMagnet(link string) (torrentFile, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return torrentFile{}, err
+	}
+	if u.Scheme != "magnet" {
+		return torrentFile{}, fmt.Errorf("%q isn't a magnet link", link)
+	}
+	q := u.Query()
+
+	tf := torrentFile{
+		MetaVersion: 1,
+		Name:        q.Get("dn"),
+		WebSeeds:    q["ws"],
+		Settings:    Settings{Port: DefaultPort},
+	}
+	found := false
+	v2 := false
+	for _, xt := range q["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			tf.InfoHash, err = parseBTIH(strings.TrimPrefix(xt, "urn:btih:"))
+			if err != nil {
+				return torrentFile{}, err
+			}
+			found = true
+		case strings.HasPrefix(xt, "urn:btmh:"):
+			// a v2 info hash (a multihash, 1220 means SHA-256). We need the v1 one to get
+			// the metadata, so this only matters if it's the only one
+			v2 = true
+		}
+	}
+	if !found {
+		if v2 {
+			return torrentFile{}, fmt.Errorf("v2 only magnet links aren't supported yet")
+		}
+		return torrentFile{}, fmt.Errorf("magnet link has no info hash")
+	}
+
+	// the link doesn't say anything about tiers, so every tracker is its own tier and
+	// they get tried one after the other
+	for _, tr := range q["tr"] {
+		if tr != "" {
+			tf.AnnounceList = append(tf.AnnounceList, []string{tr})
+		}
+	}
+	if len(tf.AnnounceList) > 0 {
+		tf.Announce = tf.AnnounceList[0][0]
+	}
+
+	for _, pe := range q["x.pe"] {
+		host, port, err := net.SplitHostPort(pe)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if ip == nil || err != nil {
+			continue
+		}
+		tf.magnetPeers = append(tf.magnetPeers, peers.Peer{IP: ip, Port: uint16(portNum)})
+	}
+	return tf, nil
+}
+
+func parseBTIH(s string) ([20]byte, error) {
+	var h [20]byte
+	var b []byte
+	var err error
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = fmt.Errorf("wrong length")
+	}
+	if err != nil || len(b) != 20 {
+		return h, fmt.Errorf("bad info hash %q in magnet link", s)
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// FetchMetadata gets the info dictionary from peers, for a torrent that came from a magnet
+// link. Peers come from the link and its trackers. Does nothing if we already have it.
+// Closing stop (which can be nil) ends it early with p2p.ErrStopped
+func (tf *torrentFile) FetchMetadata(stop <-chan struct{}) error {
+	if tf.InfoBytes != nil {
+		return nil
+	}
+	peerID, key := tf.identity()
+
+	ps := tf.magnetPeers
+	if len(tf.AnnounceList) > 0 {
+		resp, err := tf.announce(tracker.AnnounceRequest{
+			InfoHash: tf.InfoHash,
+			PeerID:   peerID,
+			Port:     tf.port(),
+			// we don't know how big it is yet. Anything but 0, or we look like a seeder
+			Left:  1,
+			Event: tracker.EventStarted,
+			Key:   key,
+		})
+		if err != nil {
+			tf.logger().Println("Couldn't get peers from the trackers:", err)
+		} else {
+			ps = append(ps, resp.Peers...)
+		}
+	}
+	tf.logger().Printf("Getting the metadata from %d peers", len(ps))
+
+	info, err := metadata.Fetch(ps, peerID, tf.InfoHash, client.Options{
+		Encryption: tf.Encryption,
+		Dial:       tf.Dial,
+	}, stop)
+	if errors.Is(err, metadata.ErrStopped) {
+		return p2p.ErrStopped
+	}
+	if err != nil {
+		return err
+	}
+
+	bto := bencodeTorrent{
+		Announce:      tf.Announce,
+		Info:          info,
+		AnnounceList:  tf.AnnounceList,
+		URLList:       tf.WebSeeds,
+		noPieceLayers: true,
+	}
+	loaded, err := bto.toTorrentFile()
+	if err != nil {
+		return err
+	}
+
+	// keep the settings and trackers, take everything the info dictionary says
+	tf.PieceHash = loaded.PieceHash
+	tf.PieceLength = loaded.PieceLength
+	tf.Name = loaded.Name
+	tf.Length = loaded.Length
+	tf.Files = loaded.Files
+	tf.Private = loaded.Private
+	tf.InfoBytes = loaded.InfoBytes
+	tf.MetaVersion = loaded.MetaVersion
+	tf.InfoHashV2 = loaded.InfoHashV2
+	tf.PieceHashV2 = loaded.PieceHashV2
+	tf.logger().Printf("Got the metadata for %s", tf.Name)
+	return nil
+}
+
+// MagnetLink is a magnet link for the torrent: its info hashes, name, trackers and web seeds
+func (tf *torrentFile) MagnetLink() string {
+	// v2 only torrents don't have a v1 info hash, InfoHash is just the v2 one cut short
+	var xts []string
+	if _, hybrid := tf.infoHashV2(); tf.MetaVersion != 2 || hybrid {
+		xts = append(xts, "urn:btih:"+hex.EncodeToString(tf.InfoHash[:]))
+	}
+	if tf.MetaVersion == 2 {
+		// a multihash: 0x12 is SHA-256, 0x20 is its length
+		xts = append(xts, "urn:btmh:1220"+hex.EncodeToString(tf.InfoHashV2[:]))
+	}
+
+	// url.Values would sort the keys, but xt reads better first
+	var params []string
+	for _, xt := range xts {
+		params = append(params, "xt="+xt)
+	}
+	if tf.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(tf.Name))
+	}
+	for _, tr := range tf.Trackers() {
+		params = append(params, "tr="+url.QueryEscape(tr))
+	}
+	for _, ws := range tf.WebSeeds {
+		params = append(params, "ws="+url.QueryEscape(ws))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
@@ -0,0 +1,73 @@
+package torrentfile
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var magnetHash = [20]byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+func TestParseMagnet(t *testing.T) {
+	link := "magnet:?xt=urn:btih:" + hex.EncodeToString(magnetHash[:]) +
+		"&dn=some%20file.iso" +
+		"&tr=http%3A%2F%2Ftracker.one%2Fannounce&tr=udp%3A%2F%2Ftracker.two%3A80&tr=" +
+		"&ws=http%3A%2F%2Fmirror%2Fsome%20file.iso" +
+		"&x.pe=10.0.0.1%3A6881&x.pe=%5B2001%3Adb8%3A%3A1%5D%3A51413&x.pe=nonsense&x.pe=host.name%3A1&x.pe=10.0.0.2%3A99999"
+	tf, err := ParseMagnet(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.InfoHash != magnetHash || tf.Name != "some file.iso" || tf.InfoBytes != nil {
+		t.Fatalf("got info hash %x, name %q", tf.InfoHash, tf.Name)
+	}
+	// every tracker is a tier of its own
+	if want := [][]string{{"http://tracker.one/announce"}, {"udp://tracker.two:80"}}; !reflect.DeepEqual(tf.AnnounceList, want) || tf.Announce != want[0][0] {
+		t.Fatalf("trackers are %q and %q", tf.Announce, tf.AnnounceList)
+	}
+	if want := []string{"http://mirror/some file.iso"}; !reflect.DeepEqual(tf.WebSeeds, want) {
+		t.Fatalf("web seeds are %q", tf.WebSeeds)
+	}
+	// only the peers that are an IP and a port
+	var got []string
+	for _, p := range tf.magnetPeers {
+		got = append(got, p.String())
+	}
+	if want := []string{"10.0.0.1:6881", "[2001:db8::1]:51413"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("peers are %q, want %q", got, want)
+	}
+}
+
+func TestParseMagnetBase32(t *testing.T) {
+	for _, encoded := range []string{base32.StdEncoding.EncodeToString(magnetHash[:]), strings.ToLower(base32.StdEncoding.EncodeToString(magnetHash[:]))} {
+		tf, err := ParseMagnet("magnet:?xt=urn:btih:" + encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tf.InfoHash != magnetHash || tf.Name != "" || len(tf.AnnounceList) != 0 {
+			t.Fatalf("%s: got %x", encoded, tf.InfoHash)
+		}
+	}
+}
+
+func TestParseMagnetErrors(t *testing.T) {
+	hexHash := hex.EncodeToString(magnetHash[:])
+	for link, want := range map[string]string{
+		"http://example.com/?xt=urn:btih:" + hexHash: "isn't a magnet link",
+		"magnet:?dn=name":                                "no info hash",
+		"magnet:?xt=urn:sha1:" + hexHash:                 "no info hash",
+		"magnet:?xt=urn:btmh:1220" + hexHash + hexHash:   "v2 only",
+		"magnet:?xt=urn:btih:" + hexHash[:38]:            "bad info hash",
+		"magnet:?xt=urn:btih:" + hexHash[:38] + "zz":     "bad info hash",
+		"magnet:?xt=urn:btih:" + strings.Repeat("1", 32): "bad info hash",
+		"magnet:?xt=urn:btih:" + hexHash + "00":          "bad info hash",
+		"://magnet":                                      "missing protocol scheme",
+	} {
+		_, err := ParseMagnet(link)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error with %q", link, err, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package torrentfile
+
+import (
+	"errors"
+	"main/p2p"
+	"main/peerpool"
+	"main/peers"
+	"main/storage"
+	"main/tracker"
+)
+
+// Run downloads the torrent into path and then seeds it, until stop is closed. It's
+// what a session does with each of its torrents, so unlike DownloadToFile, the pieces
+// go to disk as they come in and it picks up where it left off: whatever's already at
+// path and checks out doesn't get downloaded again. It doesn't listen for peers itself,
+// ready gets the running torrent so whoever does listen can hand it peers (see
+// p2p.ServePeer). Returns nil once stopped
+func (tf *torrentFile) Run(path string, stop <-chan struct{}, ready func(t *p2p.Torrent)) error {
+	// a magnet link doesn't tell us what we're downloading yet
+	// both of these can take a while, and being stopped in the middle of either isn't
+	// an error any more than it is while downloading
+	err := tf.FetchMetadata(stop)
+	if errors.Is(err, p2p.ErrStopped) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	have, err := tf.Verify(path, stop)
+	if errors.Is(err, p2p.ErrStopped) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	files, _ := tf.storageFiles(path)
+	store, err := storage.Open(files, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	t := tf.p2pTorrent()
+	numPieces := t.NumPieces()
+	var left int64
+	for i := 0; i < numPieces; i++ {
+		if !have.HasPiece(i) {
+			left += int64(t.PieceSize(i))
+		}
+	}
+	t.SetHave(have)
+	t.StartServing(store)
+	defer t.StopServing()
+	if ready != nil {
+		ready(t)
+	}
+
+	// the announces run alongside the download, handing it peers as they come in
+	defer tf.closeTrackers()
+	reqs := tf.announceRequests(left)
+	completed := make(chan struct{})
+	leave := make(chan struct{})
+	announced := make(chan struct{})
+	go func() {
+		defer close(announced)
+		tf.keepAnnouncing(reqs, func(req *tracker.AnnounceRequest) {
+			stats := t.Stats()
+			req.Downloaded = stats.Downloaded
+			req.Uploaded = stats.Uploaded
+			req.Left = stats.Length - stats.BytesDone
+		}, func(i int, ps []peers.Peer) {
+			if i == 0 {
+				t.AddPeers(peerpool.SourceTracker, ps...)
+			} else {
+				t.AddPeersV2(ps...)
+			}
+		}, completed, leave)
+	}()
+	defer func() {
+		close(leave)
+		<-announced
+	}()
+	t.AddPeers(peerpool.SourceTracker, tf.magnetPeers...)
+
+	if left > 0 {
+		stopWatching := tf.watch(t)
+		err = t.DownloadTo(store, have, stop)
+		stopWatching()
+		if errors.Is(err, p2p.ErrStopped) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = store.Sync()
+		if err != nil {
+			return err
+		}
+		close(completed)
+		tf.logger().Printf("Finished downloading %s, seeding", tf.Name)
+	}
+
+	<-stop
+	return nil
+}
@@ -0,0 +1,247 @@
+package torrentfile
+
+import (
+	"errors"
+	"fmt"
+	"main/bitfield"
+	"main/client"
+	"main/p2p"
+	"main/peers"
+	"main/storage"
+	"main/tracker"
+	"main/utp"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Verify checks the torrent's files at path (the file for a single file torrent, the
+// directory for a multi file one) against the piece hashes, and returns which pieces
+// are good. Missing files just mean their pieces aren't. Closing stop (which can be nil)
+// ends it early with p2p.ErrStopped
+func (tf *torrentFile) Verify(path string, stop <-chan struct{}) (bitfield.Bitfield, error) {
+	files, _ := tf.storageFiles(path)
+	store, err := storage.Open(files, false)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	t := tf.p2pTorrent()
+	numPieces := t.NumPieces()
+	good := make([]bool, numPieces)
+
+	// hashing is the slow part, so spread it over the CPUs
+	indexes := make(chan int, numPieces)
+	for i := 0; i < numPieces; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, tf.PieceLength)
+			for i := range indexes {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				piece := buf[:t.PieceSize(i)]
+				_, err := store.ReadAt(piece, int64(i)*int64(tf.PieceLength))
+				good[i] = err == nil && t.VerifyPiece(i, piece)
+			}
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-stop:
+		return nil, p2p.ErrStopped
+	default:
+	}
+
+	have := bitfield.New(numPieces)
+	for i, ok := range good {
+		if ok {
+			have.SetPiece(i)
+		}
+	}
+	return have, nil
+}
+
+// WrongSizes lists the torrent's files at path that are there but aren't the size the
+// torrent says, e.g. with junk on the end. Verify can't see that, every piece still
+// checks out. Missing files aren't in the list, their pieces just aren't good
+func (tf *torrentFile) WrongSizes(path string) ([]string, error) {
+	files, _ := tf.storageFiles(path)
+	var ret []string
+	for _, f := range files {
+		if f.Path == "" {
+			continue
+		}
+		info, err := os.Stat(f.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case info.IsDir():
+			ret = append(ret, fmt.Sprintf("%s is a directory, should be a %d byte file", f.Path, f.Length))
+		case info.Size() != f.Length:
+			ret = append(ret, fmt.Sprintf("%s is %d bytes, should be %d", f.Path, info.Size(), f.Length))
+		}
+	}
+	return ret, nil
+}
+
+// how long to wait between announces if the tracker doesn't say
+const defaultAnnounceInterval = 30 * time.Minute
+
+// Seed uploads the torrent's files at path to anyone who asks, until stop is closed.
+// The files get checked first, and we only offer the pieces that are good
+func (tf *torrentFile) Seed(path string, stop <-chan struct{}) error {
+	have, err := tf.Verify(path, stop)
+	if errors.Is(err, p2p.ErrStopped) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t := tf.p2pTorrent()
+	numPieces := t.NumPieces()
+	var left int64
+	haveCount := 0
+	for i := 0; i < numPieces; i++ {
+		if have.HasPiece(i) {
+			haveCount++
+		} else {
+			left += int64(t.PieceSize(i))
+		}
+	}
+	if haveCount == 0 {
+		return fmt.Errorf("none of %s is at %s", tf.Name, path)
+	}
+	tf.logger().Printf("Seeding %d of %d pieces of %s", haveCount, numPieces, tf.Name)
+
+	files, _ := tf.storageFiles(path)
+	store, err := storage.Open(files, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	listeners, err := Listen(tf.port(), tf.Dial)
+	if err != nil {
+		return err
+	}
+	tf.logger().Printf("Listening for peers on port %d", tf.port())
+
+	defer tf.closeTrackers()
+	reqs := tf.announceRequests(left)
+	announced := make(chan struct{})
+	go func() {
+		defer close(announced)
+		tf.keepAnnouncing(reqs, func(req *tracker.AnnounceRequest) {
+			req.Uploaded = t.Uploaded()
+		}, nil, nil, stop)
+	}()
+
+	err = t.Seed(listeners, store, have, stop)
+	<-announced
+	return err
+}
+
+// the started announces for the torrent: one, or two for a hybrid torrent (the v1 swarm
+// first, then the v2 one)
+func (tf *torrentFile) announceRequests(left int64) []tracker.AnnounceRequest {
+	peerID, key := tf.identity()
+	reqs := []tracker.AnnounceRequest{{
+		InfoHash: tf.InfoHash,
+		PeerID:   peerID,
+		Port:     tf.port(),
+		Left:     left,
+		Event:    tracker.EventStarted,
+		Key:      key,
+	}}
+	if h, hybrid := tf.infoHashV2(); hybrid {
+		reqV2 := reqs[0]
+		reqV2.InfoHash = h
+		reqs = append(reqs, reqV2)
+	}
+	return reqs
+}
+
+// Listen listens for peers on port, over TCP and/or uTP depending on dial
+func Listen(port uint16, dial client.DialStrategy) ([]net.Listener, error) {
+	addr := ":" + strconv.Itoa(int(port))
+	var listeners []net.Listener
+	if dial != client.DialUTP {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if dial != client.DialTCP {
+		l, err := utp.Listen(addr)
+		if err != nil {
+			for _, other := range listeners {
+				other.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// announce every interval until stop is closed, then say goodbye. progress fills in how
+// much we've uploaded, downloaded and have left before each announce, for the trackers
+// that keep count (private ones do). The peers we get back go to gotPeers, with which
+// request they came from (can be nil). Closing completed announces event=completed
+// straight away
+func (tf *torrentFile) keepAnnouncing(reqs []tracker.AnnounceRequest, progress func(req *tracker.AnnounceRequest),
+	gotPeers func(i int, ps []peers.Peer), completed <-chan struct{}, stop <-chan struct{}) {
+	for {
+		interval := defaultAnnounceInterval
+		for i := range reqs {
+			progress(&reqs[i])
+			resp, err := tf.announce(reqs[i])
+			if err != nil {
+				tf.logger().Println("Couldn't announce:", err)
+			} else {
+				if resp.Interval > 0 && resp.Interval < interval {
+					interval = resp.Interval
+				}
+				if gotPeers != nil {
+					gotPeers(i, resp.Peers)
+				}
+			}
+			reqs[i].Event = tracker.EventNone
+		}
+
+		select {
+		case <-stop:
+			for i := range reqs {
+				progress(&reqs[i])
+				reqs[i].Event = tracker.EventStopped
+				tf.announce(reqs[i])
+			}
+			return
+		case <-completed:
+			for i := range reqs {
+				reqs[i].Event = tracker.EventCompleted
+			}
+			// only once
+			completed = nil
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package torrentfile
+
+import (
+	"bytes"
+	"errors"
+	"main/p2p"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// make a torrent of the files under dir/name, and load it back
+func makeTorrent(t *testing.T, dir, name string) Torrent {
+	t.Helper()
+	var buf bytes.Buffer
+	err := Create(CreateOptions{Path: filepath.Join(dir, name), Announce: "http://127.0.0.1/announce", PieceLength: 16 << 10}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, err := Load(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyWrongSizes(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "stuff")
+	one := filepath.Join(root, "one.bin")
+	two := filepath.Join(root, "sub", "two.bin")
+	// one ends exactly on a piece boundary, so junk after it can't fail a piece
+	writeFile(t, one, bytes.Repeat([]byte{1}, 32<<10))
+	writeFile(t, two, bytes.Repeat([]byte{2}, 10000))
+	tf := makeTorrent(t, dir, "stuff")
+
+	wrong, err := tf.WrongSizes(root)
+	if err != nil || len(wrong) != 0 {
+		t.Fatalf("fresh files: %v, %v", wrong, err)
+	}
+
+	f, err := os.OpenFile(one, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{'!'})
+	f.Close()
+
+	have, err := tf.Verify(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.Count() != tf.NumPieces() {
+		t.Fatalf("%d of %d pieces good, the extra byte shouldn't touch any", have.Count(), tf.NumPieces())
+	}
+	wrong, err = tf.WrongSizes(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wrong) != 1 || !strings.Contains(wrong[0], "one.bin is 32769 bytes, should be 32768") {
+		t.Fatalf("wanted one.bin reported as a byte too long, got %q", wrong)
+	}
+
+	// a missing file is Verify's business, a directory in its place is ours
+	os.Remove(one)
+	os.Remove(two)
+	os.Mkdir(two, 0755)
+	wrong, err = tf.WrongSizes(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wrong) != 1 || !strings.Contains(wrong[0], "two.bin is a directory") {
+		t.Fatalf("wanted just two.bin reported as a directory, got %q", wrong)
+	}
+}
+
+func TestVerifyWrongSizesSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.iso")
+	writeFile(t, path, bytes.Repeat([]byte{3}, 20000))
+	tf := makeTorrent(t, dir, "file.iso")
+
+	writeFile(t, path, bytes.Repeat([]byte{3}, 19999))
+	wrong, err := tf.WrongSizes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wrong) != 1 || !strings.Contains(wrong[0], "is 19999 bytes, should be 20000") {
+		t.Fatalf("wanted the short file reported, got %q", wrong)
+	}
+}
+
+// checking what's on disk can take a while for a big torrent, so it can be stopped
+func TestVerifyStopped(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "file.iso"), bytes.Repeat([]byte{4}, 100000))
+	tf := makeTorrent(t, dir, "file.iso")
+	stop := make(chan struct{})
+	close(stop)
+	_, err := tf.Verify(filepath.Join(dir, "file.iso"), stop)
+	if !errors.Is(err, p2p.ErrStopped) {
+		t.Fatalf("got %v, want p2p.ErrStopped", err)
+	}
+}
@@ -1,22 +1,27 @@
 package torrentfile
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"log"
+	"main/bencode"
+	"main/client"
+	"main/mse"
 	"main/p2p"
+	"main/peerpool"
 	"main/peers"
+	"main/ratelimit"
+	"main/storage"
+	"main/tracker"
 	"math/rand"
-	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
-
-	"github.com/jackpal/bencode-go"
 )
 
-// Port to listen on
-const Port uint16 = 6881
+// DefaultPort is the port we tell trackers we're on, and listen on when seeding
+const DefaultPort uint16 = 6881
 
 // the third parameters are called struct tags
 // https://stackoverflow.com/questions/25497375/what-is-the-third-parameter-of-a-go-struct-field
@@ -28,22 +33,190 @@ type bencodeInfo struct {
 	Pieces      string `bencode:"pieces"`
 	PieceLength int    `bencode:"piece length"`
 	Name        string `bencode:"name"`
-	Length      int    `bencode:"length"`
+	// single file torrents have length, multi file torrents have files instead
+	Length int           `bencode:"length"`
+	Files  []bencodeFile `bencode:"files"`
+	// 1 means private (BEP 27): only use peers from the tracker. It's part of the info
+	// dictionary so it's covered by the info hash, nobody can strip it off
+	Private int `bencode:"private"`
+	// BitTorrent v2 (BEP 52). meta version is 2 for v2 and hybrid torrents,
+	// and the file tree replaces files/length. See v2.go
+	MetaVersion int                `bencode:"meta version"`
+	FileTree    bencode.RawMessage `bencode:"file tree"`
+}
+
+// one file in a multi file torrent. path is the directories then the file name,
+// relative to the torrent's directory
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	// "p" means it's a pad file (BEP 47), only there so the next file starts on a piece boundary
+	Attr string `bencode:"attr"`
 }
 
+// Info is kept raw, since the info hash is the SHA1 of exactly those bytes.
+// It gets decoded into a bencodeInfo separately
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce string             `bencode:"announce"`
+	Info     bencode.RawMessage `bencode:"info"`
+	// backup trackers, in tiers (BEP 12)
+	AnnounceList [][]string `bencode:"announce-list"`
+	// web seeds (BEP 19), HTTP servers with a copy of the files
+	URLList urlList `bencode:"url-list"`
+	// v2 only, the piece layer of the merkle tree of every file bigger than a piece,
+	// keyed by the file's pieces root
+	PieceLayers map[string]string `bencode:"piece layers"`
+	// optional, none of these are covered by the info hash
+	Comment      string `bencode:"comment"`
+	CreatedBy    string `bencode:"created by"`
+	CreationDate int64  `bencode:"creation date"`
+
+	// set when the info dictionary came from peers (a magnet link), so there's
+	// nothing but the info dictionary
+	noPieceLayers bool
 }
 
+// url-list is allowed to be a single URL instead of a list
+type urlList []string
+
+func (u *urlList) UnmarshalBencode(data []byte) error {
+	var one string
+	if bencode.Unmarshal(data, &one) == nil {
+		*u = nil
+		if one != "" {
+			*u = urlList{one}
+		}
+		return nil
+	}
+	var many []string
+	err := bencode.Unmarshal(data, &many)
+	if err != nil {
+		return err
+	}
+	*u = nil
+	for _, s := range many {
+		if s != "" {
+			*u = append(*u, s)
+		}
+	}
+	return nil
+}
+
+// File is one file of a multi file torrent. p2p needs the file list too (for web seeds),
+// so the type lives there
+type File = p2p.File
+
+// Torrent is what Open and ParseMagnet give you, for code outside this package that
+// needs to name it
+type Torrent = torrentFile
+
 // the same as the two struct above but in one struct?
 type torrentFile struct {
-	Announce    string
-	InfoHash    [20]byte   // SHA1 hash of the bencodeInfo structure. Used to uniquely identify a torrent file
-	PieceHash   [][20]byte // slice (of an byte array of size 20]). Reason is because each SHA-1 hash is 20 bytes or 160 bits
-	PieceLength int
-	Name        string
-	Length      int
+	Announce string
+	// every tracker, grouped into tiers (BEP 12). Has Announce in it too
+	AnnounceList [][]string
+	InfoHash     [20]byte   // SHA1 hash of the info dictionary (InfoBytes). Used to uniquely identify a torrent file
+	PieceHash    [][20]byte // slice (of an byte array of size 20]). Reason is because each SHA-1 hash is 20 bytes or 160 bits
+	PieceLength  int
+	Name         string
+	Length       int
+	// nil for single file torrents
+	Files []File
+	// private torrents only get peers from their trackers (BEP 27)
+	Private bool
+	// HTTP servers with a copy of the files (BEP 19)
+	WebSeeds []string
+	// what whoever made the torrent said about it, all optional. CreationDate is the
+	// zero time if it isn't there
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	// the info dictionary exactly as it was in the .torrent file. InfoHash is the SHA1 of
+	// this, and it's what we'd hand to peers that ask us for the metadata
+	InfoBytes []byte
+
+	// 1 for plain old torrents, 2 for v2 and hybrid torrents (BEP 52)
+	MetaVersion int
+	// SHA-256 of InfoBytes, only for v2 and hybrid torrents. For v2 only torrents InfoHash is
+	// this cut down to 20 bytes, since that's all that fits in the handshake
+	InfoHashV2 [32]byte
+	// the merkle hashes every piece gets checked against, nil for v1 only torrents
+	PieceHashV2 []p2p.PieceHashV2
+
+	// the rest aren't from the .torrent file, they're settings for the download
+	Settings
+
+	// one per tracker URL we've announced to
+	announcers map[string]tracker.Announcer
+	// who we are to trackers and peers, made the first time we need them
+	peerID [20]byte
+	key    uint32
+	// peers that came in the magnet link (x.pe), see magnet.go
+	magnetPeers []peers.Peer
+}
+
+// Settings are how we download and seed a torrent, as opposed to what the torrent is
+type Settings struct {
+	// the port we tell trackers we accept peer connections on, and listen on when seeding
+	Port uint16
+	// whether to use Message Stream Encryption with peers
+	Encryption mse.Policy
+	// whether to connect to peers over TCP, uTP or both
+	Dial client.DialStrategy
+	// max peers to be connected to at once, 0 for the default
+	MaxConns int
+	// the cap on connections this torrent shares with others, nil for peerpool.DefaultLimiter
+	ConnLimiter *peerpool.Limiter
+	// rate limits on top of the global ones, e.g. shared by the torrents of a session. nil for none
+	DownloadLimiter *ratelimit.Limiter
+	UploadLimiter   *ratelimit.Limiter
+	// who we are to trackers and peers, all zeros for a random one
+	PeerID [20]byte
+	// the HTTP client or proxy for HTTP trackers
+	Tracker tracker.Options
+	// where the log lines go, nil for the standard logger
+	Log *log.Logger
+	// if set, it's told about peers and pieces as the download and seeding go, see p2p.Event
+	OnEvent func(p2p.Event)
+	// if set, it gets the download while it runs, to show its progress (see the progress
+	// package). It should return once done is closed
+	Watch func(t *p2p.Torrent, done <-chan struct{})
+}
+
+// the trackers grouped into tiers. If the torrent has an announce-list, that's it and
+// announce is ignored (BEP 12 says so), otherwise announce is the only tier
+func announceTiers(announce string, announceList [][]string) [][]string {
+	var tiers [][]string
+	for _, tier := range announceList {
+		var urls []string
+		for _, u := range tier {
+			if u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) > 0 {
+			tiers = append(tiers, urls)
+		}
+	}
+	if len(tiers) == 0 && announce != "" {
+		tiers = [][]string{{announce}}
+	}
+	return tiers
+}
+
+// Trackers returns every tracker URL in the torrent, once each, in tier order
+func (tf *torrentFile) Trackers() []string {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, tier := range tf.AnnounceList {
+		for _, u := range tier {
+			if !seen[u] {
+				seen[u] = true
+				ret = append(ret, u)
+			}
+		}
+	}
+	return ret
 }
 
 // unmarshal the .torrent file into our struct of type bencodeTorrent
@@ -51,17 +224,19 @@ type torrentFile struct {
 // then to the flatter torrentFile struct which is nicer to work with in Go
 // using our custom function toTorrentFile
 func Open(path string) (torrentFile, error) {
-	bto := bencodeTorrent{}
-
-	// get io.Reader type for Unmarshal
-	read, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return torrentFile{}, err
 	}
-	defer read.Close()
+	return Load(data)
+}
+
+// Load is Open for a .torrent file that's already in memory, e.g. one that came over HTTP
+func Load(data []byte) (torrentFile, error) {
+	bto := bencodeTorrent{}
 
 	// bencode -> structs
-	err = bencode.Unmarshal(read, &bto)
+	err := bencode.Unmarshal(data, &bto)
 	if err != nil {
 		return torrentFile{}, err
 	}
@@ -70,30 +245,109 @@ func Open(path string) (torrentFile, error) {
 
 // convert from a bencodeTorrent struct to a torrentFile struct
 func (bto *bencodeTorrent) toTorrentFile() (torrentFile, error) {
-	// get the hash of info dictionary
-	infoHash, err := bto.Info.hash()
-	if err != nil {
-		return torrentFile{}, err
+	if len(bto.Info) == 0 {
+		return torrentFile{}, fmt.Errorf("torrent file has no info dictionary")
 	}
-
-	// convert pieces string to [][20]byte
-	pieceSlice, err := bto.Info.makeSlices()
+	info := bencodeInfo{}
+	err := bencode.Unmarshal(bto.Info, &info)
 	if err != nil {
 		return torrentFile{}, err
 	}
+	if info.PieceLength <= 0 {
+		return torrentFile{}, fmt.Errorf("piece length is %d", info.PieceLength)
+	}
 
 	ret := torrentFile{
-		Announce:    bto.Announce,
-		InfoHash:    infoHash,
-		PieceHash:   pieceSlice,
-		PieceLength: bto.Info.PieceLength,
-		Name:        bto.Info.Name,
-		Length:      bto.Info.Length,
+		Announce:     bto.Announce,
+		AnnounceList: announceTiers(bto.Announce, bto.AnnounceList),
+		PieceLength:  info.PieceLength,
+		Name:         info.Name,
+		InfoBytes:    bto.Info,
+		MetaVersion:  1,
+		Private:      info.Private == 1,
+		WebSeeds:     bto.URLList,
+		Comment:      bto.Comment,
+		CreatedBy:    bto.CreatedBy,
+		Settings:     Settings{Port: DefaultPort},
+	}
+	if bto.CreationDate > 0 {
+		ret.CreationDate = time.Unix(bto.CreationDate, 0)
 	}
 
+	switch info.MetaVersion {
+	case 0, 1:
+	case 2:
+		ret.MetaVersion = 2
+	default:
+		return torrentFile{}, fmt.Errorf("unsupported meta version %d", info.MetaVersion)
+	}
+
+	// v1 only and hybrid torrents have the SHA1 pieces. v2 only torrents don't
+	if ret.MetaVersion == 1 || info.Pieces != "" {
+		err = ret.loadV1(&info)
+		if err != nil {
+			return torrentFile{}, err
+		}
+	}
+	if ret.MetaVersion == 2 && bto.noPieceLayers {
+		// a magnet link only gets us the info dictionary, and the piece layers aren't in
+		// it. A hybrid still works as a plain v1 torrent, a v2 only one doesn't
+		if info.Pieces == "" {
+			return torrentFile{}, fmt.Errorf("v2 only torrents can't be downloaded from a magnet link yet")
+		}
+		ret.MetaVersion = 1
+	} else if ret.MetaVersion == 2 {
+		err = ret.loadV2(&info, bto.PieceLayers)
+		if err != nil {
+			return torrentFile{}, err
+		}
+	}
 	return ret, nil
 }
 
+// fill in the v1 parts: the SHA1 info hash, piece hashes and the file list
+func (tf *torrentFile) loadV1(info *bencodeInfo) error {
+	// get the hash of info dictionary, exactly as it was in the file
+	tf.InfoHash = sha1.Sum(tf.InfoBytes)
+
+	// convert pieces string to [][20]byte
+	pieceSlice, err := info.makeSlices()
+	if err != nil {
+		return err
+	}
+	tf.PieceHash = pieceSlice
+
+	if info.Files == nil {
+		tf.Length = info.Length
+	} else {
+		for _, f := range info.Files {
+			if f.Length < 0 {
+				return fmt.Errorf("file %v has length %d", f.Path, f.Length)
+			}
+			err = checkPath(f.Path)
+			if err != nil {
+				return err
+			}
+			tf.Files = append(tf.Files, File{
+				Path:    f.Path,
+				Length:  f.Length,
+				Offset:  tf.Length,
+				Padding: strings.Contains(f.Attr, "p"),
+			})
+			tf.Length += f.Length
+		}
+	}
+
+	// every piece but the last one is full, so that tells us exactly how many there should be
+	if tf.Length <= 0 {
+		return fmt.Errorf("torrent has length %d", tf.Length)
+	}
+	if want := (tf.Length + tf.PieceLength - 1) / tf.PieceLength; want != len(tf.PieceHash) {
+		return fmt.Errorf("torrent has %d piece hashes but its length needs %d", len(tf.PieceHash), want)
+	}
+	return nil
+}
+
 // transform a string of pieces to [][20]byte, used in toTorrentFile
 func (binfo *bencodeInfo) makeSlices() ([][20]byte, error) {
 	hashLen := 20
@@ -119,93 +373,161 @@ func (binfo *bencodeInfo) makeSlices() ([][20]byte, error) {
 
 }
 
-// hash a bencodeInfo struct to uniquely ID a torrentfile, used in toTorrentFile
-func (binfo *bencodeInfo) hash() ([20]byte, error) {
-	// bencodeInfo struct -> bencode
-	var becodeInfoBencoded bytes.Buffer
-
-	// just a go sidenote, Marshal expects something of type io.Writer as first arg
-	// this is actually an interface, and bytes.Buffer implements it since it has a
-	// function with signature "Write(p []byte) (n int, err error)" therefore this is valid
-	// syntax!
-	err := bencode.Marshal(&becodeInfoBencoded, *binfo)
+// who we are to trackers and peers. The peer ID is random, and so is the key, which
+// stays the same for every announce so trackers know it's still us
+func (tf *torrentFile) identity() ([20]byte, uint32) {
+	if tf.peerID == [20]byte{} {
+		tf.peerID = tf.PeerID
+		if tf.peerID == [20]byte{} {
+			rand.Read(tf.peerID[:])
+		}
+		tf.key = rand.Uint32()
+	}
+	return tf.peerID, tf.key
+}
 
-	if err != nil {
-		return [20]byte{}, err
+// where the log lines go, the standard logger unless Settings.Log says otherwise
+func (tf *torrentFile) logger() *log.Logger {
+	if tf.Log != nil {
+		return tf.Log
 	}
-	// get the SHA1 hash, using sha1 library
-	bencodeInfoHashed := sha1.Sum(becodeInfoBencoded.Bytes())
+	return log.Default()
+}
 
-	return bencodeInfoHashed, nil
+func (tf *torrentFile) port() uint16 {
+	if tf.Port == 0 {
+		return DefaultPort
+	}
+	return tf.Port
 }
 
-// this function make the first request to tracker and parses the response into
-// a slice of Peer objects for returning
-func (tf *torrentFile) requestPeers(peerID [20]byte, Port uint16) ([]peers.Peer, error) {
+// the v2 info hash cut down to 20 bytes, and whether it's a second swarm (a hybrid torrent)
+func (tf *torrentFile) infoHashV2() ([20]byte, bool) {
+	var h [20]byte
+	copy(h[:], tf.InfoHashV2[:20])
+	return h, tf.MetaVersion == 2 && h != tf.InfoHash
+}
 
-	// get final URL with query params already in
-	requestURL, err := tf.buildTrackerURL(peerID, Port)
-	if err != nil {
-		return nil, err
-	}
+// NumPieces is how many pieces the torrent has
+func (tf *torrentFile) NumPieces() int {
+	return tf.p2pTorrent().NumPieces()
+}
 
-	// setup HTTP stuff
-	httpClient := &http.Client{Timeout: 15 * time.Second}
-	log.Println("Sending http request to", requestURL)
-	response, err := httpClient.Get(requestURL)
-	if err != nil {
-		return nil, err
+// the p2p side of the torrent, without any peers yet
+func (tf *torrentFile) p2pTorrent() *p2p.Torrent {
+	peerID, _ := tf.identity()
+	torrent := &p2p.Torrent{
+		PeerID:      peerID,
+		InfoHash:    tf.InfoHash,
+		PieceHash:   tf.PieceHash,
+		PieceLength: tf.PieceLength,
+		Length:      tf.Length,
+		Name:        tf.Name,
+		Encryption:  tf.Encryption,
+		Dial:        tf.Dial,
+		MaxConns:    tf.MaxConns,
+		ConnLimiter: tf.ConnLimiter,
+		InfoBytes:   tf.InfoBytes,
+		PieceHashV2: tf.PieceHashV2,
+		Private:     tf.Private,
+		Files:       tf.Files,
+		WebSeeds:    tf.WebSeeds,
 	}
-	defer response.Body.Close()
-
-	// parse http response into struct
-	responseStruct := peers.PeersResponse{}
-	err = bencode.Unmarshal(response.Body, &responseStruct)
-	if err != nil {
-		return nil, err
+	torrent.DownloadLimiter = tf.DownloadLimiter
+	torrent.UploadLimiter = tf.UploadLimiter
+	torrent.Log = tf.Log
+	torrent.OnEvent = tf.OnEvent
+	if tf.MetaVersion == 2 {
+		torrent.InfoHashV2, _ = tf.infoHashV2()
 	}
-
-	// parse the string of peers into []Peer
-	return peers.Unmarshal(responseStruct.Peers)
+	return torrent
 }
 
 // this function gets called from main, and calls a bunch of sub functions
 func (tf *torrentFile) DownloadToFile(locationToPutFile string) error {
-	// create peer ID
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+	// a magnet link doesn't tell us what we're downloading yet
+	err := tf.FetchMetadata(nil)
 	if err != nil {
 		return err
 	}
+	peerID, key := tf.identity()
 
-	// make URL request based on info in the torrent file
+	if tf.Private {
+		tf.logger().Println("Torrent is private, only using peers from the tracker")
+	}
+
+	defer tf.closeTrackers()
+
+	req := tracker.AnnounceRequest{
+		InfoHash: tf.InfoHash,
+		PeerID:   peerID,
+		Port:     tf.port(),
+		Left:     int64(tf.Length),
+		Event:    tracker.EventStarted,
+		Key:      key,
+	}
+
+	// ask the trackers for peers
 	// peersArray holds the IP/port of all the peers we need to connect to!
-	peersArray, err := tf.requestPeers(peerID, Port)
-	if err != nil {
-		return err
+	peersArray := tf.magnetPeers
+	resp, err := tf.announce(req)
+	if err == nil {
+		peersArray = append(peersArray, resp.Peers...)
+	} else {
+		// web seeds can do the whole download without any peers
+		if len(tf.WebSeeds) == 0 && len(peersArray) == 0 {
+			return err
+		}
+		tf.logger().Println("Couldn't get peers from the tracker, using just the web seeds and peers we know:", err)
 	}
-	if len(peersArray) == 0 {
+
+	// a hybrid torrent is in two swarms, ask about the v2 one too
+	var peersV2 []peers.Peer
+	reqV2 := req
+	var hybrid bool
+	reqV2.InfoHash, hybrid = tf.infoHashV2()
+	if hybrid {
+		resp, err := tf.announce(reqV2)
+		if err != nil {
+			tf.logger().Println("Couldn't get peers for the v2 swarm:", err)
+		} else {
+			peersV2 = resp.Peers
+		}
+	}
+	if len(peersArray) == 0 && len(peersV2) == 0 && len(tf.WebSeeds) == 0 {
 		return fmt.Errorf("there are no peers to be found. check your .torrent file")
 	}
 
 	// store it in a Torrent struct
-	torrent := p2p.Torrent{
-		Peers:       peersArray,
-		PeerID:      peerID,
-		InfoHash:    tf.InfoHash,
-		PieceHash:   tf.PieceHash,
-		PieceLength: tf.PieceLength,
-		Length:      tf.Length,
-		Name:        tf.Name,
-	}
+	torrent := tf.p2pTorrent()
+	torrent.Peers = peersArray
+	torrent.PeersV2 = peersV2
 
+	stopWatching := tf.watch(torrent)
 	fileContents, err := torrent.Download()
+	stopWatching()
 	if err != nil {
-		log.Println(err.Error())
+		tf.logger().Println(err.Error())
 		return err
 	}
 
-	log.Println("File finished downloading")
+	tf.logger().Println("File finished downloading")
+
+	// let the trackers know we're done, and that we're leaving since we don't seed
+	for _, done := range []tracker.Event{tracker.EventCompleted, tracker.EventStopped} {
+		req.Event, reqV2.Event = done, done
+		req.Downloaded, reqV2.Downloaded = int64(tf.Length), int64(tf.Length)
+		req.Left, reqV2.Left = 0, 0
+		tf.announce(req)
+		if hybrid {
+			tf.announce(reqV2)
+		}
+	}
+
+	// multi file torrents go in a directory, each file where the torrent says
+	if tf.Files != nil {
+		return tf.writeFiles(locationToPutFile, fileContents)
+	}
 
 	outFile, err := os.Create(locationToPutFile)
 	if err != nil {
@@ -218,7 +540,91 @@ func (tf *torrentFile) DownloadToFile(locationToPutFile string) error {
 	if err != nil {
 		return err
 	}
-	log.Println("File written to", locationToPutFile)
+	tf.logger().Println("File written to", locationToPutFile)
+	return nil
+
+}
+
+// start tf.Watch on the download, if there is one. Returns a function that stops
+// it and waits for it to finish
+func (tf *torrentFile) watch(t *p2p.Torrent) func() {
+	if tf.Watch == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tf.Watch(t, done)
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// where the torrent's stream of bytes goes on disk, for the torrent at path (the file for
+// a single file torrent, the directory for a multi file one). Padding (pad files, and the
+// gaps between files in v2 torrents) isn't on disk. Also returns where the last file ends
+func (tf *torrentFile) storageFiles(path string) ([]storage.File, int) {
+	if tf.Files == nil {
+		return []storage.File{{Path: path, Length: int64(tf.Length)}}, tf.Length
+	}
+	var files []storage.File
+	offset := 0
+	for _, f := range tf.Files {
+		if f.Offset > offset {
+			files = append(files, storage.File{Length: int64(f.Offset - offset)})
+		}
+		sf := storage.File{Length: int64(f.Length)}
+		if !f.Padding {
+			sf.Path = filepath.Join(append([]string{path}, f.Path...)...)
+		}
+		files = append(files, sf)
+		offset = f.Offset + f.Length
+	}
+	return files, offset
+}
+
+// write the downloaded stream out as the torrent's files, under the directory dir
+func (tf *torrentFile) writeFiles(dir string, contents []byte) error {
+	files, offset := tf.storageFiles(dir)
+	store, err := storage.Open(files, true)
+	if err != nil {
+		return err
+	}
+	_, err = store.WriteAt(contents[:offset], 0)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	err = store.Close()
+	if err != nil {
+		return err
+	}
+	tf.logger().Println("Files written to", dir)
 	return nil
+}
 
+// PathFor is where a torrent called name goes in dir. The name comes from the torrent
+// (or whatever a magnet link said), so it can't be allowed to point anywhere else
+func PathFor(dir string, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("the torrent's name %q can't be used as a file name", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// FormatSize shows a number of bytes in KiB/MiB/GiB
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
@@ -0,0 +1,25 @@
+package torrentfile
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPathFor(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../etc", "a/b", "/etc"} {
+		if path, err := PathFor("/data", name); err == nil {
+			t.Errorf("%q went to %s", name, path)
+		}
+	}
+	if path, err := PathFor("/data", "stuff"); err != nil || path != filepath.Join("/data", "stuff") {
+		t.Fatalf("stuff went to %q, %v", path, err)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for n, want := range map[int64]string{0: "0 B", 1023: "1023 B", 1024: "1.0 KiB", 1536: "1.5 KiB", 5 << 20: "5.0 MiB", 3 << 30: "3.0 GiB", 1 << 62: "4.0 EiB"} {
+		if got := FormatSize(n); got != want {
+			t.Errorf("FormatSize(%d) is %q, want %q", n, got, want)
+		}
+	}
+}
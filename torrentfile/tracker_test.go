@@ -0,0 +1,184 @@
+package torrentfile
+
+import (
+	"io"
+	"log"
+	"main/tracker"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+var testInfoHash = [20]byte{0xaa, 0xbb}
+
+// a real tracker on loopback, over HTTP and UDP. It believes the ip peers send it, so
+// the test can fill the swarm with peers that aren't on loopback
+func startTracker(t *testing.T) (httpURL string, udpURL string) {
+	t.Helper()
+	srv := tracker.NewServer(tracker.ServerConfig{TrustIP: true})
+	web := httptest.NewServer(srv)
+	t.Cleanup(web.Close)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go srv.ServeUDP(conn)
+	return web.URL + "/announce", "udp://" + conn.LocalAddr().String()
+}
+
+// put a peer in the swarm, as if it had announced itself
+func addPeer(t *testing.T, announceURL string, id byte, ip string, port uint16) {
+	t.Helper()
+	_, err := tracker.NewHTTP(announceURL, nil).Announce(tracker.AnnounceRequest{
+		InfoHash: testInfoHash,
+		PeerID:   [20]byte{id},
+		Port:     port,
+		Left:     100,
+		IP:       net.ParseIP(ip),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testTorrent(tiers ...[]string) *torrentFile {
+	return &torrentFile{AnnounceList: tiers, Settings: Settings{Log: log.New(io.Discard, "", 0)}}
+}
+
+func ourAnnounce() tracker.AnnounceRequest {
+	return tracker.AnnounceRequest{InfoHash: testInfoHash, PeerID: [20]byte{99}, Port: 6881, Left: 100}
+}
+
+// the addresses of the peers in resp
+func peerAddrs(resp *tracker.AnnounceResponse) map[string]bool {
+	ret := make(map[string]bool)
+	for _, p := range resp.Peers {
+		ret[p.String()] = true
+	}
+	return ret
+}
+
+func TestAnnounceHTTP(t *testing.T) {
+	httpURL, _ := startTracker(t)
+	addPeer(t, httpURL, 1, "10.0.0.1", 1000)
+	// peers6 in the response
+	addPeer(t, httpURL, 2, "2001:db8::1", 2000)
+
+	tf := testTorrent([]string{httpURL})
+	resp, err := tf.announce(ourAnnounce())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := peerAddrs(resp)
+	for _, want := range []string{"10.0.0.1:1000", "[2001:db8::1]:2000"} {
+		if !got[want] {
+			t.Fatalf("wanted %s in the peers, got %v", want, got)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("wanted just the 2 other peers, got %v", got)
+	}
+	if resp.Leechers != 3 || resp.Seeders != 0 {
+		t.Fatalf("tracker says %d seeders and %d leechers, want 0 and 3", resp.Seeders, resp.Leechers)
+	}
+}
+
+func TestAnnounceUDP(t *testing.T) {
+	httpURL, udpURL := startTracker(t)
+	addPeer(t, httpURL, 1, "10.0.0.1", 1000)
+
+	tf := testTorrent([]string{udpURL})
+	defer tf.closeTrackers()
+	for i := 0; i < 2; i++ {
+		// the second time goes over the same socket and connection ID
+		resp, err := tf.announce(ourAnnounce())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := peerAddrs(resp); len(got) != 1 || !got["10.0.0.1:1000"] {
+			t.Fatalf("wanted just 10.0.0.1:1000, got %v", got)
+		}
+	}
+}
+
+// a tracker that always fails, and counts how many times it was asked
+func brokenTracker(t *testing.T) (string, *int32) {
+	t.Helper()
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/announce", &hits
+}
+
+// the tracker that answered moves to the front of its tier (BEP 12), so the broken
+// one in front of it isn't asked again. The next tier is only for when a whole tier fails
+func TestAnnounceTierFailover(t *testing.T) {
+	good, _ := startTracker(t)
+	addPeer(t, good, 1, "10.0.0.1", 1000)
+	broken, brokenHits := brokenTracker(t)
+	backup, backupHits := brokenTracker(t)
+	tier := []string{broken, good}
+	tf := testTorrent(tier, []string{backup})
+
+	for i := 0; i < 3; i++ {
+		resp, err := tf.announce(ourAnnounce())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !peerAddrs(resp)["10.0.0.1:1000"] {
+			t.Fatalf("announce %d didn't get the good tracker's peers", i)
+		}
+	}
+	if tier[0] != good || tier[1] != broken {
+		t.Fatalf("tier is %v, the tracker that answered should be first", tier)
+	}
+	if n := atomic.LoadInt32(brokenHits); n != 1 {
+		t.Fatalf("broken tracker asked %d times, it should have moved to the back after the first", n)
+	}
+	if n := atomic.LoadInt32(backupHits); n != 0 {
+		t.Fatalf("second tier asked %d times while the first tier worked", n)
+	}
+}
+
+func TestAnnounceNextTier(t *testing.T) {
+	good, _ := startTracker(t)
+	addPeer(t, good, 1, "10.0.0.1", 1000)
+	broken1, _ := brokenTracker(t)
+	broken2, _ := brokenTracker(t)
+	first := []string{broken1, broken2}
+	// one we can't even talk to
+	second := []string{"gopher://nowhere", good}
+	tf := testTorrent(first, second)
+
+	resp, err := tf.announce(ourAnnounce())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peerAddrs(resp)["10.0.0.1:1000"] {
+		t.Fatal("didn't get the second tier's peers")
+	}
+	if first[0] != broken1 || first[1] != broken2 {
+		t.Fatalf("a tier where nothing answered got reordered: %v", first)
+	}
+	if second[0] != good {
+		t.Fatalf("second tier is %v, the tracker that answered should be first", second)
+	}
+}
+
+func TestAnnounceAllFail(t *testing.T) {
+	broken, _ := brokenTracker(t)
+	_, err := testTorrent([]string{broken}).announce(ourAnnounce())
+	if err == nil {
+		t.Fatal("every tracker failed but announce didn't")
+	}
+	_, err = testTorrent().announce(ourAnnounce())
+	if err == nil {
+		t.Fatal("announced with no trackers")
+	}
+}
@@ -0,0 +1,233 @@
+package torrentfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"main/bencode"
+	"main/merkle"
+	"main/p2p"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// BitTorrent v2 (BEP 52). The differences from v1 that matter to us:
+//   - the info hash is SHA-256 instead of SHA1. The handshake only has room for 20 bytes,
+//     so peers use the first 20 bytes of it there
+//   - files are listed as a "file tree" of nested dictionaries, and every file starts on a
+//     piece boundary, so a piece never has bits of two files in it
+//   - each file is hashed as a merkle tree (see the merkle package), and the .torrent has
+//     the piece layer of every file's tree in "piece layers"
+//
+// Hybrid torrents have all the v1 stuff as well, with pad files (BEP 47) in the v1 file list
+// so the pieces line up the same way in both. They have two info hashes and two swarms
+
+// a file from the file tree
+type v2File struct {
+	Path       []string
+	Length     int
+	PiecesRoot merkle.Hash
+}
+
+// what's under the "" key of a file in the file tree
+type v2FileInfo struct {
+	Length     int    `bencode:"length"`
+	PiecesRoot string `bencode:"pieces root"`
+}
+
+// fill in the v2 parts: the SHA-256 info hash and the merkle hash for every piece.
+// For v2 only torrents this is also where the file list and length come from
+func (tf *torrentFile) loadV2(info *bencodeInfo, pieceLayers map[string]string) error {
+	tf.InfoHashV2 = sha256.Sum256(tf.InfoBytes)
+
+	// every piece has to be a whole number of merkle leaves, and a power of two so
+	// the piece hashes are nodes of the tree
+	if tf.PieceLength < merkle.BlockSize || tf.PieceLength&(tf.PieceLength-1) != 0 {
+		return fmt.Errorf("v2 piece length has to be a power of two of at least 16KB, got %d", tf.PieceLength)
+	}
+	if len(info.FileTree) == 0 {
+		return fmt.Errorf("v2 torrent has no file tree")
+	}
+	files, err := parseFileTree(info.FileTree, nil, 0)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("v2 torrent has no files")
+	}
+
+	layout, pieces, length, err := buildV2Pieces(files, tf.PieceLength, pieceLayers)
+	if err != nil {
+		return err
+	}
+	tf.PieceHashV2 = pieces
+
+	// a single file torrent's tree is just {name: file}
+	single := len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == tf.Name
+
+	if tf.PieceHash == nil {
+		// v2 only, so the v2 layout is the only one there is
+		copy(tf.InfoHash[:], tf.InfoHashV2[:20])
+		tf.Length = length
+		if !single {
+			tf.Files = layout
+		}
+		return nil
+	}
+
+	// hybrid. The v1 and v2 halves have to describe the same thing, or peers from one
+	// swarm would be sending us different data than the other
+	if len(pieces) != len(tf.PieceHash) {
+		return fmt.Errorf("hybrid torrent has %d v1 pieces but %d v2 pieces", len(tf.PieceHash), len(pieces))
+	}
+	if single {
+		if tf.Files != nil || tf.Length != files[0].Length {
+			return fmt.Errorf("hybrid torrent's v1 and v2 files don't match")
+		}
+		return nil
+	}
+	var v1Files []File
+	for _, f := range tf.Files {
+		if !f.Padding {
+			v1Files = append(v1Files, f)
+		}
+	}
+	if len(v1Files) != len(layout) {
+		return fmt.Errorf("hybrid torrent has %d v1 files but %d v2 files", len(v1Files), len(layout))
+	}
+	for i, f := range layout {
+		v1 := v1Files[i]
+		if strings.Join(v1.Path, "/") != strings.Join(f.Path, "/") || v1.Length != f.Length || (f.Length > 0 && v1.Offset != f.Offset) {
+			return fmt.Errorf("hybrid torrent's v1 and v2 files don't match at %s", strings.Join(f.Path, "/"))
+		}
+	}
+	return nil
+}
+
+// read the file tree into a list of files, in the order they're in the torrent (sorted by path).
+// A file is a dictionary with an empty key, everything else is a directory
+func parseFileTree(raw bencode.RawMessage, path []string, depth int) ([]v2File, error) {
+	if depth > 64 {
+		return nil, fmt.Errorf("file tree is nested too deep")
+	}
+	var node map[string]bencode.RawMessage
+	err := bencode.Unmarshal(raw, &node)
+	if err != nil {
+		return nil, err
+	}
+
+	if leaf, ok := node[""]; ok {
+		if len(path) == 0 || len(node) != 1 {
+			return nil, fmt.Errorf("bad file entry in file tree at %q", strings.Join(path, "/"))
+		}
+		fi := v2FileInfo{}
+		err = bencode.Unmarshal(leaf, &fi)
+		if err != nil {
+			return nil, err
+		}
+		f := v2File{Path: path, Length: fi.Length}
+		if fi.Length < 0 {
+			return nil, fmt.Errorf("file %q has length %d", strings.Join(path, "/"), fi.Length)
+		}
+		// empty files don't have a pieces root, there's nothing to hash
+		if fi.Length > 0 {
+			if len(fi.PiecesRoot) != merkle.HashSize {
+				return nil, fmt.Errorf("file %q has a %d byte pieces root", strings.Join(path, "/"), len(fi.PiecesRoot))
+			}
+			copy(f.PiecesRoot[:], fi.PiecesRoot)
+		}
+		return []v2File{f}, nil
+	}
+
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ret []v2File
+	for _, name := range names {
+		// copy the path, so the files don't end up sharing one backing array
+		childPath := append(append([]string(nil), path...), name)
+		err = checkPath(childPath)
+		if err != nil {
+			return nil, err
+		}
+		files, err := parseFileTree(node[name], childPath, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, files...)
+	}
+	return ret, nil
+}
+
+// work out where each file starts (on a piece boundary) and the merkle hash of every piece.
+// Returns the files, the piece hashes, and where the last file ends
+func buildV2Pieces(files []v2File, pieceLength int, pieceLayers map[string]string) ([]File, []p2p.PieceHashV2, int, error) {
+	pieceLeaves := pieceLength / merkle.BlockSize
+	var layout []File
+	var pieces []p2p.PieceHashV2
+	offset := 0
+	for _, f := range files {
+		// every file starts on a new piece
+		offset = len(pieces) * pieceLength
+		layout = append(layout, File{Path: f.Path, Length: f.Length, Offset: offset})
+		if f.Length == 0 {
+			continue
+		}
+		name := strings.Join(f.Path, "/")
+
+		if f.Length <= pieceLength {
+			// one piece, and its hash is the file's pieces root. The tree is only as wide
+			// as the file needs, not a whole piece
+			pieces = append(pieces, p2p.PieceHashV2{
+				Root:       f.PiecesRoot,
+				DataLength: f.Length,
+				Leaves:     merkle.NextPowerOfTwo((f.Length + merkle.BlockSize - 1) / merkle.BlockSize),
+			})
+			offset += f.Length
+			continue
+		}
+
+		numPieces := (f.Length + pieceLength - 1) / pieceLength
+		layer, ok := pieceLayers[string(f.PiecesRoot[:])]
+		if !ok {
+			return nil, nil, 0, fmt.Errorf("no piece layer for %q", name)
+		}
+		if len(layer) != numPieces*merkle.HashSize {
+			return nil, nil, 0, fmt.Errorf("piece layer for %q is %d bytes, expected %d", name, len(layer), numPieces*merkle.HashSize)
+		}
+		hashes := make([]merkle.Hash, numPieces)
+		for i := range hashes {
+			copy(hashes[i][:], layer[i*merkle.HashSize:])
+		}
+		// don't trust the piece layer until we've checked it builds up to the pieces root
+		if !merkle.VerifyPieceLayer(hashes, pieceLeaves, f.PiecesRoot) {
+			return nil, nil, 0, fmt.Errorf("piece layer for %q doesn't match its pieces root", name)
+		}
+		for i, h := range hashes {
+			dataLength := pieceLength
+			if i == numPieces-1 {
+				dataLength = f.Length - i*pieceLength
+			}
+			pieces = append(pieces, p2p.PieceHashV2{Root: h, DataLength: dataLength, Leaves: pieceLeaves})
+		}
+		offset += f.Length
+	}
+	return layout, pieces, offset, nil
+}
+
+// file names come from whoever made the torrent, so make sure none of them can
+// get us writing outside the download directory
+func checkPath(path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("file with an empty path")
+	}
+	for _, part := range path {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\\x00") || filepath.IsAbs(part) {
+			return fmt.Errorf("bad file path %q", strings.Join(path, "/"))
+		}
+	}
+	return nil
+}
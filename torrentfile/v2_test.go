@@ -0,0 +1,335 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"main/bencode"
+	"main/merkle"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const v2PieceLength = 2 * merkle.BlockSize
+
+type v2TestFile struct {
+	path []string
+	data []byte
+}
+
+// a 3 piece file, a file smaller than a piece and an empty one
+func v2TestFiles() []v2TestFile {
+	big := make([]byte, 2*v2PieceLength+5000)
+	for i := range big {
+		big[i] = byte(i*7 ^ i>>8)
+	}
+	return []v2TestFile{
+		{[]string{"big.bin"}, big},
+		{[]string{"sub", "empty"}, nil},
+		{[]string{"sub", "small.txt"}, bytes.Repeat([]byte("small"), 300)},
+	}
+}
+
+// the pieces root of data, and its piece layer if it's bigger than a piece
+func v2Hashes(data []byte) (root merkle.Hash, layer []byte) {
+	if len(data) <= v2PieceLength {
+		leaves := merkle.Leaves(data)
+		return merkle.Root(leaves, merkle.NextPowerOfTwo(len(leaves)), merkle.Hash{}), nil
+	}
+	pieceLeaves := v2PieceLength / merkle.BlockSize
+	var hashes []merkle.Hash
+	for begin := 0; begin < len(data); begin += v2PieceLength {
+		end := begin + v2PieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		h := merkle.PieceRoot(data[begin:end], pieceLeaves)
+		hashes = append(hashes, h)
+		layer = append(layer, h[:]...)
+	}
+	return merkle.Root(hashes, merkle.NextPowerOfTwo(len(hashes)), merkle.ZeroRoot(pieceLeaves)), layer
+}
+
+// the .torrent for files under name, as maps so tests can break it before encoding it.
+// With hybrid set it has the v1 half too, with pad files lining every file up with a piece
+func v2Torrent(name string, files []v2TestFile, hybrid bool) (torrent map[string]any, info map[string]any) {
+	tree := map[string]any{}
+	layers := map[string]any{}
+	var stream []byte
+	var v1Files []any
+	for i, f := range files {
+		leaf := map[string]any{"length": len(f.data)}
+		if len(f.data) > 0 {
+			root, layer := v2Hashes(f.data)
+			leaf["pieces root"] = string(root[:])
+			if layer != nil {
+				layers[string(root[:])] = string(layer)
+			}
+		}
+		dir := tree
+		for _, part := range f.path[:len(f.path)-1] {
+			if dir[part] == nil {
+				dir[part] = map[string]any{}
+			}
+			dir = dir[part].(map[string]any)
+		}
+		dir[f.path[len(f.path)-1]] = map[string]any{"": leaf}
+
+		stream = append(stream, f.data...)
+		v1Files = append(v1Files, map[string]any{"length": len(f.data), "path": f.path})
+		if pad := (v2PieceLength - len(stream)%v2PieceLength) % v2PieceLength; pad > 0 && i < len(files)-1 {
+			stream = append(stream, make([]byte, pad)...)
+			v1Files = append(v1Files, map[string]any{"attr": "p", "length": pad, "path": []string{".pad", strconv.Itoa(pad)}})
+		}
+	}
+
+	info = map[string]any{"name": name, "piece length": v2PieceLength, "meta version": 2, "file tree": tree}
+	if hybrid {
+		var pieces []byte
+		for begin := 0; begin < len(stream); begin += v2PieceLength {
+			end := begin + v2PieceLength
+			if end > len(stream) {
+				end = len(stream)
+			}
+			h := sha1.Sum(stream[begin:end])
+			pieces = append(pieces, h[:]...)
+		}
+		info["pieces"] = string(pieces)
+		if len(files) == 1 && len(files[0].path) == 1 {
+			info["length"] = len(files[0].data)
+		} else {
+			info["files"] = v1Files
+		}
+	}
+	return map[string]any{"piece layers": layers}, info
+}
+
+func loadV2(t *testing.T, torrent, info map[string]any) (torrentFile, error) {
+	t.Helper()
+	torrent["info"] = info
+	data, err := bencode.Marshal(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Load(data)
+}
+
+// put files on disk under dir, and check every piece of tf against them
+func verifyV2(t *testing.T, tf torrentFile, dir string, files []v2TestFile) {
+	t.Helper()
+	for _, f := range files {
+		writeFile(t, filepath.Join(append([]string{dir}, f.path...)...), f.data)
+	}
+	have, err := tf.Verify(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.Count() != tf.NumPieces() {
+		t.Fatalf("%d of %d pieces check out", have.Count(), tf.NumPieces())
+	}
+}
+
+func TestLoadV2Only(t *testing.T) {
+	files := v2TestFiles()
+	torrent, info := v2Torrent("stuff", files, false)
+	tf, err := loadV2(t, torrent, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.MetaVersion != 2 || tf.PieceHash != nil || tf.InfoHashV2 != sha256.Sum256(tf.InfoBytes) {
+		t.Fatalf("meta version %d, %d v1 pieces, v2 info hash %x", tf.MetaVersion, len(tf.PieceHash), tf.InfoHashV2)
+	}
+	// there's no v1 info hash, so the v2 one cut short stands in for it, and there's
+	// only the one swarm
+	if !bytes.Equal(tf.InfoHash[:], tf.InfoHashV2[:20]) {
+		t.Fatalf("info hash is %x, want the start of %x", tf.InfoHash, tf.InfoHashV2)
+	}
+	if _, hybrid := tf.infoHashV2(); hybrid {
+		t.Fatal("a v2 only torrent says it's hybrid")
+	}
+	// every file starts on a piece, big.bin's 3 pieces come from its piece layer
+	want := []File{
+		{Path: []string{"big.bin"}, Length: 2*v2PieceLength + 5000, Offset: 0},
+		{Path: []string{"sub", "empty"}, Length: 0, Offset: 3 * v2PieceLength},
+		{Path: []string{"sub", "small.txt"}, Length: 1500, Offset: 3 * v2PieceLength},
+	}
+	if !reflect.DeepEqual(tf.Files, want) {
+		t.Fatalf("files are %+v, want %+v", tf.Files, want)
+	}
+	if tf.NumPieces() != 4 || tf.Length != 3*v2PieceLength+1500 {
+		t.Fatalf("%d pieces, length %d", tf.NumPieces(), tf.Length)
+	}
+	for i, size := range []int{v2PieceLength, v2PieceLength, 5000, 1500} {
+		if tf.PieceHashV2[i].DataLength != size {
+			t.Fatalf("piece %d has %d bytes of data, want %d", i, tf.PieceHashV2[i].DataLength, size)
+		}
+	}
+	verifyV2(t, tf, t.TempDir(), files)
+
+	// a single file is just {name: file} in the tree, with no file list
+	big := files[:1]
+	torrent, info = v2Torrent("big.bin", big, false)
+	tf, err = loadV2(t, torrent, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.Files != nil || tf.Length != len(big[0].data) || tf.NumPieces() != 3 {
+		t.Fatalf("single file: files %+v, length %d, %d pieces", tf.Files, tf.Length, tf.NumPieces())
+	}
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "big.bin"), big[0].data)
+	have, err := tf.Verify(filepath.Join(dir, "big.bin"), nil)
+	if err != nil || have.Count() != 3 {
+		t.Fatalf("single file: %d good pieces, %v", have.Count(), err)
+	}
+}
+
+func TestLoadHybrid(t *testing.T) {
+	files := v2TestFiles()
+	torrent, info := v2Torrent("stuff", files, true)
+	tf, err := loadV2(t, torrent, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.MetaVersion != 2 || tf.InfoHash != sha1.Sum(tf.InfoBytes) || tf.InfoHashV2 != sha256.Sum256(tf.InfoBytes) {
+		t.Fatalf("meta version %d, info hashes %x and %x", tf.MetaVersion, tf.InfoHash, tf.InfoHashV2)
+	}
+	// two swarms, one for each info hash
+	if h, hybrid := tf.infoHashV2(); !hybrid || !bytes.Equal(h[:], tf.InfoHashV2[:20]) {
+		t.Fatalf("second swarm is %x, %v", h, hybrid)
+	}
+	if len(tf.PieceHash) != 4 || len(tf.PieceHashV2) != 4 {
+		t.Fatalf("%d v1 pieces and %d v2 ones, want 4 of each", len(tf.PieceHash), len(tf.PieceHashV2))
+	}
+	// the v1 file list, pad file and all
+	if len(tf.Files) != 4 || !tf.Files[1].Padding || tf.Files[3].Offset != 3*v2PieceLength {
+		t.Fatalf("files are %+v", tf.Files)
+	}
+	verifyV2(t, tf, t.TempDir(), files)
+
+	// the same for a single file
+	torrent, info = v2Torrent("big.bin", files[:1], true)
+	tf, err = loadV2(t, torrent, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.Files != nil || tf.Length != len(files[0].data) || len(tf.PieceHashV2) != 3 {
+		t.Fatalf("single file: files %+v, length %d, %d v2 pieces", tf.Files, tf.Length, len(tf.PieceHashV2))
+	}
+}
+
+// the piece layer is checked against the pieces root in the info dictionary, the only
+// part that's covered by the info hash
+func TestPieceLayers(t *testing.T) {
+	files := v2TestFiles()
+	root, layerBytes := v2Hashes(files[0].data)
+	layer := string(layerBytes)
+	cases := []struct {
+		name   string
+		layers map[string]any
+		want   string
+	}{
+		{"missing", map[string]any{}, `no piece layer for "big.bin"`},
+		{"changed", map[string]any{string(root[:]): "x" + layer[1:]}, "doesn't match its pieces root"},
+		{"swapped", map[string]any{string(root[:]): layer[merkle.HashSize:2*merkle.HashSize] + layer[:merkle.HashSize] + layer[2*merkle.HashSize:]}, "doesn't match its pieces root"},
+		{"short", map[string]any{string(root[:]): layer[:2*merkle.HashSize]}, "is 64 bytes, expected 96"},
+		{"long", map[string]any{string(root[:]): layer + layer[:merkle.HashSize]}, "is 128 bytes, expected 96"},
+	}
+	for _, hybrid := range []bool{false, true} {
+		for _, c := range cases {
+			torrent, info := v2Torrent("stuff", files, hybrid)
+			torrent["piece layers"] = c.layers
+			_, err := loadV2(t, torrent, info)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("%s (hybrid %v): got %v, want an error with %q", c.name, hybrid, err, c.want)
+			}
+		}
+	}
+}
+
+// a hybrid torrent's v1 and v2 halves have to be the same files in the same places
+func TestHybridMismatch(t *testing.T) {
+	cases := []struct {
+		name   string
+		files  []v2TestFile
+		change func(info map[string]any)
+		want   string
+	}{
+		{"renamed", v2TestFiles(), func(info map[string]any) {
+			info["files"].([]any)[0].(map[string]any)["path"] = []string{"other.bin"}
+		}, "don't match at big.bin"},
+		{"different length", v2TestFiles(), func(info map[string]any) {
+			v1 := info["files"].([]any)
+			v1[len(v1)-1].(map[string]any)["length"] = 1499
+		}, "don't match at sub/small.txt"},
+		{"no padding", v2TestFiles(), func(info map[string]any) {
+			v1 := info["files"].([]any)
+			info["files"] = append([]any{v1[0]}, v1[2:]...)
+			// and the pieces to go with it, so that's not what fails
+			pieces := info["pieces"].(string)
+			info["pieces"] = pieces[:3*sha1.Size]
+		}, "v1 pieces but"},
+		{"extra file", v2TestFiles(), func(info map[string]any) {
+			v1 := info["files"].([]any)
+			info["files"] = append(v1, map[string]any{"length": 0, "path": []string{"zzz"}})
+		}, "has 4 v1 files but 3 v2 files"},
+		{"reordered", v2TestFiles(), func(info map[string]any) {
+			v1 := info["files"].([]any)
+			v1[2], v1[3] = v1[3], v1[2]
+		}, "don't match at sub/empty"},
+		{"single file length", v2TestFiles()[:1], func(info map[string]any) {
+			info["length"] = 2*v2PieceLength + 4999
+		}, "v1 and v2 files don't match"},
+		{"single file as a list", v2TestFiles()[:1], func(info map[string]any) {
+			delete(info, "length")
+			info["files"] = []any{map[string]any{"length": 2*v2PieceLength + 5000, "path": []string{"big.bin"}}}
+		}, "v1 and v2 files don't match"},
+	}
+	for _, c := range cases {
+		torrent, info := v2Torrent(c.files[0].path[0], c.files, true)
+		c.change(info)
+		_, err := loadV2(t, torrent, info)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error with %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	for _, path := range [][]string{
+		nil,
+		{""},
+		{"."},
+		{".."},
+		{"a", "..", "b"},
+		{"a/b"},
+		{`a\b`},
+		{"/etc"},
+		{"a", "b\x00"},
+	} {
+		if checkPath(path) == nil {
+			t.Errorf("%q is allowed", path)
+		}
+	}
+	for _, path := range [][]string{{"a"}, {"a", "b c", "d.txt"}, {"..."}, {".hidden"}, {"a..b"}} {
+		if err := checkPath(path); err != nil {
+			t.Errorf("%q: %v", path, err)
+		}
+	}
+
+	// and it's what stops both kinds of file list getting out of the download directory
+	files := v2TestFiles()
+	torrent, info := v2Torrent("stuff", files, false)
+	info["file tree"].(map[string]any)[".."] = info["file tree"].(map[string]any)["sub"]
+	if _, err := loadV2(t, torrent, info); err == nil || !strings.Contains(err.Error(), "bad file path") {
+		t.Errorf("file tree with ..: got %v", err)
+	}
+	torrent, info = v2Torrent("stuff", files, true)
+	info["files"].([]any)[0].(map[string]any)["path"] = []string{"..", "big.bin"}
+	if _, err := loadV2(t, torrent, info); err == nil || !strings.Contains(err.Error(), "bad file path") {
+		t.Errorf("v1 file list with ..: got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"main/torrentfile"
+	"main/tracker"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// gotorrent tracker [flags]
+// runs a tracker, so peers on a network without one (or without the internet) can find each other
+func runTracker(args []string) {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	httpAddr := fs.String("http", ":6969", "address to serve HTTP /announce and /scrape on, empty to turn off")
+	udpAddr := fs.String("udp", "", "address to serve the UDP tracker protocol on, e.g. :6969. Off by default")
+	interval := fs.Duration("interval", 0, "how often peers should announce (default 30m)")
+	minInterval := fs.Duration("min-interval", 0, "how often peers are allowed to announce, 0 to not say")
+	peerTTL := fs.Duration("peer-ttl", 0, "drop peers that haven't announced for this long (default twice the interval)")
+	maxPeers := fs.Int("max-peers", 0, "most peers in one response (default 50)")
+	trustIP := fs.Bool("trust-ip", false, "use the ip peers say they have instead of where their request came from")
+	var allow stringList
+	fs.Var(&allow, "allow", "only track this torrent: a .torrent file, a 40 character hex info hash, or a file with one info hash per line. Can be repeated")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : [executable] tracker [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 || (*httpAddr == "" && *udpAddr == "") {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	cfg := tracker.ServerConfig{
+		Interval:    *interval,
+		MinInterval: *minInterval,
+		PeerTTL:     *peerTTL,
+		MaxPeers:    *maxPeers,
+		TrustIP:     *trustIP,
+	}
+	if len(allow) > 0 {
+		cfg.Allowed = make(map[[20]byte]bool)
+		for _, a := range allow {
+			err := addAllowed(cfg.Allowed, a)
+			if err != nil {
+				fatal(err)
+			}
+		}
+		log.Printf("Tracking %d torrents", len(cfg.Allowed))
+	}
+	server := tracker.NewServer(cfg)
+
+	errs := make(chan error, 2)
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			fatal(err)
+		}
+		log.Println("UDP tracker on", conn.LocalAddr())
+		go func() { errs <- server.ServeUDP(conn) }()
+	}
+	if *httpAddr != "" {
+		listener, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			fatal(err)
+		}
+		log.Printf("HTTP tracker on http://%s/announce", listener.Addr())
+		go func() { errs <- http.Serve(listener, server) }()
+	}
+	fatal(<-errs)
+}
+
+// add what -allow points at to the allowlist
+func addAllowed(allowed map[[20]byte]bool, arg string) error {
+	if h, err := parseInfoHash(arg); err == nil {
+		allowed[h] = true
+		return nil
+	}
+	if strings.HasSuffix(arg, ".torrent") {
+		tf, err := torrentfile.Open(arg)
+		if err != nil {
+			return err
+		}
+		allowed[tf.InfoHash] = true
+		// hybrid torrents have a second swarm under the v2 info hash
+		if tf.MetaVersion == 2 {
+			var h [20]byte
+			copy(h[:], tf.InfoHashV2[:20])
+			allowed[h] = true
+		}
+		return nil
+	}
+
+	f, err := os.Open(arg)
+	if err != nil {
+		return fmt.Errorf("-allow %s isn't an info hash, and %w", arg, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		h, err := parseInfoHash(line)
+		if err != nil {
+			return fmt.Errorf("%s: %w", arg, err)
+		}
+		allowed[h] = true
+	}
+	return scanner.Err()
+}
+
+func parseInfoHash(s string) ([20]byte, error) {
+	var h [20]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 20 {
+		return h, fmt.Errorf("%q isn't a 40 character hex info hash", s)
+	}
+	copy(h[:], b)
+	return h, nil
+}
@@ -0,0 +1,192 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"main/bencode"
+	"main/peers"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTPTracker is a tracker we talk to with plain HTTP GETs (BEP 3)
+type HTTPTracker struct {
+	// the announce URL
+	URL    string
+	Client *http.Client
+
+	// some trackers give us an ID in the first response and want it back every time after
+	mu        sync.Mutex
+	trackerID string
+}
+
+// NewHTTP returns a tracker for an http(s):// announce URL, using client for the requests
+func NewHTTP(announce string, client *http.Client) *HTTPTracker {
+	if client == nil {
+		client = &http.Client{Timeout: httpTimeout}
+	}
+	return &HTTPTracker{URL: announce, Client: client}
+}
+
+// the bencoded announce response
+type httpAnnounceResponse struct {
+	FailureReason  string   `bencode:"failure reason"`
+	WarningMessage string   `bencode:"warning message"`
+	Interval       int      `bencode:"interval"`
+	MinInterval    int      `bencode:"min interval"`
+	TrackerID      string   `bencode:"tracker id"`
+	Complete       *int     `bencode:"complete"`
+	Incomplete     *int     `bencode:"incomplete"`
+	Peers          peerList `bencode:"peers"`
+	Peers6         string   `bencode:"peers6"`
+}
+
+// peers comes as a string of 6 byte ip+port chunks if the tracker did what we asked
+// (compact=1), but it's allowed to send a list of dictionaries instead
+type peerList []peers.Peer
+
+type peerDict struct {
+	PeerID string `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+func (p *peerList) UnmarshalBencode(data []byte) error {
+	var compact string
+	if bencode.Unmarshal(data, &compact) == nil {
+		ps, err := peers.Unmarshal(compact)
+		*p = ps
+		return err
+	}
+	var dicts []peerDict
+	err := bencode.Unmarshal(data, &dicts)
+	if err != nil {
+		return err
+	}
+	*p = nil
+	for _, d := range dicts {
+		ip := net.ParseIP(d.IP)
+		// it could be a hostname, but we're not doing a DNS lookup for every peer
+		if ip == nil || d.Port <= 0 || d.Port > 65535 {
+			continue
+		}
+		*p = append(*p, peers.Peer{IP: ip, Port: uint16(d.Port)})
+	}
+	return nil
+}
+
+// IPv6 peers (BEP 7) are 16 byte ip + 2 byte port chunks
+func unmarshalPeers6(s string) ([]peers.Peer, error) {
+	if len(s)%18 != 0 {
+		return nil, fmt.Errorf("peers6 is %d bytes, not a multiple of 18", len(s))
+	}
+	ret := make([]peers.Peer, 0, len(s)/18)
+	for i := 0; i < len(s); i += 18 {
+		ret = append(ret, peers.Peer{
+			IP:   net.IP([]byte(s[i : i+16])),
+			Port: binary.BigEndian.Uint16([]byte(s[i+16 : i+18])),
+		})
+	}
+	return ret, nil
+}
+
+// the official explanation for the fields are here http://www.bittorrent.org/beps/bep_0003.html
+func (t *HTTPTracker) announceURL(req AnnounceRequest) (string, error) {
+	// parse string into *url.URL
+	base, err := url.Parse(t.URL)
+	if err != nil {
+		return "", err
+	}
+	// keep anything that's already in the query, private trackers put a passkey there
+	params := base.Query()
+	params.Set("info_hash", string(req.InfoHash[:]))
+	params.Set("peer_id", string(req.PeerID[:]))
+	params.Set("port", strconv.Itoa(int(req.Port)))
+	params.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	params.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	params.Set("left", strconv.FormatInt(req.Left, 10))
+	// compact = 1 asks for peers as 6 byte ip+port chunks instead of a list of dictionaries
+	params.Set("compact", "1")
+	if req.Event != EventNone {
+		params.Set("event", req.Event.String())
+	}
+	if req.NumWant > 0 {
+		params.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.Key != 0 {
+		params.Set("key", fmt.Sprintf("%08x", req.Key))
+	}
+	if req.IP != nil {
+		params.Set("ip", req.IP.String())
+	}
+	t.mu.Lock()
+	if t.trackerID != "" {
+		params.Set("trackerid", t.trackerID)
+	}
+	t.mu.Unlock()
+
+	base.RawQuery = params.Encode()
+	return base.String(), nil
+}
+
+func (t *HTTPTracker) Announce(req AnnounceRequest) (*AnnounceResponse, error) {
+	requestURL, err := t.announceURL(req)
+	if err != nil {
+		return nil, err
+	}
+	response, err := t.Client.Get(requestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	// trackers usually send failures as a 200 with a failure reason, but not always
+	resp := httpAnnounceResponse{}
+	decodeErr := bencode.NewDecoder(response.Body).Decode(&resp)
+	if resp.FailureReason != "" {
+		return nil, fmt.Errorf("tracker announce failed: %s", resp.FailureReason)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker announce: %s", response.Status)
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	if resp.TrackerID != "" {
+		t.mu.Lock()
+		t.trackerID = resp.TrackerID
+		t.mu.Unlock()
+	}
+
+	ret := &AnnounceResponse{
+		Interval:    time.Duration(resp.Interval) * time.Second,
+		MinInterval: time.Duration(resp.MinInterval) * time.Second,
+		Seeders:     -1,
+		Leechers:    -1,
+		Peers:       resp.Peers,
+		Warning:     resp.WarningMessage,
+	}
+	if resp.Complete != nil {
+		ret.Seeders = *resp.Complete
+	}
+	if resp.Incomplete != nil {
+		ret.Leechers = *resp.Incomplete
+	}
+	if resp.Peers6 != "" {
+		ps, err := unmarshalPeers6(resp.Peers6)
+		if err != nil {
+			return nil, err
+		}
+		ret.Peers = append(ret.Peers, ps...)
+	}
+	return ret, nil
+}
+
+func (t *HTTPTracker) Scrape(infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	return scrapeHTTP(t.Client, t.URL, infoHashes)
+}
@@ -0,0 +1,151 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"main/bencode"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// a scrape asks a tracker how busy a torrent is without joining the swarm
+
+// ScrapeResult is what a tracker knows about one torrent
+type ScrapeResult struct {
+	// peers with the whole torrent
+	Seeders int
+	// peers still downloading
+	Leechers int
+	// how many times someone has finished downloading it
+	Completed int
+}
+
+// Scrape asks the tracker at announce (an http(s):// or udp:// announce URL) about the
+// given torrents. Torrents the tracker has never heard of are left out of the result
+func Scrape(announce string, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	t, err := New(announce, Options{})
+	if err != nil {
+		return nil, err
+	}
+	if udp, ok := t.(*UDPTracker); ok {
+		defer udp.Close()
+	}
+	return t.Scrape(infoHashes...)
+}
+
+// ScrapeURL works out the scrape URL from an announce URL. The convention (it's not really
+// a spec) is that the last part of the path starts with "announce", and swapping that for
+// "scrape" gives the scrape URL. Trackers that don't follow it don't support scraping
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	last := u.Path[slash+1:]
+	if !strings.HasPrefix(last, "announce") {
+		return "", fmt.Errorf("tracker %s doesn't support scrape", announce)
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(last, "announce")
+	return u.String(), nil
+}
+
+// the http scrape response, files is keyed by the raw 20 byte info hash
+type httpScrapeResponse struct {
+	Files         map[string]httpScrapeFile `bencode:"files"`
+	FailureReason string                    `bencode:"failure reason,omitempty"`
+}
+
+type httpScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Incomplete int `bencode:"incomplete"`
+	Downloaded int `bencode:"downloaded"`
+}
+
+func scrapeHTTP(httpClient *http.Client, announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	if len(infoHashes) == 0 {
+		return nil, fmt.Errorf("nothing to scrape")
+	}
+	scrapeURL, err := ScrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(scrapeURL)
+	if err != nil {
+		return nil, err
+	}
+	// keep whatever query the announce URL already had (some trackers put a passkey there)
+	query := u.Query()
+	for _, h := range infoHashes {
+		query.Add("info_hash", string(h[:]))
+	}
+	u.RawQuery = query.Encode()
+
+	response, err := httpClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker scrape: %s", response.Status)
+	}
+
+	resp := httpScrapeResponse{}
+	err = bencode.NewDecoder(response.Body).Decode(&resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.FailureReason != "" {
+		return nil, fmt.Errorf("tracker scrape failed: %s", resp.FailureReason)
+	}
+
+	ret := make(map[[20]byte]ScrapeResult)
+	for key, f := range resp.Files {
+		if len(key) != 20 {
+			continue
+		}
+		var h [20]byte
+		copy(h[:], key)
+		ret[h] = ScrapeResult{Seeders: f.Complete, Leechers: f.Incomplete, Completed: f.Downloaded}
+	}
+	return ret, nil
+}
+
+// UDP scrape, after connecting:
+// request:  <connection id 8><action=2 4><transaction id 4><info hash 20>...
+// response: <action=2 4><transaction id 4> then <seeders 4><completed 4><leechers 4> per info hash
+// there's only room for about 74 info hashes in one packet
+const maxUDPScrape = 74
+
+func scrapeUDP(t *UDPTracker, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	if len(infoHashes) == 0 {
+		return nil, fmt.Errorf("nothing to scrape")
+	}
+	ret := make(map[[20]byte]ScrapeResult)
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > maxUDPScrape {
+			batch = batch[:maxUDPScrape]
+		}
+		infoHashes = infoHashes[len(batch):]
+
+		payload := make([]byte, 0, 20*len(batch))
+		for _, h := range batch {
+			payload = append(payload, h[:]...)
+		}
+		resp, err := t.request(actionScrape, payload, 8+12*len(batch))
+		if err != nil {
+			return nil, err
+		}
+		for i, h := range batch {
+			stats := resp[8+12*i:]
+			ret[h] = ScrapeResult{
+				Seeders:   int(binary.BigEndian.Uint32(stats[0:4])),
+				Completed: int(binary.BigEndian.Uint32(stats[4:8])),
+				Leechers:  int(binary.BigEndian.Uint32(stats[8:12])),
+			}
+		}
+	}
+	return ret, nil
+}
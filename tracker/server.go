@@ -0,0 +1,372 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"main/bencode"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the tracker server side: peers announce to us, we remember them for a while and
+// hand them out to everyone else in the same swarm. Everything is in memory, so a
+// restart forgets every peer, but they all announce again within one interval anyway
+
+// ServerConfig are the settings for a Server. The zero value works
+type ServerConfig struct {
+	// how often peers should announce, default 30 minutes
+	Interval time.Duration
+	// how often they're allowed to, 0 to not say
+	MinInterval time.Duration
+	// a peer that hasn't announced for this long is dropped, default twice Interval
+	PeerTTL time.Duration
+	// the most peers in one response, default 50. Peers can ask for fewer with numwant
+	MaxPeers int
+	// if not nil, only these torrents are tracked, anything else gets a failure
+	Allowed map[[20]byte]bool
+	// use the ip a peer says it has, instead of the address its request came from.
+	// Only turn this on for a network you trust, anyone can claim any address
+	TrustIP bool
+}
+
+// Server is an in-memory tracker. It's an http.Handler for /announce and /scrape,
+// and ServeUDP does the UDP tracker protocol on a socket
+type Server struct {
+	cfg ServerConfig
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	lastSweep time.Time
+
+	// for the UDP connection IDs, see udpserver.go
+	secret [16]byte
+}
+
+// every peer we know about for one torrent
+type swarm struct {
+	peers map[string]*serverPeer
+	// how many announced event=completed
+	completed int
+}
+
+type serverPeer struct {
+	id   [20]byte
+	ip   net.IP
+	port uint16
+	// 0 means it's a seeder
+	left     int64
+	lastSeen time.Time
+	// whether it's announced event=completed, so a resend doesn't count twice
+	completed bool
+}
+
+// one announce, however it came in
+type serverAnnounce struct {
+	infoHash [20]byte
+	peerID   [20]byte
+	ip       net.IP
+	port     uint16
+	left     int64
+	event    Event
+	numWant  int
+}
+
+// NewServer makes a tracker with the defaults filled in
+func NewServer(cfg ServerConfig) *Server {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Minute
+	}
+	if cfg.PeerTTL <= 0 {
+		cfg.PeerTTL = 2 * cfg.Interval
+	}
+	if cfg.MaxPeers <= 0 {
+		cfg.MaxPeers = 50
+	}
+	s := &Server{cfg: cfg, swarms: make(map[[20]byte]*swarm), lastSweep: time.Now()}
+	rand.Read(s.secret[:])
+	return s
+}
+
+// record an announce and pick peers to send back. Returns the peers and the
+// swarm's seeder/leecher counts
+func (s *Server) announce(a serverAnnounce) ([]*serverPeer, int, int, error) {
+	if s.cfg.Allowed != nil && !s.cfg.Allowed[a.infoHash] {
+		return nil, 0, 0, fmt.Errorf("torrent isn't tracked here")
+	}
+	if a.port == 0 {
+		return nil, 0, 0, fmt.Errorf("port can't be 0")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+
+	sw, ok := s.swarms[a.infoHash]
+	if !ok {
+		sw = &swarm{peers: make(map[string]*serverPeer)}
+		s.swarms[a.infoHash] = sw
+	}
+	key := string(a.peerID[:])
+	old, known := sw.peers[key]
+	completed := known && old.completed
+	switch a.event {
+	case EventStopped:
+		delete(sw.peers, key)
+	case EventCompleted:
+		// clients send it again if they didn't hear back from us, only count it the once
+		if !completed {
+			sw.completed++
+			completed = true
+		}
+		fallthrough
+	default:
+		sw.peers[key] = &serverPeer{id: a.peerID, ip: a.ip, port: a.port, left: a.left, lastSeen: now, completed: completed}
+	}
+
+	numWant := a.numWant
+	if numWant <= 0 || numWant > s.cfg.MaxPeers {
+		numWant = s.cfg.MaxPeers
+	}
+	seeders, leechers := sw.counts()
+	// map order is random, so this is a different random handful of peers every time
+	var ret []*serverPeer
+	for k, p := range sw.peers {
+		if len(ret) >= numWant || a.event == EventStopped {
+			break
+		}
+		// seeders have no use for other seeders
+		if k == key || (a.left == 0 && p.left == 0) {
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return ret, seeders, leechers, nil
+}
+
+func (sw *swarm) counts() (seeders int, leechers int) {
+	for _, p := range sw.peers {
+		if p.left == 0 {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers
+}
+
+// drop peers that stopped announcing without saying goodbye. It's done as part of
+// other requests, but not more than once a minute. s.mu has to be held
+func (s *Server) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for h, sw := range s.swarms {
+		for k, p := range sw.peers {
+			if now.Sub(p.lastSeen) > s.cfg.PeerTTL {
+				delete(sw.peers, k)
+			}
+		}
+		if len(sw.peers) == 0 && sw.completed == 0 {
+			delete(s.swarms, h)
+		}
+	}
+}
+
+// stats for the given torrents, or every torrent if there are none
+func (s *Server) scrape(infoHashes [][20]byte) map[[20]byte]ScrapeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(time.Now())
+
+	ret := make(map[[20]byte]ScrapeResult)
+	if len(infoHashes) == 0 {
+		for h := range s.swarms {
+			infoHashes = append(infoHashes, h)
+		}
+	}
+	for _, h := range infoHashes {
+		if s.cfg.Allowed != nil && !s.cfg.Allowed[h] {
+			continue
+		}
+		result := ScrapeResult{}
+		if sw, ok := s.swarms[h]; ok {
+			result.Seeders, result.Leechers = sw.counts()
+			result.Completed = sw.completed
+		}
+		ret[h] = result
+	}
+	return ret
+}
+
+// ServeHTTP answers /announce and /scrape. The tracker can live under any path,
+// only the last part matters, same as ScrapeURL expects
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/announce"):
+		s.serveAnnounce(w, r)
+	case strings.HasSuffix(path, "/scrape"):
+		s.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// what we send back for an HTTP announce. Peers is a compact string, or a list
+// of peerDicts if the peer asked for compact=0
+type httpAnnounceReply struct {
+	Interval    int    `bencode:"interval"`
+	MinInterval int    `bencode:"min interval,omitempty"`
+	Complete    int    `bencode:"complete"`
+	Incomplete  int    `bencode:"incomplete"`
+	Peers       any    `bencode:"peers"`
+	Peers6      string `bencode:"peers6,omitempty"`
+}
+
+type httpFailure struct {
+	FailureReason string `bencode:"failure reason"`
+}
+
+// failures still go out as a 200, that's what clients expect
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, httpFailure{FailureReason: reason})
+}
+
+func writeBencode(w http.ResponseWriter, v any) {
+	data, err := bencode.Marshal(v)
+	if err != nil {
+		log.Println("Tracker couldn't encode a response:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
+
+func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	a := serverAnnounce{}
+	infoHash, peerID := q.Get("info_hash"), q.Get("peer_id")
+	if len(infoHash) != 20 || len(peerID) != 20 {
+		writeFailure(w, "info_hash and peer_id have to be 20 bytes")
+		return
+	}
+	copy(a.infoHash[:], infoHash)
+	copy(a.peerID[:], peerID)
+
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil {
+		writeFailure(w, "bad port")
+		return
+	}
+	a.port = uint16(port)
+	// a peer that doesn't say how much it has left is assumed to have everything left
+	a.left = -1
+	if left := q.Get("left"); left != "" {
+		a.left, err = strconv.ParseInt(left, 10, 64)
+		if err != nil || a.left < 0 {
+			writeFailure(w, "bad left")
+			return
+		}
+	}
+	a.numWant, _ = strconv.Atoi(q.Get("numwant"))
+	switch q.Get("event") {
+	case "started":
+		a.event = EventStarted
+	case "completed":
+		a.event = EventCompleted
+	case "stopped":
+		a.event = EventStopped
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	a.ip = net.ParseIP(host)
+	if s.cfg.TrustIP {
+		if ip := net.ParseIP(q.Get("ip")); ip != nil {
+			a.ip = ip
+		}
+	}
+	if a.ip == nil {
+		writeFailure(w, "can't work out your IP")
+		return
+	}
+
+	found, seeders, leechers, err := s.announce(a)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	reply := httpAnnounceReply{
+		Interval:    int(s.cfg.Interval / time.Second),
+		MinInterval: int(s.cfg.MinInterval / time.Second),
+		Complete:    seeders,
+		Incomplete:  leechers,
+	}
+	if q.Get("compact") == "0" {
+		withID := q.Get("no_peer_id") != "1"
+		dicts := []peerDict{}
+		for _, p := range found {
+			d := peerDict{IP: p.ip.String(), Port: int(p.port)}
+			if withID {
+				d.PeerID = string(p.id[:])
+			}
+			dicts = append(dicts, d)
+		}
+		reply.Peers = dicts
+	} else {
+		compact, compact6 := compactPeers(found)
+		reply.Peers = compact
+		reply.Peers6 = compact6
+	}
+	writeBencode(w, reply)
+}
+
+// 6 byte IPv4 peers and 18 byte IPv6 peers
+func compactPeers(found []*serverPeer) (string, string) {
+	var v4, v6 []byte
+	for _, p := range found {
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], p.port)
+		if ip4 := p.ip.To4(); ip4 != nil {
+			v4 = append(append(v4, ip4...), port[:]...)
+		} else {
+			v6 = append(append(v6, p.ip.To16()...), port[:]...)
+		}
+	}
+	return string(v4), string(v6)
+}
+
+func (s *Server) serveScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, h := range r.URL.Query()["info_hash"] {
+		if len(h) != 20 {
+			writeFailure(w, "info_hash has to be 20 bytes")
+			return
+		}
+		var ih [20]byte
+		copy(ih[:], h)
+		infoHashes = append(infoHashes, ih)
+	}
+
+	reply := httpScrapeResponse{Files: make(map[string]httpScrapeFile)}
+	for h, result := range s.scrape(infoHashes) {
+		reply.Files[string(h[:])] = httpScrapeFile{
+			Complete:   result.Seeders,
+			Incomplete: result.Leechers,
+			Downloaded: result.Completed,
+		}
+	}
+	writeBencode(w, reply)
+}
@@ -0,0 +1,266 @@
+package tracker
+
+import (
+	"bytes"
+	"io"
+	"main/bencode"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	tracked   = [20]byte{1}
+	untracked = [20]byte{2}
+)
+
+// a Server on loopback over HTTP and UDP that only tracks one torrent, and an
+// Announcer for each
+func startServer(t *testing.T) (*HTTPTracker, *UDPTracker) {
+	t.Helper()
+	announceURL, udpAddr := serve(t, NewServer(ServerConfig{Allowed: map[[20]byte]bool{tracked: true}}))
+	udp := NewUDP(udpAddr)
+	t.Cleanup(func() { udp.Close() })
+	return NewHTTP(announceURL, nil), udp
+}
+
+// run srv over HTTP and UDP until the test ends
+func serve(t *testing.T, srv *Server) (announceURL string, udpAddr string) {
+	t.Helper()
+	web := httptest.NewServer(srv)
+	t.Cleanup(web.Close)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go srv.ServeUDP(conn)
+	return web.URL + "/announce", conn.LocalAddr().String()
+}
+
+func hasPeer(resp *AnnounceResponse, addr string) bool {
+	for _, p := range resp.Peers {
+		if p.String() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// one peer announces over HTTP and the other over UDP, and they end up in the same swarm
+func TestServerHTTPAndUDP(t *testing.T) {
+	web, udp := startServer(t)
+	leecher := AnnounceRequest{InfoHash: tracked, PeerID: [20]byte{'l'}, Port: 1001, Left: 100, Event: EventStarted}
+	seeder := AnnounceRequest{InfoHash: tracked, PeerID: [20]byte{'s'}, Port: 1002, Left: 0, Event: EventStarted}
+
+	_, err := web.Announce(leecher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := udp.Announce(seeder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasPeer(resp, "127.0.0.1:1001") {
+		t.Fatalf("the UDP peer didn't get the HTTP one, got %v", resp.Peers)
+	}
+	leecher.Event = EventNone
+	resp, err = web.Announce(leecher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasPeer(resp, "127.0.0.1:1002") {
+		t.Fatalf("the HTTP peer didn't get the UDP one, got %v", resp.Peers)
+	}
+	if resp.Seeders != 1 || resp.Leechers != 1 {
+		t.Fatalf("got %d seeders and %d leechers, want 1 and 1", resp.Seeders, resp.Leechers)
+	}
+	checkScrape(t, web, udp, ScrapeResult{Seeders: 1, Leechers: 1, Completed: 0})
+
+	// the leecher finishes, and sends completed again like a client that didn't hear back
+	leecher.Left, leecher.Event = 0, EventCompleted
+	for i := 0; i < 3; i++ {
+		_, err = web.Announce(leecher)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkScrape(t, web, udp, ScrapeResult{Seeders: 2, Leechers: 0, Completed: 1})
+
+	// and leaves
+	leecher.Event = EventStopped
+	_, err = udp.Announce(leecher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScrape(t, web, udp, ScrapeResult{Seeders: 1, Leechers: 0, Completed: 1})
+}
+
+// both kinds of scrape should say the same thing
+func checkScrape(t *testing.T, web *HTTPTracker, udp *UDPTracker, want ScrapeResult) {
+	t.Helper()
+	for name, tr := range map[string]Announcer{"HTTP": web, "UDP": udp} {
+		results, err := tr.Scrape(tracked)
+		if err != nil {
+			t.Fatalf("%s scrape: %s", name, err)
+		}
+		if got := results[tracked]; got != want {
+			t.Fatalf("%s scrape: got %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+// with an allowlist, torrents that aren't on it get a failure
+func TestServerAllowlist(t *testing.T) {
+	web, udp := startServer(t)
+	req := AnnounceRequest{InfoHash: untracked, PeerID: [20]byte{'x'}, Port: 1001, Left: 100}
+	for name, tr := range map[string]Announcer{"HTTP": web, "UDP": udp} {
+		_, err := tr.Announce(req)
+		if err == nil || !strings.Contains(err.Error(), "isn't tracked") {
+			t.Fatalf("%s announce for a torrent that isn't allowed: %v", name, err)
+		}
+	}
+	results, err := web.Scrape(untracked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := results[untracked]; ok {
+		t.Fatal("scrape has a torrent that isn't allowed")
+	}
+}
+
+// a non compact announce reply, with the peers as a list of dicts
+type dictReply struct {
+	Interval int        `bencode:"interval"`
+	Peers    []peerDict `bencode:"peers"`
+}
+
+// announce by hand, so we can ask for the reply formats our own client doesn't use.
+// extra has to ask for compact=0, or the peers won't decode
+func announceQuery(t *testing.T, announceURL string, id byte, port int, extra string) dictReply {
+	t.Helper()
+	q := url.Values{}
+	q.Set("info_hash", string(tracked[:]))
+	q.Set("peer_id", string(bytes.Repeat([]byte{id}, 20)))
+	q.Set("port", strconv.Itoa(port))
+	q.Set("left", "100")
+	resp, err := http.Get(announceURL + "?" + q.Encode() + extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply dictReply
+	err = bencode.Unmarshal(body, &reply)
+	if err != nil {
+		t.Fatalf("%s: %q", err, body)
+	}
+	return reply
+}
+
+func TestServerNotCompact(t *testing.T) {
+	announceURL, _ := serve(t, NewServer(ServerConfig{}))
+	announceQuery(t, announceURL, 'a', 1001, "&compact=0")
+
+	reply := announceQuery(t, announceURL, 'b', 1002, "&compact=0")
+	if len(reply.Peers) != 1 {
+		t.Fatalf("got peers %+v, want just a", reply.Peers)
+	}
+	want := peerDict{PeerID: strings.Repeat("a", 20), IP: "127.0.0.1", Port: 1001}
+	if reply.Peers[0] != want {
+		t.Fatalf("got %+v, want %+v", reply.Peers[0], want)
+	}
+
+	// no_peer_id leaves the IDs out, it's only for dicts
+	reply = announceQuery(t, announceURL, 'c', 1003, "&compact=0&no_peer_id=1")
+	if len(reply.Peers) != 2 {
+		t.Fatalf("got peers %+v, want a and b", reply.Peers)
+	}
+	for _, p := range reply.Peers {
+		if p.PeerID != "" || p.IP != "127.0.0.1" {
+			t.Fatalf("got %+v with no_peer_id", p)
+		}
+	}
+}
+
+// peers that stop announcing without saying goodbye get dropped after PeerTTL
+func TestServerPeerTTL(t *testing.T) {
+	s := NewServer(ServerConfig{PeerTTL: 10 * time.Minute})
+	for i, left := range []int64{0, 100} {
+		_, _, _, err := s.announce(serverAnnounce{infoHash: tracked, peerID: [20]byte{byte(i)}, ip: net.IPv4(10, 0, 0, 1), port: 1000, left: left})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, _, err := s.announce(serverAnnounce{infoHash: untracked, peerID: [20]byte{9}, ip: net.IPv4(10, 0, 0, 2), port: 1000, left: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	// the seeder last announced 11 minutes ago
+	stale := [20]byte{0}
+	s.swarms[tracked].peers[string(stale[:])].lastSeen = time.Now().Add(-11 * time.Minute)
+	// sweeps happen at most once a minute
+	s.sweep(time.Now())
+	if len(s.swarms[tracked].peers) != 2 {
+		s.mu.Unlock()
+		t.Fatal("swept less than a minute after the last one")
+	}
+	s.sweep(time.Now().Add(time.Minute + time.Second))
+	s.mu.Unlock()
+
+	results := s.scrape(nil)
+	if got := results[tracked]; got != (ScrapeResult{Seeders: 0, Leechers: 1}) {
+		t.Fatalf("after the sweep the swarm is %+v, want just the leecher", got)
+	}
+	if _, ok := results[untracked]; !ok {
+		t.Fatal("swept a peer that announced a minute ago")
+	}
+
+	// and once everyone's gone, so is the swarm
+	s.mu.Lock()
+	s.sweep(time.Now().Add(time.Hour))
+	empty := len(s.swarms) == 0
+	s.mu.Unlock()
+	if !empty {
+		t.Fatal("swarms with nobody left in them are still there")
+	}
+}
+
+func TestServerIntervals(t *testing.T) {
+	announceURL, udpAddr := serve(t, NewServer(ServerConfig{Interval: 10 * time.Minute, MinInterval: time.Minute}))
+	udp := NewUDP(udpAddr)
+	defer udp.Close()
+	req := AnnounceRequest{InfoHash: tracked, PeerID: [20]byte{'i'}, Port: 1001, Left: 100}
+	resp, err := NewHTTP(announceURL, nil).Announce(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 10*time.Minute || resp.MinInterval != time.Minute {
+		t.Fatalf("HTTP says announce every %s, at most every %s", resp.Interval, resp.MinInterval)
+	}
+	// the UDP protocol only has room for the interval
+	resp, err = udp.Announce(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 10*time.Minute {
+		t.Fatalf("UDP says announce every %s", resp.Interval)
+	}
+
+	// the defaults
+	announceURL, _ = serve(t, NewServer(ServerConfig{}))
+	reply := announceQuery(t, announceURL, 'd', 1002, "&compact=0")
+	if reply.Interval != 30*60 {
+		t.Fatalf("default interval is %ds, want 30 minutes", reply.Interval)
+	}
+}
@@ -0,0 +1,113 @@
+package tracker
+
+import (
+	"fmt"
+	"main/peers"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Announcer is a tracker we can announce to and scrape. HTTPTracker and UDPTracker implement
+// it, and anything else that does (e.g. a fake tracker in a test) can stand in for them
+type Announcer interface {
+	// Announce tells the tracker about us and gets peers back
+	Announce(req AnnounceRequest) (*AnnounceResponse, error)
+	// Scrape asks how busy some torrents are. Torrents the tracker doesn't know are left out
+	Scrape(infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error)
+}
+
+// Event says why we're announcing. Most announces are just the regular
+// check in every interval, which is EventNone
+type Event int
+
+const (
+	EventNone Event = iota
+	// the first announce of a download
+	EventStarted
+	// we just finished downloading
+	EventCompleted
+	// we're leaving the swarm
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventStarted:
+		return "started"
+	case EventCompleted:
+		return "completed"
+	case EventStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+// AnnounceRequest is everything we tell the tracker when we announce
+type AnnounceRequest struct {
+	InfoHash [20]byte
+	PeerID   [20]byte
+	// the port we accept peer connections on
+	Port uint16
+	// totals for this torrent so far, in bytes
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	// how many peers we'd like, 0 lets the tracker decide
+	NumWant int
+	// a random number that stays the same for the whole session, so the tracker can
+	// recognize us even if our IP changes
+	Key uint32
+	// our IP, if the tracker shouldn't just use the address the request came from
+	IP net.IP
+}
+
+// AnnounceResponse is what the tracker tells us back
+type AnnounceResponse struct {
+	// how long to wait before announcing again
+	Interval time.Duration
+	// don't announce again sooner than this, 0 if the tracker didn't say
+	MinInterval time.Duration
+	// how many peers the tracker has for the torrent, -1 if it didn't say
+	Seeders  int
+	Leechers int
+	Peers    []peers.Peer
+	// something the tracker wants a human to see, but isn't an error
+	Warning string
+}
+
+// Options are the settings for talking to trackers
+type Options struct {
+	// for HTTP trackers. nil means a client with a 15 second timeout
+	HTTPClient *http.Client
+	// a proxy for HTTP trackers, like http.Transport's Proxy. Only used when
+	// HTTPClient is nil, otherwise set it on your own client
+	Proxy func(*http.Request) (*url.URL, error)
+}
+
+// the timeout for HTTP trackers if nobody gives us a client
+const httpTimeout = 15 * time.Second
+
+// New returns the Announcer for an announce URL: http(s):// or udp://
+func New(announce string, opts Options) (Announcer, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		client := opts.HTTPClient
+		if client == nil {
+			client = &http.Client{Timeout: httpTimeout}
+			if opts.Proxy != nil {
+				client.Transport = &http.Transport{Proxy: opts.Proxy}
+			}
+		}
+		return NewHTTP(announce, client), nil
+	case "udp":
+		return NewUDP(u.Host), nil
+	}
+	return nil, fmt.Errorf("don't know how to talk to a %q tracker", u.Scheme)
+}
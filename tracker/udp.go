@@ -0,0 +1,254 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"main/peers"
+	"net"
+	"sync"
+	"time"
+)
+
+// the UDP tracker protocol (BEP 15). Everything starts with getting a connection ID,
+// which is the tracker's way of checking we're not spoofing our address, and then
+// every request has that ID plus a random transaction ID the tracker echoes back
+//
+// connect request:  <protocol id 8><action=0 4><transaction id 4>
+// connect response: <action=0 4><transaction id 4><connection id 8>
+
+const (
+	udpProtocolID  = 0x41727101980
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+)
+
+// BEP 15 says to wait 15 * 2^n seconds and try up to 8 times, which adds up to about an hour.
+// Nobody is going to sit in front of the terminal that long, so we give up a lot sooner
+const (
+	udpTimeout = 3 * time.Second
+	udpRetries = 3
+)
+
+// a connection ID is good for a minute
+const udpConnectionLifetime = time.Minute
+
+type udpConn struct {
+	conn         *net.UDPConn
+	connectionID uint64
+	connectedAt  time.Time
+}
+
+// dialUDP opens a socket to the tracker at host:port. It doesn't send anything yet
+func dialUDP(hostport string) (*udpConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{conn: conn}, nil
+}
+
+func (u *udpConn) Close() error {
+	return u.conn.Close()
+}
+
+// the peers in an announce response are the same kind of address as the tracker's
+func (u *udpConn) isIPv6() bool {
+	addr, ok := u.conn.RemoteAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
+
+// connect gets a connection ID, unless we've got one that's still good
+func (u *udpConn) connect() error {
+	if !u.connectedAt.IsZero() && time.Since(u.connectedAt) < udpConnectionLifetime {
+		return nil
+	}
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], actionConnect)
+	resp, err := u.roundTrip(req, actionConnect, 16)
+	if err != nil {
+		return err
+	}
+	u.connectionID = binary.BigEndian.Uint64(resp[8:16])
+	u.connectedAt = time.Now()
+	return nil
+}
+
+// request sends action with payload after the connection ID/action/transaction ID header,
+// connecting first if needed. Returns the whole response, which is at least minLen bytes
+func (u *udpConn) request(action uint32, payload []byte, minLen int) ([]byte, error) {
+	err := u.connect()
+	if err != nil {
+		return nil, err
+	}
+	req := make([]byte, 16+len(payload))
+	binary.BigEndian.PutUint64(req[0:8], u.connectionID)
+	binary.BigEndian.PutUint32(req[8:12], action)
+	copy(req[16:], payload)
+	return u.roundTrip(req, action, minLen)
+}
+
+// roundTrip fills in a fresh transaction ID at req[12:16], sends it, and waits for the
+// matching response, retrying a few times since it's UDP and packets go missing
+func (u *udpConn) roundTrip(req []byte, action uint32, minLen int) ([]byte, error) {
+	var transactionID [4]byte
+	_, err := rand.Read(transactionID[:])
+	if err != nil {
+		return nil, err
+	}
+	copy(req[12:16], transactionID[:])
+
+	buf := make([]byte, 65536)
+	timeout := udpTimeout
+	for try := 0; try < udpRetries; try++ {
+		_, err = u.conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		u.conn.SetReadDeadline(deadline)
+		for {
+			n, err := u.conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			resp := buf[:n]
+			// anything that isn't an answer to this request is a late answer to an
+			// old one, or junk. Ignore it and keep waiting
+			if n < 8 || string(resp[4:8]) != string(transactionID[:]) {
+				continue
+			}
+			switch got := binary.BigEndian.Uint32(resp[0:4]); {
+			case got == actionError:
+				return nil, fmt.Errorf("tracker error: %s", resp[8:])
+			case got != action:
+				return nil, fmt.Errorf("tracker answered action %d with action %d", action, got)
+			case n < minLen:
+				return nil, fmt.Errorf("tracker response is %d bytes, expected at least %d", n, minLen)
+			}
+			return append([]byte(nil), resp...), nil
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("tracker didn't answer after %d tries", udpRetries)
+}
+
+// UDPTracker is a tracker we talk to over UDP (BEP 15). It keeps its socket and
+// connection ID between requests, so announcing every interval doesn't reconnect each time
+type UDPTracker struct {
+	// host:port of the tracker
+	Addr string
+
+	mu   sync.Mutex
+	conn *udpConn
+}
+
+// NewUDP returns a tracker for host:port. Nothing is sent until the first request
+func NewUDP(hostport string) *UDPTracker {
+	return &UDPTracker{Addr: hostport}
+}
+
+// Close drops the socket, the next request opens a new one
+func (t *UDPTracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+// request does one request on the shared socket, dialing it first if needed. A socket
+// that fails gets thrown away, so a tracker that changed address gets resolved again
+func (t *UDPTracker) request(action uint32, payload []byte, minLen int) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		conn, err := dialUDP(t.Addr)
+		if err != nil {
+			return nil, err
+		}
+		t.conn = conn
+	}
+	resp, err := t.conn.request(action, payload, minLen)
+	if err != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	return resp, err
+}
+
+// UDP announce, after connecting:
+// request:  <connection id 8><action=1 4><transaction id 4><info hash 20><peer id 20>
+//           <downloaded 8><left 8><uploaded 8><event 4><ip 4><key 4><num want 4><port 2>
+// response: <action=1 4><transaction id 4><interval 4><leechers 4><seeders 4> then 6 byte peers,
+//           or 18 byte ones if we're talking to the tracker over IPv6
+
+// the events have different numbers over UDP than the order we keep them in
+var udpEvents = map[Event]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+func (t *UDPTracker) Announce(req AnnounceRequest) (*AnnounceResponse, error) {
+	payload := make([]byte, 82)
+	copy(payload[0:20], req.InfoHash[:])
+	copy(payload[20:40], req.PeerID[:])
+	binary.BigEndian.PutUint64(payload[40:48], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(payload[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint64(payload[56:64], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(payload[64:68], udpEvents[req.Event])
+	// 0 means use the address the packet came from, and there's only room for IPv4
+	if ip4 := req.IP.To4(); ip4 != nil {
+		copy(payload[68:72], ip4)
+	}
+	binary.BigEndian.PutUint32(payload[72:76], req.Key)
+	numWant := int32(-1)
+	if req.NumWant > 0 {
+		numWant = int32(req.NumWant)
+	}
+	binary.BigEndian.PutUint32(payload[76:80], uint32(numWant))
+	binary.BigEndian.PutUint16(payload[80:82], req.Port)
+
+	resp, err := t.request(actionAnnounce, payload, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(resp[8:12])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(resp[12:16])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[16:20])),
+	}
+	compact := string(resp[20:])
+	t.mu.Lock()
+	ipv6 := t.conn != nil && t.conn.isIPv6()
+	t.mu.Unlock()
+	if ipv6 {
+		ret.Peers, err = unmarshalPeers6(compact)
+	} else {
+		ret.Peers, err = peers.Unmarshal(compact)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (t *UDPTracker) Scrape(infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	return scrapeUDP(t, infoHashes)
+}
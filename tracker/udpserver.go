@@ -0,0 +1,154 @@
+package tracker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// the UDP side of Server (BEP 15). Instead of remembering every connection ID we handed
+// out, a connection ID is a hash of a secret, the client's address and the current minute.
+// So we can check one without any state, and it's only good for a minute or two
+
+// binary.BigEndian.AppendUint32 would do, but it needs a newer Go than go.mod says
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// the connection ID for addr during the window'th minute
+func (s *Server) connectionID(addr net.Addr, window int64) uint64 {
+	h := sha256.New()
+	h.Write(s.secret[:])
+	h.Write([]byte(addr.String()))
+	var w [8]byte
+	binary.BigEndian.PutUint64(w[:], uint64(window))
+	h.Write(w[:])
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// a connection ID from this minute or the last one is good
+func (s *Server) validConnectionID(addr net.Addr, id uint64) bool {
+	window := time.Now().Unix() / 60
+	return id == s.connectionID(addr, window) || id == s.connectionID(addr, window-1)
+}
+
+// ServeUDP answers UDP tracker requests on conn until it's closed
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		resp := s.handleUDP(buf[:n], addr)
+		if resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// the response to one packet, nil if it's not worth answering
+func (s *Server) handleUDP(req []byte, addr net.Addr) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(req[0:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	transactionID := req[12:16]
+
+	header := func(action uint32) []byte {
+		resp := make([]byte, 8, 64)
+		binary.BigEndian.PutUint32(resp[0:4], action)
+		copy(resp[4:8], transactionID)
+		return resp
+	}
+	fail := func(msg string) []byte {
+		return append(header(actionError), msg...)
+	}
+
+	if action == actionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		resp := header(actionConnect)
+		id := s.connectionID(addr, time.Now().Unix()/60)
+		resp = appendUint32(resp, uint32(id>>32))
+		return appendUint32(resp, uint32(id))
+	}
+	if !s.validConnectionID(addr, connectionID) {
+		return fail("bad connection id")
+	}
+
+	switch action {
+	case actionAnnounce:
+		if len(req) < 98 {
+			return fail("announce too short")
+		}
+		a := serverAnnounce{
+			left:    int64(binary.BigEndian.Uint64(req[64:72])),
+			numWant: int(int32(binary.BigEndian.Uint32(req[92:96]))),
+			port:    binary.BigEndian.Uint16(req[96:98]),
+		}
+		copy(a.infoHash[:], req[16:36])
+		copy(a.peerID[:], req[36:56])
+		for e, code := range udpEvents {
+			if code == binary.BigEndian.Uint32(req[80:84]) {
+				a.event = e
+			}
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			a.ip = udpAddr.IP
+		}
+		if ip := net.IP(req[84:88]); s.cfg.TrustIP && !ip.Equal(net.IPv4zero) {
+			a.ip = append(net.IP(nil), ip...)
+		}
+		if a.ip == nil {
+			return fail("can't work out your IP")
+		}
+
+		found, seeders, leechers, err := s.announce(a)
+		if err != nil {
+			return fail(err.Error())
+		}
+		resp := header(actionAnnounce)
+		resp = appendUint32(resp, uint32(s.cfg.Interval/time.Second))
+		resp = appendUint32(resp, uint32(leechers))
+		resp = appendUint32(resp, uint32(seeders))
+		// a UDP response only has one kind of peer in it, the same kind as the
+		// address it's going to
+		v4, v6 := compactPeers(found)
+		if a.ip.To4() != nil {
+			resp = append(resp, v4...)
+		} else {
+			resp = append(resp, v6...)
+		}
+		return resp
+
+	case actionScrape:
+		payload := req[16:]
+		if len(payload) == 0 || len(payload)%20 != 0 || len(payload)/20 > maxUDPScrape {
+			return fail("bad scrape")
+		}
+		infoHashes := make([][20]byte, len(payload)/20)
+		for i := range infoHashes {
+			copy(infoHashes[i][:], payload[i*20:])
+		}
+		results := s.scrape(infoHashes)
+		resp := header(actionScrape)
+		for _, h := range infoHashes {
+			// torrents we don't track get all zeros, there's no way to leave them out
+			r := results[h]
+			resp = appendUint32(resp, uint32(r.Seeders))
+			resp = appendUint32(resp, uint32(r.Completed))
+			resp = appendUint32(resp, uint32(r.Leechers))
+		}
+		return resp
+	}
+	return fail("unknown action")
+}
@@ -0,0 +1,594 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// connection states
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+// a packet we sent that the other side hasn't acked yet
+type outPacket struct {
+	typ           uint8
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+// Conn is one uTP connection. It implements net.Conn
+type Conn struct {
+	sock   *socket
+	remote *net.UDPAddr
+	// we receive packets with recvID on them and send ours with sendID
+	recvID uint16
+	sendID uint16
+
+	mu    sync.Mutex
+	state int
+	// the seq_nr our next packet gets
+	seq uint16
+	// the last seq_nr we received in order
+	ack uint16
+
+	// sent but not acked, oldest first
+	inflight []*outPacket
+	// bytes of payload in inflight
+	curWindow int
+	// LEDBAT's congestion window in bytes
+	cwnd float64
+	// how much the other side says it can take
+	peerWnd int
+	// round trip time estimates, for the retransmission timeout
+	rtt    time.Duration
+	rttVar time.Duration
+	rto    time.Duration
+	// how many acks in a row didn't ack anything new
+	dupAcks int
+	// the lowest delay we've seen recently, this is our guess of what the delay
+	// would be with no queueing at all. Kept per minute for the last two minutes
+	baseDelays   [2]uint32
+	baseDelayMin time.Time
+	// how long the other side's last packet took to get to us (by their clock vs ours),
+	// we echo it back so they can measure their delay
+	replyMicro uint32
+
+	// data that arrived in order and is waiting for Read
+	readBuf []byte
+	// data that arrived early, keyed by seq_nr
+	outOfOrder map[uint16]*inPacket
+	// set when the other side sent a FIN and we've read everything up to it
+	eof bool
+	// the seq_nr of the other side's FIN, if we got it
+	finSeq  uint16
+	gotFin  bool
+	closing bool
+	err     error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// poked whenever something changes that a blocked Read or Write might care about
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+	// closed once the handshake is done (or failed), for Dial
+	connected chan struct{}
+}
+
+type inPacket struct {
+	typ     uint8
+	payload []byte
+}
+
+func newConn(sock *socket, remote *net.UDPAddr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		sock:        sock,
+		remote:      remote,
+		recvID:      recvID,
+		sendID:      sendID,
+		cwnd:        maxPayload * 2,
+		peerWnd:     recvWindow,
+		rto:         time.Second,
+		outOfOrder:  make(map[uint16]*inPacket),
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+		connected:   make(chan struct{}),
+	}
+}
+
+func randomSeq() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// Dial connects to a uTP peer at addr ("ip:port"), giving up after timeout
+func Dial(addr string, timeout time.Duration) (*Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	sock := newSocket(udp, false)
+
+	c := newConn(sock, remote, 0, 0)
+	c.recvID = sock.register(remote, c)
+	c.sendID = c.recvID + 1
+
+	// the SYN goes out with our *receive* id on it, that's how the other side learns both ids
+	c.mu.Lock()
+	c.seq = randomSeq()
+	c.queue(stSyn, nil)
+	c.mu.Unlock()
+
+	select {
+	case <-c.connected:
+	case <-time.After(timeout):
+		c.fail(fmt.Errorf("utp: dial %s timed out", addr))
+	}
+	c.mu.Lock()
+	err = c.err
+	c.mu.Unlock()
+	if err != nil {
+		sock.remove(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// the listener side of the handshake: remember their seq_nr and send back a STATE
+func (c *Conn) acceptSyn(h header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ack = h.seq
+	c.seq = randomSeq()
+	c.state = stateConnected
+	c.peerWnd = int(h.wndSize)
+	c.replyMicro = nowMicros() - h.timestamp
+	close(c.connected)
+	c.sendState()
+}
+
+// handles one packet from the other side
+func (c *Conn) receive(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+
+	if h.typ == stReset {
+		c.failLocked(fmt.Errorf("utp: connection reset by peer"))
+		return
+	}
+	if h.typ == stSyn {
+		// our STATE must have gotten lost, send it again
+		c.sendState()
+		return
+	}
+
+	c.replyMicro = nowMicros() - h.timestamp
+	c.peerWnd = int(h.wndSize)
+
+	if c.state == stateSynSent && h.typ == stState {
+		// the STATE carries the seq_nr their first data packet is going to have
+		c.ack = h.seq - 1
+		c.state = stateConnected
+		close(c.connected)
+	}
+
+	c.processAck(h)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receiveData(h, payload)
+		// ack everything that carries a sequence number
+		c.sendState()
+	}
+	c.notify()
+}
+
+// put an in sequence packet's data where Read can find it, or park it if it came early
+func (c *Conn) receiveData(h header, payload []byte) {
+	if !seqLess(c.ack, h.seq) {
+		// we already have this one
+		return
+	}
+	if h.seq != c.ack+1 {
+		if seqLess(c.ack+maxOutOfOrder, h.seq) {
+			return
+		}
+		c.outOfOrder[h.seq] = &inPacket{typ: h.typ, payload: payload}
+		return
+	}
+	// a peer that ignores the window we advertise doesn't get to fill up our memory.
+	// We don't ack what we drop, so it comes again once Read has made some room
+	if h.typ == stData && len(c.readBuf) >= recvWindow {
+		return
+	}
+
+	c.deliver(h.typ, h.seq, payload)
+	// this might have filled the gap before some packets that came early
+	for {
+		next, ok := c.outOfOrder[c.ack+1]
+		if !ok || (next.typ == stData && len(c.readBuf) >= recvWindow) {
+			break
+		}
+		delete(c.outOfOrder, c.ack+1)
+		c.deliver(next.typ, c.ack+1, next.payload)
+	}
+}
+
+func (c *Conn) deliver(typ uint8, seq uint16, payload []byte) {
+	c.ack = seq
+	if typ == stFin {
+		c.gotFin = true
+		c.finSeq = seq
+		c.eof = true
+		return
+	}
+	if !c.eof {
+		c.readBuf = append(c.readBuf, payload...)
+	}
+}
+
+// drop everything the ack_nr covers from inflight, and let LEDBAT adjust the window
+func (c *Conn) processAck(h header) {
+	now := time.Now()
+	acked := 0
+	ackedPackets := 0
+	for len(c.inflight) > 0 && !seqLess(h.ack, c.inflight[0].seq) {
+		p := c.inflight[0]
+		c.inflight = c.inflight[1:]
+		acked += len(p.payload)
+		ackedPackets++
+		// only packets sent once give a trustworthy round trip time
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sentAt))
+		}
+	}
+	c.curWindow -= acked
+
+	if ackedPackets == 0 {
+		// the same ack over and over means the packet after it got lost.
+		// three in a row and we resend it without waiting for the timeout
+		if h.typ == stState && len(c.inflight) > 0 && h.ack == c.inflight[0].seq-1 {
+			c.dupAcks++
+			if c.dupAcks == 3 {
+				c.cwnd /= 2
+				if c.cwnd < maxPayload {
+					c.cwnd = maxPayload
+				}
+				c.resend(c.inflight[0])
+			}
+		}
+		return
+	}
+	c.dupAcks = 0
+
+	if acked > 0 && h.timestampDiff != 0 {
+		c.ledbat(h.timestampDiff, acked)
+	}
+}
+
+// LEDBAT: grow the window when the delay we cause is under target, shrink it when over.
+// delaySample is how long our packet took to reach them (by their clock minus ours,
+// so there's a big constant offset in it). Subtracting the lowest sample we've seen
+// cancels out the offset and leaves just the queueing delay
+func (c *Conn) ledbat(delaySample uint32, acked int) {
+	now := time.Now()
+	if now.Sub(c.baseDelayMin) > time.Minute {
+		c.baseDelays[1] = c.baseDelays[0]
+		c.baseDelays[0] = delaySample
+		c.baseDelayMin = now
+	}
+	if delaySample-c.baseDelays[0] > 1<<31 {
+		// wrapped around, meaning the sample is lower
+		c.baseDelays[0] = delaySample
+	}
+	base := c.baseDelays[0]
+	if c.baseDelays[1] != 0 && base-c.baseDelays[1] < 1<<31 {
+		base = c.baseDelays[1]
+	}
+
+	ourDelay := time.Duration(delaySample-base) * time.Microsecond
+	offTarget := float64(targetDelay-ourDelay) / float64(targetDelay)
+	c.cwnd += gain * offTarget * float64(acked) * maxPayload / c.cwnd
+	if c.cwnd < maxPayload {
+		c.cwnd = maxPayload
+	}
+	if c.cwnd > maxWindow {
+		c.cwnd = maxWindow
+	}
+}
+
+// the usual TCP style smoothed round trip time (RFC 6298)
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minTimeout {
+		c.rto = minTimeout
+	}
+}
+
+// called every so often by the socket: resend the oldest packet if it's been too long
+func (c *Conn) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.inflight) == 0 || c.state == stateClosed {
+		return
+	}
+	oldest := c.inflight[0]
+	if time.Since(oldest.sentAt) < c.rto {
+		return
+	}
+	if oldest.transmissions >= maxTransmissions {
+		c.failLocked(fmt.Errorf("utp: connection timed out"))
+		return
+	}
+	// a timeout means things are really congested, start over with a tiny window
+	c.cwnd = maxPayload
+	c.rto *= 2
+	if c.rto > maxTimeout {
+		c.rto = maxTimeout
+	}
+	c.resend(oldest)
+}
+
+// how much room the other side has for more data
+func (c *Conn) window() int {
+	w := int(c.cwnd)
+	if c.peerWnd < w {
+		w = c.peerWnd
+	}
+	return w
+}
+
+// send a packet that needs to be acked, and keep it around in case it needs resending.
+// expects c.mu to be held
+func (c *Conn) queue(typ uint8, payload []byte) {
+	p := &outPacket{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.inflight = append(c.inflight, p)
+	c.curWindow += len(payload)
+	c.resend(p)
+}
+
+func (c *Conn) resend(p *outPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	connID := c.sendID
+	if p.typ == stSyn {
+		connID = c.recvID
+	}
+	h := header{
+		typ:           p.typ,
+		connID:        connID,
+		timestamp:     nowMicros(),
+		timestampDiff: c.replyMicro,
+		wndSize:       c.recvWindow(),
+		seq:           p.seq,
+		ack:           c.ack,
+	}
+	c.sock.send(c.remote, h.marshal(p.payload))
+}
+
+// a bare ack. STATE packets don't use up a sequence number
+func (c *Conn) sendState() {
+	h := header{
+		typ:           stState,
+		connID:        c.sendID,
+		timestamp:     nowMicros(),
+		timestampDiff: c.replyMicro,
+		wndSize:       c.recvWindow(),
+		seq:           c.seq,
+		ack:           c.ack,
+	}
+	c.sock.send(c.remote, h.marshal(nil))
+}
+
+func (c *Conn) recvWindow() uint32 {
+	free := recvWindow - len(c.readBuf)
+	if free < 0 {
+		free = 0
+	}
+	return uint32(free)
+}
+
+// wake up anyone blocked in Read or Write
+func (c *Conn) notify() {
+	select {
+	case c.readNotify <- struct{}{}:
+	default:
+	}
+	select {
+	case c.writeNotify <- struct{}{}:
+	default:
+	}
+}
+
+// wait for a notification or the deadline. Expects c.mu to be held, and
+// unlocks it while waiting
+func (c *Conn) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if len(c.readBuf) > 0 {
+			wasFull := c.recvWindow() == 0
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if wasFull {
+				// tell the other side there's room again
+				c.sendState()
+			}
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.closing {
+			return 0, net.ErrClosed
+		}
+		err := c.wait(c.readNotify, c.readDeadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.closing {
+			return written, net.ErrClosed
+		}
+		chunk := b[written:]
+		if len(chunk) > maxPayload {
+			chunk = chunk[:maxPayload]
+		}
+		// always let one packet through even if the window is tiny, otherwise we'd never send anything
+		if len(c.inflight) > 0 && c.curWindow+len(chunk) > c.window() {
+			err := c.wait(c.writeNotify, c.writeDeadline)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		c.queue(stData, append([]byte(nil), chunk...))
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Close sends a FIN and gives the other side a couple of seconds to ack
+// everything before forgetting about the connection
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closing || c.state == stateClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closing = true
+	if c.err == nil && c.state == stateConnected {
+		c.queue(stFin, nil)
+	}
+	c.notify()
+	c.mu.Unlock()
+
+	go func() {
+		deadline := time.Now().Add(2 * time.Second)
+		c.mu.Lock()
+		for len(c.inflight) > 0 && c.err == nil && c.state != stateClosed {
+			if c.wait(c.writeNotify, deadline) != nil {
+				break
+			}
+		}
+		c.state = stateClosed
+		c.mu.Unlock()
+		c.sock.remove(c)
+	}()
+	return nil
+}
+
+// kill the connection with this error
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failLocked(err)
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	if c.state == stateSynSent {
+		close(c.connected)
+	}
+	c.state = stateClosed
+	c.notify()
+	go c.sock.remove(c)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sock.udp.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notify()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.notify()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.notify()
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,52 @@
+package utp
+
+import (
+	"net"
+	"sync"
+)
+
+// Listener accepts incoming uTP connections on one UDP socket. It implements net.Listener
+type Listener struct {
+	sock   *socket
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Listen starts accepting uTP connections on addr, e.g. ":6881"
+func Listen(addr string) (*Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{sock: newSocket(udp, true), closed: make(chan struct{})}, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c, ok := <-l.sock.accept:
+		if !ok {
+			return nil, net.ErrClosed
+		}
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting new connections. Connections that were already
+// accepted keep working until they're closed themselves
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.sock.stopListening()
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.sock.udp.LocalAddr()
+}
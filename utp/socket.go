@@ -0,0 +1,175 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// a connection is identified by who it's with and the connection_id they put on
+// the packets they send us
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// socket is one UDP socket that can carry many uTP connections. Dial makes a socket
+// per connection, Listen makes one socket that all the accepted connections share
+type socket struct {
+	udp *net.UDPConn
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+	// new incoming connections go here, nil when not listening
+	accept    chan *Conn
+	listening bool
+	closed    bool
+
+	done chan struct{}
+}
+
+func newSocket(udp *net.UDPConn, listening bool) *socket {
+	s := &socket{
+		udp:       udp,
+		conns:     make(map[connKey]*Conn),
+		listening: listening,
+		done:      make(chan struct{}),
+	}
+	if listening {
+		s.accept = make(chan *Conn, 64)
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// reads every datagram and hands it to whichever connection it belongs to
+func (s *socket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			s.shutdown()
+			return
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		// the conn keeps the payload around, so it needs its own copy
+		payload = append([]byte(nil), payload...)
+
+		s.mu.Lock()
+		c, ok := s.conns[connKey{addr.String(), h.connID}]
+		if !ok && h.typ == stSyn && s.listening {
+			// the other side sends us packets with the SYN's connection_id + 1
+			key := connKey{addr.String(), h.connID + 1}
+			if c, ok = s.conns[key]; !ok {
+				c = newConn(s, addr, h.connID+1, h.connID)
+				c.acceptSyn(h)
+				select {
+				case s.accept <- c:
+					s.conns[key] = c
+				default:
+					// nobody is calling Accept fast enough
+					c = nil
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		if c == nil {
+			continue
+		}
+		if ok || h.typ != stSyn {
+			c.receive(h, payload)
+		}
+	}
+}
+
+// drives the retransmission timers of every connection on this socket
+func (s *socket) tickLoop() {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.tick()
+		}
+	}
+}
+
+func (s *socket) send(addr *net.UDPAddr, b []byte) error {
+	_, err := s.udp.WriteToUDP(b, addr)
+	return err
+}
+
+// pick a connection id that isn't in use with this address yet
+func (s *socket) register(addr *net.UDPAddr, c *Conn) uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b [2]byte
+	for {
+		rand.Read(b[:])
+		id := binary.BigEndian.Uint16(b[:])
+		key := connKey{addr.String(), id}
+		if _, taken := s.conns[key]; !taken {
+			s.conns[key] = c
+			return id
+		}
+	}
+}
+
+// forget about a finished connection. Once nothing is using the socket anymore, close it
+func (s *socket) remove(c *Conn) {
+	s.mu.Lock()
+	delete(s.conns, connKey{c.remote.String(), c.recvID})
+	idle := !s.listening && len(s.conns) == 0
+	s.mu.Unlock()
+	if idle {
+		s.udp.Close()
+	}
+}
+
+// the listener is going away, close the socket once the accepted connections are done too
+func (s *socket) stopListening() {
+	s.mu.Lock()
+	s.listening = false
+	idle := len(s.conns) == 0
+	s.mu.Unlock()
+	if idle {
+		s.udp.Close()
+	}
+}
+
+// the UDP socket died (or got closed), so every connection on it is dead too
+func (s *socket) shutdown() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	if s.accept != nil {
+		close(s.accept)
+	}
+	conns := s.conns
+	s.conns = make(map[connKey]*Conn)
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.fail(net.ErrClosed)
+	}
+}
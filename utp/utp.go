@@ -0,0 +1,130 @@
+package utp
+
+// uTP (micro transport protocol, BEP 29) is bittorrent's own reliable stream protocol
+// on top of UDP. The big difference from TCP is the congestion control (LEDBAT): it
+// measures how much queueing delay it is causing and backs off before the link gets
+// saturated, so torrents don't make everyone else's internet slow.
+// http://bittorrent.org/beps/bep_0029.html
+//
+// Conn implements net.Conn, so the rest of the client doesn't care whether
+// it's talking over TCP or uTP.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// packet types
+const (
+	stData  uint8 = 0
+	stFin   uint8 = 1
+	stState uint8 = 2
+	stReset uint8 = 3
+	stSyn   uint8 = 4
+)
+
+const (
+	version   = 1
+	headerLen = 20
+	// max payload per packet. Stays under a 1500 byte MTU after the IP, UDP and uTP headers
+	maxPayload = 1400
+	// LEDBAT tries to keep the queueing delay we cause around this
+	targetDelay = 100 * time.Millisecond
+	// how fast the window grows or shrinks compared to how far off target we are
+	gain = 1.0
+	// the retransmission timeout never goes below this
+	minTimeout = 500 * time.Millisecond
+	maxTimeout = 30 * time.Second
+	// give up on the connection after retransmitting the same packet this many times
+	maxTransmissions = 8
+	// how many bytes we're willing to buffer that the application hasn't read yet
+	recvWindow = 1 << 20
+	// don't let the congestion window grow past this
+	maxWindow = 1 << 20
+	// how far ahead of what we've acked we'll buffer out of order packets
+	maxOutOfOrder = 1024
+)
+
+// every uTP packet starts with this 20 byte header
+//
+// 0       4       8               16              24              32
+// +-------+-------+---------------+---------------+---------------+
+// | type  | ver   | extension     | connection_id                 |
+// +-------+-------+---------------+---------------+---------------+
+// | timestamp_microseconds                                        |
+// +---------------+---------------+---------------+---------------+
+// | timestamp_difference_microseconds                             |
+// +---------------+---------------+---------------+---------------+
+// | wnd_size                                                      |
+// +---------------+---------------+---------------+---------------+
+// | seq_nr                        | ack_nr                        |
+// +---------------+---------------+---------------+---------------+
+type header struct {
+	typ           uint8
+	extension     uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seq           uint16
+	ack           uint16
+}
+
+// header + payload into one []byte ready for the UDP socket
+func (h *header) marshal(payload []byte) []byte {
+	buf := make([]byte, headerLen+len(payload))
+	buf[0] = h.typ<<4 | version
+	buf[1] = 0 // we never send extensions
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+	copy(buf[headerLen:], payload)
+	return buf
+}
+
+// parse a UDP datagram into its header and payload
+func parsePacket(b []byte) (header, []byte, error) {
+	var h header
+	if len(b) < headerLen {
+		return h, nil, fmt.Errorf("utp: packet too short (%d bytes)", len(b))
+	}
+	h.typ = b[0] >> 4
+	if b[0]&0x0f != version || h.typ > stSyn {
+		return h, nil, fmt.Errorf("utp: not a uTP packet")
+	}
+	h.extension = b[1]
+	h.connID = binary.BigEndian.Uint16(b[2:4])
+	h.timestamp = binary.BigEndian.Uint32(b[4:8])
+	h.timestampDiff = binary.BigEndian.Uint32(b[8:12])
+	h.wndSize = binary.BigEndian.Uint32(b[12:16])
+	h.seq = binary.BigEndian.Uint16(b[16:18])
+	h.ack = binary.BigEndian.Uint16(b[18:20])
+
+	// skip over the extension chain (e.g. selective acks), we don't use any of them.
+	// each one is [type of the next extension][length][data]
+	rest := b[headerLen:]
+	next := h.extension
+	for next != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return h, nil, fmt.Errorf("utp: truncated extension")
+		}
+		next = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+	return h, rest, nil
+}
+
+// sequence numbers wrap around at 65536, so "a < b" means b is less than half the space ahead
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// the low 32 bits of the current time in microseconds, which is what goes on the wire.
+// It wraps every hour or so but we only ever subtract two of them
+func nowMicros() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
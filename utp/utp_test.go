@@ -0,0 +1,255 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) *Listener {
+	t.Helper()
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func randomData(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// dial addr, send data over, and have the other end send it back. Checks both directions
+// get every byte in order, and that closing shows up as EOF
+func transfer(t *testing.T, l *Listener, addr string, data []byte) {
+	t.Helper()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(20 * time.Second))
+		got := make([]byte, len(data))
+		_, err = io.ReadFull(conn, got)
+		if err == nil {
+			_, err = conn.Write(got)
+		}
+		accepted <- err
+	}()
+
+	conn, err := Dial(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+	go conn.Write(data)
+	back := make([]byte, len(data))
+	_, err = io.ReadFull(conn, back)
+	if err != nil {
+		t.Fatalf("reading it back: %s", err)
+	}
+	if err := <-accepted; err != nil {
+		t.Fatalf("listener side: %s", err)
+	}
+	if !bytes.Equal(back, data) {
+		t.Fatal("what came back isn't what we sent")
+	}
+	// the listener side has closed, so there's nothing more coming
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("wanted EOF after the other side closed, got %v", err)
+	}
+}
+
+func TestLoopbackTransfer(t *testing.T) {
+	l := listen(t)
+	transfer(t, l, l.Addr().String(), randomData(t, 512<<10))
+}
+
+// a few connections at once through the one listening socket
+func TestSeveralConnections(t *testing.T) {
+	l := listen(t)
+	data := randomData(t, 64<<10)
+	for i := 0; i < 3; i++ {
+		transfer(t, l, l.Addr().String(), data)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// a UDP socket that never answers
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	start := time.Now()
+	_, err = Dial(udp.LocalAddr().String(), 300*time.Millisecond)
+	if err == nil {
+		t.Fatal("dial to nobody worked")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("took %s to give up", took)
+	}
+}
+
+// a UDP proxy between a dialer and a listener that drops and reorders packets
+type lossyProxy struct {
+	front  *net.UDPConn // the dialer talks to this
+	back   *net.UDPConn // and this talks to the listener
+	target *net.UDPAddr
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+}
+
+// every dropEvery'th packet each way gets lost, and every holdEvery'th gets held back
+// until the one after it has gone through
+func newLossyProxy(t *testing.T, target net.Addr, dropEvery, holdEvery int) *lossyProxy {
+	t.Helper()
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	front, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		front.Close()
+		t.Fatal(err)
+	}
+	p := &lossyProxy{front: front, back: back, target: target.(*net.UDPAddr)}
+	t.Cleanup(func() {
+		front.Close()
+		back.Close()
+	})
+	go p.forward(front, back, func() *net.UDPAddr { return p.target }, dropEvery, holdEvery, true)
+	go p.forward(back, front, func() *net.UDPAddr {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.client
+	}, dropEvery, holdEvery, false)
+	return p
+}
+
+func (p *lossyProxy) forward(from, to *net.UDPConn, dest func() *net.UDPAddr, dropEvery, holdEvery int, fromClient bool) {
+	buf := make([]byte, 65536)
+	var held []byte
+	for n := 1; ; n++ {
+		size, addr, err := from.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if fromClient {
+			p.mu.Lock()
+			p.client = addr
+			p.mu.Unlock()
+		}
+		packet := append([]byte(nil), buf[:size]...)
+		switch {
+		case n%dropEvery == 0:
+			continue
+		case n%holdEvery == 0 && held == nil:
+			held = packet
+			continue
+		}
+		to.WriteToUDP(packet, dest())
+		if held != nil {
+			to.WriteToUDP(held, dest())
+			held = nil
+		}
+	}
+}
+
+func TestLossAndReordering(t *testing.T) {
+	l := listen(t)
+	p := newLossyProxy(t, l.Addr(), 13, 7)
+	transfer(t, l, p.front.LocalAddr().String(), randomData(t, 128<<10))
+}
+
+func TestSeqLess(t *testing.T) {
+	for _, c := range []struct {
+		a, b uint16
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		// wrapping around
+		{65535, 0, true},
+		{0, 65535, false},
+		{65000, 100, true},
+	} {
+		if got := seqLess(c.a, c.b); got != c.less {
+			t.Errorf("seqLess(%d, %d) = %v", c.a, c.b, got)
+		}
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	h := header{typ: stData, connID: 1234, timestamp: 5, timestampDiff: 6, wndSize: 7, seq: 8, ack: 9}
+	got, payload, err := parsePacket(h.marshal([]byte("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != h || string(payload) != "payload" {
+		t.Fatalf("got %+v %q, want %+v", got, payload, h)
+	}
+
+	// a selective ack extension in front of the payload gets skipped
+	b := h.marshal(append([]byte{0, 4, 1, 2, 3, 4}, "payload"...))
+	b[1] = 1
+	_, payload, err = parsePacket(b)
+	if err != nil || string(payload) != "payload" {
+		t.Fatalf("with an extension: %q, %v", payload, err)
+	}
+	b[headerLen+1] = 200
+	if _, _, err := parsePacket(b); err == nil {
+		t.Fatal("took an extension longer than the packet")
+	}
+	if _, _, err := parsePacket(b[:headerLen-1]); err == nil {
+		t.Fatal("took a packet shorter than the header")
+	}
+}
+
+// a peer that keeps sending past the window we advertise gets its packets dropped, not
+// buffered, and the ones it sent early stay parked until there's room again
+func TestReceiveWindowFull(t *testing.T) {
+	c := &Conn{ack: 100, outOfOrder: make(map[uint16]*inPacket)}
+	payload := make([]byte, maxPayload)
+	seq := uint16(101)
+	for len(c.readBuf) < recvWindow {
+		c.receiveData(header{typ: stData, seq: seq}, payload)
+		seq++
+	}
+	full := len(c.readBuf)
+	// this one came early, then the one before it fills the gap
+	c.receiveData(header{typ: stData, seq: seq + 1}, payload)
+	c.receiveData(header{typ: stData, seq: seq}, payload)
+	if len(c.readBuf) != full || c.ack != seq-1 {
+		t.Fatalf("buffered %d bytes and acked %d with the window full, want %d and %d", len(c.readBuf), c.ack, full, seq-1)
+	}
+	if c.recvWindow() != 0 {
+		t.Fatalf("advertising %d bytes of window when full", c.recvWindow())
+	}
+
+	// Read takes some, and the resent packet gets in along with the one parked after it
+	c.readBuf = c.readBuf[:0]
+	c.receiveData(header{typ: stData, seq: seq}, payload)
+	if c.ack != seq+1 || len(c.readBuf) != 2*maxPayload {
+		t.Fatalf("acked %d with %d bytes buffered after making room, want %d and %d", c.ack, len(c.readBuf), seq+1, 2*maxPayload)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// gotorrent verify [.torrent file] [path]
+// checks the files you already have against the torrent's piece hashes
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	output := fs.String("o", ".", "directory the torrent's files are in, if you don't give a path")
+	config := addConfigFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage : [executable] verify [flags] [path to .torrent file] [optional path to the file or directory]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, *config, args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	tf := openTorrent(fs.Arg(0))
+	if tf.InfoBytes == nil {
+		usageError("a magnet link has nothing to check against, use a .torrent file")
+	}
+	path := fs.Arg(1)
+	if path == "" {
+		var err error
+		path, err = outputPath(*output, tf.Name)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	have, err := tf.Verify(path, nil)
+	if err != nil {
+		fatal(err)
+	}
+	numPieces := tf.NumPieces()
+	good := 0
+	for i := 0; i < numPieces; i++ {
+		if have.HasPiece(i) {
+			good++
+		}
+	}
+	fmt.Printf("%s: %d of %d pieces are good\n", path, good, numPieces)
+
+	// the pieces can all be good with extra bytes on the end of a file
+	wrong, err := tf.WrongSizes(path)
+	if err != nil {
+		fatal(err)
+	}
+	for _, w := range wrong {
+		fmt.Println(w)
+	}
+	if good != numPieces || len(wrong) > 0 {
+		os.Exit(exitError)
+	}
+}